@@ -5,17 +5,27 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
 
 	_ "embed"
 
-	"github.com/moby/moby/client"
 	"github.com/pelletier/go-toml/v2"
 )
 
@@ -27,13 +37,60 @@ var defaultConfigYAML []byte
 
 const imageRepository = "mheap/agent-en-place"
 
+// labelPrefix prefixes the per-tool version labels applied to built images
+const labelPrefix = "com.mheap.agent-en-place."
+
 type Config struct {
-	Debug          bool
-	Rebuild        bool
-	DockerfileOnly bool
-	MiseFileOnly   bool
-	Tool           string
-	ConfigPath     string
+	Debug            bool
+	Rebuild          bool
+	NoCache          bool // build without reusing cached layers, even when the image exists
+	DockerfileOnly   bool
+	MiseFileOnly     bool
+	ShowContext      bool // print every file in the build context and exit
+	DryRun           bool // assemble the build context and summarize it without connecting to Docker
+	ListAgents       bool // print every configured agent with its package, command and dependencies and exit
+	AgentOnly        bool
+	SeedConfig       bool
+	ListImages       bool
+	WorkdirName      bool     // name the container after the project directory and agent
+	Hostname         string   // overrides run.hostname
+	Platform         string   // comma-separated platforms to build, e.g. "linux/amd64,linux/arm64"
+	RefreshBase      bool     // pull the base image before building, rebuilding if it changed
+	BuildArgs        []string // KEY=VALUE build args from --build-arg, overriding image.buildArgs
+	BuildNetwork     string   // network mode for the image build, e.g. host; empty uses the daemon default
+	Mounts           []string // host:container[:ro] bind mounts from --mount, added to the agent's mounts
+	EnvVars          []string // KEY=VALUE or KEY env vars from --env, overriding the agent's env vars
+	Memory           string   // docker run --memory limit, e.g. 2g; empty is unlimited
+	CPUs             string   // docker run --cpus limit, e.g. 1.5; empty is unlimited
+	AgentUID         int      // agent user's uid, overrides image.agentUid; 0 keeps the config value
+	AgentGID         int      // agent group's gid, overrides image.agentGid; 0 keeps the config value
+	Project          string   // project directory to mount and detect tools in; defaults to the cwd
+	CreateConfigDir  bool     // create a missing agent config dir on the host instead of skipping its mount
+	Report           string   // print a tool resolution report in this format instead of building
+	PlanJSON         bool     // print the image name, tools, packages and mise env as JSON instead of building
+	MiseJobs         int      // parallel mise install jobs, overrides mise.jobs; 0 keeps the config value
+	NoUserConfig     bool     // ignore the XDG and project-local configs, using only the defaults and --config
+	MergeMiseConfigs bool     // layer mise.toml files from parent directories up to the repo root, nearest winning
+	SecurityOpts     []string // docker run --security-opt values, added to run.securityOpt
+	VerifyPackages   bool     // check system packages exist in the base image before building
+	FromWorkflows    bool     // detect tool versions from GitHub Actions setup steps
+	StrictIdiomatic  bool     // fail on idiomatic version files that don't hold a valid version
+	NoFollowSymlinks bool     // skip idiomatic version files that are symlinks
+	FixWorkdirPerms  bool     // start as root and give the agent user the uid and gid that own /workdir before running the agent
+	RunMode          string   // "print" or "run", overrides run.mode; empty uses the config
+	ShowPackages     bool     // print the final system package list with each package's source and exit
+	Bundle           string   // path to write a reproduction bundle to after building
+	ConfigDigest     bool     // print a digest of the image inputs for CI cache keys and exit
+	DockerAPIVersion string   // pin the Docker API version instead of negotiating it
+	ForcePlatformTag bool     // add the host platform to the image tag, like image.tagArch
+	NoColor          bool     // set run.noColorEnv and the agent's noColorEnv in the container, for scripted runs
+	Prune            bool     // remove stale images under imageRepository and exit
+	PruneOlderThan   int      // with Prune, remove images older than this many days instead of all but the newest per agent
+	PruneOutdated    bool     // with Prune, remove images whose agent version is older than its latest release
+	PruneDryRun      bool     // with Prune, list what would be removed without removing it
+	Yes              bool     // skip confirmation of destructive operations such as Prune
+	Tool             string
+	ConfigPath       string
 }
 
 type ToolSpec struct {
@@ -43,6 +100,20 @@ type ToolSpec struct {
 	ConfigDir        string
 	AdditionalMounts []string
 	EnvVars          []string
+	SeedFiles        []string
+	LocalBinary      string   // host binary mounted into the container instead of a mise package
+	NoColorEnv       []string // env vars added with --no-color on top of run.noColorEnv
+	NoConfigMount    bool     // skip mounting ConfigDir; it is still used for --seed-config
+	PassEnv          []string // host env var names forwarded to the container when set
+	PackageVersion   string   // version of MiseToolName to install; empty installs latest
+}
+
+// ResolvePackageVersion returns the version of the agent's package to install
+func (s ToolSpec) ResolvePackageVersion() string {
+	if s.PackageVersion == "" {
+		return "latest"
+	}
+	return s.PackageVersion
 }
 
 // dockerBuildMessage represents a message from the Docker build output stream.
@@ -54,49 +125,268 @@ type dockerBuildMessage struct {
 
 // getLabelName returns a friendly label name for a tool
 // It extracts the last component from npm package names (e.g., "npm:@openai/codex" -> "codex")
+// and from other backends such as "cargo:ripgrep" or "ubi:BurntSushi/ripgrep[exe=rg]" -> "ripgrep"
 func getLabelName(toolName string) string {
+	// Drop mise backend options like "[exe=rg]" and a trailing ".git" on repo URLs
+	if idx := strings.Index(toolName, "["); idx >= 0 {
+		toolName = toolName[:idx]
+	}
+	toolName = strings.TrimSuffix(strings.TrimRight(toolName, "/"), ".git")
+
 	// For npm packages like "npm:@openai/codex", extract the last part
 	if idx := strings.LastIndex(toolName, "/"); idx >= 0 {
-		return toolName[idx+1:]
+		return sanitizeTagComponent(toolName[idx+1:])
 	}
 	// For simple names like "npm:opencode-ai", strip the prefix
 	if idx := strings.Index(toolName, ":"); idx >= 0 {
-		return toolName[idx+1:]
+		return sanitizeTagComponent(toolName[idx+1:])
 	}
-	return toolName
+	return sanitizeTagComponent(toolName)
 }
 
 func Run(cfg Config) error {
-	imgCfg, err := LoadMergedConfig(defaultConfigYAML, cfg.ConfigPath)
+	// --mount host paths are relative to where the command was run
+	mounts, err := parseMountFlags(cfg.Mounts)
+	if err != nil {
+		return err
+	}
+	if err := validateEnvFlags(cfg.EnvVars); err != nil {
+		return err
+	}
+	if err := validateResourceLimits(cfg.Memory, cfg.CPUs); err != nil {
+		return err
+	}
+	if cfg.Project != "" {
+		// Resolve --config against the directory it was given in before moving
+		if cfg.ConfigPath != "" {
+			abs, err := filepath.Abs(cfg.ConfigPath)
+			if err != nil {
+				return fmt.Errorf("failed to resolve config path: %w", err)
+			}
+			cfg.ConfigPath = abs
+		}
+		if cfg.Bundle != "" {
+			abs, err := filepath.Abs(cfg.Bundle)
+			if err != nil {
+				return fmt.Errorf("failed to resolve bundle path: %w", err)
+			}
+			cfg.Bundle = abs
+		}
+		// --security-opt profile paths are relative to where the command was run
+		opts, err := absSecurityOpts(cfg.SecurityOpts)
+		if err != nil {
+			return err
+		}
+		cfg.SecurityOpts = opts
+
+		restore, err := enterProjectDir(cfg.Project)
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+
+	flagArgs, err := parseBuildArgs(cfg.BuildArgs)
+	if err != nil {
+		return err
+	}
+	imgCfg, err := LoadMergedConfig(defaultConfigYAML, LoadOptions{ConfigPath: cfg.ConfigPath, NoUserConfig: cfg.NoUserConfig, BuildArgs: slices.Collect(maps.Keys(flagArgs))})
 	if err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
+	if cfg.ListAgents {
+		writeAgentList(os.Stdout, imgCfg)
+		return nil
+	}
+
+	// Pruning covers the images of every agent, so it doesn't need one resolved
+	if cfg.Prune {
+		if cfg.PruneOlderThan < 0 {
+			return fmt.Errorf("--prune-older-than must be a positive number of days, got %d", cfg.PruneOlderThan)
+		}
+		if cfg.PruneOutdated && cfg.PruneOlderThan > 0 {
+			return fmt.Errorf("--prune-outdated and --prune-older-than can't be used together")
+		}
+		if cfg.DockerAPIVersion != "" {
+			if err := validateAPIVersion(cfg.DockerAPIVersion); err != nil {
+				return err
+			}
+		}
+		ctx := context.Background()
+		cli, err := connectDocker(ctx, cfg.DockerAPIVersion)
+		if err != nil {
+			return err
+		}
+		opts := pruneOptions{olderThan: time.Duration(cfg.PruneOlderThan) * 24 * time.Hour, outdated: cfg.PruneOutdated, dryRun: cfg.PruneDryRun, yes: cfg.Yes}
+		opts.confirm = terminalConfirm(os.Stdin, os.Stdout)
+		return pruneImages(ctx, cli, os.Stdout, imgCfg.Agents, opts)
+	}
+
+	if cfg.Tool == "" {
+		if cfg.Tool, err = resolveDefaultAgent(imgCfg); err != nil {
+			return err
+		}
+	}
+
+	// Everything below, from tool resolution to image labels, uses the
+	// configured agent's name rather than the alias it was invoked with
+	cfg.Tool = imgCfg.ResolveAgentName(cfg.Tool)
 	agentCfg, ok := imgCfg.GetAgent(cfg.Tool)
 	if !ok {
 		return fmt.Errorf("unknown agent: %s (available: %s)", cfg.Tool, strings.Join(imgCfg.AgentNames(), ", "))
 	}
 	spec := agentCfg.ToToolSpec()
 
+	platforms, err := parsePlatforms(cfg.Platform)
+	if err != nil {
+		return err
+	}
+	if err := validateReportFormat(cfg.Report); err != nil {
+		return err
+	}
+	if cfg.DockerAPIVersion != "" {
+		if err := validateAPIVersion(cfg.DockerAPIVersion); err != nil {
+			return err
+		}
+	}
+	runMode, err := resolveRunMode(cfg.RunMode, imgCfg.Run)
+	if err != nil {
+		return err
+	}
+	imgCfg.Image.BuildArgs = mergeBuildArgs(imgCfg.Image.BuildArgs, flagArgs)
+	if err := validateHostname("--hostname", cfg.Hostname); err != nil {
+		return err
+	}
+	if cfg.MiseJobs < 0 {
+		return fmt.Errorf("--mise-jobs must be a positive integer, got %d", cfg.MiseJobs)
+	}
+	if cfg.MiseJobs > 0 {
+		imgCfg.Mise.Jobs = cfg.MiseJobs
+		imgCfg.Mise.jobsFromFlag = true
+		if host, ok := os.LookupEnv("MISE_JOBS"); ok && host != strconv.Itoa(cfg.MiseJobs) {
+			logWarn(fmt.Sprintf("--mise-jobs %d overrides MISE_JOBS=%s from the environment", cfg.MiseJobs, host), "env", "MISE_JOBS")
+		}
+	}
+	if cfg.AgentUID < 0 || cfg.AgentGID < 0 {
+		return fmt.Errorf("--uid and --gid must be positive integers")
+	}
+	if cfg.AgentUID > 0 {
+		imgCfg.Image.AgentUID = cfg.AgentUID
+	}
+	if cfg.AgentGID > 0 {
+		imgCfg.Image.AgentGID = cfg.AgentGID
+	}
+
+	if cfg.BuildNetwork != "" {
+		if err := validateBuildNetwork(cfg.BuildNetwork); err != nil {
+			return err
+		}
+	}
+	securityOpts, err := absSecurityOpts(append(append([]string{}, imgCfg.Run.SecurityOpt...), cfg.SecurityOpts...))
+	if err != nil {
+		return err
+	}
+
 	toolFile, err := optionalFileSpec(".tool-versions")
 	if err != nil {
 		return fmt.Errorf("failed to read .tool-versions: %w", err)
 	}
-	miseFile, err := optionalFileSpec("mise.toml")
+	var miseFile *fileSpec
+	if cfg.MergeMiseConfigs {
+		miseFile, err = layeredMiseFileSpec(".")
+	} else {
+		miseFile, err = findMiseFileSpec(".")
+	}
 	if err != nil {
-		return fmt.Errorf("failed to read mise.toml: %w", err)
+		return fmt.Errorf("failed to read mise config: %w", err)
 	}
 
-	// When AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY=1 is set with AGENT_EN_PLACE_TOOLS,
-	// skip file-based tool sources entirely. We nil them out so they aren't
+	// In specified-only mode (tools.specifiedOnly, or
+	// AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY=1 with AGENT_EN_PLACE_TOOLS) skip
+	// file-based tool sources entirely. We nil them out so they aren't
 	// copied into the Docker image or parsed for tools.
-	specifiedOnly := os.Getenv("AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY") == "1" && os.Getenv("AGENT_EN_PLACE_TOOLS") != ""
-	if specifiedOnly {
+	// --agent-only skips them in the same way, ignoring env var tools as well.
+	specifiedOnly, _ := specifiedToolsOnly(imgCfg, os.Getenv("AGENT_EN_PLACE_TOOLS") != "")
+	if specifiedOnly || cfg.AgentOnly {
 		toolFile = nil
 		miseFile = nil
 	}
+	collectOpts := collectOptions{debug: cfg.Debug, agentOnly: cfg.AgentOnly, fromWorkflows: cfg.FromWorkflows, noFollowSymlinks: cfg.NoFollowSymlinks}
+	if cfg.StrictIdiomatic && !specifiedOnly && !cfg.AgentOnly {
+		if err := checkIdiomaticFiles(collectOpts); err != nil {
+			return err
+		}
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		home = "~"
+	}
+
+	if spec.LocalBinary != "" {
+		if spec.MiseToolName != "" {
+			return fmt.Errorf("agent %s sets both packageName and localBinary; use one or the other", cfg.Tool)
+		}
+		spec.LocalBinary, err = resolveLocalBinary(spec.LocalBinary, home)
+		if err != nil {
+			return err
+		}
+	}
 
-	collection := collectToolSpecs(toolFile, miseFile, spec, imgCfg, cfg.Tool, cfg.Debug)
+	// Only seed config files into the image when explicitly requested
+	if cfg.SeedConfig {
+		spec.SeedFiles, err = resolveSeedFiles(home, spec)
+		if err != nil {
+			return err
+		}
+	} else {
+		spec.SeedFiles = nil
+	}
+
+	collection := collectToolSpecsCached(toolFile, miseFile, spec, imgCfg, cfg.Tool, collectOpts)
+	if err := imgCfg.CheckBaseCompatibility(toolNames(collection.specs)); err != nil {
+		return err
+	}
+	imageName, inputsHash, err := agentImageName(toolFile, miseFile, collection, spec, imgCfg, cfg.Tool, os.Environ())
+	if err != nil {
+		return err
+	}
+	if cfg.Report != "" {
+		return writeToolReport(os.Stdout, buildToolReport(toolFile, miseFile, collection, spec, imgCfg, cfg.Tool, imageName, collectOpts))
+	}
+	if cfg.PlanJSON {
+		return writeBuildPlan(os.Stdout, buildBuildPlan(collection, spec, imgCfg, cfg.Tool, imageName, os.Environ()))
+	}
+	if cfg.ShowPackages {
+		writePackageList(os.Stdout, packageSources(imgCfg, cfg.Tool, collection.userTools), imgCfg.appliedCustomizations)
+		return nil
+	}
+	if cfg.ConfigDigest {
+		digest, err := configDigest(toolFile, miseFile, collection, spec, imgCfg, cfg.Tool, os.Environ())
+		if err != nil {
+			return err
+		}
+		fmt.Println(digest)
+		return nil
+	}
+	if cfg.ShowContext {
+		buildCtx, err := makeBuildContext(toolFile, miseFile, collection, spec, imgCfg, cfg.Tool)
+		if err != nil {
+			return err
+		}
+		return writeBuildContext(os.Stdout, buildCtx)
+	}
+	if cfg.DryRun {
+		// Stop before connectDocker so this works without a daemon.
+		// makeBuildContext runs validateDockerfile, so a broken Dockerfile
+		// fails here as it would before a build.
+		buildCtx, err := makeBuildContext(toolFile, miseFile, collection, spec, imgCfg, cfg.Tool)
+		if err != nil {
+			return err
+		}
+		return writeDryRun(os.Stdout, imageName, buildCtx)
+	}
 	if cfg.DockerfileOnly {
 		fmt.Print(buildDockerfile(toolFile != nil, miseFile != nil, collection, spec, imgCfg, cfg.Tool, os.Environ()))
 		return nil
@@ -106,7 +396,7 @@ func Run(cfg Config) error {
 		if miseFile != nil {
 			userMiseData = miseFile.data
 		}
-		agentMiseData, err := buildAgentMiseConfig(userMiseData, collection, spec)
+		agentMiseData, err := agentMiseConfig(userMiseData, collection, spec, imgCfg)
 		if err != nil {
 			return fmt.Errorf("failed to build mise.agent.toml: %w", err)
 		}
@@ -122,75 +412,620 @@ func Run(cfg Config) error {
 		fmt.Print(string(agentMiseData))
 		return nil
 	}
-	imageName := buildImageName(collection.specs)
-
 	ctx := context.Background()
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	cli, err := connectDocker(ctx, cfg.DockerAPIVersion)
 	if err != nil {
-		return fmt.Errorf("failed to connect to docker daemon: %w", err)
+		return err
 	}
 
-	needBuild := !imageExists(ctx, cli, imageName) || cfg.Rebuild
-
-	if needBuild {
-		buildCtx, err := makeBuildContext(toolFile, miseFile, collection, spec, imgCfg, cfg.Tool)
+	if cfg.ListImages {
+		images, err := findAgentImages(ctx, cli, spec)
 		if err != nil {
-			return fmt.Errorf("failed to prepare build context: %w", err)
+			return err
 		}
+		printAgentImages(os.Stdout, cfg.Tool, images)
+		return nil
+	}
 
-		buildResp, err := cli.ImageBuild(ctx, buildCtx, client.ImageBuildOptions{
-			Tags:        []string{imageName},
-			Remove:      true,
-			PullParent:  true,
-			Dockerfile:  "Dockerfile",
-			ForceRemove: true,
-		})
+	platforms = buildPlatforms(platforms, imgCfg.Image.TagHostArch() || cfg.ForcePlatformTag)
+	targets := platformTargets(imageName, platforms)
+	if imgCfg.Image.AliasTag != "" {
+		wd, _ := os.Getwd()
+		targets = withAliasTag(targets, imageName, aliasTagName(imgCfg.Image.AliasTag, cfg.Tool, filepath.Base(wd)))
+	}
+	newContext := func() (io.Reader, error) {
+		return makeBuildContext(toolFile, miseFile, collection, spec, imgCfg, cfg.Tool)
+	}
+	rebuild := cfg.Rebuild
+	if cfg.RefreshBase {
+		changed, err := refreshBaseImages(ctx, cli, imgCfg.Image.ResolveBase(), targets)
 		if err != nil {
-			return fmt.Errorf("failed to build image: %w", err)
+			return err
 		}
-		defer buildResp.Body.Close()
-
-		if err := handleBuildOutput(buildResp.Body, cfg.Debug, imageName); err != nil {
+		// A new base means the existing image is stale
+		rebuild = rebuild || changed
+	}
+	if cfg.VerifyPackages {
+		packages := imagePackages(imgCfg, cfg.Tool, collection)
+		if err := verifyPackages(ctx, cli, imgCfg.Image.ResolveBase(), imgCfg.Image.ResolvePackageManager(), packages); err != nil {
+			return err
+		}
+	}
+	labels := gitLabels(".")
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[inputsLabel] = inputsHash
+	opts := buildOptions{rebuild: rebuild, noCache: cfg.NoCache, inputsHash: inputsHash, debug: cfg.Debug, buildArgs: imgCfg.Image.BuildArgs, network: cfg.BuildNetwork, labels: labels}
+	var buildLog bytes.Buffer
+	if cfg.Bundle != "" {
+		opts.log = &buildLog
+	}
+	buildErr := buildImages(ctx, cli, targets, opts, newContext)
+	if cfg.Bundle != "" {
+		err := saveBundle(cfg.Bundle, bundleInput{
+			toolFile:   toolFile,
+			miseFile:   miseFile,
+			collection: collection,
+			spec:       spec,
+			imgCfg:     imgCfg,
+			agentName:  cfg.Tool,
+			imageName:  imageName,
+			opts:       collectOpts,
+			env:        os.Environ(),
+			buildLog:   buildLog.Bytes(),
+			buildErr:   buildErr,
+		})
+		if err != nil {
 			return err
 		}
+		logInfo(fmt.Sprintf("Wrote reproduction bundle to %s", cfg.Bundle), "path", cfg.Bundle)
+	}
+	if buildErr != nil {
+		return buildErr
 	}
 
 	cwd, err := os.Getwd()
 	if err != nil {
 		cwd = "."
 	}
-	home, err := os.UserHomeDir()
-	if err != nil || home == "" {
-		home = "~"
+
+	mountConfig, err := prepareConfigDir(home, spec, cfg.CreateConfigDir, imgCfg.Image.ResolveAgentUID(), imgCfg.Image.AgentGID)
+	if err != nil {
+		return err
+	}
+	if !mountConfig {
+		// buildRunBinds skips the config mount for agents without a config dir
+		spec.ConfigDir = ""
+	}
+
+	target := runTarget(targets)
+	hostname, name := runIdentity(cfg, imgCfg.Run, cwd)
+	run := runSpec{
+		image:        target.tag,
+		command:      spec.Command,
+		platform:     target.platform,
+		hostname:     hostname,
+		name:         name,
+		securityOpts: securityOpts,
+		tmpfs:        imgCfg.Run.Tmpfs,
+		memory:       cfg.Memory,
+		cpus:         cfg.CPUs,
+	}
+	if cfg.FixWorkdirPerms {
+		run.fixWorkdirPerms()
+	}
+	spec.EnvVars = append(spec.EnvVars, passEnvVars(cfg.Tool, spec, os.LookupEnv, cfg.Debug)...)
+	env, binds := mergeExtraRunSettings(buildRunEnv(spec), buildRunBinds(spec, cwd, home), cfg.EnvVars, mounts)
+	run.env = append(run.env, env...)
+	run.binds = binds
+	if cfg.NoColor {
+		run.env = append(run.env, noColorEnv(imgCfg.Run, spec)...)
+	}
+	if runMode == runModePrint {
+		fmt.Println(run.printCommand())
+		return nil
 	}
-	configMount := filepath.Join(home, spec.ConfigDir)
-	containerConfigPath := filepath.Join("/home/agent", spec.ConfigDir)
 
-	envs := []string{
-		"-e MISE_ENV=agent",
+	options, err := run.createOptions()
+	if err != nil {
+		return err
 	}
-	for _, env := range spec.EnvVars {
-		envs = append(envs, fmt.Sprintf("-e %s", env))
+	code, err := runContainer(ctx, cli, options, os.Stdin, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return &ExitError{Code: code}
 	}
+	return nil
+}
 
-	volumes := []string{
-		fmt.Sprintf("-v %s:/workdir", filepath.Clean(cwd)),
-		fmt.Sprintf("-v %s:%s", filepath.Clean(configMount), containerConfigPath),
+// AgentNames returns the agents that can be run with cfg: the built-in agents
+// plus any defined in the user, project or --config files
+func AgentNames(cfg Config) ([]string, error) {
+	if cfg.Project != "" {
+		if cfg.ConfigPath != "" {
+			abs, err := filepath.Abs(cfg.ConfigPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve config path: %w", err)
+			}
+			cfg.ConfigPath = abs
+		}
+		restore, err := enterProjectDir(cfg.Project)
+		if err != nil {
+			return nil, err
+		}
+		defer restore()
+	}
+	imgCfg, err := mergeConfigFiles(defaultConfigYAML, LoadOptions{ConfigPath: cfg.ConfigPath, NoUserConfig: cfg.NoUserConfig})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	return imgCfg.AgentNames(), nil
+}
+
+// resolveDefaultAgent picks the agent to run when none was given on the
+// command line: AGENT_EN_PLACE_DEFAULT_AGENT first, then defaultAgent from config
+func resolveDefaultAgent(imgCfg *ImageConfig) (string, error) {
+	if name := strings.TrimSpace(os.Getenv("AGENT_EN_PLACE_DEFAULT_AGENT")); name != "" {
+		return strings.ToLower(name), nil
+	}
+	if name := strings.TrimSpace(imgCfg.DefaultAgent); name != "" {
+		return strings.ToLower(name), nil
+	}
+	return "", fmt.Errorf("no agent given: pass one as an argument, or set defaultAgent in config or AGENT_EN_PLACE_DEFAULT_AGENT (available: %s)", strings.Join(imgCfg.AgentNames(), ", "))
+}
+
+// enterProjectDir changes into the project directory so tool detection, the
+// project config and the /workdir mount all use it instead of the current
+// directory. The returned function changes back.
+func enterProjectDir(project string) (func(), error) {
+	if rest, ok := strings.CutPrefix(project, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand project path %s: %w", project, err)
+		}
+		project = filepath.Join(home, rest)
+	}
+	dir, err := filepath.Abs(project)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve project path %s: %w", project, err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("project directory %s: %w", dir, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("project path %s is not a directory", dir)
+	}
+
+	previous, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current directory: %w", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		return nil, fmt.Errorf("failed to enter project directory: %w", err)
+	}
+	return func() { os.Chdir(previous) }, nil
+}
+
+// runIdentity returns the container's hostname and, with --workdir-name, its
+// name. The hostname comes from --hostname, then run.hostname, then the agent
+// name. The container name combines the project directory and agent so
+// repeated runs are recognizable.
+func runIdentity(cfg Config, run RunSettings, cwd string) (hostname, name string) {
+	hostname = cfg.Hostname
+	if hostname == "" {
+		hostname = run.Hostname
+	}
+	if hostname == "" {
+		hostname = cfg.Tool
+	}
+
+	if cfg.WorkdirName {
+		name = sanitizeTagComponent(filepath.Base(filepath.Clean(cwd)))
+		if name == "" {
+			name = "workdir"
+		}
+		name += "-" + sanitizeTagComponent(cfg.Tool)
+	}
+	return hostname, name
+}
+
+// absSecurityOpts checks that seccomp profiles referenced by --security-opt
+// values exist and makes their paths absolute, so the printed docker run
+// command works from any directory. Other options are passed through.
+func absSecurityOpts(opts []string) ([]string, error) {
+	result := make([]string, 0, len(opts))
+	for _, opt := range opts {
+		profile, ok := strings.CutPrefix(opt, "seccomp=")
+		if !ok || profile == "unconfined" || profile == "builtin" {
+			result = append(result, opt)
+			continue
+		}
+		abs, err := filepath.Abs(profile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve seccomp profile %s: %w", profile, err)
+		}
+		info, err := os.Stat(abs)
+		if err != nil {
+			return nil, fmt.Errorf("seccomp profile not found: %s", profile)
+		}
+		if info.IsDir() {
+			return nil, fmt.Errorf("seccomp profile is a directory: %s", profile)
+		}
+		result = append(result, "seccomp="+abs)
+	}
+	return result, nil
+}
+
+// fixWorkdirPermsEnv tells the entrypoint to remap the agent user to the owner
+// of /workdir and drop privileges. It only takes effect when the container
+// runs as root.
+const fixWorkdirPermsEnv = "AGENT_EN_PLACE_FIX_WORKDIR_PERMS"
+
+// fixWorkdirPerms starts the container as root with fixWorkdirPermsEnv set
+func (s *runSpec) fixWorkdirPerms() {
+	s.user = "0"
+	s.env = append(s.env, fixWorkdirPermsEnv+"=1")
+}
+
+// buildSecurityArgs returns a docker run --security-opt argument for each option
+func buildSecurityArgs(opts []string) []string {
+	args := make([]string, 0, len(opts))
+	for _, opt := range opts {
+		args = append(args, fmt.Sprintf("--security-opt %s", opt))
+	}
+	return args
+}
+
+// buildTmpfsArgs returns a --tmpfs argument for each run.tmpfs mount, e.g.
+// --tmpfs /tmp:size=512m,mode=1777
+func buildTmpfsArgs(mounts []TmpfsMount) []string {
+	args := make([]string, 0, len(mounts))
+	for _, m := range mounts {
+		arg := "--tmpfs " + m.Path
+		if opts := tmpfsOptions(m); opts != "" {
+			arg += ":" + opts
+		}
+		args = append(args, arg)
+	}
+	return args
+}
+
+// tmpfsOptions returns the mount options of a run.tmpfs entry, e.g.
+// size=512m,mode=1777
+func tmpfsOptions(m TmpfsMount) string {
+	var opts []string
+	if m.Size != "" {
+		opts = append(opts, "size="+m.Size)
+	}
+	if m.Mode != "" {
+		opts = append(opts, "mode="+m.Mode)
+	}
+	return strings.Join(opts, ",")
+}
+
+// minMemoryLimit is the smallest --memory docker run accepts
+const minMemoryLimit = 6 * 1024 * 1024
+
+var (
+	memoryLimitPattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)([bkmgBKMG]?)$`)
+	memoryUnits        = map[string]float64{"": 1, "b": 1, "k": 1 << 10, "m": 1 << 20, "g": 1 << 30}
+)
+
+// parseMemoryLimit converts a --memory value such as 512m or 2g to bytes,
+// using binary units like docker run
+func parseMemoryLimit(value string) (int64, error) {
+	match := memoryLimitPattern.FindStringSubmatch(value)
+	if match == nil {
+		return 0, fmt.Errorf("invalid --memory %q: expected a number with an optional b, k, m or g suffix, e.g. 2g", value)
+	}
+	n, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid --memory %q: %w", value, err)
+	}
+	limit := int64(n * memoryUnits[strings.ToLower(match[2])])
+	if limit < minMemoryLimit {
+		return 0, fmt.Errorf("invalid --memory %q: the minimum is 6m", value)
+	}
+	return limit, nil
+}
+
+// parseCPULimit converts a --cpus value such as 1.5 to the nano CPUs docker
+// uses for HostConfig.NanoCPUs
+func parseCPULimit(value string) (int64, error) {
+	cpus, err := strconv.ParseFloat(value, 64)
+	if err != nil || cpus <= 0 || math.IsInf(cpus, 0) {
+		return 0, fmt.Errorf("invalid --cpus %q: expected a positive number, e.g. 1.5", value)
+	}
+	nano := int64(cpus * 1e9)
+	if nano < 1 {
+		return 0, fmt.Errorf("invalid --cpus %q: too small", value)
+	}
+	return nano, nil
+}
+
+// validateResourceLimits checks docker run would accept the --memory and
+// --cpus limits that are set
+func validateResourceLimits(memory, cpus string) error {
+	if memory != "" {
+		if _, err := parseMemoryLimit(memory); err != nil {
+			return err
+		}
+	}
+	if cpus != "" {
+		if _, err := parseCPULimit(cpus); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// noColorEnv returns the --no-color env vars: run.noColorEnv, then the
+// agent's own. They come after the agent's envVars so that Docker uses them
+// when both set the same variable.
+func noColorEnv(run RunSettings, spec ToolSpec) []string {
+	return append(append([]string{}, run.ResolveNoColorEnv()...), spec.NoColorEnv...)
+}
+
+// prepareConfigDir makes sure the agent's config dir exists on the host before
+// it is mounted. Docker would otherwise create it owned by root, leaving the
+// agent unable to write its config. When create is false a missing dir is
+// reported and not mounted. Agents with noConfigMount are never mounted, so
+// their dir isn't created either. A created dir is given to the agent's uid
+// and gid; when that isn't allowed it's left as it is with a warning, as the
+// agent can only write to it when it runs with the host user's uid.
+func prepareConfigDir(home string, spec ToolSpec, create bool, uid, gid int) (bool, error) {
+	if spec.ConfigDir == "" || spec.NoConfigMount {
+		return false, nil
+	}
+	dir := filepath.Join(home, spec.ConfigDir)
+	info, err := os.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return false, fmt.Errorf("agent config path %s is not a directory", dir)
+		}
+		return true, nil
+	}
+	if !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to check agent config dir: %w", err)
+	}
+	if !create {
+		logWarn(fmt.Sprintf("agent config dir %s does not exist, not mounting it", dir), "path", dir)
+		return false, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return false, fmt.Errorf("failed to create agent config dir: %w", err)
+	}
+	// os.Getuid is -1 on Windows, where Docker doesn't map host owners
+	if hostUID := os.Getuid(); hostUID == -1 || hostUID == uid {
+		return true, nil
+	}
+	chownGID := gid
+	if chownGID == 0 {
+		// groupadd picks the gid, so only the owner is changed
+		chownGID = -1
+	}
+	if err := os.Chown(dir, uid, chownGID); err != nil {
+		logWarn(fmt.Sprintf("can't give %s to the agent's uid %d, so the agent may not be able to save its config: %v; pass --uid %d --gid %d to run the agent as you", dir, uid, err, os.Getuid(), os.Getgid()), "path", dir)
+	}
+	return true, nil
+}
+
+// buildRunEnv returns the agent container's env vars: MISE_ENV, then the
+// agent's envVars as written in config
+func buildRunEnv(spec ToolSpec) []string {
+	return append([]string{"MISE_ENV=agent"}, spec.EnvVars...)
+}
+
+// buildRunBinds returns the agent container's host:container[:mode] binds:
+// the project, the agent's config dir and additional mounts, and a local
+// agent binary
+func buildRunBinds(spec ToolSpec, cwd, home string) []string {
+	binds := []string{
+		fmt.Sprintf("%s:/workdir", filepath.Clean(cwd)),
+	}
+	if spec.ConfigDir != "" && !spec.NoConfigMount {
+		configMount := filepath.Join(home, spec.ConfigDir)
+		containerConfigPath := filepath.Join("/home/agent", spec.ConfigDir)
+		binds = append(binds, fmt.Sprintf("%s:%s", filepath.Clean(configMount), containerConfigPath))
 	}
 	for _, mount := range spec.AdditionalMounts {
 		hostPath := filepath.Join(home, mount)
 		containerPath := filepath.Join("/home/agent", mount)
-		volumes = append(volumes, fmt.Sprintf("-v %s:%s", filepath.Clean(hostPath), containerPath))
+		binds = append(binds, fmt.Sprintf("%s:%s", filepath.Clean(hostPath), containerPath))
+	}
+	if spec.LocalBinary != "" {
+		binds = append(binds, fmt.Sprintf("%s:%s:ro", filepath.Clean(spec.LocalBinary), localBinaryContainerPath(spec)))
 	}
+	return binds
+}
 
-	allArgs := append(envs, volumes...)
-	fmt.Printf("docker run --rm -it %s %s %s\n", strings.Join(allArgs, " "), imageName, spec.Command)
+// passEnvVars returns the agent's passEnv names that are set in the host
+// environment, as bare names that resolveRunEnv reads when the container is
+// created so their values aren't printed with --print. Names already in
+// envVars are left to that entry. Agents usually need only one of their
+// credentials, and some don't need any when logged in another way, so unset
+// names are only warned about when none of them is available, and otherwise
+// listed with debug.
+func passEnvVars(agentName string, spec ToolSpec, lookup func(string) (string, bool), debug bool) []string {
+	configured := make(map[string]bool, len(spec.EnvVars))
+	for _, env := range spec.EnvVars {
+		key, _, _ := strings.Cut(env, "=")
+		configured[key] = true
+	}
+	var envs, missing []string
+	available := false
+	for _, name := range spec.PassEnv {
+		if configured[name] {
+			available = true
+			continue
+		}
+		if _, ok := lookup(name); !ok {
+			if !slices.Contains(missing, name) {
+				missing = append(missing, name)
+			}
+			continue
+		}
+		configured[name] = true
+		available = true
+		envs = append(envs, name)
+	}
+	switch {
+	case available || len(missing) == 0:
+		if debug {
+			for _, name := range missing {
+				logDebug(fmt.Sprintf("%s is not set, so it isn't passed to %s", name, agentName), "agent", agentName, "env", name)
+			}
+		}
+	case len(missing) == 1:
+		logWarn(fmt.Sprintf("%s is not set, so it isn't passed to %s; set it if %s needs it to authenticate", missing[0], agentName, agentName), "agent", agentName, "env", missing[0])
+	default:
+		logWarn(fmt.Sprintf("none of %s are set, so none are passed to %s; set one if %s needs it to authenticate", strings.Join(missing, ", "), agentName, agentName), "agent", agentName, "env", strings.Join(missing, ","))
+	}
+	return envs
+}
+
+// parseMountFlags checks --mount values are host:container with an optional
+// ro or rw mode, returning them with ~ expanded and both paths made absolute
+// and cleaned
+func parseMountFlags(values []string) ([]string, error) {
+	var mounts []string
+	for _, value := range values {
+		parts := strings.Split(value, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid --mount %q: expected host:container[:ro]", value)
+		}
+		if len(parts) == 3 && parts[2] != "ro" && parts[2] != "rw" {
+			return nil, fmt.Errorf("invalid --mount %q: mode must be ro or rw, got %q", value, parts[2])
+		}
+		if !path.IsAbs(parts[1]) {
+			return nil, fmt.Errorf("invalid --mount %q: container path must be absolute", value)
+		}
+		hostPath := parts[0]
+		if rest, ok := strings.CutPrefix(hostPath, "~/"); ok || hostPath == "~" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, fmt.Errorf("failed to get home directory: %w", err)
+			}
+			hostPath = filepath.Join(home, rest)
+		}
+		hostPath, err := filepath.Abs(hostPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve --mount %q: %w", value, err)
+		}
+		mount := fmt.Sprintf("%s:%s", filepath.Clean(hostPath), path.Clean(parts[1]))
+		if len(parts) == 3 {
+			mount += ":" + parts[2]
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+// validateEnvFlags checks --env values are KEY=VALUE or a bare KEY, which
+// like docker run -e takes its value from the environment
+func validateEnvFlags(values []string) error {
+	for _, value := range values {
+		key, _, _ := strings.Cut(value, "=")
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return fmt.Errorf("invalid --env %q: expected KEY=VALUE", value)
+		}
+	}
 	return nil
 }
 
+// mergeExtraRunSettings adds --env and --mount values to the env vars from
+// buildRunEnv and the binds from buildRunBinds. An --env replaces the agent's
+// env var with the same key and a --mount replaces the mount at the same
+// container path, since docker rejects duplicate mount points.
+func mergeExtraRunSettings(env, binds, extraEnv, mounts []string) ([]string, []string) {
+	envKeys := make(map[string]bool, len(extraEnv))
+	for _, entry := range extraEnv {
+		key, _, _ := strings.Cut(entry, "=")
+		envKeys[key] = true
+	}
+	targets := make(map[string]bool, len(mounts))
+	for _, mount := range mounts {
+		targets[mountTarget(mount)] = true
+	}
+
+	mergedEnv := make([]string, 0, len(env)+len(extraEnv))
+	for _, entry := range env {
+		if key, _, _ := strings.Cut(entry, "="); !envKeys[key] {
+			mergedEnv = append(mergedEnv, entry)
+		}
+	}
+	mergedBinds := make([]string, 0, len(binds)+len(mounts))
+	for _, bind := range binds {
+		if !targets[mountTarget(bind)] {
+			mergedBinds = append(mergedBinds, bind)
+		}
+	}
+	return append(mergedEnv, extraEnv...), append(mergedBinds, mounts...)
+}
+
+// mountTarget returns the container path of a host:container[:mode] bind
+func mountTarget(mount string) string {
+	parts := strings.Split(mount, ":")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// localBinaryContainerPath returns where a local agent binary is mounted,
+// named after the first word of the agent's command
+func localBinaryContainerPath(spec ToolSpec) string {
+	name := filepath.Base(spec.LocalBinary)
+	if fields := strings.Fields(spec.Command); len(fields) > 0 {
+		name = fields[0]
+	}
+	return path.Join("/usr/local/bin", name)
+}
+
+// resolveLocalBinary expands ~ in a local agent binary path, makes it absolute
+// and checks that it is an executable file on the host
+func resolveLocalBinary(binary, home string) (string, error) {
+	if rest, ok := strings.CutPrefix(binary, "~/"); ok {
+		binary = filepath.Join(home, rest)
+	}
+	abs, err := filepath.Abs(binary)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve localBinary %s: %w", binary, err)
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", fmt.Errorf("localBinary %s not found: %w", abs, err)
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return "", fmt.Errorf("localBinary %s is not an executable file", abs)
+	}
+	return abs, nil
+}
+
 func makeBuildContext(toolFile, miseFile *fileSpec, collection collectResult, spec ToolSpec, imgCfg *ImageConfig, agentName string) (io.Reader, error) {
+	data, err := buildContextTar(toolFile, miseFile, collection, spec, imgCfg, agentName, os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
 
-	dockerfile := buildDockerfile(toolFile != nil, miseFile != nil, collection, spec, imgCfg, agentName, os.Environ())
+// buildContextTar returns the tar of the build context. Headers carry no
+// timestamps, so the same inputs always give the same bytes.
+func buildContextTar(toolFile, miseFile *fileSpec, collection collectResult, spec ToolSpec, imgCfg *ImageConfig, agentName string, environ []string) ([]byte, error) {
+	dockerfile := buildDockerfile(toolFile != nil, miseFile != nil, collection, spec, imgCfg, agentName, environ)
+	if err := validateDockerfile(dockerfile); err != nil {
+		return nil, err
+	}
+
+	perms, err := imgCfg.Image.ResolveFilePerms()
+	if err != nil {
+		return nil, err
+	}
 
 	var buf bytes.Buffer
 	tw := tar.NewWriter(&buf)
@@ -200,7 +1035,11 @@ func makeBuildContext(toolFile, miseFile *fileSpec, collection collectResult, sp
 	}
 
 	if toolFile != nil {
-		if err := writeFileToTar(tw, toolFile.path, toolFile.data, toolFile.mode); err != nil {
+		mode := toolFile.mode
+		if perms.toolVersions != 0 {
+			mode = perms.toolVersions
+		}
+		if err := writeFileToTar(tw, toolFile.path, toolFile.data, mode); err != nil {
 			return nil, err
 		}
 	}
@@ -210,27 +1049,30 @@ func makeBuildContext(toolFile, miseFile *fileSpec, collection collectResult, sp
 	if miseFile != nil {
 		userMiseData = miseFile.data
 	}
-	agentMiseData, err := buildAgentMiseConfig(userMiseData, collection, spec)
+	agentMiseData, err := agentMiseConfig(userMiseData, collection, spec, imgCfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build mise.agent.toml: %w", err)
 	}
 
 	// Add user's mise.toml if present (unchanged)
 	if miseFile != nil {
-		if err := writeFileToTar(tw, "mise.toml", miseFile.data, 0644); err != nil {
+		if err := writeFileToTar(tw, "mise.toml", miseFile.data, perms.miseConfig); err != nil {
 			return nil, err
 		}
 	}
 
 	// Always add mise.agent.toml with agent requirements
-	if err := writeFileToTar(tw, "mise.agent.toml", agentMiseData, 0644); err != nil {
+	if err := writeFileToTar(tw, "mise.agent.toml", agentMiseData, perms.miseConfig); err != nil {
 		return nil, err
 	}
 
 	if err := writeIdiomaticFiles(tw, collection.idiomaticPaths); err != nil {
 		return nil, err
 	}
-	if err := writeFileToTar(tw, "assets/agent-entrypoint.sh", agentEntrypointScript, 0755); err != nil {
+	if err := writeSeedFiles(tw, spec); err != nil {
+		return nil, err
+	}
+	if err := writeFileToTar(tw, "assets/agent-entrypoint.sh", agentEntrypointScript, perms.entrypoint); err != nil {
 		return nil, err
 	}
 
@@ -238,52 +1080,79 @@ func makeBuildContext(toolFile, miseFile *fileSpec, collection collectResult, sp
 		return nil, err
 	}
 
-	return bytes.NewReader(buf.Bytes()), nil
+	return buf.Bytes(), nil
 }
 
 func buildDockerfile(hasTool, hasMise bool, collection collectResult, spec ToolSpec, imgCfg *ImageConfig, agentName string, environ []string) string {
 	var b strings.Builder
 
 	// Use configured base image
-	baseImage := imgCfg.Image.Base
-	if baseImage == "" {
-		baseImage = "debian:12-slim"
-	}
+	baseImage := imgCfg.Image.ResolveBase()
 
-	// Collect packages: base packages + additional packages from tool dependencies
-	packages := append([]string{}, imgCfg.Image.Packages...)
-	packages = append(packages, imgCfg.ResolveAdditionalPackages(agentName, collection.userTools)...)
-	packages = dedupeStrings(packages)
+	packages := imagePackages(imgCfg, agentName, collection)
+
+	packageManager := imgCfg.Image.ResolvePackageManager()
 
 	b.WriteString(fmt.Sprintf("FROM %s\n\n", baseImage))
-	b.WriteString("RUN apt-get update && apt-get install -y --no-install-recommends ")
+	if packageManager == packageManagerApk {
+		b.WriteString("RUN apk add --no-cache ")
+	} else if imgCfg.Image.InstallRecommendedPackages() {
+		b.WriteString("RUN apt-get update && apt-get install -y ")
+	} else {
+		b.WriteString("RUN apt-get update && apt-get install -y --no-install-recommends ")
+	}
 	b.WriteString(strings.Join(packages, " "))
+	// Remove the apt lists in the same RUN so they never persist in a layer;
+	// apk add --no-cache leaves no package index behind to clean up
+	const aptCleanup = " && rm -rf /var/lib/apt/lists/*"
+	cleanApt := packageManager == packageManagerApt && imgCfg.Image.CleanAptLists()
+	if cleanApt {
+		b.WriteString(aptCleanup)
+	}
 	b.WriteString("\n")
 
 	// Use configured mise installation commands (joined with && in a single RUN)
 	if len(imgCfg.Mise.Install) > 0 {
 		b.WriteString("RUN ")
 		b.WriteString(strings.Join(imgCfg.Mise.Install, " && "))
+		// The mise install commands refresh the apt lists too
+		if cleanApt {
+			b.WriteString(aptCleanup)
+		}
 		b.WriteString("\n")
 	}
+	b.WriteString("\n")
 
-	b.WriteString("RUN rm -rf /var/lib/apt/lists/*\n\n")
-	b.WriteString("RUN groupadd -r agent && useradd -m -r -u 1000 -g agent -s /bin/bash agent\n")
+	uid := imgCfg.Image.ResolveAgentUID()
+	var gid string
+	if imgCfg.Image.AgentGID > 0 {
+		gid = fmt.Sprintf(" -g %d", imgCfg.Image.AgentGID)
+	}
+	if packageManager == packageManagerApk {
+		b.WriteString(fmt.Sprintf("RUN addgroup -S%s agent && adduser -S -D -u %d -G agent -h /home/agent -s /bin/bash agent\n", gid, uid))
+	} else {
+		b.WriteString(fmt.Sprintf("RUN groupadd -r%s agent && useradd -m -r -u %d -g agent -s /bin/bash agent\n", gid, uid))
+	}
+	dataDir := imgCfg.Mise.ResolveDataDir()
+	shimsDir := path.Join(dataDir, "shims")
 	b.WriteString("ENV HOME=/home/agent\n")
-	b.WriteString("ENV PATH=\"/home/agent/.local/share/mise/shims:/home/agent/.local/bin:${PATH}\"\n")
+	if dataDir != defaultMiseDataDir {
+		b.WriteString(fmt.Sprintf("ENV MISE_DATA_DIR=%s\n", dataDir))
+	}
+	b.WriteString(fmt.Sprintf("ENV PATH=\"%s:/home/agent/.local/bin:${PATH}\"\n", shimsDir))
 
 	// Forward MISE_* environment variables into the image.
 	// Sources: mise.env from config (lower priority) and host env vars (higher priority).
 	// These are baked in so mise can use them during `mise install` (build time)
 	// and at runtime. MISE_ENV and MISE_SHELL are excluded from host env vars.
-	cfgEnvVars := configMiseEnvVars(imgCfg.Mise.Env)
-	hostEnvVars := collectMiseEnvVars(environ)
-	miseEnvVars := mergeMiseEnvVars(cfgEnvVars, hostEnvVars)
-	for _, kv := range miseEnvVars {
+	for _, kv := range imageMiseEnvVars(imgCfg, environ) {
 		b.WriteString(fmt.Sprintf("ENV %s=%q\n", kv[0], kv[1]))
 	}
 	b.WriteString("\n")
 	b.WriteString("RUN mkdir -p /home/agent/.config/mise\n")
+	if dataDir != defaultMiseDataDir {
+		b.WriteString(fmt.Sprintf("RUN mkdir -p %s && chown agent:agent %s\n", dataDir, dataDir))
+	}
 	b.WriteString(buildToolLabels(collection.specs))
 	b.WriteString("WORKDIR /home/agent\n")
 
@@ -303,35 +1172,387 @@ func buildDockerfile(hasTool, hasMise bool, collection collectResult, spec ToolS
 	if hasTool {
 		b.WriteString(" .tool-versions")
 	}
-	if hasMise {
-		b.WriteString(" /home/agent/.config/mise/config.toml")
+	if hasMise {
+		b.WriteString(" /home/agent/.config/mise/config.toml")
+	}
+	b.WriteString(" /home/agent/.config/mise/mise.agent.toml\n")
+
+	if len(spec.SeedFiles) > 0 {
+		containerConfigDir := path.Join("/home/agent", spec.ConfigDir)
+		for _, name := range spec.SeedFiles {
+			b.WriteString(fmt.Sprintf("COPY %s/%s %s\n", seedContextDir, name, path.Join(containerConfigDir, name)))
+		}
+		b.WriteString(fmt.Sprintf("RUN chown -R agent:agent %s\n", containerConfigDir))
+	}
+
+	b.WriteString("COPY assets/agent-entrypoint.sh /usr/local/bin/agent-entrypoint\n")
+	b.WriteString("RUN chmod +x /usr/local/bin/agent-entrypoint\n")
+	if imgCfg.Image.UseLoginShell() {
+		// /etc/profile resets PATH on Debian, so login shells need the shims
+		// added back from profile.d rather than from ENV
+		b.WriteString(fmt.Sprintf("RUN printf 'export PATH=\"%s:/home/agent/.local/bin:$PATH\"\\n%s' > /etc/profile.d/agent-en-place.sh\n", shimsDir, bashrcExtraLines(imgCfg.Image.BashrcExtra)))
+	}
+
+	b.WriteString("USER agent\n")
+
+	// Point npm at private registries before mise installs npm: packages
+	if lines := npmrcLines(imgCfg, agentName, collection.specs); len(lines) > 0 {
+		b.WriteString(fmt.Sprintf("RUN printf '%s' > /home/agent/.npmrc\n", strings.Join(lines, "")))
+	}
+
+	// Trust mise config files
+	if hasMise {
+		b.WriteString("RUN mise trust && mise trust /home/agent/.config/mise/mise.agent.toml\n")
+	} else {
+		b.WriteString("RUN mise trust /home/agent/.config/mise/mise.agent.toml\n")
+	}
+
+	// Tools with custom install args are installed on their own first;
+	// the blanket install below then finds them already present
+	for _, cmd := range customInstallCommands(collection.specs, imgCfg) {
+		b.WriteString("RUN " + cmd + "\n")
+	}
+
+	// Run mise install for user config (if present) and agent config
+	if hasMise {
+		b.WriteString("RUN mise install && mise install --env agent\n")
+	} else {
+		b.WriteString("RUN mise install --env agent\n")
+	}
+
+	if imgCfg.Image.UseLoginShell() {
+		// Start the entrypoint from a login shell so /etc/profile.d is applied
+		b.WriteString("WORKDIR /workdir\n")
+		b.WriteString("ENTRYPOINT [\"/bin/bash\", \"-lc\", \"exec /usr/local/bin/agent-entrypoint \\\"$@\\\"\", \"agent-entrypoint\"]\n")
+	} else {
+		b.WriteString(fmt.Sprintf("RUN printf 'export PATH=\"%s:/home/agent/.local/bin:$PATH\"\\n%s' > /home/agent/.bashrc\n", shimsDir, bashrcExtraLines(imgCfg.Image.BashrcExtra)))
+		b.WriteString("RUN printf 'source ~/.bashrc\\n' > /home/agent/.bash_profile\n")
+		b.WriteString("WORKDIR /workdir\n")
+		b.WriteString("ENTRYPOINT [\"/bin/bash\", \"/usr/local/bin/agent-entrypoint\"]\n")
+	}
+	b.WriteString(buildDefaultCmd(spec, imgCfg))
+	return declareBuildArgs(b.String(), baseImage, imgCfg.Image.BuildArgs)
+}
+
+// bashrcExtraLines formats image.bashrcExtra for the single-quoted printf
+// format string that writes the shell startup file
+func bashrcExtraLines(lines []string) string {
+	var b strings.Builder
+	for _, line := range lines {
+		// Escape printf's backslashes and % but leave the shell's '\'' quote escapes intact
+		parts := strings.Split(line, `'\''`)
+		for i, part := range parts {
+			part = strings.ReplaceAll(part, `\`, `\\`)
+			parts[i] = strings.ReplaceAll(part, "%", "%%")
+		}
+		b.WriteString(strings.Join(parts, `'\''`) + `\n`)
+	}
+	return b.String()
+}
+
+// npmrcLines returns the .npmrc lines for the configured npm registries,
+// formatted for a printf format string: image.npmRegistry as the default
+// registry, then a scope registry for the agent and each collected tool that
+// sets npmRegistry. The first registry for a scope wins.
+func npmrcLines(imgCfg *ImageConfig, agentName string, specs []toolDescriptor) []string {
+	var lines []string
+	if imgCfg.Image.NpmRegistry != "" {
+		lines = append(lines, fmt.Sprintf("registry=%s\\n", imgCfg.Image.NpmRegistry))
+	}
+
+	seen := make(map[string]bool)
+	addScope := func(pkg, registry string) {
+		scope, ok := npmScope(pkg)
+		if registry == "" || !ok || seen[scope] {
+			return
+		}
+		seen[scope] = true
+		lines = append(lines, fmt.Sprintf("%s:registry=%s\\n", scope, registry))
+	}
+	agent := imgCfg.Agents[agentName]
+	addScope(agent.PackageName, agent.NpmRegistry)
+	names := make([]string, 0, len(specs))
+	for _, s := range specs {
+		names = append(names, s.toolName())
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		addScope(name, imgCfg.Tools[name].NpmRegistry)
+	}
+
+	for i, line := range lines {
+		lines[i] = strings.ReplaceAll(line, "%", "%%")
+	}
+	return lines
+}
+
+// declareBuildArgs adds ARG instructions for the build args a Dockerfile
+// references. Args used in the base image are declared before FROM, the rest
+// right after it. Unreferenced args are only passed to the daemon.
+func declareBuildArgs(dockerfile, baseImage string, buildArgs map[string]string) string {
+	if len(buildArgs) == 0 {
+		return dockerfile
+	}
+	fromLine, body, _ := strings.Cut(dockerfile, "\n")
+
+	names := make([]string, 0, len(buildArgs))
+	for name := range buildArgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var before, after strings.Builder
+	for _, name := range names {
+		ref := regexp.MustCompile(`\$\{?` + regexp.QuoteMeta(name) + `(\W|$)`)
+		if ref.MatchString(baseImage) {
+			before.WriteString(fmt.Sprintf("ARG %s\n", name))
+		}
+		if ref.MatchString(body) {
+			after.WriteString(fmt.Sprintf("ARG %s\n", name))
+		}
+	}
+	return before.String() + fromLine + "\n" + after.String() + body
+}
+
+// parseBuildArgs parses --build-arg values. Like docker build, a bare KEY
+// takes its value from the environment.
+func parseBuildArgs(values []string) (map[string]string, error) {
+	args := make(map[string]string)
+	for _, value := range values {
+		key, val, ok := strings.Cut(value, "=")
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return nil, fmt.Errorf("invalid --build-arg %q: expected KEY=VALUE", value)
+		}
+		if !ok {
+			env, set := os.LookupEnv(key)
+			if !set {
+				return nil, fmt.Errorf("--build-arg %s has no value and is not set in the environment", key)
+			}
+			val = env
+		}
+		args[key] = val
+	}
+	return args, nil
+}
+
+// mergeBuildArgs returns the config build args overridden by flag values
+func mergeBuildArgs(config, flags map[string]string) map[string]string {
+	if len(flags) == 0 {
+		return config
+	}
+	merged := make(map[string]string, len(config)+len(flags))
+	for k, v := range config {
+		merged[k] = v
+	}
+	for k, v := range flags {
+		merged[k] = v
+	}
+	return merged
+}
+
+// buildDefaultCmd returns the CMD instruction so the image runs the agent when
+// started without arguments. image.defaultCommand overrides the agent command.
+func buildDefaultCmd(spec ToolSpec, imgCfg *ImageConfig) string {
+	command := imgCfg.Image.DefaultCommand
+	if command == "" {
+		command = spec.Command
+	}
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return ""
+	}
+	quoted := make([]string, 0, len(fields))
+	for _, field := range fields {
+		data, err := json.Marshal(field)
+		if err != nil {
+			return ""
+		}
+		quoted = append(quoted, string(data))
+	}
+	return fmt.Sprintf("CMD [%s]\n", strings.Join(quoted, ", "))
+}
+
+// customInstallCommands returns a `mise install` command for every collected
+// tool whose config entry sets installArgs, sorted by tool name. Each
+// argument is quoted for the shell that runs the RUN line.
+func customInstallCommands(specs []toolDescriptor, imgCfg *ImageConfig) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, s := range specs {
+		name := s.toolName()
+		if seen[name] || len(imgCfg.Tools[name].InstallArgs) == 0 {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	cmds := make([]string, 0, len(names))
+	for _, name := range names {
+		args := make([]string, 0, len(imgCfg.Tools[name].InstallArgs))
+		for _, arg := range imgCfg.Tools[name].InstallArgs {
+			args = append(args, shellQuote(arg))
+		}
+		cmds = append(cmds, fmt.Sprintf("mise install --env agent %s %s", strings.Join(args, " "), shellQuote(name)))
+	}
+	return cmds
+}
+
+// validateDockerfile performs a sanity check on a generated Dockerfile so that
+// bugs in buildDockerfile surface as a descriptive error rather than a
+// failure from the Docker daemon part way through the build.
+func validateDockerfile(dockerfile string) error {
+	var problems []string
+	hasFrom := false
+	for _, inst := range dockerfileInstructions(dockerfile) {
+		lineNum, instruction, args := inst.line, inst.keyword, inst.args
+		switch strings.ToUpper(instruction) {
+		case "FROM":
+			hasFrom = true
+			if args == "" {
+				problems = append(problems, fmt.Sprintf("line %d: FROM has no base image", lineNum))
+			}
+		case "RUN":
+			if args == "" {
+				problems = append(problems, fmt.Sprintf("line %d: RUN has no command", lineNum))
+			}
+			for _, cmd := range strings.Split(args, "&&") {
+				if isEmptyPackageInstall(cmd) {
+					problems = append(problems, fmt.Sprintf("line %d: package install has no packages: %s", lineNum, strings.TrimSpace(cmd)))
+				}
+			}
+		case "COPY", "ADD":
+			paths := copyPaths(args)
+			if len(paths) < 2 {
+				problems = append(problems, fmt.Sprintf("line %d: %s requires a source and destination: %s %s", lineNum, instruction, instruction, args))
+			} else if slices.Contains(paths[:len(paths)-1], "") {
+				problems = append(problems, fmt.Sprintf("line %d: %s has an empty source: %s %s", lineNum, instruction, instruction, args))
+			}
+		case "ENV", "LABEL", "WORKDIR", "USER", "ENTRYPOINT", "CMD", "ARG", "EXPOSE", "VOLUME", "STOPSIGNAL", "HEALTHCHECK", "SHELL", "ONBUILD", "MAINTAINER":
+			if args == "" {
+				problems = append(problems, fmt.Sprintf("line %d: %s has no arguments", lineNum, instruction))
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("line %d: unknown instruction %q", lineNum, instruction))
+		}
+	}
+	if !hasFrom {
+		problems = append(problems, "missing FROM instruction")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid Dockerfile generated:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// copyPaths returns the sources and destination of a COPY or ADD, leaving out
+// flags such as --chown. The JSON form is decoded; in the shell form quoted
+// paths are unquoted, so an empty source shows up as "".
+func copyPaths(args string) []string {
+	var paths []string
+	if strings.HasPrefix(args, "[") {
+		if err := json.Unmarshal([]byte(args), &paths); err == nil {
+			return paths
+		}
+	}
+	for _, field := range strings.Fields(args) {
+		if len(paths) == 0 && strings.HasPrefix(field, "--") {
+			continue
+		}
+		paths = append(paths, strings.Trim(field, `"'`))
 	}
-	b.WriteString(" /home/agent/.config/mise/mise.agent.toml\n")
-
-	b.WriteString("COPY assets/agent-entrypoint.sh /usr/local/bin/agent-entrypoint\n")
-	b.WriteString("RUN chmod +x /usr/local/bin/agent-entrypoint\n")
+	return paths
+}
 
-	b.WriteString("USER agent\n")
+// dockerfileInstruction is one logical instruction, after joining lines
+// continued with a backslash
+type dockerfileInstruction struct {
+	line    int // where the instruction starts
+	keyword string
+	args    string
+}
 
-	// Trust mise config files
-	if hasMise {
-		b.WriteString("RUN mise trust && mise trust /home/agent/.config/mise/mise.agent.toml\n")
-	} else {
-		b.WriteString("RUN mise trust /home/agent/.config/mise/mise.agent.toml\n")
+// heredocPattern matches heredoc markers such as <<EOF, <<-EOF and <<"EOF"
+var heredocPattern = regexp.MustCompile(`<<(-?)(["']?)([A-Za-z_][A-Za-z0-9_]*)(["']?)`)
+
+// dockerfileInstructions splits a Dockerfile into logical instructions the
+// way Docker reads it: comments and blank lines are skipped, even inside a
+// continued instruction, and the bodies of heredocs aren't instructions
+func dockerfileInstructions(dockerfile string) []dockerfileInstruction {
+	lines := strings.Split(dockerfile, "\n")
+	var instructions []dockerfileInstruction
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		start := i + 1
+		var parts []string
+		for {
+			continued := strings.HasSuffix(line, "\\")
+			parts = append(parts, strings.TrimSpace(strings.TrimSuffix(line, "\\")))
+			if !continued {
+				break
+			}
+			// Skip comments and blank lines until the next part
+			for i++; i < len(lines); i++ {
+				line = strings.TrimSpace(lines[i])
+				if line != "" && !strings.HasPrefix(line, "#") {
+					break
+				}
+			}
+			if i >= len(lines) {
+				break
+			}
+		}
+		logical := strings.Join(parts, " ")
+		keyword, args, _ := strings.Cut(logical, " ")
+		instructions = append(instructions, dockerfileInstruction{line: start, keyword: keyword, args: strings.TrimSpace(args)})
+
+		// Skip each heredoc's body up to its terminator
+		for _, marker := range heredocPattern.FindAllStringSubmatch(args, -1) {
+			stripTabs, word := marker[1] == "-", marker[3]
+			for i++; i < len(lines); i++ {
+				body := lines[i]
+				if stripTabs {
+					body = strings.TrimLeft(body, "\t")
+				}
+				if body == word {
+					break
+				}
+			}
+		}
 	}
+	return instructions
+}
 
-	// Run mise install for user config (if present) and agent config
-	if hasMise {
-		b.WriteString("RUN mise install && mise install --env agent\n")
-	} else {
-		b.WriteString("RUN mise install --env agent\n")
-	}
+// imagePackages returns the system packages installed in the image: the base
+// packages followed by additional packages from tool dependencies
+func imagePackages(imgCfg *ImageConfig, agentName string, collection collectResult) []string {
+	packages := append([]string{}, imgCfg.Image.Packages...)
+	packages = append(packages, imgCfg.ResolveAdditionalPackages(agentName, collection.userTools)...)
+	return dedupeStrings(packages)
+}
 
-	b.WriteString("RUN printf 'export PATH=\"/home/agent/.local/share/mise/shims:/home/agent/.local/bin:$PATH\"\\n' > /home/agent/.bashrc\n")
-	b.WriteString("RUN printf 'source ~/.bashrc\\n' > /home/agent/.bash_profile\n")
-	b.WriteString("WORKDIR /workdir\n")
-	b.WriteString("ENTRYPOINT [\"/bin/bash\", \"/usr/local/bin/agent-entrypoint\"]\n")
-	return b.String()
+// isEmptyPackageInstall reports whether cmd is an apt-get install or apk add with no packages
+func isEmptyPackageInstall(cmd string) bool {
+	fields := strings.Fields(cmd)
+	if len(fields) < 2 {
+		return false
+	}
+	isApt := fields[0] == "apt-get" && fields[1] == "install"
+	isApk := fields[0] == "apk" && fields[1] == "add"
+	if !isApt && !isApk {
+		return false
+	}
+	for _, f := range fields[2:] {
+		if !strings.HasPrefix(f, "-") {
+			return false
+		}
+	}
+	return true
 }
 
 type fileSpec struct {
@@ -340,12 +1561,19 @@ type fileSpec struct {
 	mode int64
 }
 
+// optionalFileSpec reads path, returning nil when it doesn't exist. A broken
+// symlink counts as missing, and one that can't be resolved, e.g. because it
+// is part of a loop, is skipped with a warning.
 func optionalFileSpec(path string) (*fileSpec, error) {
 	info, err := os.Stat(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, nil
 		}
+		if link, lerr := os.Lstat(path); lerr == nil && link.Mode()&os.ModeSymlink != 0 {
+			logWarn(fmt.Sprintf("skipping %s: symlink can't be resolved: %v", path, err), "path", path)
+			return nil, nil
+		}
 		return nil, err
 	}
 
@@ -361,6 +1589,110 @@ func optionalFileSpec(path string) (*fileSpec, error) {
 	}, nil
 }
 
+// miseConfigFiles are the project config files mise reads, highest
+// precedence first. mise.local.toml is left out as it holds machine-specific
+// settings.
+var miseConfigFiles = []string{
+	".mise.toml",
+	"mise.toml",
+	"mise/config.toml",
+	".mise/config.toml",
+	".config/mise.toml",
+	".config/mise/config.toml",
+}
+
+// findMiseFileSpec returns the mise config file in dir that mise gives the
+// highest precedence, warning when several exist. Whichever file is found, it
+// is copied into the image as mise.toml.
+func findMiseFileSpec(dir string) (*fileSpec, error) {
+	var found []*fileSpec
+	for _, name := range miseConfigFiles {
+		file, err := optionalFileSpec(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		if file != nil {
+			found = append(found, file)
+		}
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+	if len(found) > 1 {
+		paths := make([]string, 0, len(found))
+		for _, file := range found {
+			paths = append(paths, file.path)
+		}
+		logWarn(fmt.Sprintf("found several mise config files (%s); using %s, which mise gives the highest precedence", strings.Join(paths, ", "), found[0].path), "path", found[0].path)
+	}
+	return found[0], nil
+}
+
+// layeredMiseFileSpec finds the mise config in dir and each parent up to the
+// repository root (the first directory containing .git) and merges them the
+// way mise layers config files: tables such as [tools] and [env] are merged
+// key by key with the nearest file winning, other values are replaced.
+func layeredMiseFileSpec(dir string) (*fileSpec, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nearest first
+	var files []*fileSpec
+	for {
+		file, err := findMiseFileSpec(dir)
+		if err != nil {
+			return nil, err
+		}
+		if file != nil {
+			files = append(files, file)
+		}
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	switch len(files) {
+	case 0:
+		return nil, nil
+	case 1:
+		// Keep a single file byte-for-byte
+		files[0].path = "mise.toml"
+		return files[0], nil
+	}
+
+	merged := map[string]any{}
+	for i := len(files) - 1; i >= 0; i-- {
+		var config map[string]any
+		if err := toml.Unmarshal(files[i].data, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", files[i].path, err)
+		}
+		for key, value := range config {
+			table, isTable := value.(map[string]any)
+			existing, hasTable := merged[key].(map[string]any)
+			if !isTable || !hasTable {
+				merged[key] = value
+				continue
+			}
+			for k, v := range table {
+				existing[k] = v
+			}
+		}
+	}
+
+	data, err := toml.Marshal(merged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge mise.toml files: %w", err)
+	}
+	return &fileSpec{path: "mise.toml", data: data, mode: files[0].mode}, nil
+}
+
 // toolSource indicates where a tool specification originated
 type toolSource string
 
@@ -373,9 +1705,12 @@ const (
 
 type toolDescriptor struct {
 	name      string
+	tool      string // the tool as written in config and version files (e.g. "npm:@org/x"), before name was sanitized
 	version   string
 	labelName string     // friendly name for Docker labels (e.g., "codex" instead of "npm-openai-codex")
 	source    toolSource // tracks origin of this tool
+	fallbacks []string   // further versions from a .tool-versions line, after version
+	origin    string     // the file, variable or setting the version was read from
 }
 
 type collectResult struct {
@@ -383,6 +1718,10 @@ type collectResult struct {
 	idiomaticPaths []string
 	idiomaticInfos []idiomaticInfo
 	userTools      map[string]bool // tools specified by user/idiomatic sources
+	// candidates is every version offered for each tool, in precedence
+	// order. The first one for a tool is the version in specs.
+	candidates          []toolDescriptor
+	projectToolsSkipped bool // specified-only or agent-only mode ignored project sources
 }
 
 type idiomaticInfo struct {
@@ -393,29 +1732,86 @@ type idiomaticInfo struct {
 	source    toolSource // tracks origin of this tool
 }
 
-func collectToolSpecs(toolFile, miseFile *fileSpec, spec ToolSpec, imgCfg *ImageConfig, agentName string, debug bool) collectResult {
+// collectOptions controls which tool sources collectToolSpecs consults
+type collectOptions struct {
+	debug            bool // log skipped transitive dependencies
+	agentOnly        bool // ignore env, file and idiomatic sources; install only the agent and its config deps
+	fromWorkflows    bool // also read versions from GitHub Actions setup steps, below the other project sources
+	noFollowSymlinks bool // skip idiomatic version files that are symlinks
+}
+
+// specifiedToolsOnly reports whether only env var and config tools are
+// installed, skipping file and idiomatic detection. tools.specifiedOnly sets
+// the default and AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY overrides it when set:
+// "1" turns it on and any other value turns it off. Turning it on with the env
+// var needs AGENT_EN_PLACE_TOOLS too; envIgnored reports when it was missing.
+func specifiedToolsOnly(imgCfg *ImageConfig, haveEnvTools bool) (specifiedOnly, envIgnored bool) {
+	value := os.Getenv("AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY")
+	switch {
+	case value == "":
+		return imgCfg.ToolsSpecifiedOnly(), false
+	case value != "1":
+		return false, false
+	case !haveEnvTools:
+		return imgCfg.ToolsSpecifiedOnly(), true
+	}
+	return true, false
+}
+
+func collectToolSpecs(toolFile, miseFile *fileSpec, spec ToolSpec, imgCfg *ImageConfig, agentName string, opts collectOptions) collectResult {
 	envTools := parseEnvTools()
-	specifiedOnly := os.Getenv("AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY") == "1"
+	specifiedOnly, envIgnored := specifiedToolsOnly(imgCfg, len(envTools) > 0)
 
-	// Warn if SPECIFIED_TOOLS_ONLY is set without TOOLS
-	if specifiedOnly && len(envTools) == 0 {
-		fmt.Fprintf(os.Stderr, "Warning: AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY requires AGENT_EN_PLACE_TOOLS to be set, ignoring\n")
+	if opts.agentOnly {
+		// Agent-only mode takes precedence over the env var based tool selection
+		envTools = nil
 		specifiedOnly = false
+	} else if envIgnored {
+		// Warn if SPECIFIED_TOOLS_ONLY is set without TOOLS
+		logWarn("AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY requires AGENT_EN_PLACE_TOOLS to be set, ignoring")
 	}
+	skipProjectTools := specifiedOnly || opts.agentOnly
 
 	// Start with env var tools (highest priority, first-wins dedup)
-	specs := append([]toolDescriptor{}, envTools...)
+	specs := withOrigin(envTools, "AGENT_EN_PLACE_TOOLS")
 
 	var idiomatic []idiomaticInfo
-	if !specifiedOnly {
-		specs = append(specs, parseToolVersions(toolFile)...)
-		specs = append(specs, parseMiseToml(miseFile)...)
-		idiomatic = parseIdiomaticFiles()
+	if !skipProjectTools {
+		idiomatic = parseIdiomaticFiles(opts)
+		for _, alias := range resolveLtsAliases(idiomatic, imgCfg.Tools["node"].LtsAliases) {
+			logWarn(fmt.Sprintf("unknown Node.js LTS alias %q, using latest (map it in tools.node.ltsAliases)", alias))
+		}
+		var idiomaticSpecs []toolDescriptor
 		for _, info := range idiomatic {
 			if info.version == "" {
 				continue
 			}
-			specs = append(specs, toolDescriptor{name: info.tool, version: info.version, source: sourceIdiomatic})
+			idiomaticSpecs = append(idiomaticSpecs, toolDescriptor{name: info.tool, version: info.version, source: sourceIdiomatic, origin: info.path})
+		}
+		sources := map[string][]toolDescriptor{
+			precedenceToolVersions: withOrigin(parseToolVersions(toolFile), fileSpecLabel(toolFile, ".tool-versions")),
+			precedenceMiseToml:     withOrigin(parseMiseToml(miseFile), fileSpecLabel(miseFile, "mise.toml")),
+			precedenceIdiomatic:    idiomaticSpecs,
+		}
+		// Precedence was validated when the config was loaded
+		order, err := imgCfg.ResolvePrecedence()
+		if err != nil {
+			order = defaultPrecedence
+		}
+		for _, source := range order {
+			specs = append(specs, sources[source]...)
+		}
+		if opts.fromWorkflows {
+			specs = append(specs, withOrigin(parseWorkflowTools(imgCfg.Tools["node"].LtsAliases), workflowsDir)...)
+		}
+		warnVersionConflicts(specs)
+		if node, ok := packageManagerNode(idiomatic, specs, imgCfg); ok {
+			idiomatic = append(idiomatic, node)
+			specs = append(specs, toolDescriptor{name: node.tool, version: node.version, source: sourceIdiomatic, origin: "package.json packageManager"})
+		}
+		if erlang, ok := elixirErlang(specs, imgCfg); ok {
+			idiomatic = append(idiomatic, erlang)
+			specs = append(specs, toolDescriptor{name: erlang.tool, version: erlang.version, source: sourceIdiomatic, origin: "elixir"})
 		}
 	}
 
@@ -432,8 +1828,8 @@ func collectToolSpecs(toolFile, miseFile *fileSpec, spec ToolSpec, imgCfg *Image
 		// Add tools from config's dependency resolution
 		// These come after mise.toml/.tool-versions so they have lower priority
 		// Pass userTools so transitive deps are only resolved for user-specified tools
-		configTools := imgCfg.ResolveToolDeps(agentName, userTools, debug)
-		specs = append(specs, configTools...)
+		configTools := imgCfg.ResolveToolDeps(agentName, userTools, opts.debug)
+		specs = append(specs, withOrigin(configTools, string(sourceConfig))...)
 	}
 
 	deduped := dedupeToolSpecs(specs)
@@ -464,16 +1860,88 @@ func collectToolSpecs(toolFile, miseFile *fileSpec, spec ToolSpec, imgCfg *Image
 	infos = ensureToolInfo(infos, spec)
 
 	var idiomaticPaths []string
-	if !specifiedOnly {
+	if !skipProjectTools {
 		idiomaticPaths = uniquePaths(idiomatic)
 	}
 
 	return collectResult{
-		specs:          deduped,
-		idiomaticPaths: idiomaticPaths,
-		idiomaticInfos: infos,
-		userTools:      userTools,
+		specs:               deduped,
+		idiomaticPaths:      idiomaticPaths,
+		idiomaticInfos:      infos,
+		userTools:           userTools,
+		candidates:          specs,
+		projectToolsSkipped: skipProjectTools,
+	}
+}
+
+// withOrigin returns a copy of tools with each one's origin set
+func withOrigin(tools []toolDescriptor, origin string) []toolDescriptor {
+	result := make([]toolDescriptor, 0, len(tools))
+	for _, tool := range tools {
+		tool.origin = origin
+		result = append(result, tool)
+	}
+	return result
+}
+
+// fileSpecLabel returns the path a file was read from, or name if it has none
+func fileSpecLabel(file *fileSpec, name string) string {
+	if file != nil && file.path != "" {
+		return file.path
+	}
+	return name
+}
+
+// warnVersionConflicts warns about each tool given versions that disagree
+// across origins. specs are in precedence order so the first one wins in
+// dedupeToolSpecs. Versions agree when one is a prefix of the other at a
+// version boundary, such as 20 and 20.11.1.
+func warnVersionConflicts(specs []toolDescriptor) {
+	type sighting struct{ version, label string }
+	var names []string
+	sightings := map[string][]sighting{}
+	for _, tool := range specs {
+		key := sanitizeTagComponent(tool.name)
+		if key == "" {
+			continue
+		}
+		version := strings.TrimPrefix(tool.version, "v")
+		if version == "" {
+			version = "latest"
+		}
+		if _, ok := sightings[key]; !ok {
+			names = append(names, key)
+		}
+		sightings[key] = append(sightings[key], sighting{version: version, label: tool.origin})
+	}
+	for _, name := range names {
+		seen := sightings[name]
+		conflict := false
+		for _, other := range seen[1:] {
+			if !versionsAgree(seen[0].version, other.version) {
+				conflict = true
+				break
+			}
+		}
+		if !conflict {
+			continue
+		}
+		parts := make([]string, 0, len(seen))
+		for _, s := range seen {
+			parts = append(parts, fmt.Sprintf("%s (%s)", s.version, s.label))
+		}
+		logWarn(fmt.Sprintf("%s has conflicting versions: %s; using %s from %s", name, strings.Join(parts, ", "), seen[0].version, seen[0].label),
+			"tool", name, "version", seen[0].version, "source", seen[0].label)
+	}
+}
+
+// versionsAgree reports whether two versions are equal or one narrows the
+// other, e.g. 20 and 20.11.1 but not 2 and 20
+func versionsAgree(a, b string) bool {
+	if len(a) > len(b) {
+		a, b = b, a
 	}
+	return a == b || strings.HasPrefix(b, a+".")
 }
 
 func dedupeToolSpecs(specs []toolDescriptor) []toolDescriptor {
@@ -496,12 +1964,34 @@ func dedupeToolSpecs(specs []toolDescriptor) []toolDescriptor {
 		if labelName == "" {
 			labelName = getLabelName(spec.name)
 		}
-		result = append(result, toolDescriptor{name: key, version: version, labelName: labelName, source: spec.source})
+		result = append(result, toolDescriptor{name: key, tool: spec.toolName(), version: version, labelName: labelName, source: spec.source, fallbacks: spec.fallbacks, origin: spec.origin})
 	}
 	return result
 }
 
+// toolNames returns each spec's tool as written, for looking tools up in config
+func toolNames(specs []toolDescriptor) []string {
+	names := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		names = append(names, spec.toolName())
+	}
+	return names
+}
+
+// toolName returns the tool as written, which is how it's keyed under tools
+// in the config
+func (t toolDescriptor) toolName() string {
+	if t.tool != "" {
+		return t.tool
+	}
+	return t.name
+}
+
 func ensureDefaultTool(specs []toolDescriptor, toolSpec ToolSpec) []toolDescriptor {
+	// Agents backed by a local binary have no mise package to install
+	if toolSpec.MiseToolName == "" {
+		return specs
+	}
 	sanitizedName := sanitizeTagComponent(toolSpec.MiseToolName)
 	for _, spec := range specs {
 		if spec.name == sanitizedName {
@@ -510,18 +2000,24 @@ func ensureDefaultTool(specs []toolDescriptor, toolSpec ToolSpec) []toolDescript
 	}
 	return append(specs, toolDescriptor{
 		name:      toolSpec.MiseToolName,
-		version:   "latest",
+		tool:      toolSpec.MiseToolName,
+		version:   toolSpec.ResolvePackageVersion(),
+		source:    sourceConfig,
 		labelName: getLabelName(toolSpec.MiseToolName),
+		origin:    "agent",
 	})
 }
 
 func ensureToolInfo(infos []idiomaticInfo, spec ToolSpec) []idiomaticInfo {
+	if spec.ConfigKey == "" {
+		return infos
+	}
 	for _, info := range infos {
 		if info.configKey == spec.ConfigKey {
 			return infos
 		}
 	}
-	return append(infos, idiomaticInfo{tool: spec.MiseToolName, version: "latest", configKey: spec.ConfigKey})
+	return append(infos, idiomaticInfo{tool: spec.MiseToolName, version: spec.ResolvePackageVersion(), configKey: spec.ConfigKey})
 }
 
 func uniquePaths(infos []idiomaticInfo) []string {
@@ -614,6 +2110,17 @@ func configMiseEnvVars(env map[string]any) [][2]string {
 	return result
 }
 
+// imageMiseEnvVars returns the MISE_* env vars baked into the image: mise.env
+// from config, overridden by MISE_* vars from environ except a MISE_JOBS
+// that --mise-jobs replaces
+func imageMiseEnvVars(imgCfg *ImageConfig, environ []string) [][2]string {
+	hostVars := collectMiseEnvVars(environ)
+	if imgCfg.Mise.jobsFromFlag {
+		hostVars = slices.DeleteFunc(hostVars, func(kv [2]string) bool { return kv[0] == "MISE_JOBS" })
+	}
+	return mergeMiseEnvVars(configMiseEnvVars(imgCfg.Mise.ResolveEnv()), hostVars)
+}
+
 // mergeMiseEnvVars merges config-based and host-based MISE_ env vars.
 // Host env vars take precedence over config env vars for the same key.
 // Returns the merged list sorted by key.
@@ -709,7 +2216,12 @@ func parseToolVersions(spec *fileSpec) []toolDescriptor {
 		if len(fields) > 1 {
 			version = fields[1]
 		}
-		specs = append(specs, toolDescriptor{name: name, version: version, source: sourceUser})
+		// asdf allows fallback versions on the same line, e.g. "nodejs 20.10.0 18.19.0"
+		var fallbacks []string
+		if len(fields) > 2 {
+			fallbacks = fields[2:]
+		}
+		specs = append(specs, toolDescriptor{name: name, version: version, source: sourceUser, fallbacks: fallbacks})
 	}
 	return specs
 }
@@ -723,68 +2235,366 @@ func parseMiseToml(spec *fileSpec) []toolDescriptor {
 	if err := toml.Unmarshal(spec.data, &config); err != nil {
 		return nil // Fall back gracefully on parse error
 	}
-
-	// Extract tools from [tools] section
-	tools, ok := config["tools"].(map[string]any)
-	if !ok {
-		return nil
+
+	// Extract tools from [tools] section
+	tools, ok := config["tools"].(map[string]any)
+	if !ok {
+		return nil
+	}
+
+	// Sort tool names so the image tag and labels don't depend on map order
+	names := make([]string, 0, len(tools))
+	for name := range tools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var specs []toolDescriptor
+	for _, name := range names {
+		if v, ok := miseToolVersion(tools[name]); ok {
+			specs = append(specs, toolDescriptor{name: name, version: v, source: sourceUser})
+		}
+	}
+	return specs
+}
+
+// miseToolVersion reads the version of a [tools] entry, which mise accepts as
+// a string, a table with a version key (node = { version = "20" }) or a list
+// of versions where the first is the primary one. Tables and lists without a
+// version install the latest release.
+func miseToolVersion(value any) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case map[string]any:
+		if version, ok := v["version"].(string); ok && version != "" {
+			return version, true
+		}
+		return "latest", true
+	case []any:
+		if len(v) == 0 {
+			return "latest", true
+		}
+		return miseToolVersion(v[0])
+	}
+	return "", false
+}
+
+var idiomaticToolFiles = map[string][]string{
+	"crystal":   {".crystal-version"},
+	"elixir":    {".exenv-version", "mix.exs"},
+	"go":        {".go-version", "go.mod"},
+	"java":      {".java-version"},
+	"node":      {".nvmrc", ".node-version", "package.json"},
+	"python":    {".python-version", ".python-versions"},
+	"ruby":      {".ruby-version", "Gemfile"},
+	"rust":      {"rust-toolchain.toml", "rust-toolchain"},
+	"terraform": {".terraform-version"},
+	"dotnet":    {"global.json"},
+	"yarn":      {".yvmrc"},
+	"bun":       {".bun-version", "bunfig.toml", "bun.lockb"},
+	"php":       {".php-version", "composer.json"},
+}
+
+// parseIdiomaticFiles reads the version files in the working directory. With
+// opts.noFollowSymlinks, version files that are symlinks are skipped.
+func parseIdiomaticFiles(opts collectOptions) []idiomaticInfo {
+	// Visit tools in sorted order so detection results are deterministic
+	tools := make([]string, 0, len(idiomaticToolFiles))
+	for tool := range idiomaticToolFiles {
+		tools = append(tools, tool)
+	}
+	sort.Strings(tools)
+
+	var infos []idiomaticInfo
+	for _, tool := range tools {
+		for _, path := range idiomaticToolFiles[tool] {
+			if !versionFileUsable(path, opts) {
+				continue
+			}
+			version, ok := readIdiomaticVersion(tool, path)
+			if !ok || version == "" {
+				continue
+			}
+			configKey := tool
+			if strings.Contains(tool, ":") {
+				configKey = tool
+			}
+			infos = append(infos, idiomaticInfo{tool: tool, version: version, path: path, configKey: configKey, source: sourceIdiomatic})
+			break
+		}
+	}
+	// Files that can pin several tools only add tools that weren't already
+	// found in a dedicated version file
+	for _, file := range multiToolFiles {
+		if !versionFileUsable(file.path, opts) {
+			continue
+		}
+		for _, info := range file.parse(file.path) {
+			if !hasIdiomaticTool(infos, info.tool) {
+				infos = append(infos, info)
+			}
+		}
+	}
+	return infos
+}
+
+// versionFileUsable reports whether a version file should be read. Missing
+// files and symlinks that can't be resolved, whether broken or looping, count
+// as not present. With opts.noFollowSymlinks, symlinks are skipped with a
+// warning so a version file can't point outside the project.
+func versionFileUsable(path string, opts collectOptions) bool {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return true
+	}
+	if opts.noFollowSymlinks {
+		logWarn(fmt.Sprintf("skipping %s: it is a symlink", path), "path", path)
+		return false
+	}
+	if _, err := os.Stat(path); err != nil {
+		if opts.debug {
+			logDebug(fmt.Sprintf("skipping %s: symlink can't be resolved: %v", path, err), "path", path)
+		}
+		return false
+	}
+	return true
+}
+
+// multiToolFiles are idiomatic files that can specify more than one tool,
+// checked in order after the single-tool files in idiomaticToolFiles
+var multiToolFiles = []struct {
+	path  string
+	parse func(path string) []idiomaticInfo
+}{
+	{".sdkmanrc", parseSdkmanVersion},
+	{"package.json", parsePackageManagerInfos},
+}
+
+// parsePackageManagerInfos adapts parsePackageManager to multiToolFiles
+func parsePackageManagerInfos(path string) []idiomaticInfo {
+	if info, ok := parsePackageManager(path); ok {
+		return []idiomaticInfo{info}
+	}
+	return nil
+}
+
+func hasIdiomaticTool(infos []idiomaticInfo, tool string) bool {
+	for _, info := range infos {
+		if info.tool == tool {
+			return true
+		}
+	}
+	return false
+}
+
+// packageManagerTools maps the package manager named in package.json's
+// "packageManager" field to the mise tool that installs it.
+var packageManagerTools = map[string]string{
+	"npm":  "npm:npm",
+	"pnpm": "pnpm",
+	"yarn": "yarn",
+}
+
+// parsePackageManager reads the "packageManager" field from package.json
+// (e.g. "pnpm@8.15.0+sha256.abc") and returns the matching mise tool and version.
+func parsePackageManager(path string) (idiomaticInfo, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return idiomaticInfo{}, false
+	}
+	var pkg struct {
+		PackageManager string `json:"packageManager"`
+	}
+	if err := json.Unmarshal(data, &pkg); err != nil || pkg.PackageManager == "" {
+		return idiomaticInfo{}, false
+	}
+	name, version, _ := strings.Cut(pkg.PackageManager, "@")
+	tool, ok := packageManagerTools[name]
+	if !ok {
+		return idiomaticInfo{}, false
+	}
+	// Strip the corepack integrity hash suffix
+	version, _, _ = strings.Cut(version, "+")
+	if version == "" {
+		version = "latest"
+	}
+	return idiomaticInfo{tool: tool, version: version, path: path, configKey: tool, source: sourceIdiomatic}, true
+}
+
+// otpSuffix matches the Erlang/OTP release an Elixir build was compiled
+// against, as in "1.16.0-otp-26"
+var otpSuffix = regexp.MustCompile(`-otp-([0-9]+)$`)
+
+// elixirErlang returns an erlang entry to add when elixir was detected but
+// erlang was not specified anywhere, since elixir can't run without it. An
+// -otp-NN suffix on the elixir version picks the matching OTP release.
+func elixirErlang(specs []toolDescriptor, imgCfg *ImageConfig) (idiomaticInfo, bool) {
+	var elixir *toolDescriptor
+	for i, s := range specs {
+		switch sanitizeTagComponent(s.name) {
+		case "erlang":
+			return idiomaticInfo{}, false
+		case "elixir":
+			if elixir == nil {
+				elixir = &specs[i]
+			}
+		}
+	}
+	if elixir == nil {
+		return idiomaticInfo{}, false
+	}
+	version := imgCfg.Tools["erlang"].Version
+	if match := otpSuffix.FindStringSubmatch(elixir.version); match != nil {
+		version = match[1]
+	}
+	if version == "" {
+		version = "latest"
+	}
+	return idiomaticInfo{tool: "erlang", version: version, configKey: "erlang", source: sourceIdiomatic}, true
+}
+
+// packageManagerNode returns a node entry to add when a package manager was
+// detected from package.json but node itself was not specified anywhere,
+// since npm/pnpm/yarn all need node to run.
+func packageManagerNode(infos []idiomaticInfo, specs []toolDescriptor, imgCfg *ImageConfig) (idiomaticInfo, bool) {
+	hasPackageManager := false
+	for _, info := range infos {
+		if info.path == "package.json" && info.tool != "node" {
+			hasPackageManager = true
+		}
+	}
+	if !hasPackageManager {
+		return idiomaticInfo{}, false
+	}
+	for _, s := range specs {
+		if sanitizeTagComponent(s.name) == "node" {
+			return idiomaticInfo{}, false
+		}
+	}
+	version := imgCfg.Tools["node"].Version
+	if version == "" {
+		version = "latest"
+	}
+	return idiomaticInfo{tool: "node", version: version, configKey: "node", source: sourceIdiomatic}, true
+}
+
+// structuredVersionFiles are idiomatic files that aren't a bare version
+// string. They may legitimately not pin a version.
+var structuredVersionFiles = map[string]func(path string) (string, bool){
+	"Gemfile":             parseGemfileVersion,
+	"go.mod":              parseGoModVersion,
+	"bunfig.toml":         parseBunfig,
+	"bun.lockb":           detectFile,
+	"composer.json":       parseComposerPhp,
+	"mix.exs":             parseMixExs,
+	"rust-toolchain.toml": parseRustToolchain,
+	"rust-toolchain":      parseLegacyRustToolchain,
+	"package.json":        parsePackageJsonNode,
+	"global.json":         parseGlobalJsonDotnet,
+}
+
+func readIdiomaticVersion(tool, path string) (string, bool) {
+	if parse, ok := structuredVersionFiles[path]; ok {
+		return parse(path)
+	}
+	line, ok := readFirstLine(path)
+	if !ok {
+		return "", false
+	}
+	return line, true
+}
+
+// nodeLtsCodenames maps the Node.js LTS codenames used in .nvmrc aliases such
+// as "lts/iron" to their major version
+var nodeLtsCodenames = map[string]string{
+	"argon":    "4",
+	"boron":    "6",
+	"carbon":   "8",
+	"dubnium":  "10",
+	"erbium":   "12",
+	"fermium":  "14",
+	"gallium":  "16",
+	"hydrogen": "18",
+	"iron":     "20",
+	"jod":      "22",
+	"krypton":  "24",
+}
+
+// resolveNodeLts converts an nvm LTS alias into a version mise understands:
+// "lts/*" becomes "lts" and "lts/<codename>" the codename's major version,
+// checking tools.node.ltsAliases before the built-in codenames. Other versions
+// are returned unchanged. ok is false when the codename is unknown.
+func resolveNodeLts(version string, aliases map[string]string) (string, bool) {
+	codename, isAlias := strings.CutPrefix(strings.ToLower(version), "lts/")
+	if !isAlias {
+		return version, true
+	}
+	if codename == "*" {
+		return "lts", true
+	}
+	if major, ok := aliases[codename]; ok {
+		return major, true
+	}
+	if major, ok := nodeLtsCodenames[codename]; ok {
+		return major, true
 	}
+	return "latest", false
+}
 
-	var specs []toolDescriptor
-	for name, version := range tools {
-		if v, ok := version.(string); ok {
-			specs = append(specs, toolDescriptor{name: name, version: v, source: sourceUser})
+// resolveLtsAliases rewrites node LTS aliases from version files in place and
+// returns the aliases that couldn't be resolved, which fall back to latest
+func resolveLtsAliases(infos []idiomaticInfo, aliases map[string]string) []string {
+	var unknown []string
+	for i, info := range infos {
+		if info.tool != "node" {
+			continue
+		}
+		version, ok := resolveNodeLts(info.version, aliases)
+		if !ok {
+			unknown = append(unknown, info.version)
 		}
+		infos[i].version = version
 	}
-	return specs
+	return unknown
 }
 
-var idiomaticToolFiles = map[string][]string{
-	"crystal": {".crystal-version"},
-	"elixir":  {".exenv-version"},
-	"go":      {".go-version", "go.mod"},
-	"java":    {".java-version", ".sdkmanrc"},
-	"node":    {".nvmrc", ".node-version"},
-	"python":  {".python-version", ".python-versions"},
-	"ruby":    {".ruby-version", "Gemfile"},
-	"yarn":    {".yvmrc"},
-	"bun":     {".bun-version"},
-}
-
-func parseIdiomaticFiles() []idiomaticInfo {
-	var infos []idiomaticInfo
-	for tool, paths := range idiomaticToolFiles {
-		for _, path := range paths {
-			version, ok := readIdiomaticVersion(tool, path)
-			if !ok || version == "" {
+// idiomaticVersionPattern matches the version strings and aliases (lts/*,
+// 3.12, v20.11.0, temurin-17) found in version files
+var idiomaticVersionPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+*/-]*$`)
+
+// checkIdiomaticFiles is used by --strict-idiomatic. Instead of skipping a
+// version file that exists but doesn't hold a usable version, it returns an
+// error naming the file and its content.
+func checkIdiomaticFiles(opts collectOptions) error {
+	tools := make([]string, 0, len(idiomaticToolFiles))
+	for tool := range idiomaticToolFiles {
+		tools = append(tools, tool)
+	}
+	sort.Strings(tools)
+
+	for _, tool := range tools {
+		for _, path := range idiomaticToolFiles[tool] {
+			if !versionFileUsable(path, opts) {
 				continue
 			}
-			configKey := tool
-			if strings.Contains(tool, ":") {
-				configKey = tool
+			_, structured := structuredVersionFiles[path]
+			version, ok := readIdiomaticVersion(tool, path)
+			if !ok {
+				if structured {
+					continue
+				}
+				return fmt.Errorf("%s does not contain a %s version", path, tool)
+			}
+			if !idiomaticVersionPattern.MatchString(version) {
+				return fmt.Errorf("%s contains an invalid %s version: %q", path, tool, version)
 			}
-			infos = append(infos, idiomaticInfo{tool: tool, version: version, path: path, configKey: configKey, source: sourceIdiomatic})
-			break
-		}
-	}
-	return infos
-}
-
-func readIdiomaticVersion(tool, path string) (string, bool) {
-	switch path {
-	case "Gemfile":
-		return parseGemfileVersion(path)
-	case ".sdkmanrc":
-		return parseSdkmanVersion(path)
-	case "go.mod":
-		return parseGoModVersion(path)
-	default:
-		line, ok := readFirstLine(path)
-		if !ok {
-			return "", false
 		}
-		return line, true
 	}
+	return nil
 }
 
 func readFirstLine(path string) (string, bool) {
@@ -822,37 +2632,283 @@ func parseGemfileVersion(path string) (string, bool) {
 	return "", false
 }
 
-func parseSdkmanVersion(path string) (string, bool) {
+// sdkmanCandidates maps SDKMAN! candidate names to mise tools
+var sdkmanCandidates = map[string]string{
+	"ant":    "ant",
+	"gradle": "gradle",
+	"groovy": "groovy",
+	"java":   "java",
+	"kotlin": "kotlin",
+	"maven":  "maven",
+	"sbt":    "sbt",
+	"scala":  "scala",
+}
+
+// parseSdkmanVersion reads every supported candidate from a .sdkmanrc
+// (e.g. "java=17", "gradle=8.5") as a separate tool
+func parseSdkmanVersion(path string) []idiomaticInfo {
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return "", false
+		return nil
 	}
+	var infos []idiomaticInfo
 	scanner := bufio.NewScanner(bytes.NewReader(data))
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
-		if strings.HasPrefix(line, "java=") {
-			version := strings.TrimPrefix(line, "java=")
-			return version, version != ""
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		candidate, version, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		tool, known := sdkmanCandidates[strings.TrimSpace(candidate)]
+		version = strings.TrimSpace(version)
+		if !known || version == "" || hasIdiomaticTool(infos, tool) {
+			continue
 		}
+		infos = append(infos, idiomaticInfo{tool: tool, version: version, path: path, configKey: tool, source: sourceIdiomatic})
 	}
-	return "", false
+	return infos
+}
+
+// parseGlobalJsonDotnet reads the .NET SDK version from global.json, e.g.
+// {"sdk": {"version": "8.0.100"}}
+func parseGlobalJsonDotnet(path string) (string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	var global struct {
+		SDK struct {
+			Version string `json:"version"`
+		} `json:"sdk"`
+	}
+	if err := json.Unmarshal(data, &global); err != nil {
+		return "", false
+	}
+	version := strings.TrimSpace(global.SDK.Version)
+	return version, version != ""
+}
+
+// parseRustToolchain reads the channel from a rust-toolchain.toml file, e.g.
+//
+//	[toolchain]
+//	channel = "1.75.0"
+func parseRustToolchain(path string) (string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	var toolchain struct {
+		Toolchain struct {
+			Channel string `toml:"channel"`
+		} `toml:"toolchain"`
+	}
+	if err := toml.Unmarshal(data, &toolchain); err != nil {
+		return "", false
+	}
+	channel := strings.TrimSpace(toolchain.Toolchain.Channel)
+	return channel, channel != ""
+}
+
+// parseLegacyRustToolchain reads a rust-toolchain file without an extension.
+// rustup accepts either a bare channel on the first line or the same TOML as
+// rust-toolchain.toml.
+func parseLegacyRustToolchain(path string) (string, bool) {
+	if channel, ok := parseRustToolchain(path); ok {
+		return channel, true
+	}
+	line, ok := readFirstLine(path)
+	if !ok || strings.HasPrefix(line, "[") {
+		return "", false
+	}
+	return line, true
+}
+
+// parseBunfig detects bun from bunfig.toml. Bun's config file has no field
+// pinning the runtime version, so a valid bunfig.toml means "latest".
+func parseBunfig(path string) (string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	var config map[string]any
+	if err := toml.Unmarshal(data, &config); err != nil {
+		return "", false
+	}
+	return "latest", true
+}
+
+// detectFile reports "latest" when a file exists without parsing it.
+// Used for binary lockfiles that only imply a tool is needed.
+func detectFile(path string) (string, bool) {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", false
+	}
+	return "latest", true
 }
 
+// parseGoModVersion reads the go directive from go.mod. With
+// AGENT_EN_PLACE_GO_TOOLCHAIN=1 a newer toolchain directive (e.g.
+// "toolchain go1.24.5") wins, since that is the Go the project builds with.
 func parseGoModVersion(path string) (string, bool) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return "", false
 	}
+	var goVersion, toolchain string
 	scanner := bufio.NewScanner(bytes.NewReader(data))
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
-		if strings.HasPrefix(line, "go ") {
-			version := strings.TrimPrefix(line, "go ")
-			version = strings.TrimSpace(version)
-			return version, version != ""
+		if strings.HasPrefix(line, "go ") && goVersion == "" {
+			goVersion = strings.TrimSpace(strings.TrimPrefix(line, "go "))
+		}
+		if strings.HasPrefix(line, "toolchain ") && toolchain == "" {
+			toolchain = strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(line, "toolchain ")), "go")
 		}
 	}
-	return "", false
+	if goVersion == "" {
+		return "", false
+	}
+	if os.Getenv("AGENT_EN_PLACE_GO_TOOLCHAIN") == "1" && toolchain != "" && goVersionNewer(toolchain, goVersion) {
+		return toolchain, true
+	}
+	return goVersion, true
+}
+
+// goVersionNewer reports whether Go version a is newer than b, comparing the
+// numeric release components ("1.24.5" > "1.24"). Pre-release suffixes such as
+// "rc1" are ignored.
+func goVersionNewer(a, b string) bool {
+	partsA, partsB := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < max(len(partsA), len(partsB)); i++ {
+		numA, numB := goVersionPart(partsA, i), goVersionPart(partsB, i)
+		if numA != numB {
+			return numA > numB
+		}
+	}
+	return false
+}
+
+// goVersionPart returns the leading number of the i'th version component, or
+// 0 when there is none
+func goVersionPart(parts []string, i int) int {
+	if i >= len(parts) {
+		return 0
+	}
+	digits := strings.IndexFunc(parts[i], func(r rune) bool { return r < '0' || r > '9' })
+	if digits < 0 {
+		digits = len(parts[i])
+	}
+	n, _ := strconv.Atoi(parts[i][:digits])
+	return n
+}
+
+// parseComposerPhp reads the PHP version from composer.json. The exact
+// config.platform.php override wins over the require.php constraint, and
+// range constraints such as "^8.3" resolve to their lower bound.
+func parseComposerPhp(path string) (string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	var composer struct {
+		Config struct {
+			Platform struct {
+				PHP string `json:"php"`
+			} `json:"platform"`
+		} `json:"config"`
+		Require map[string]string `json:"require"`
+	}
+	if err := json.Unmarshal(data, &composer); err != nil {
+		return "", false
+	}
+	if version := strings.TrimSpace(composer.Config.Platform.PHP); version != "" {
+		return version, true
+	}
+	return constraintFloor(composer.Require["php"])
+}
+
+// mixElixirRequirement matches the elixir requirement in a mix.exs project
+// definition, e.g. elixir: "~> 1.16"
+var mixElixirRequirement = regexp.MustCompile(`\belixir:\s*"([^"]+)"`)
+
+// parseMixExs reads the Elixir version from the project's elixir requirement
+// in mix.exs. Requirements resolve to their lowest version ("~> 1.16" ->
+// "1.16") and for alternatives joined with "or" the first one is used.
+func parseMixExs(path string) (string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	match := mixElixirRequirement.FindSubmatch(data)
+	if match == nil {
+		return "", false
+	}
+	requirement, _, _ := strings.Cut(string(match[1]), " or ")
+	return constraintFloor(rangeOperatorSpace.ReplaceAllString(requirement, "$1"))
+}
+
+// parsePackageJsonNode reads the node version from package.json's
+// engines.node field. Ranges such as ">=20" or "^18.0.0" resolve to their
+// lowest version, like Composer constraints, and x wildcards are dropped
+// ("20.x" -> "20").
+func parsePackageJsonNode(path string) (string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	var pkg struct {
+		Engines struct {
+			Node string `json:"node"`
+		} `json:"engines"`
+	}
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return "", false
+	}
+	constraint := rangeOperatorSpace.ReplaceAllString(pkg.Engines.Node, "$1")
+	version, ok := constraintFloor(constraint)
+	if !ok {
+		return "", false
+	}
+	return trimVersionWildcard(version)
+}
+
+// trimVersionWildcard strips trailing wildcard components, which mise treats
+// as a prefix anyway: "20.x" -> "20", "3.12.x" -> "3.12". ok is false when
+// nothing but a wildcard is left.
+func trimVersionWildcard(version string) (string, bool) {
+	for {
+		trimmed := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(version, ".x"), ".X"), ".*")
+		if trimmed == version {
+			break
+		}
+		version = trimmed
+	}
+	return version, version != "" && version != "x" && version != "X" && version != "*"
+}
+
+// rangeOperatorSpace matches the space npm allows between a range operator
+// and its version, as in ">= 20"
+var rangeOperatorSpace = regexp.MustCompile(`([<>=^~]+)\s+`)
+
+// constraintFloor returns the lowest version allowed by a Composer style
+// constraint, e.g. "^8.3" -> "8.3", ">=8.1 <9.0" -> "8.1", "8.2.*" -> "8.2".
+// For alternatives ("^8.1 || ^8.2") the first one is used.
+func constraintFloor(constraint string) (string, bool) {
+	constraint, _, _ = strings.Cut(constraint, "|")
+	fields := strings.FieldsFunc(constraint, func(r rune) bool { return r == ' ' || r == ',' })
+	if len(fields) == 0 {
+		return "", false
+	}
+	version := strings.TrimLeft(fields[0], "^~>=v")
+	version = strings.TrimSuffix(strings.TrimSuffix(version, "*"), ".")
+	if version == "" || strings.ContainsAny(version, "<!") {
+		return "", false
+	}
+	return version, true
 }
 
 func buildImageName(specs []toolDescriptor) string {
@@ -874,16 +2930,69 @@ func buildImageName(specs []toolDescriptor) string {
 	if len(parts) == 0 {
 		return fmt.Sprintf("%s:latest", imageRepository)
 	}
-	return fmt.Sprintf("%s:%s", imageRepository, strings.Join(parts, "-"))
+	tag := strings.Join(parts, "-")
+	if len(tag) > maxImageTagLength {
+		tag = shortenImageTag(parts)
+	}
+	return fmt.Sprintf("%s:%s", imageRepository, tag)
+}
+
+const (
+	// maxImageTagLength caps the computed tag, leaving room for the inputs
+	// hash and platform suffixes under Docker's 128 character limit
+	maxImageTagLength  = 96
+	imageTagHashLength = 12
+)
+
+// shortenImageTag keeps the leading name-version parts that fit and appends a
+// truncated sha256 of every part. The parts are sorted before hashing so the
+// hash doesn't depend on the order the tools were found in.
+func shortenImageTag(parts []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(slices.Sorted(slices.Values(parts)), "\n")))
+	hash := hex.EncodeToString(sum[:])[:imageTagHashLength]
+	budget := maxImageTagLength - len(hash) - 1
+
+	readable := ""
+	for _, part := range parts {
+		next := part
+		if readable != "" {
+			next = readable + "-" + part
+		}
+		if len(next) > budget {
+			break
+		}
+		readable = next
+	}
+	if readable == "" {
+		// A single part longer than the budget is cut short
+		readable = strings.TrimRight(parts[0][:budget], "-.")
+	}
+	return readable + "-" + hash
+}
+
+// imageTagSpecs returns the specs used to compute the image tag.
+// When image.excludeAgentFromTag is set and the agent tool is unpinned ("latest"),
+// it is left out so the tag stays stable as the agent package is updated.
+// The agent is still recorded in the image labels.
+func imageTagSpecs(specs []toolDescriptor, spec ToolSpec, imgCfg *ImageConfig) []toolDescriptor {
+	if !imgCfg.Image.OmitAgentFromTag() {
+		return specs
+	}
+	agentName := sanitizeTagComponent(spec.MiseToolName)
+	var result []toolDescriptor
+	for _, s := range specs {
+		if sanitizeTagComponent(s.name) == agentName && s.version == "latest" {
+			continue
+		}
+		result = append(result, s)
+	}
+	return result
 }
 
 func buildToolLabels(specs []toolDescriptor) string {
 	var b strings.Builder
 	for _, spec := range specs {
-		name := spec.labelName
-		if name == "" {
-			name = sanitizeTagComponent(spec.name)
-		}
+		name := toolLabelName(spec)
 		if name == "" {
 			continue
 		}
@@ -891,15 +3000,86 @@ func buildToolLabels(specs []toolDescriptor) string {
 		if version == "" {
 			version = "latest"
 		}
-		key := fmt.Sprintf("com.mheap.agent-en-place.%s", name)
+		key := labelPrefix + name
 		b.WriteString(fmt.Sprintf("LABEL %s=\"%s\"\n", key, version))
 	}
 	return b.String()
 }
 
+// toolLabelName returns the image label name for a tool, without labelPrefix
+func toolLabelName(spec toolDescriptor) string {
+	if spec.labelName != "" {
+		return spec.labelName
+	}
+	return sanitizeTagComponent(spec.name)
+}
+
+// agentMiseConfig builds mise.agent.toml, adding the [env] section of the
+// user's mise.toml when mise.inheritUserEnv is set and a [settings] section
+// with the keys named in mise.propagateSettings
+func agentMiseConfig(userMiseData []byte, collection collectResult, spec ToolSpec, imgCfg *ImageConfig) ([]byte, error) {
+	data, err := buildAgentMiseConfig(userMiseData, collection, spec)
+	if err != nil {
+		return nil, err
+	}
+	inheritEnv := imgCfg.Mise.InheritProjectEnv()
+	propagate := imgCfg.Mise.PropagateSettings
+	if !inheritEnv && len(propagate) == 0 {
+		return data, nil
+	}
+	var userConfig struct {
+		Env      map[string]any `toml:"env"`
+		Settings map[string]any `toml:"settings"`
+	}
+	if len(userMiseData) > 0 {
+		if err := toml.Unmarshal(userMiseData, &userConfig); err != nil {
+			return nil, fmt.Errorf("failed to parse mise.toml: %w", err)
+		}
+	}
+	if inheritEnv && len(userConfig.Env) > 0 {
+		if data, err = appendMiseTable(data, "env", userConfig.Env); err != nil {
+			return nil, err
+		}
+	}
+	if settings := propagatedSettings(propagate, imgCfg.Mise.ResolveEnv(), userConfig.Settings); len(settings) > 0 {
+		if data, err = appendMiseTable(data, "settings", settings); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// propagatedSettings picks the named keys from mise.env and the project
+// mise.toml's [settings], the project's value winning. Keys set in neither
+// are left out.
+func propagatedSettings(keys []string, configEnv, userSettings map[string]any) map[string]any {
+	settings := make(map[string]any)
+	for _, key := range keys {
+		if value, ok := userSettings[key]; ok {
+			settings[key] = value
+		} else if value, ok := configEnv[key]; ok {
+			settings[key] = value
+		}
+	}
+	return settings
+}
+
+// appendMiseTable appends a [name] table to a generated mise config
+func appendMiseTable(data []byte, name string, table map[string]any) ([]byte, error) {
+	encoded, err := toml.Marshal(map[string]any{name: table})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode mise.toml %s: %w", name, err)
+	}
+	if len(data) > 0 {
+		data = append(data, '\n')
+	}
+	return append(data, encoded...), nil
+}
+
 // buildAgentMiseConfig creates a mise.agent.toml with only the [tools] section.
 // It excludes any tools that are already defined in the user's mise.toml,
-// allowing user-specified versions to take precedence via mise's environment layering.
+// allowing user-specified versions to take precedence via mise's environment
+// layering, unless the project's sources disagree on a tool's version.
 func buildAgentMiseConfig(userMiseData []byte, collection collectResult, spec ToolSpec) ([]byte, error) {
 	// Parse user's mise.toml to get their tool names (for filtering)
 	userTools := make(map[string]bool)
@@ -934,15 +3114,55 @@ func buildAgentMiseConfig(userMiseData []byte, collection collectResult, spec To
 		}
 	}
 
-	// Ensure the agent's primary tool is present (unless user specified it)
-	if !userTools[spec.ConfigKey] {
-		agentTools[spec.ConfigKey] = "latest"
+	// mise.agent.toml overrides the project's files, so a tool that sources
+	// disagree on is written with the version tools.precedence picked, even
+	// when the user's mise.toml has it. Otherwise mise would choose for
+	// itself and the image could hold a different version than its tag.
+	// Tools pinned with several versions keep all of them; mise installs each
+	// and uses the first.
+	contested := contestedTools(collection.candidates)
+	for _, tool := range collection.specs {
+		key := sanitizeTagComponent(tool.name)
+		switch {
+		case len(tool.fallbacks) > 0 && (contested[key] || !userTools[tool.toolName()]):
+			agentTools[tool.toolName()] = append([]string{tool.version}, tool.fallbacks...)
+		case contested[key]:
+			agentTools[tool.toolName()] = tool.version
+		}
+	}
+
+	// Ensure the agent's primary tool is present (unless user specified it),
+	// keeping a version pinned through AGENT_EN_PLACE_TOOLS
+	if spec.ConfigKey != "" && !userTools[spec.ConfigKey] {
+		if _, ok := agentTools[spec.ConfigKey]; !ok {
+			agentTools[spec.ConfigKey] = spec.ResolvePackageVersion()
+		}
 	}
 
 	// Marshal to TOML (only [tools] section)
 	return marshalAgentMiseConfig(agentTools)
 }
 
+// contestedTools returns the sanitized names of tools that candidates offer
+// more than one version of
+func contestedTools(candidates []toolDescriptor) map[string]bool {
+	versions := make(map[string]string)
+	contested := make(map[string]bool)
+	for _, tool := range candidates {
+		key := sanitizeTagComponent(tool.name)
+		version := strings.Join(append([]string{tool.version}, tool.fallbacks...), ",")
+		seen, ok := versions[key]
+		if !ok {
+			versions[key] = version
+			continue
+		}
+		if seen != version {
+			contested[key] = true
+		}
+	}
+	return contested
+}
+
 // marshalAgentMiseConfig marshals the tools map to a TOML [tools] section with sorted keys
 func marshalAgentMiseConfig(tools map[string]any) ([]byte, error) {
 	var buf bytes.Buffer
@@ -964,6 +3184,14 @@ func marshalAgentMiseConfig(tools map[string]any) ([]byte, error) {
 			if strings.ContainsAny(name, ":@/") {
 				quotedName = fmt.Sprintf("%q", name)
 			}
+			if versions, ok := version.([]string); ok {
+				quoted := make([]string, len(versions))
+				for i, v := range versions {
+					quoted[i] = fmt.Sprintf("%q", v)
+				}
+				buf.WriteString(fmt.Sprintf("%s = [%s]\n", quotedName, strings.Join(quoted, ", ")))
+				continue
+			}
 			buf.WriteString(fmt.Sprintf("%s = %q\n", quotedName, version))
 		}
 	}
@@ -971,6 +3199,12 @@ func marshalAgentMiseConfig(tools map[string]any) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// aliasTagName renders an image.aliasTag pattern into a tag, replacing the
+// {agent} and {project} placeholders and sanitizing the result
+func aliasTagName(pattern, agentName, project string) string {
+	return sanitizeTagComponent(strings.NewReplacer("{agent}", agentName, "{project}", project).Replace(pattern))
+}
+
 func sanitizeTagComponent(value string) string {
 	value = strings.ToLower(strings.TrimSpace(value))
 	var b strings.Builder
@@ -996,6 +3230,80 @@ func sanitizeTagComponent(value string) string {
 	return out
 }
 
+// writeBuildContext prints each file in a build context under a
+// "=== <name> ===" header. It reads the tar makeBuildContext produced so the
+// output matches what is sent to the daemon. Binary files, such as bun.lockb,
+// are summarised rather than printed.
+func writeBuildContext(w io.Writer, buildCtx io.Reader) error {
+	tr := tar.NewReader(buildCtx)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read build context: %w", err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("failed to read %s from build context: %w", header.Name, err)
+		}
+
+		fmt.Fprintf(w, "=== %s ===\n", header.Name)
+		if bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(data) {
+			fmt.Fprintf(w, "(binary, %d bytes)\n", len(data))
+			continue
+		}
+		w.Write(data)
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeDryRun lists the files in a build context with their sizes, followed
+// by the size of the tar that would be sent to the Docker daemon
+func writeDryRun(w io.Writer, imageName string, buildCtx io.Reader) error {
+	counter := &countingReader{r: buildCtx}
+	tr := tar.NewReader(counter)
+	fmt.Fprintf(w, "Dry run: build context for %s\n", imageName)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tMODE\tSIZE")
+	files := 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read build context: %w", err)
+		}
+		fmt.Fprintf(tw, "%s\t%04o\t%d\n", header.Name, header.Mode, header.Size)
+		files++
+	}
+	// Drain the tar's end-of-archive padding so the total matches what is sent
+	if _, err := io.Copy(io.Discard, counter); err != nil {
+		return fmt.Errorf("failed to read build context: %w", err)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d files, %d bytes\n", files, counter.n)
+	return nil
+}
+
+// writeFileToTar adds a file to the build context. Only name, mode and size
+// are set so the tar bytes (and therefore the build) are reproducible.
 func writeFileToTar(tw *tar.Writer, name string, data []byte, mode int64) error {
 	header := &tar.Header{
 		Name: name,
@@ -1027,6 +3335,54 @@ func writeIdiomaticFiles(tw *tar.Writer, paths []string) error {
 	return nil
 }
 
+// seedContextDir is the build context directory holding seeded config files
+const seedContextDir = "seed-config"
+
+// resolveSeedFiles returns the allowlisted seed files that exist in the agent's
+// host config dir. Only plain filenames are accepted so nothing outside the
+// config dir can be copied into the image.
+func resolveSeedFiles(home string, spec ToolSpec) ([]string, error) {
+	if len(spec.SeedFiles) == 0 {
+		logWarn("--seed-config has no effect: no seedFiles are configured for this agent")
+		return nil, nil
+	}
+	var names []string
+	for _, name := range spec.SeedFiles {
+		if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+			return nil, fmt.Errorf("invalid seedFiles entry %q: must be a filename inside %s", name, spec.ConfigDir)
+		}
+		hostPath := filepath.Join(home, spec.ConfigDir, name)
+		info, err := os.Stat(hostPath)
+		if err != nil || !info.Mode().IsRegular() {
+			logWarn(fmt.Sprintf("seed file %s not found, skipping", hostPath), "path", hostPath)
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// writeSeedFiles adds the resolved seed files from the host config dir to the build context
+func writeSeedFiles(tw *tar.Writer, spec ToolSpec) error {
+	if len(spec.SeedFiles) == 0 {
+		return nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return fmt.Errorf("failed to find home directory for seed files: %w", err)
+	}
+	for _, name := range spec.SeedFiles {
+		data, err := os.ReadFile(filepath.Join(home, spec.ConfigDir, name))
+		if err != nil {
+			return fmt.Errorf("failed to read seed file: %w", err)
+		}
+		if err := writeFileToTar(tw, path.Join(seedContextDir, name), data, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func handleBuildOutput(rc io.Reader, debug bool, imageName string) error {
 	scanner := bufio.NewScanner(rc)
 	// Keep last 3 non-empty lines of output for error reporting
@@ -1075,7 +3431,7 @@ func handleBuildOutput(rc io.Reader, debug bool, imageName string) error {
 	return nil
 }
 
-func imageExists(ctx context.Context, cli *client.Client, name string) bool {
+func imageExists(ctx context.Context, cli dockerClient, name string) bool {
 	_, err := cli.ImageInspect(ctx, name)
 	return err == nil
 }
@@ -1,12 +1,35 @@
 package agent
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"maps"
+	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	dockerspec "github.com/moby/docker-image-spec/specs-go/v1"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/image"
+	"github.com/moby/moby/api/types/jsonstream"
+	"github.com/moby/moby/client"
+	"github.com/pelletier/go-toml/v2"
 )
 
 // updateGolden returns true if golden files should be updated
@@ -42,7 +65,7 @@ func goldenTest(t *testing.T, goldenFile string, got string) {
 // loadTestConfig loads the default config for tests
 func loadTestConfig(t *testing.T) *ImageConfig {
 	t.Helper()
-	imgCfg, err := LoadMergedConfig(defaultConfigYAML, "")
+	imgCfg, err := LoadMergedConfig(defaultConfigYAML, LoadOptions{})
 	if err != nil {
 		t.Fatalf("failed to load config: %v", err)
 	}
@@ -100,6 +123,25 @@ func TestDockerfile_Basic(t *testing.T) {
 	}
 }
 
+// TestDockerfile_Aider covers a python based agent, whose dependencies come
+// from config.yaml rather than the node default in buildDefaultCollection
+func TestDockerfile_Aider(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "aider")
+	toolDeps := imgCfg.ResolveToolDeps("aider", map[string]bool{}, false)
+	collection := collectResult{specs: ensureDefaultTool(dedupeToolSpecs(toolDeps), spec)}
+	for _, dep := range toolDeps {
+		collection.idiomaticInfos = append(collection.idiomaticInfos, idiomaticInfo{tool: dep.name, version: dep.version, configKey: dep.name})
+	}
+	collection.idiomaticInfos = ensureToolInfo(collection.idiomaticInfos, spec)
+
+	got := buildDockerfile(false, false, collection, spec, imgCfg, "aider", nil)
+	if err := validateDockerfile(got); err != nil {
+		t.Errorf("expected valid Dockerfile, got: %v", err)
+	}
+	goldenTest(t, "dockerfile_aider_basic.golden", got)
+}
+
 func TestDockerfile_Claude_WithToolVersions(t *testing.T) {
 	imgCfg := loadTestConfig(t)
 	spec := getToolSpec(t, imgCfg, "claude")
@@ -487,6 +529,48 @@ python = "3.12.0"
 	}
 }
 
+func TestParseMiseToml_TableFormat(t *testing.T) {
+	// Test parsing the table form, with and without a version key
+	data := []byte(`[tools]
+node = { version = "20.10.0" }
+python = { version = "3.12.0", virtualenv = ".venv" }
+ruby = { os = ["linux"] }
+`)
+
+	spec := &fileSpec{data: data}
+	specs := parseMiseToml(spec)
+
+	want := []toolDescriptor{
+		{name: "node", version: "20.10.0", source: sourceUser},
+		{name: "python", version: "3.12.0", source: sourceUser},
+		{name: "ruby", version: "latest", source: sourceUser},
+	}
+	if diff := cmp.Diff(want, specs, cmp.AllowUnexported(toolDescriptor{})); diff != "" {
+		t.Errorf("unexpected tools (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseMiseToml_ArrayFormat(t *testing.T) {
+	// Test parsing the array form; the first version is the primary one
+	data := []byte(`[tools]
+python = ["3.12", "3.11"]
+node = [{ version = "22" }, "20"]
+go = []
+`)
+
+	spec := &fileSpec{data: data}
+	specs := parseMiseToml(spec)
+
+	want := []toolDescriptor{
+		{name: "go", version: "latest", source: sourceUser},
+		{name: "node", version: "22", source: sourceUser},
+		{name: "python", version: "3.12", source: sourceUser},
+	}
+	if diff := cmp.Diff(want, specs, cmp.AllowUnexported(toolDescriptor{})); diff != "" {
+		t.Errorf("unexpected tools (-want +got):\n%s", diff)
+	}
+}
+
 func TestParseMiseToml_NilSpec(t *testing.T) {
 	specs := parseMiseToml(nil)
 	if specs != nil {
@@ -712,7 +796,7 @@ python = "3.11.0"
 func TestBuildAgentMiseConfig_GoldenFiles(t *testing.T) {
 	imgCfg := loadTestConfig(t)
 
-	agents := []string{"codex", "opencode", "copilot", "claude", "gemini"}
+	agents := []string{"codex", "opencode", "copilot", "claude", "gemini", "aider"}
 
 	for _, agentName := range agents {
 		t.Run(agentName, func(t *testing.T) {
@@ -848,6 +932,53 @@ require (
 	}
 }
 
+func TestParseGoModVersion_PreferToolchain(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		wantVersion string
+	}{
+		{
+			name:        "newer toolchain wins",
+			content:     "module example.com/myapp\n\ngo 1.24.4\n\ntoolchain go1.24.5\n",
+			wantVersion: "1.24.5",
+		},
+		{
+			name:        "toolchain newer than minor-only go directive",
+			content:     "module example.com/myapp\n\ngo 1.22\n\ntoolchain go1.22.3\n",
+			wantVersion: "1.22.3",
+		},
+		{
+			name:        "older toolchain is ignored",
+			content:     "module example.com/myapp\n\ngo 1.24.4\n\ntoolchain go1.23.0\n",
+			wantVersion: "1.24.4",
+		},
+		{
+			name:        "no toolchain directive",
+			content:     "module example.com/myapp\n\ngo 1.21.0\n",
+			wantVersion: "1.21.0",
+		},
+	}
+
+	t.Setenv("AGENT_EN_PLACE_GO_TOOLCHAIN", "1")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			goModPath := filepath.Join(t.TempDir(), "go.mod")
+			if err := os.WriteFile(goModPath, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("failed to write test file: %v", err)
+			}
+
+			gotVersion, gotOk := parseGoModVersion(goModPath)
+			if !gotOk {
+				t.Fatal("parseGoModVersion() ok = false, want true")
+			}
+			if gotVersion != tt.wantVersion {
+				t.Errorf("parseGoModVersion() version = %q, want %q", gotVersion, tt.wantVersion)
+			}
+		})
+	}
+}
+
 func TestParseGoModVersion_FileNotFound(t *testing.T) {
 	version, ok := parseGoModVersion("/nonexistent/path/go.mod")
 	if ok {
@@ -919,7 +1050,7 @@ go 1.21.0
 	}
 
 	// Parse idiomatic files - should get .go-version (1.20.0), not go.mod (1.21.0)
-	infos := parseIdiomaticFiles()
+	infos := parseIdiomaticFiles(collectOptions{})
 
 	var goVersion string
 	for _, info := range infos {
@@ -934,6 +1065,75 @@ go 1.21.0
 	}
 }
 
+func TestIdiomaticFiles_Symlinks(t *testing.T) {
+	tmpDir := t.TempDir()
+	outside := filepath.Join(t.TempDir(), "python-version")
+	if err := os.WriteFile(outside, []byte("3.11\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+
+	// An external symlink, a broken one and a loop
+	for target, link := range map[string]string{
+		outside:         ".python-version",
+		"missing-file":  ".nvmrc",
+		".ruby-version": ".ruby-version",
+		"mise.toml":     "mise.toml",
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+	}
+
+	versions := func(infos []idiomaticInfo) map[string]string {
+		found := make(map[string]string)
+		for _, info := range infos {
+			found[info.tool] = info.version
+		}
+		return found
+	}
+
+	logs := captureLog(t, "text")
+	want := map[string]string{"python": "3.11"}
+	if diff := cmp.Diff(want, versions(parseIdiomaticFiles(collectOptions{}))); diff != "" {
+		t.Errorf("expected the external symlink to be followed and the others treated as missing (-want +got):\n%s", diff)
+	}
+	if err := checkIdiomaticFiles(collectOptions{}); err != nil {
+		t.Errorf("expected broken symlinks to be skipped by --strict-idiomatic, got %v", err)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("expected unresolvable symlinks to be skipped quietly without --debug, got %q", logs.String())
+	}
+
+	logs = captureLog(t, "text")
+	parseIdiomaticFiles(collectOptions{debug: true})
+	if !strings.Contains(logs.String(), "skipping .nvmrc: symlink can't be resolved") {
+		t.Errorf("expected a debug message for the broken symlink, got %q", logs.String())
+	}
+
+	logs = captureLog(t, "text")
+	if found := versions(parseIdiomaticFiles(collectOptions{noFollowSymlinks: true})); len(found) != 0 {
+		t.Errorf("expected symlinks to be skipped with noFollowSymlinks, got %v", found)
+	}
+	if !strings.Contains(logs.String(), "skipping .python-version: it is a symlink") {
+		t.Errorf("expected a warning for the skipped symlink, got %q", logs.String())
+	}
+
+	logs = captureLog(t, "text")
+	file, err := optionalFileSpec("mise.toml")
+	if err != nil || file != nil {
+		t.Errorf("expected a symlink loop to be treated as missing, got %v, %v", file, err)
+	}
+	if !strings.Contains(logs.String(), "skipping mise.toml") {
+		t.Errorf("expected a warning for the symlink loop, got %q", logs.String())
+	}
+	if file, err := optionalFileSpec(".nvmrc"); err != nil || file != nil {
+		t.Errorf("expected a broken symlink to be treated as missing, got %v, %v", file, err)
+	}
+}
+
 func TestIdiomaticFiles_GoModUsedAsFallback(t *testing.T) {
 	// Create temp dir with only go.mod (no .go-version)
 	tmpDir := t.TempDir()
@@ -958,7 +1158,7 @@ go 1.22.0
 	}
 
 	// Parse idiomatic files - should get go.mod version since no .go-version
-	infos := parseIdiomaticFiles()
+	infos := parseIdiomaticFiles(collectOptions{})
 
 	var goVersion string
 	for _, info := range infos {
@@ -1000,7 +1200,7 @@ go 1.23.0
 	spec := getToolSpec(t, imgCfg, "claude")
 
 	// Parse idiomatic files to get go version from go.mod
-	idiomaticInfos := parseIdiomaticFiles()
+	idiomaticInfos := parseIdiomaticFiles(collectOptions{})
 
 	collection := collectResult{
 		idiomaticInfos: idiomaticInfos,
@@ -1047,7 +1247,7 @@ go 1.23.0
 	spec := getToolSpec(t, imgCfg, "claude")
 
 	// Parse idiomatic files to get go version from go.mod
-	idiomaticInfos := parseIdiomaticFiles()
+	idiomaticInfos := parseIdiomaticFiles(collectOptions{})
 
 	collection := collectResult{
 		idiomaticInfos: idiomaticInfos,
@@ -1154,6 +1354,217 @@ func TestApplyImageCustomizations_NoCustomizations(t *testing.T) {
 	}
 }
 
+// TestApplyImageCustomizations_Reset tests that a user config can reset inherited customizations
+func TestApplyImageCustomizations_Reset(t *testing.T) {
+	base := &ImageConfig{
+		Image: ImageSettings{
+			Packages: []string{"curl", "git", "gnupg"},
+		},
+		ImageCustomizations: ImageCustomizations{
+			Packages: []ImageCustomization{
+				{Op: "add", Value: "vim"},
+				{Op: "remove", Value: "gnupg"},
+			},
+		},
+	}
+	user := &ImageConfig{
+		ImageCustomizations: ImageCustomizations{
+			Packages: []ImageCustomization{
+				{Op: "reset"},
+				{Op: "add", Value: "htop"},
+			},
+		},
+	}
+
+	result := applyImageCustomizations(mergeConfigs(base, user))
+
+	expected := []string{"curl", "git", "gnupg", "htop"}
+	if !slicesEqual(result.Image.Packages, expected) {
+		t.Errorf("expected packages %v, got %v", expected, result.Image.Packages)
+	}
+}
+
+// TestApplyImageCustomizations_MiseInstall tests adding and removing mise install commands
+func TestApplyImageCustomizations_MiseInstall(t *testing.T) {
+	cfg := &ImageConfig{
+		Mise: MiseSettings{
+			Install: []string{"apt-get update", "apt-get install -y mise", "apt-get update"},
+		},
+		ImageCustomizations: ImageCustomizations{
+			MiseInstall: []ImageCustomization{
+				{Op: "remove", Value: "apt-get update"},
+				{Op: "add", Value: "mise --version"},
+			},
+		},
+	}
+
+	result := applyImageCustomizations(cfg)
+
+	expected := []string{"apt-get install -y mise", "mise --version"}
+	if !slicesEqual(result.Mise.Install, expected) {
+		t.Errorf("expected install commands %v, got %v", expected, result.Mise.Install)
+	}
+}
+
+// TestApplyImageCustomizations_MiseEnv tests adding and removing mise env keys
+func TestApplyImageCustomizations_MiseEnv(t *testing.T) {
+	base := map[string]any{"ruby_compile": false, "python_compile": false}
+	cfg := &ImageConfig{
+		Mise: MiseSettings{Env: base},
+		ImageCustomizations: ImageCustomizations{
+			MiseEnv: []ImageCustomization{
+				{Op: "add", Value: "node_mirror_url=https://mirror.example.com/node"},
+				{Op: "remove", Value: "python_compile"},
+			},
+		},
+	}
+
+	result := applyImageCustomizations(cfg)
+
+	expected := map[string]any{"ruby_compile": false, "node_mirror_url": "https://mirror.example.com/node"}
+	if diff := cmp.Diff(expected, result.Mise.Env); diff != "" {
+		t.Errorf("unexpected mise env (-want +got):\n%s", diff)
+	}
+	if _, ok := base["node_mirror_url"]; ok {
+		t.Error("expected the original mise.env map to be left alone")
+	}
+}
+
+// TestApplyImageCustomizations_MiseStrict tests that strict applies to mise customizations too
+func TestApplyImageCustomizations_MiseStrict(t *testing.T) {
+	logs := captureLog(t, "text")
+	customizations := ImageCustomizations{
+		MiseInstall: []ImageCustomization{{Op: "remove", Value: "apt-get upgrade"}},
+		MiseEnv:     []ImageCustomization{{Op: "remove", Value: "go_compile"}},
+	}
+
+	result := applyImageCustomizations(&ImageConfig{ImageCustomizations: customizations})
+	if len(result.customizationErrors) != 0 {
+		t.Errorf("expected warnings only without strict, got %v", result.customizationErrors)
+	}
+	if !strings.Contains(logs.String(), `mise env "go_compile" not found for removal`) {
+		t.Errorf("expected a warning, got %q", logs.String())
+	}
+
+	enabled := true
+	customizations.Strict = &enabled
+	result = applyImageCustomizations(&ImageConfig{ImageCustomizations: customizations})
+	var got []string
+	for _, err := range result.customizationErrors {
+		got = append(got, err.Error())
+	}
+	expected := []string{
+		`image_customizations.miseInstall[0]: mise install command "apt-get upgrade" not found for removal`,
+		`image_customizations.miseEnv[0]: mise env "go_compile" not found for removal`,
+	}
+	if !slicesEqual(got, expected) {
+		t.Errorf("expected errors %v, got %v", expected, got)
+	}
+}
+
+// TestApplyImageCustomizations_OrderIndependent tests that add is idempotent,
+// remove drops every occurrence and replace swaps a package in place
+func TestApplyImageCustomizations_OrderIndependent(t *testing.T) {
+	tests := []struct {
+		name           string
+		packages       []string
+		customizations []ImageCustomization
+		want           []string
+		wantApplied    []string
+	}{
+		{
+			name:           "add already present",
+			packages:       []string{"curl", "git"},
+			customizations: []ImageCustomization{{Op: "add", Value: "curl"}},
+			want:           []string{"curl", "git"},
+			wantApplied:    []string{"add curl (already present)"},
+		},
+		{
+			name:           "remove duplicates",
+			packages:       []string{"curl", "git", "curl"},
+			customizations: []ImageCustomization{{Op: "remove", Value: "curl"}},
+			want:           []string{"git"},
+			wantApplied:    []string{"remove curl"},
+		},
+		{
+			name:           "replace in place",
+			packages:       []string{"curl", "vim", "git"},
+			customizations: []ImageCustomization{{Op: "replace", From: "vim", Value: "neovim"}},
+			want:           []string{"curl", "neovim", "git"},
+			wantApplied:    []string{"replace vim with neovim"},
+		},
+		{
+			name:           "replace with a package already present",
+			packages:       []string{"curl", "vim", "neovim"},
+			customizations: []ImageCustomization{{Op: "replace", From: "vim", Value: "neovim"}},
+			want:           []string{"curl", "neovim"},
+			wantApplied:    []string{"replace vim with neovim"},
+		},
+		{
+			name:           "replace missing package",
+			packages:       []string{"curl"},
+			customizations: []ImageCustomization{{Op: "replace", From: "vim", Value: "neovim"}},
+			want:           []string{"curl"},
+			wantApplied:    []string{"replace vim with neovim (not found)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t, "text")
+			cfg := &ImageConfig{
+				Image:               ImageSettings{Packages: tt.packages},
+				ImageCustomizations: ImageCustomizations{Packages: tt.customizations},
+			}
+			result := applyImageCustomizations(cfg)
+			if !slicesEqual(result.Image.Packages, tt.want) {
+				t.Errorf("expected packages %v, got %v", tt.want, result.Image.Packages)
+			}
+			if !slicesEqual(result.appliedCustomizations, tt.wantApplied) {
+				t.Errorf("expected applied %v, got %v", tt.wantApplied, result.appliedCustomizations)
+			}
+			if len(result.customizationErrors) != 0 {
+				t.Errorf("expected no errors without strict, got %v", result.customizationErrors)
+			}
+		})
+	}
+}
+
+// TestLoadMergedConfig_StrictCustomizations tests that strict turns a missing
+// remove or replace target into an error
+func TestLoadMergedConfig_StrictCustomizations(t *testing.T) {
+	config := "image_customizations:\n  packages:\n    - op: remove\n      value: nano\n    - op: replace\n      from: emacs\n      value: neovim\n"
+
+	load := func(t *testing.T, data string) (*ImageConfig, error) {
+		t.Helper()
+		configPath := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(configPath, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return LoadMergedConfig(defaultConfigYAML, LoadOptions{ConfigPath: configPath, NoUserConfig: true})
+	}
+
+	t.Run("warns by default", func(t *testing.T) {
+		logs := captureLog(t, "text")
+		if _, err := load(t, config); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !strings.Contains(logs.String(), `package "emacs" not found for replacement`) {
+			t.Errorf("expected a warning, got %q", logs.String())
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		_, err := load(t, "image_customizations:\n  strict: true\n"+strings.TrimPrefix(config, "image_customizations:\n"))
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if !strings.Contains(err.Error(), `image_customizations.packages[0]: package "nano" not found for removal`) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
 // TestMergeConfigs_AccumulatesCustomizations tests that customizations are accumulated across config files
 func TestMergeConfigs_AccumulatesCustomizations(t *testing.T) {
 	base := &ImageConfig{
@@ -1254,6 +1665,129 @@ func TestResolveToolDeps_IncludesTransitiveDepsForUserTools(t *testing.T) {
 	}
 }
 
+// TestResolveToolDeps_When verifies that conditional tools are only included
+// when their trigger file exists in the working directory
+func TestCheckBaseCompatibility(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	imgCfg.Tools["glibc-tool"] = ToolConfigEntry{IncompatibleBases: []string{"alpine*"}}
+
+	imgCfg.Image.Base = "alpine:3.19"
+	err := imgCfg.CheckBaseCompatibility([]string{"node", "glibc-tool"})
+	if err == nil {
+		t.Fatal("expected error for a tool incompatible with an alpine base")
+	}
+	for _, want := range []string{`"glibc-tool"`, `"alpine:3.19"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %s, got %v", want, err)
+		}
+	}
+
+	imgCfg.Image.Base = "debian:12-slim"
+	if err := imgCfg.CheckBaseCompatibility([]string{"node", "glibc-tool"}); err != nil {
+		t.Errorf("expected debian base to be compatible, got %v", err)
+	}
+
+	// Backend tools are checked by their config key, not the sanitized name
+	imgCfg.Tools["npm:@org/glibc-cli"] = ToolConfigEntry{IncompatibleBases: []string{"alpine*"}}
+	imgCfg.Image.Base = "alpine:3.19"
+	specs := dedupeToolSpecs([]toolDescriptor{{name: "node"}, {name: "npm:@org/glibc-cli"}})
+	if err := imgCfg.CheckBaseCompatibility(toolNames(specs)); err == nil || !strings.Contains(err.Error(), `"npm:@org/glibc-cli"`) {
+		t.Errorf("expected the scoped npm tool to be incompatible, got %v", err)
+	}
+}
+
+func TestLoadMergedConfig_InvalidIncompatibleBases(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("tools:\n  node:\n    incompatibleBases:\n      - \"alpine[\"\n"), 0644)
+
+	_, err := LoadMergedConfig(defaultConfigYAML, LoadOptions{ConfigPath: path})
+	if err == nil || !strings.Contains(err.Error(), "tools.node.incompatibleBases") {
+		t.Errorf("expected invalid pattern error, got %v", err)
+	}
+}
+
+func TestResolveToolDeps_When(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+
+	imgCfg := loadTestConfig(t)
+	imgCfg.Agents["claude"] = AgentConfig{PackageName: "npm:@anthropic-ai/claude-code", Depends: []string{"node", "python"}}
+	imgCfg.Tools["node"] = ToolConfigEntry{Version: "20", When: []string{"package.json"}, AdditionalPackages: []string{"libatomic1"}}
+	imgCfg.Tools["python"] = ToolConfigEntry{Version: "3.12", When: []string{"requirements.txt", "pyproject.toml"}}
+
+	toolNames := func() map[string]bool {
+		names := make(map[string]bool)
+		for _, d := range imgCfg.ResolveToolDeps("claude", map[string]bool{}, false) {
+			names[d.name] = true
+		}
+		return names
+	}
+
+	if names := toolNames(); names["node"] || names["python"] {
+		t.Errorf("expected no conditional tools without trigger files, got %v", names)
+	}
+	if pkgs := imgCfg.ResolveAdditionalPackages("claude", map[string]bool{}); len(pkgs) != 0 {
+		t.Errorf("expected no additional packages for skipped tools, got %v", pkgs)
+	}
+
+	if err := os.WriteFile("package.json", []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if names := toolNames(); !names["node"] || names["python"] {
+		t.Errorf("expected only node with package.json present, got %v", names)
+	}
+	if pkgs := imgCfg.ResolveAdditionalPackages("claude", map[string]bool{}); !slices.Contains(pkgs, "libatomic1") {
+		t.Errorf("expected node's additional packages, got %v", pkgs)
+	}
+
+	if err := os.WriteFile("pyproject.toml", []byte(""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if names := toolNames(); !names["node"] || !names["python"] {
+		t.Errorf("expected node and python with both trigger files present, got %v", names)
+	}
+
+	// The agent's own package is never conditional
+	spec := getToolSpec(t, imgCfg, "claude")
+	os.Remove("package.json")
+	collection := collectToolSpecs(nil, nil, spec, imgCfg, "claude", collectOptions{})
+	if !slices.ContainsFunc(collection.specs, func(d toolDescriptor) bool { return d.labelName == "claude-code" }) {
+		t.Errorf("expected agent package to be installed regardless of conditions, got %+v", collection.specs)
+	}
+}
+
+func TestResolveToolDeps_WhenIgnoredForUserTools(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+
+	imgCfg := loadTestConfig(t)
+	imgCfg.Agents["claude"] = AgentConfig{PackageName: "npm:@anthropic-ai/claude-code", Depends: []string{"python"}}
+	imgCfg.Tools["python"] = ToolConfigEntry{Version: "3.12", When: []string{"requirements.txt"}, AdditionalPackages: []string{"libpython3-dev"}}
+	if err := os.WriteFile(".python-version", []byte("3.11\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	spec := getToolSpec(t, imgCfg, "claude")
+	collection := collectToolSpecs(nil, nil, spec, imgCfg, "claude", collectOptions{})
+	if !collection.userTools["python"] {
+		t.Fatalf("expected python from .python-version to be a user tool, got %v", collection.userTools)
+	}
+	if pkgs := imgCfg.ResolveAdditionalPackages("claude", collection.userTools); !slices.Contains(pkgs, "libpython3-dev") {
+		t.Errorf("expected the additional packages of a user tool whose when doesn't match, got %v", pkgs)
+	}
+	if !slices.ContainsFunc(imgCfg.ResolveToolDeps("claude", collection.userTools, false), func(d toolDescriptor) bool { return d.name == "python" }) {
+		t.Error("expected a user tool to be resolved even though its when doesn't match")
+	}
+	if pkgs := imgCfg.ResolveAdditionalPackages("claude", map[string]bool{}); slices.Contains(pkgs, "libpython3-dev") {
+		t.Errorf("expected when to still skip the packages of an implied tool, got %v", pkgs)
+	}
+}
+
 // TestResolveToolDeps_SourceIsConfig verifies that tools from ResolveToolDeps have sourceConfig
 func TestResolveToolDeps_SourceIsConfig(t *testing.T) {
 	imgCfg := loadTestConfig(t)
@@ -1312,6 +1846,57 @@ func TestResolveAdditionalPackages_IncludesTransitivePackages(t *testing.T) {
 	}
 }
 
+// TestResolveToolDeps_ReportsCycle verifies that a depends chain leading back
+// to a tool on its own path is reported once, while tools are still resolved
+// breadth first
+func TestResolveToolDeps_ReportsCycle(t *testing.T) {
+	logs := captureLog(t, "text")
+	imgCfg := &ImageConfig{
+		Tools: map[string]ToolConfigEntry{
+			"a": {Depends: "b", AdditionalPackages: []string{"liba"}},
+			"b": {Depends: "a", AdditionalPackages: []string{"libb"}},
+		},
+		Agents: map[string]AgentConfig{"agent": {Depends: []string{"a"}}},
+	}
+	userTools := map[string]bool{"a": true, "b": true}
+
+	var names []string
+	for _, dep := range imgCfg.ResolveToolDeps("agent", userTools, false) {
+		names = append(names, dep.name)
+	}
+	if diff := cmp.Diff([]string{"a", "b"}, names); diff != "" {
+		t.Errorf("unexpected tools (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"liba", "libb"}, imgCfg.ResolveAdditionalPackages("agent", userTools)); diff != "" {
+		t.Errorf("unexpected packages (-want +got):\n%s", diff)
+	}
+
+	if got := strings.Count(logs.String(), "dependency cycle a -> b -> a"); got != 1 {
+		t.Errorf("expected the cycle to be reported once, got %d times:\n%s", got, logs.String())
+	}
+}
+
+// TestResolveToolDeps_SharedDependencyIsNotACycle verifies that a tool reached
+// from two places isn't mistaken for a cycle
+func TestResolveToolDeps_SharedDependencyIsNotACycle(t *testing.T) {
+	logs := captureLog(t, "text")
+	imgCfg := &ImageConfig{
+		Tools: map[string]ToolConfigEntry{
+			"node":   {Depends: "python"},
+			"python": {},
+		},
+		Agents: map[string]AgentConfig{"agent": {Depends: []string{"node", "python"}}},
+	}
+
+	deps := imgCfg.ResolveToolDeps("agent", map[string]bool{"node": true}, false)
+	if len(deps) != 2 {
+		t.Errorf("expected node and python, got %v", deps)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("expected no warnings, got:\n%s", logs.String())
+	}
+}
+
 // TestDedupeToolSpecs_PreservesSource verifies that deduplication preserves the source
 // from the first occurrence (which has higher priority)
 func TestDedupeToolSpecs_PreservesSource(t *testing.T) {
@@ -1377,11 +1962,51 @@ func TestParseToolVersions_SetsSourceUser(t *testing.T) {
 	}
 }
 
-// TestParseMiseToml_SetsSourceUser verifies that parseMiseToml sets sourceUser
-func TestParseMiseToml_SetsSourceUser(t *testing.T) {
+func TestParseToolVersions_MultipleVersions(t *testing.T) {
 	spec := &fileSpec{
-		path: "mise.toml",
-		data: []byte(`[tools]
+		path: ".tool-versions",
+		data: []byte("nodejs 20.10.0 18.19.0\npython 3.12.0\n"),
+	}
+
+	specs := parseToolVersions(spec)
+	if len(specs) != 2 {
+		t.Fatalf("expected 2 tools, got %d", len(specs))
+	}
+	if specs[0].version != "20.10.0" {
+		t.Errorf("expected primary version 20.10.0, got %q", specs[0].version)
+	}
+	if diff := cmp.Diff([]string{"18.19.0"}, specs[0].fallbacks); diff != "" {
+		t.Errorf("fallbacks mismatch (-want +got):\n%s", diff)
+	}
+	if specs[1].fallbacks != nil {
+		t.Errorf("expected no fallbacks for python, got %v", specs[1].fallbacks)
+	}
+
+	collection := collectResult{specs: dedupeToolSpecs(specs)}
+	data, err := buildAgentMiseConfig(nil, collection, ToolSpec{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "[tools]\nnodejs = [\"20.10.0\", \"18.19.0\"]\n"
+	if string(data) != want {
+		t.Errorf("expected mise config %q, got %q", want, string(data))
+	}
+
+	// A tool the user's mise.toml defines is left to it
+	data, err = buildAgentMiseConfig([]byte("[tools]\nnodejs = \"22\"\n"), collection, ToolSpec{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(string(data), "nodejs") {
+		t.Errorf("expected nodejs to be left to mise.toml, got %q", string(data))
+	}
+}
+
+// TestParseMiseToml_SetsSourceUser verifies that parseMiseToml sets sourceUser
+func TestParseMiseToml_SetsSourceUser(t *testing.T) {
+	spec := &fileSpec{
+		path: "mise.toml",
+		data: []byte(`[tools]
 node = "20.0.0"
 python = "3.11.0"
 `),
@@ -1551,7 +2176,7 @@ func TestCollectToolSpecs_EnvOverridesUserTools(t *testing.T) {
 		data: []byte("[tools]\nnode = \"18\"\n"),
 	}
 
-	collection := collectToolSpecs(nil, miseFile, spec, imgCfg, "claude", false)
+	collection := collectToolSpecs(nil, miseFile, spec, imgCfg, "claude", collectOptions{})
 
 	// Find node in the deduped specs — should have version "20" from env var
 	var nodeSpec *toolDescriptor
@@ -1589,7 +2214,7 @@ func TestCollectToolSpecs_EnvMergesWithFileTools(t *testing.T) {
 		data: []byte("[tools]\nnode = \"18\"\n"),
 	}
 
-	collection := collectToolSpecs(nil, miseFile, spec, imgCfg, "claude", false)
+	collection := collectToolSpecs(nil, miseFile, spec, imgCfg, "claude", collectOptions{})
 
 	// Both ruby (from env) and node (from mise.toml) should be present
 	toolNames := make(map[string]string)
@@ -1627,7 +2252,7 @@ func TestCollectToolSpecs_SpecifiedToolsOnly(t *testing.T) {
 		data: []byte("go 1.21\n"),
 	}
 
-	collection := collectToolSpecs(toolFile, miseFile, spec, imgCfg, "claude", false)
+	collection := collectToolSpecs(toolFile, miseFile, spec, imgCfg, "claude", collectOptions{})
 
 	toolNames := make(map[string]bool)
 	for _, s := range collection.specs {
@@ -1684,7 +2309,7 @@ func TestCollectToolSpecs_SpecifiedToolsOnlyWithoutToolsEnv(t *testing.T) {
 		data: []byte("[tools]\nnode = \"18\"\n"),
 	}
 
-	collection := collectToolSpecs(nil, miseFile, spec, imgCfg, "claude", false)
+	collection := collectToolSpecs(nil, miseFile, spec, imgCfg, "claude", collectOptions{})
 
 	// node should be present because specifiedOnly was ignored
 	toolNames := make(map[string]bool)
@@ -1697,6 +2322,57 @@ func TestCollectToolSpecs_SpecifiedToolsOnlyWithoutToolsEnv(t *testing.T) {
 	}
 }
 
+func TestCollectToolSpecs_SpecifiedOnlyFromConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte("tools:\n  specifiedOnly: true\n  python:\n    version: \"3.12\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	imgCfg, err := LoadMergedConfig(defaultConfigYAML, LoadOptions{ConfigPath: configPath, NoUserConfig: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !imgCfg.ToolsSpecifiedOnly() {
+		t.Fatal("expected tools.specifiedOnly to be read from the config")
+	}
+	if _, ok := imgCfg.Tools["specifiedOnly"]; ok {
+		t.Error("expected specifiedOnly not to be treated as a tool")
+	}
+	if imgCfg.Tools["python"].Version != "3.12" {
+		t.Errorf("expected the other tool entries to be kept, got %+v", imgCfg.Tools["python"])
+	}
+	spec := getToolSpec(t, imgCfg, "claude")
+	miseFile := &fileSpec{
+		path: "mise.toml",
+		data: []byte("[tools]\nnode = \"18\"\n"),
+	}
+
+	hasNode := func() bool {
+		for _, s := range collectToolSpecs(nil, miseFile, spec, imgCfg, "claude", collectOptions{}).specs {
+			if s.name == "node" {
+				return true
+			}
+		}
+		return false
+	}
+
+	// The config applies without AGENT_EN_PLACE_TOOLS
+	t.Setenv("AGENT_EN_PLACE_TOOLS", "")
+	t.Setenv("AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY", "")
+	if hasNode() {
+		t.Error("expected node from mise.toml to be skipped with tools.specifiedOnly set")
+	}
+
+	t.Setenv("AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY", "0")
+	if !hasNode() {
+		t.Error("expected AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY=0 to override tools.specifiedOnly")
+	}
+}
+
 func TestCollectToolSpecs_EnvToolsTriggersTransitiveDeps(t *testing.T) {
 	tmpDir := t.TempDir()
 	oldWd, _ := os.Getwd()
@@ -1710,7 +2386,7 @@ func TestCollectToolSpecs_EnvToolsTriggersTransitiveDeps(t *testing.T) {
 	imgCfg := loadTestConfig(t)
 	spec := getToolSpec(t, imgCfg, "claude")
 
-	collection := collectToolSpecs(nil, nil, spec, imgCfg, "claude", false)
+	collection := collectToolSpecs(nil, nil, spec, imgCfg, "claude", collectOptions{})
 
 	toolNames := make(map[string]bool)
 	for _, s := range collection.specs {
@@ -1737,7 +2413,7 @@ func TestCollectToolSpecs_EnvToolsAreInUserToolsSet(t *testing.T) {
 	imgCfg := loadTestConfig(t)
 	spec := getToolSpec(t, imgCfg, "claude")
 
-	collection := collectToolSpecs(nil, nil, spec, imgCfg, "claude", false)
+	collection := collectToolSpecs(nil, nil, spec, imgCfg, "claude", collectOptions{})
 
 	// node should be in userTools (for transitive dep resolution and additional packages)
 	if !collection.userTools["node"] {
@@ -1757,7 +2433,7 @@ func TestCollectToolSpecs_EnvToolInMiseAgentConfig(t *testing.T) {
 	imgCfg := loadTestConfig(t)
 	spec := getToolSpec(t, imgCfg, "claude")
 
-	collection := collectToolSpecs(nil, nil, spec, imgCfg, "claude", false)
+	collection := collectToolSpecs(nil, nil, spec, imgCfg, "claude", collectOptions{})
 
 	// Build mise.agent.toml — ruby should appear since there's no user mise.toml
 	data, err := buildAgentMiseConfig(nil, collection, spec)
@@ -1790,7 +2466,7 @@ func TestCollectToolSpecs_EnvToolOverridesInMiseAgentConfig(t *testing.T) {
 		data: userMise,
 	}
 
-	collection := collectToolSpecs(nil, miseFile, spec, imgCfg, "claude", false)
+	collection := collectToolSpecs(nil, miseFile, spec, imgCfg, "claude", collectOptions{})
 
 	// Env var tool (node@20) is in idiomaticInfos but the user's mise.toml
 	// also has node. Since user mise.toml has node, it should be filtered out
@@ -2041,6 +2717,81 @@ func TestMergeMiseEnvVars(t *testing.T) {
 	}
 }
 
+func TestDockerfile_MiseJobs(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+	collection := buildDefaultCollection("claude", spec)
+
+	if got := buildDockerfile(false, false, collection, spec, imgCfg, "claude", nil); strings.Contains(got, "MISE_JOBS") {
+		t.Errorf("expected no MISE_JOBS by default, got:\n%s", got)
+	}
+
+	imgCfg.Mise.Env["jobs"] = 2
+	imgCfg.Mise.Jobs = 8
+	got := buildDockerfile(false, false, collection, spec, imgCfg, "claude", nil)
+	if !strings.Contains(got, `ENV MISE_JOBS="8"`) {
+		t.Errorf("expected mise.jobs to set MISE_JOBS, got:\n%s", got)
+	}
+	if imgCfg.Mise.Env["jobs"] != 2 {
+		t.Errorf("expected mise.env to be left untouched, got %v", imgCfg.Mise.Env["jobs"])
+	}
+}
+
+func TestRun_MiseJobs(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	project := t.TempDir()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	runErr := Run(Config{Tool: "claude", DockerfileOnly: true, Project: project, MiseJobs: 4})
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	if runErr != nil {
+		t.Fatalf("unexpected error: %v", runErr)
+	}
+	if !strings.Contains(string(out), `ENV MISE_JOBS="4"`) {
+		t.Errorf("expected --mise-jobs to set MISE_JOBS, got:\n%s", out)
+	}
+
+	if err := Run(Config{Tool: "claude", DockerfileOnly: true, Project: project, MiseJobs: -1}); err == nil {
+		t.Error("expected error for negative --mise-jobs")
+	}
+}
+
+func TestRun_MiseJobsOverridesHostEnv(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("MISE_JOBS", "2")
+	project := t.TempDir()
+	buf := captureLog(t, "text")
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	runErr := Run(Config{Tool: "claude", DockerfileOnly: true, Project: project, MiseJobs: 4})
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	if runErr != nil {
+		t.Fatalf("unexpected error: %v", runErr)
+	}
+	if !strings.Contains(string(out), `ENV MISE_JOBS="4"`) || strings.Contains(string(out), `MISE_JOBS="2"`) {
+		t.Errorf("expected --mise-jobs to beat the host MISE_JOBS, got:\n%s", out)
+	}
+	if !strings.Contains(buf.String(), "--mise-jobs 4 overrides MISE_JOBS=2") {
+		t.Errorf("expected a warning about the host MISE_JOBS, got: %s", buf.String())
+	}
+}
+
 func TestMergeConfigs_MiseEnv(t *testing.T) {
 	base := &ImageConfig{
 		Tools:  make(map[string]ToolConfigEntry),
@@ -2078,3 +2829,5840 @@ func TestMergeConfigs_MiseEnv(t *testing.T) {
 		t.Errorf("expected experimental=true, got %v", result.Mise.Env["experimental"])
 	}
 }
+
+func TestParsePackageManager(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		wantTool    string
+		wantVersion string
+		wantOk      bool
+	}{
+		{"pnpm", `{"packageManager": "pnpm@8.15.0"}`, "pnpm", "8.15.0", true},
+		{"yarn with hash", `{"packageManager": "yarn@4.1.0+sha256.abc123"}`, "yarn", "4.1.0", true},
+		{"npm", `{"packageManager": "npm@10.2.0"}`, "npm:npm", "10.2.0", true},
+		{"unknown manager", `{"packageManager": "bower@1.0.0"}`, "", "", false},
+		{"no field", `{"name": "my-app"}`, "", "", false},
+		{"invalid json", `{`, "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "package.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("failed to write package.json: %v", err)
+			}
+
+			info, ok := parsePackageManager(path)
+			if ok != tt.wantOk {
+				t.Fatalf("parsePackageManager() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if info.tool != tt.wantTool {
+				t.Errorf("tool = %q, want %q", info.tool, tt.wantTool)
+			}
+			if info.version != tt.wantVersion {
+				t.Errorf("version = %q, want %q", info.version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestParsePackageJsonNode(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		wantVersion string
+		wantOk      bool
+	}{
+		{"minimum", `{"engines": {"node": ">=20"}}`, "20", true},
+		{"caret", `{"engines": {"node": "^18.0.0"}}`, "18.0.0", true},
+		{"tilde", `{"engines": {"node": "~20.11"}}`, "20.11", true},
+		{"space after operator", `{"engines": {"node": ">= 18.17.0"}}`, "18.17.0", true},
+		{"x wildcard", `{"engines": {"node": "20.x"}}`, "20", true},
+		{"alternatives", `{"engines": {"node": "^18 || ^20"}}`, "18", true},
+		{"any version", `{"engines": {"node": "*"}}`, "", false},
+		{"engines without node", `{"engines": {"npm": ">=10"}}`, "", false},
+		{"missing engines field", `{"name": "my-app"}`, "", false},
+		{"invalid json", `{`, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "package.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("failed to write package.json: %v", err)
+			}
+
+			version, ok := parsePackageJsonNode(path)
+			if ok != tt.wantOk {
+				t.Fatalf("parsePackageJsonNode() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if version != tt.wantVersion {
+				t.Errorf("version = %q, want %q", version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestIdiomaticFiles_PackageJsonEnginesFallback(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+
+	if err := os.WriteFile("package.json", []byte(`{"engines": {"node": ">=20"}, "packageManager": "pnpm@9.0.0"}`), 0644); err != nil {
+		t.Fatalf("failed to write package.json: %v", err)
+	}
+
+	nodeInfo := func() idiomaticInfo {
+		for _, info := range parseIdiomaticFiles(collectOptions{}) {
+			if info.tool == "node" {
+				return info
+			}
+		}
+		return idiomaticInfo{}
+	}
+
+	// Without .nvmrc or .node-version the engines field is used
+	if info := nodeInfo(); info.version != "20" || info.path != "package.json" {
+		t.Errorf("expected node 20 from package.json, got %q from %q", info.version, info.path)
+	}
+
+	// .nvmrc takes precedence
+	if err := os.WriteFile(".nvmrc", []byte("22.1.0\n"), 0644); err != nil {
+		t.Fatalf("failed to write .nvmrc: %v", err)
+	}
+	if info := nodeInfo(); info.version != "22.1.0" || info.path != ".nvmrc" {
+		t.Errorf("expected node 22.1.0 from .nvmrc, got %q from %q", info.version, info.path)
+	}
+}
+
+func TestCollectToolSpecs_PackageManagerAddsNode(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+
+	t.Setenv("AGENT_EN_PLACE_TOOLS", "")
+	t.Setenv("AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY", "")
+
+	if err := os.WriteFile("package.json", []byte(`{"packageManager": "pnpm@8.15.0"}`), 0644); err != nil {
+		t.Fatalf("failed to write package.json: %v", err)
+	}
+
+	// Use an agent without a node dependency so node can only come from packageManager
+	imgCfg := loadTestConfig(t)
+	imgCfg.Agents["standalone"] = AgentConfig{PackageName: "standalone-agent", Command: "standalone"}
+	spec := getToolSpec(t, imgCfg, "standalone")
+
+	collection := collectToolSpecs(nil, nil, spec, imgCfg, "standalone", collectOptions{})
+
+	versions := make(map[string]string)
+	for _, s := range collection.specs {
+		versions[s.name] = s.version
+	}
+	if versions["pnpm"] != "8.15.0" {
+		t.Errorf("expected pnpm@8.15.0, got %q", versions["pnpm"])
+	}
+	if _, ok := versions["node"]; !ok {
+		t.Errorf("expected node to be added alongside pnpm, got specs %v", versions)
+	}
+
+	data, err := buildAgentMiseConfig(nil, collection, spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	result := string(data)
+	if !strings.Contains(result, `pnpm = "8.15.0"`) {
+		t.Errorf("expected pnpm in mise.agent.toml, got:\n%s", result)
+	}
+	if !strings.Contains(result, `node = "latest"`) {
+		t.Errorf("expected node in mise.agent.toml, got:\n%s", result)
+	}
+}
+
+func TestCollectToolSpecs_PackageManagerKeepsNodeVersion(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+
+	t.Setenv("AGENT_EN_PLACE_TOOLS", "")
+	t.Setenv("AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY", "")
+
+	if err := os.WriteFile("package.json", []byte(`{"packageManager": "pnpm@9.0.0"}`), 0644); err != nil {
+		t.Fatalf("failed to write package.json: %v", err)
+	}
+	if err := os.WriteFile(".nvmrc", []byte("20.11.0\n"), 0644); err != nil {
+		t.Fatalf("failed to write .nvmrc: %v", err)
+	}
+
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+
+	collection := collectToolSpecs(nil, nil, spec, imgCfg, "claude", collectOptions{})
+
+	versions := make(map[string]string)
+	for _, s := range collection.specs {
+		versions[s.name] = s.version
+	}
+	if versions["node"] != "20.11.0" {
+		t.Errorf("expected node@20.11.0 from .nvmrc, got %q", versions["node"])
+	}
+	if versions["pnpm"] != "9.0.0" {
+		t.Errorf("expected pnpm@9.0.0 from packageManager, got %q", versions["pnpm"])
+	}
+}
+
+func TestValidateDockerfile_GeneratedIsValid(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+
+	for _, name := range imgCfg.AgentNames() {
+		t.Run(name, func(t *testing.T) {
+			spec := getToolSpec(t, imgCfg, name)
+			collection := buildDefaultCollection(name, spec)
+			dockerfile := buildDockerfile(true, true, collection, spec, imgCfg, name, nil)
+
+			if err := validateDockerfile(dockerfile); err != nil {
+				t.Errorf("expected generated Dockerfile to be valid, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateDockerfile_EmptyPackageList(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	imgCfg.Image.Packages = nil
+	// Remove node's additional packages so nothing is left to install
+	imgCfg.Tools["node"] = ToolConfigEntry{Version: "latest"}
+	spec := getToolSpec(t, imgCfg, "claude")
+	collection := buildDefaultCollection("claude", spec)
+
+	dockerfile := buildDockerfile(false, false, collection, spec, imgCfg, "claude", nil)
+
+	err := validateDockerfile(dockerfile)
+	if err == nil {
+		t.Fatal("expected error for empty package list")
+	}
+	if !strings.Contains(err.Error(), "package install has no packages") {
+		t.Errorf("expected descriptive error, got: %v", err)
+	}
+}
+
+func TestValidateDockerfile_BrokenLines(t *testing.T) {
+	tests := []struct {
+		name       string
+		dockerfile string
+		wantErr    string
+	}{
+		{"missing from", "RUN echo hi\n", "missing FROM"},
+		{"empty copy source", "FROM debian\nCOPY /home/agent/x\n", "COPY requires a source and destination"},
+		{"copy with only flags and a destination", "FROM debian\nCOPY --chown=agent:agent /home/agent/x\n", "COPY requires a source and destination"},
+		{"quoted empty copy source", "FROM debian\nCOPY \"\" /home/agent/x\n", "COPY has an empty source"},
+		{"json copy with no source", "FROM debian\nCOPY [\"/home/agent/x\"]\n", "COPY requires a source and destination"},
+		{"empty run", "FROM debian\nRUN\n", "RUN has no command"},
+		{"unknown instruction", "FROM debian\nBOGUS thing\n", "unknown instruction"},
+		{"continued empty install", "FROM debian\nRUN apt-get update && \\\n  apt-get install -y\n", "package install has no packages"},
+		{"unknown after heredoc", "FROM debian\nRUN <<EOF\necho hi\nEOF\nBOGUS thing\n", `line 5: unknown instruction "BOGUS"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateDockerfile(tt.dockerfile)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateDockerfile_LogicalInstructions(t *testing.T) {
+	dockerfile := strings.Join([]string{
+		"FROM debian:12-slim",
+		"RUN apt-get update && \\",
+		"    # comments and blank lines don't end the instruction",
+		"",
+		"    apt-get install -y \\",
+		"      git curl",
+		"COPY <<EOF /etc/motd",
+		"not an instruction",
+		"EOF",
+		"RUN <<-SCRIPT",
+		"\tset -e",
+		"\tSCRIPT",
+		"ADD https://example.com/tool.tar.gz /opt/",
+		"EXPOSE 8080",
+		"HEALTHCHECK NONE",
+		"STOPSIGNAL SIGTERM",
+		"",
+	}, "\n")
+	if err := validateDockerfile(dockerfile); err != nil {
+		t.Errorf("expected valid Dockerfile, got: %v", err)
+	}
+
+	var keywords []string
+	for _, inst := range dockerfileInstructions(dockerfile) {
+		keywords = append(keywords, fmt.Sprintf("%d %s", inst.line, inst.keyword))
+	}
+	want := []string{"1 FROM", "2 RUN", "7 COPY", "10 RUN", "13 ADD", "14 EXPOSE", "15 HEALTHCHECK", "16 STOPSIGNAL"}
+	if diff := cmp.Diff(want, keywords); diff != "" {
+		t.Errorf("instructions mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestResolvePackageManager(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings ImageSettings
+		want     string
+	}{
+		{"default debian", ImageSettings{Base: "debian:12-slim"}, "apt"},
+		{"empty base", ImageSettings{}, "apt"},
+		{"alpine detected", ImageSettings{Base: "alpine:3.20"}, "apk"},
+		{"alpine variant detected", ImageSettings{Base: "node:20-alpine"}, "apk"},
+		{"explicit apt overrides detection", ImageSettings{Base: "my-alpine-fork", PackageManager: "apt"}, "apt"},
+		{"explicit apk", ImageSettings{Base: "custom:latest", PackageManager: "apk"}, "apk"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.settings.ResolvePackageManager(); got != tt.want {
+				t.Errorf("ResolvePackageManager() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDockerfile_Claude_Apk(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	imgCfg.Image.Base = "alpine:3.20"
+	imgCfg.Image.Packages = []string{"bash", "curl", "ca-certificates", "git"}
+	imgCfg.Mise.Install = []string{"apk add --no-cache mise"}
+	spec := getToolSpec(t, imgCfg, "claude")
+	collection := buildDefaultCollection("claude", spec)
+
+	got := buildDockerfile(false, false, collection, spec, imgCfg, "claude", nil)
+
+	if err := validateDockerfile(got); err != nil {
+		t.Errorf("expected valid Dockerfile, got: %v", err)
+	}
+	if strings.Contains(got, "apt-get") {
+		t.Errorf("expected no apt-get commands for apk image, got:\n%s", got)
+	}
+
+	goldenTest(t, "dockerfile_claude_apk.golden", got)
+}
+
+func TestLoadMergedConfig_InvalidPackageManager(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte("image:\n  packageManager: yum\n"), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	_, err := LoadMergedConfig(defaultConfigYAML, LoadOptions{ConfigPath: configPath})
+	if err == nil {
+		t.Fatal("expected error for unknown package manager")
+	}
+	if !strings.Contains(err.Error(), "yum") {
+		t.Errorf("expected error to name the package manager, got: %v", err)
+	}
+}
+
+func TestLayeredMiseFileSpec(t *testing.T) {
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, ".git"), 0755)
+	pkg := filepath.Join(root, "packages", "api")
+	os.MkdirAll(pkg, 0755)
+	os.WriteFile(filepath.Join(root, "mise.toml"), []byte("[tools]\nnode = \"20\"\npython = \"3.12\"\n\n[env]\nSHARED = \"root\"\n"), 0644)
+	os.WriteFile(filepath.Join(pkg, "mise.toml"), []byte("[tools]\nnode = \"22\"\ngo = \"1.22\"\n"), 0600)
+
+	file, err := layeredMiseFileSpec(pkg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if file.path != "mise.toml" || file.mode != 0600 {
+		t.Errorf("expected the nearest file's name and mode, got %s %o", file.path, file.mode)
+	}
+	want := []toolDescriptor{
+		{name: "go", version: "1.22", source: sourceUser},
+		{name: "node", version: "22", source: sourceUser},
+		{name: "python", version: "3.12", source: sourceUser},
+	}
+	if diff := cmp.Diff(want, parseMiseToml(file), cmp.AllowUnexported(toolDescriptor{})); diff != "" {
+		t.Errorf("unexpected merged tools (-want +got):\n%s", diff)
+	}
+	if !strings.Contains(string(file.data), "SHARED = 'root'") {
+		t.Errorf("expected [env] from the root config to be kept, got:\n%s", file.data)
+	}
+
+	// A single file is used unchanged
+	os.Remove(filepath.Join(root, "mise.toml"))
+	file, err = layeredMiseFileSpec(pkg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(file.data) != "[tools]\nnode = \"22\"\ngo = \"1.22\"\n" {
+		t.Errorf("expected the nearest file unchanged, got:\n%s", file.data)
+	}
+
+	// Files above the repository root are ignored
+	os.WriteFile(filepath.Join(filepath.Dir(root), "mise.toml"), []byte("[tools]\nruby = \"3.3\"\n"), 0644)
+	defer os.Remove(filepath.Join(filepath.Dir(root), "mise.toml"))
+	os.Remove(filepath.Join(pkg, "mise.toml"))
+	if file, err := layeredMiseFileSpec(pkg); err != nil || file != nil {
+		t.Errorf("expected no mise.toml inside the repository, got %v (%v)", file, err)
+	}
+}
+
+func TestCheckIdiomaticFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{"valid versions", map[string]string{".go-version": "1.22.1\n", ".nvmrc": "lts/iron\n", ".java-version": "temurin-17\n"}, ""},
+		{"structured file without a version", map[string]string{"Gemfile": "source 'https://rubygems.org'\n"}, ""},
+		{"garbage version", map[string]string{".go-version": "<<<<<<< HEAD\n"}, `.go-version contains an invalid go version: "<<<<<<< HEAD"`},
+		{"empty file", map[string]string{".python-version": "\n"}, ".python-version does not contain a python version"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			oldWd, _ := os.Getwd()
+			defer os.Chdir(oldWd)
+			os.Chdir(dir)
+			for path, content := range tt.files {
+				os.WriteFile(path, []byte(content), 0644)
+			}
+
+			err := checkIdiomaticFiles(collectOptions{})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("expected error %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRun_StrictIdiomatic(t *testing.T) {
+	project := t.TempDir()
+	os.WriteFile(filepath.Join(project, ".go-version"), []byte("go version please\n"), 0644)
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	stdout := os.Stdout
+	devNull, _ := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	os.Stdout = devNull
+	lenientErr := Run(Config{Tool: "claude", DockerfileOnly: true, Project: project})
+	os.Stdout = stdout
+	devNull.Close()
+	if lenientErr != nil {
+		t.Fatalf("expected malformed file to be used without --strict-idiomatic, got %v", lenientErr)
+	}
+
+	err := Run(Config{Tool: "claude", DockerfileOnly: true, Project: project, StrictIdiomatic: true})
+	if err == nil || !strings.Contains(err.Error(), ".go-version") || !strings.Contains(err.Error(), "go version please") {
+		t.Errorf("expected strict mode to reject .go-version, got %v", err)
+	}
+}
+
+func TestParseWorkflowTools(t *testing.T) {
+	tests := []struct {
+		name     string
+		workflow string
+		files    map[string]string
+		want     []toolDescriptor
+	}{
+		{
+			name:     "setup-node",
+			workflow: "jobs:\n  test:\n    steps:\n      - uses: actions/checkout@v4\n      - uses: actions/setup-node@v4\n        with:\n          node-version: 20.11.0\n",
+			want:     []toolDescriptor{{name: "node", version: "20.11.0", source: sourceUser}},
+		},
+		{
+			name:     "setup-python keeps the literal version",
+			workflow: "jobs:\n  test:\n    steps:\n      - uses: actions/setup-python@v5\n        with:\n          python-version: 3.10\n",
+			want:     []toolDescriptor{{name: "python", version: "3.10", source: sourceUser}},
+		},
+		{
+			name:     "setup-go version file",
+			workflow: "jobs:\n  build:\n    steps:\n      - uses: actions/setup-go@v5\n        with:\n          go-version-file: api/go.mod\n",
+			files:    map[string]string{"api/go.mod": "module example.com/api\n\ngo 1.22.1\n"},
+			want:     []toolDescriptor{{name: "go", version: "1.22.1", source: sourceUser}},
+		},
+		{
+			name:     "setup-java",
+			workflow: "jobs:\n  build:\n    steps:\n      - uses: actions/setup-java@v4\n        with:\n          distribution: temurin\n          java-version: '21'\n",
+			want:     []toolDescriptor{{name: "java", version: "21", source: sourceUser}},
+		},
+		{
+			name:     "node version file",
+			workflow: "jobs:\n  test:\n    steps:\n      - uses: actions/setup-node@v4\n        with:\n          node-version-file: .nvmrc\n",
+			files:    map[string]string{".nvmrc": "18\n"},
+			want:     []toolDescriptor{{name: "node", version: "18", source: sourceUser}},
+		},
+		{
+			name:     "matrix expressions and lists are skipped",
+			workflow: "jobs:\n  test:\n    strategy:\n      matrix:\n        node: [18, 20]\n    steps:\n      - uses: actions/setup-node@v4\n        with:\n          node-version: ${{ matrix.node }}\n      - uses: actions/setup-python@v5\n        with:\n          python-version: ['3.11', '3.12']\n",
+		},
+		{
+			name:     "first job wins",
+			workflow: "jobs:\n  b:\n    steps:\n      - uses: actions/setup-node@v4\n        with:\n          node-version: 22\n  a:\n    steps:\n      - uses: actions/setup-node@v4\n        with:\n          node-version: 20\n",
+			want:     []toolDescriptor{{name: "node", version: "20", source: sourceUser}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			oldWd, _ := os.Getwd()
+			defer os.Chdir(oldWd)
+			os.Chdir(dir)
+
+			os.MkdirAll(workflowsDir, 0755)
+			os.WriteFile(filepath.Join(workflowsDir, "ci.yml"), []byte(tt.workflow), 0644)
+			for path, content := range tt.files {
+				os.MkdirAll(filepath.Dir(path), 0755)
+				os.WriteFile(path, []byte(content), 0644)
+			}
+
+			got := parseWorkflowTools(nil)
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(toolDescriptor{})); diff != "" {
+				t.Errorf("unexpected tools (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNormalizeWorkflowVersion(t *testing.T) {
+	aliases := map[string]string{"nova": "26"}
+	tests := []struct {
+		tool    string
+		version string
+		want    string
+		wantOK  bool
+	}{
+		{"node", "20", "20", true},
+		{"node", "20.x", "20", true},
+		{"node", "20.11.x", "20.11", true},
+		{"python", "3.12.x", "3.12", true},
+		{"python", "3.x", "3", true},
+		{"java", "21.*", "21", true},
+		{"node", "v20.11.1", "20.11.1", true},
+		{"node", "lts/*", "lts", true},
+		{"node", "lts/iron", "20", true},
+		{"node", "lts/Nova", "26", true},
+		{"node", "lts/unknown", "lts/unknown", false},
+		{"node", "x", "x", false},
+		{"node", "latest", "latest", false},
+		{"node", "current", "current", false},
+		{"node", "node", "node", false},
+		{"go", "stable", "stable", false},
+		{"go", "oldstable", "oldstable", false},
+		{"go", "Stable", "Stable", false},
+		{"go", "1.22.x", "1.22", true},
+	}
+	for _, tt := range tests {
+		got, ok := normalizeWorkflowVersion(tt.tool, tt.version, aliases)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("normalizeWorkflowVersion(%q, %q) = %q, %v; want %q, %v", tt.tool, tt.version, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestParseWorkflowTools_SkipsAliases(t *testing.T) {
+	dir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(dir)
+	logs := captureLog(t, "text")
+
+	workflow := "jobs:\n  test:\n    steps:\n" +
+		"      - uses: actions/setup-go@v5\n        with:\n          go-version: stable\n" +
+		"      - uses: actions/setup-node@v4\n        with:\n          node-version: lts/*\n" +
+		"      - uses: actions/setup-python@v5\n        with:\n          python-version: 3.12.x\n" +
+		"  upgrade:\n    steps:\n" +
+		"      - uses: actions/setup-go@v5\n        with:\n          go-version: '1.23'\n"
+	os.MkdirAll(workflowsDir, 0755)
+	os.WriteFile(filepath.Join(workflowsDir, "ci.yml"), []byte(workflow), 0644)
+
+	want := []toolDescriptor{
+		{name: "go", version: "1.23", source: sourceUser},
+		{name: "node", version: "lts", source: sourceUser},
+		{name: "python", version: "3.12", source: sourceUser},
+	}
+	got := parseWorkflowTools(nil)
+	sort.Slice(got, func(i, j int) bool { return got[i].name < got[j].name })
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(toolDescriptor{})); diff != "" {
+		t.Errorf("unexpected tools (-want +got):\n%s", diff)
+	}
+	if !strings.Contains(logs.String(), "skipping go-version stable from .github/workflows/ci.yml") {
+		t.Errorf("expected a warning for the stable alias, got %q", logs.String())
+	}
+}
+
+func TestCollectToolSpecs_FromWorkflows(t *testing.T) {
+	dir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(dir)
+	os.MkdirAll(workflowsDir, 0755)
+	os.WriteFile(filepath.Join(workflowsDir, "ci.yaml"), []byte("jobs:\n  test:\n    steps:\n      - uses: actions/setup-node@v4\n        with:\n          node-version: 20\n      - uses: actions/setup-go@v5\n        with:\n          go-version: 1.22\n"), 0644)
+	os.WriteFile(".nvmrc", []byte("22\n"), 0644)
+
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+
+	versions := func(specs []toolDescriptor) map[string]string {
+		m := map[string]string{}
+		for _, s := range specs {
+			m[s.name] = s.version
+		}
+		return m
+	}
+
+	got := versions(collectToolSpecs(nil, nil, spec, imgCfg, "claude", collectOptions{}).specs)
+	if _, ok := got["go"]; ok {
+		t.Errorf("expected workflows to be ignored without the flag, got %v", got)
+	}
+
+	got = versions(collectToolSpecs(nil, nil, spec, imgCfg, "claude", collectOptions{fromWorkflows: true}).specs)
+	if got["go"] != "1.22" {
+		t.Errorf("expected go from the workflow, got %v", got)
+	}
+	if got["node"] != "22" {
+		t.Errorf("expected .nvmrc to take priority over the workflow, got node %q", got["node"])
+	}
+}
+
+func TestLoadMergedConfig_NoUserConfig(t *testing.T) {
+	xdg := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", xdg)
+	os.WriteFile(filepath.Join(xdg, "agent-en-place.yaml"), []byte("image:\n  base: xdg:latest\nrun:\n  hostname: from-xdg\n"), 0644)
+
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	os.WriteFile(".agent-en-place.yaml", []byte("image:\n  base: project:latest\n"), 0644)
+	explicit := filepath.Join(t.TempDir(), "ci.yaml")
+	os.WriteFile(explicit, []byte("defaultAgent: codex\n"), 0644)
+
+	cfg, err := LoadMergedConfig(defaultConfigYAML, LoadOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Image.Base != "project:latest" || cfg.Run.Hostname != "from-xdg" {
+		t.Fatalf("expected user configs to be loaded by default, got base %q hostname %q", cfg.Image.Base, cfg.Run.Hostname)
+	}
+
+	cfg, err = LoadMergedConfig(defaultConfigYAML, LoadOptions{ConfigPath: explicit, NoUserConfig: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Image.Base != "debian:12-slim" {
+		t.Errorf("expected default base with user configs ignored, got %q", cfg.Image.Base)
+	}
+	if cfg.Run.Hostname != "" {
+		t.Errorf("expected XDG hostname to be ignored, got %q", cfg.Run.Hostname)
+	}
+	if cfg.DefaultAgent != "codex" {
+		t.Errorf("expected explicit config to still apply, got defaultAgent %q", cfg.DefaultAgent)
+	}
+}
+
+func TestCollectToolSpecs_AgentOnly(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+
+	t.Setenv("AGENT_EN_PLACE_TOOLS", "ruby@3.2")
+	t.Setenv("AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY", "")
+
+	if err := os.WriteFile(".nvmrc", []byte("18.19.0\n"), 0644); err != nil {
+		t.Fatalf("failed to write .nvmrc: %v", err)
+	}
+
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+
+	miseFile := &fileSpec{
+		path: "mise.toml",
+		data: []byte("[tools]\ngo = \"1.22\"\n"),
+	}
+
+	collection := collectToolSpecs(nil, miseFile, spec, imgCfg, "claude", collectOptions{agentOnly: true})
+
+	versions := make(map[string]string)
+	for _, s := range collection.specs {
+		versions[s.name] = s.version
+	}
+
+	if versions["node"] != "latest" {
+		t.Errorf("expected node from config deps at latest (not from .nvmrc), got %q", versions["node"])
+	}
+	if _, ok := versions["ruby"]; ok {
+		t.Error("expected env var tools to be ignored in agent-only mode")
+	}
+	if _, ok := versions["go"]; ok {
+		t.Error("expected mise.toml tools to be ignored in agent-only mode")
+	}
+	if _, ok := versions["python"]; ok {
+		t.Error("expected transitive deps to be skipped in agent-only mode")
+	}
+	if len(collection.idiomaticPaths) != 0 {
+		t.Errorf("expected no idiomatic paths in agent-only mode, got %v", collection.idiomaticPaths)
+	}
+
+	want := "mheap/agent-en-place:node-latest-npm-anthropic-ai-claude-code-latest"
+	if got := buildImageName(collection.specs); got != want {
+		t.Errorf("buildImageName() = %q, want %q", got, want)
+	}
+}
+
+func TestBuildImageName_LongTagIsHashed(t *testing.T) {
+	specs := []toolDescriptor{
+		{name: "node", version: "20.11.1"},
+		{name: "python", version: "3.12.2"},
+		{name: "ruby", version: "3.3.0"},
+		{name: "go", version: "1.22.1"},
+		{name: "java", version: "temurin-21.0.2+13.0.LTS"},
+		{name: "rust", version: "1.76.0"},
+		{name: "terraform", version: "1.7.4"},
+		{name: "kubectl", version: "1.29.2"},
+		{name: "npm:@anthropic-ai/claude-code", version: "latest"},
+	}
+
+	name := buildImageName(specs)
+	tag := strings.TrimPrefix(name, imageRepository+":")
+	if len(tag) > maxImageTagLength {
+		t.Errorf("expected the tag to be at most %d characters, got %d: %s", maxImageTagLength, len(tag), tag)
+	}
+	if !strings.HasPrefix(tag, "node-20.11.1-python-3.12.2-") {
+		t.Errorf("expected the leading tools to stay readable, got %s", tag)
+	}
+	if again := buildImageName(specs); again != name {
+		t.Errorf("expected a stable name, got %s and %s", name, again)
+	}
+
+	reordered := append([]toolDescriptor{}, specs...)
+	reordered[0], reordered[1] = reordered[1], reordered[0]
+	if suffix := name[len(name)-imageTagHashLength:]; !strings.HasSuffix(buildImageName(reordered), suffix) {
+		t.Error("expected the hash not to depend on tool order")
+	}
+
+	changed := append([]toolDescriptor{}, specs...)
+	changed[len(changed)-1].version = "1.0.0"
+	if buildImageName(changed) == name {
+		t.Error("expected a different version to change the name")
+	}
+
+	short := buildImageName(specs[:2])
+	if short != imageRepository+":node-20.11.1-python-3.12.2" {
+		t.Errorf("expected short tags to be left alone, got %s", short)
+	}
+}
+
+// captureLog redirects log output to a buffer for the duration of the test
+func captureLog(t *testing.T, format string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	oldOutput, oldJSON := logOutput, logJSON
+	t.Cleanup(func() {
+		logOutput, logJSON = oldOutput, oldJSON
+	})
+	logOutput = &buf
+	if err := SetLogFormat(format); err != nil {
+		t.Fatalf("SetLogFormat(%q) failed: %v", format, err)
+	}
+	return &buf
+}
+
+func TestLog_JSONWarnings(t *testing.T) {
+	buf := captureLog(t, "json")
+
+	cfg := &ImageConfig{
+		Image: ImageSettings{Packages: []string{"curl"}},
+		ImageCustomizations: ImageCustomizations{
+			Packages: []ImageCustomization{
+				{Op: "remove", Value: "vim"},
+				{Op: "upgrade", Value: "git"},
+			},
+		},
+	}
+	applyImageCustomizations(cfg)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 JSON log lines, got %d:\n%s", len(lines), buf.String())
+	}
+
+	var first map[string]string
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatalf("expected valid JSON, got %q: %v", lines[0], err)
+	}
+	want := map[string]string{"level": "warn", "msg": `package "vim" not found for removal`, "package": "vim"}
+	if diff := cmp.Diff(want, first); diff != "" {
+		t.Errorf("unexpected warning (-want +got):\n%s", diff)
+	}
+
+	var second map[string]string
+	if err := json.Unmarshal([]byte(lines[1]), &second); err != nil {
+		t.Fatalf("expected valid JSON, got %q: %v", lines[1], err)
+	}
+	if second["level"] != "warn" || second["op"] != "upgrade" {
+		t.Errorf("expected unknown op warning with op field, got %v", second)
+	}
+}
+
+func TestLog_TextWarnings(t *testing.T) {
+	buf := captureLog(t, "text")
+
+	logWarn(`package "vim" not found for removal`, "package", "vim")
+
+	want := "Warning: package \"vim\" not found for removal\n"
+	if buf.String() != want {
+		t.Errorf("expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestLog_JSONError(t *testing.T) {
+	buf := captureLog(t, "json")
+
+	LogError(errors.New("failed to build image"))
+
+	want := `{"level":"error","msg":"failed to build image"}` + "\n"
+	if buf.String() != want {
+		t.Errorf("expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestSetLogFormat_Invalid(t *testing.T) {
+	captureLog(t, "text")
+	if err := SetLogFormat("xml"); err == nil {
+		t.Error("expected error for unknown log format")
+	}
+}
+
+func TestImageTagSpecs_ExcludeAgentFromTag(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+	collection := buildDefaultCollection("claude", spec)
+
+	// Default: agent tool is part of the tag
+	withAgent := buildImageName(imageTagSpecs(collection.specs, spec, imgCfg))
+	if !strings.Contains(withAgent, "claude-code") {
+		t.Errorf("expected agent tool in tag by default, got %q", withAgent)
+	}
+
+	enabled := true
+	imgCfg.Image.ExcludeAgentFromTag = &enabled
+	got := buildImageName(imageTagSpecs(collection.specs, spec, imgCfg))
+	if got != "mheap/agent-en-place:node-latest" {
+		t.Errorf("expected agent tool to be excluded from tag, got %q", got)
+	}
+
+	// The agent is still recorded in the labels
+	labels := buildToolLabels(collection.specs)
+	if !strings.Contains(labels, `com.mheap.agent-en-place.claude="latest"`) {
+		t.Errorf("expected agent label to remain, got:\n%s", labels)
+	}
+}
+
+func TestImageTagSpecs_PinnedAgentStaysInTag(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	enabled := true
+	imgCfg.Image.ExcludeAgentFromTag = &enabled
+	spec := getToolSpec(t, imgCfg, "claude")
+
+	specs := []toolDescriptor{
+		{name: sanitizeTagComponent(spec.MiseToolName), version: "1.0.0", labelName: "claude"},
+		{name: "node", version: "20", labelName: "node"},
+	}
+
+	got := buildImageName(imageTagSpecs(specs, spec, imgCfg))
+	if !strings.Contains(got, "claude-code-1.0.0") {
+		t.Errorf("expected pinned agent version to stay in tag, got %q", got)
+	}
+}
+
+// readTarModes returns the mode of every file in a tar stream, keyed by name
+func readTarModes(t *testing.T, r io.Reader) map[string]int64 {
+	t.Helper()
+	modes := make(map[string]int64)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read tar: %v", err)
+		}
+		modes[header.Name] = header.Mode
+	}
+	return modes
+}
+
+func TestMakeBuildContext_FilePerms(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+	collection := buildDefaultCollection("claude", spec)
+	toolFile := &fileSpec{path: ".tool-versions", data: []byte("node 20\n"), mode: 0664}
+	miseFile := &fileSpec{path: "mise.toml", data: []byte("[tools]\nnode = \"20\"\n"), mode: 0644}
+
+	t.Run("defaults", func(t *testing.T) {
+		buildCtx, err := makeBuildContext(toolFile, miseFile, collection, spec, imgCfg, "claude")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		modes := readTarModes(t, buildCtx)
+		want := map[string]int64{
+			"Dockerfile":                 0644,
+			".tool-versions":             0664,
+			"mise.toml":                  0644,
+			"mise.agent.toml":            0644,
+			"assets/agent-entrypoint.sh": 0755,
+		}
+		if diff := cmp.Diff(want, modes); diff != "" {
+			t.Errorf("unexpected modes (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("configured", func(t *testing.T) {
+		imgCfg.Image.FilePerms = map[string]string{
+			"miseConfig":   "0600",
+			"entrypoint":   "0555",
+			"toolVersions": "600",
+		}
+		buildCtx, err := makeBuildContext(toolFile, miseFile, collection, spec, imgCfg, "claude")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		modes := readTarModes(t, buildCtx)
+		want := map[string]int64{
+			"Dockerfile":                 0644,
+			".tool-versions":             0600,
+			"mise.toml":                  0600,
+			"mise.agent.toml":            0600,
+			"assets/agent-entrypoint.sh": 0555,
+		}
+		if diff := cmp.Diff(want, modes); diff != "" {
+			t.Errorf("unexpected modes (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestResolveFilePerms_Invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		perms map[string]string
+	}{
+		{"not octal", map[string]string{"miseConfig": "0689"}},
+		{"not a number", map[string]string{"entrypoint": "rwx"}},
+		{"out of range", map[string]string{"entrypoint": "7777"}},
+		{"unknown kind", map[string]string{"secrets": "0600"}},
+		{"entrypoint not readable by others", map[string]string{"entrypoint": "0711"}},
+		{"entrypoint not executable by others", map[string]string{"entrypoint": "0744"}},
+		{"entrypoint owner only", map[string]string{"entrypoint": "0700"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := (ImageSettings{FilePerms: tt.perms}).ResolveFilePerms(); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestValidate_EntrypointFilePerms(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	imgCfg.Image.FilePerms = map[string]string{"entrypoint": "0700"}
+	err := imgCfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "image.filePerms.entrypoint") {
+		t.Errorf("expected config validation to reject an entrypoint mode others can't run, got %v", err)
+	}
+}
+
+func TestSeedConfig_OnlyAllowlistedFilesCopied(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	configDir := filepath.Join(home, ".claude")
+	if err := os.MkdirAll(configDir, 0755); err != nil {
+		t.Fatalf("failed to create config dir: %v", err)
+	}
+	for _, name := range []string{"settings.json", "credentials.json"} {
+		if err := os.WriteFile(filepath.Join(configDir, name), []byte("{}"), 0600); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+	spec.SeedFiles = []string{"settings.json", "missing.json"}
+
+	names, err := resolveSeedFiles(home, spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"settings.json"}, names); diff != "" {
+		t.Fatalf("unexpected seed files (-want +got):\n%s", diff)
+	}
+	spec.SeedFiles = names
+
+	collection := buildDefaultCollection("claude", spec)
+	dockerfile := buildDockerfile(false, false, collection, spec, imgCfg, "claude", nil)
+	if !strings.Contains(dockerfile, "COPY seed-config/settings.json /home/agent/.claude/settings.json\n") {
+		t.Errorf("expected settings.json to be copied, got:\n%s", dockerfile)
+	}
+	if strings.Contains(dockerfile, "credentials.json") {
+		t.Errorf("expected credentials.json not to be copied, got:\n%s", dockerfile)
+	}
+
+	buildCtx, err := makeBuildContext(nil, nil, collection, spec, imgCfg, "claude")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	modes := readTarModes(t, buildCtx)
+	if _, ok := modes["seed-config/settings.json"]; !ok {
+		t.Errorf("expected seed-config/settings.json in build context, got %v", modes)
+	}
+	if _, ok := modes["seed-config/credentials.json"]; ok {
+		t.Error("expected credentials.json not to be in build context")
+	}
+}
+
+func TestWriteBuildContext(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	t.Setenv("AGENT_EN_PLACE_TOOLS", "")
+	t.Setenv("AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY", "")
+
+	if err := os.WriteFile(".nvmrc", []byte("20\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("bun.lockb", []byte{0x00, 0x01, 0x02}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+	toolFile := &fileSpec{path: ".tool-versions", data: []byte("python 3.12"), mode: 0644}
+	collection := collectToolSpecs(toolFile, nil, spec, imgCfg, "claude", collectOptions{})
+
+	buildCtx, err := makeBuildContext(toolFile, nil, collection, spec, imgCfg, "claude")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var out bytes.Buffer
+	if err := writeBuildContext(&out, buildCtx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dockerfile := buildDockerfile(true, false, collection, spec, imgCfg, "claude", os.Environ())
+	agentMise, err := agentMiseConfig(nil, collection, spec, imgCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"=== Dockerfile ===\n" + dockerfile,
+		"=== .tool-versions ===\npython 3.12\n=== ",
+		"=== mise.agent.toml ===\n" + string(agentMise),
+		"=== .nvmrc ===\n20\n",
+		"=== bun.lockb ===\n(binary, 3 bytes)\n",
+		"=== assets/agent-entrypoint.sh ===\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected the output to contain %q, got:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestSeedConfig_RejectsPaths(t *testing.T) {
+	home := t.TempDir()
+	spec := ToolSpec{ConfigDir: ".claude", SeedFiles: []string{"../.ssh/id_rsa"}}
+
+	if _, err := resolveSeedFiles(home, spec); err == nil {
+		t.Error("expected error for seed file outside the config dir")
+	}
+}
+
+func TestDockerfile_NoSeedFilesByDefault(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+	collection := buildDefaultCollection("claude", spec)
+
+	dockerfile := buildDockerfile(false, false, collection, spec, imgCfg, "claude", nil)
+	if strings.Contains(dockerfile, "seed-config") {
+		t.Errorf("expected no seed files without seedFiles configured, got:\n%s", dockerfile)
+	}
+}
+
+// fakeDockerClient is an in-memory dockerClient used to test Docker orchestration
+type fakeDockerClient struct {
+	images   []image.Summary
+	builds   []client.ImageBuildOptions // options passed to each ImageBuild call
+	buildErr error
+	pulls    map[string]image.Summary // image stored locally when a ref is pulled
+	calls    []string                 // "build <tag>", "pull <ref>" and "tag <source> <target>" in call order
+
+	containers    []client.ContainerCreateOptions // options passed to each ContainerCreate call
+	containerLogs string                          // output returned by ContainerLogs
+	containerExit int64                           // exit code reported by ContainerWait
+	removed       []string                        // IDs passed to ContainerRemove
+	killed        []string                        // signals passed to ContainerKill
+
+	serverVersion    client.ServerVersionResult // daemon version reported by ServerVersion
+	serverVersionErr error
+
+	removedImages []string         // refs passed to ImageRemove
+	removeErrs    map[string]error // errors returned by ImageRemove, by ref
+}
+
+func (f *fakeDockerClient) ContainerCreate(ctx context.Context, options client.ContainerCreateOptions) (client.ContainerCreateResult, error) {
+	f.containers = append(f.containers, options)
+	id := fmt.Sprintf("container-%d", len(f.containers))
+	f.calls = append(f.calls, "create "+id)
+	return client.ContainerCreateResult{ID: id}, nil
+}
+
+func (f *fakeDockerClient) ContainerStart(ctx context.Context, containerID string, options client.ContainerStartOptions) (client.ContainerStartResult, error) {
+	f.calls = append(f.calls, "start "+containerID)
+	return client.ContainerStartResult{}, nil
+}
+
+func (f *fakeDockerClient) ContainerWait(ctx context.Context, containerID string, options client.ContainerWaitOptions) client.ContainerWaitResult {
+	result := make(chan container.WaitResponse, 1)
+	result <- container.WaitResponse{StatusCode: f.containerExit}
+	return client.ContainerWaitResult{Result: result, Error: make(chan error)}
+}
+
+func (f *fakeDockerClient) ContainerLogs(ctx context.Context, containerID string, options client.ContainerLogsOptions) (client.ContainerLogsResult, error) {
+	return io.NopCloser(strings.NewReader(f.containerLogs)), nil
+}
+
+func (f *fakeDockerClient) ContainerRemove(ctx context.Context, containerID string, options client.ContainerRemoveOptions) (client.ContainerRemoveResult, error) {
+	f.removed = append(f.removed, containerID)
+	f.calls = append(f.calls, "remove "+containerID)
+	return client.ContainerRemoveResult{}, nil
+}
+
+// ContainerAttach returns a connection that streams containerLogs and then
+// closes, discarding anything written to it
+func (f *fakeDockerClient) ContainerAttach(ctx context.Context, containerID string, options client.ContainerAttachOptions) (client.ContainerAttachResult, error) {
+	f.calls = append(f.calls, "attach "+containerID)
+	conn, server := net.Pipe()
+	go func() {
+		go io.Copy(io.Discard, server)
+		io.WriteString(server, f.containerLogs)
+		server.Close()
+	}()
+	return client.ContainerAttachResult{HijackedResponse: client.NewHijackedResponse(conn, "")}, nil
+}
+
+func (f *fakeDockerClient) ContainerKill(ctx context.Context, containerID string, options client.ContainerKillOptions) (client.ContainerKillResult, error) {
+	f.killed = append(f.killed, options.Signal)
+	return client.ContainerKillResult{}, nil
+}
+
+func (f *fakeDockerClient) ContainerResize(ctx context.Context, containerID string, options client.ContainerResizeOptions) (client.ContainerResizeResult, error) {
+	return client.ContainerResizeResult{}, nil
+}
+
+func (f *fakeDockerClient) ServerVersion(ctx context.Context, options client.ServerVersionOptions) (client.ServerVersionResult, error) {
+	return f.serverVersion, f.serverVersionErr
+}
+
+// fakePullResponse is a completed, empty image pull
+type fakePullResponse struct {
+	io.ReadCloser
+}
+
+func (fakePullResponse) JSONMessages(ctx context.Context) iter.Seq2[jsonstream.Message, error] {
+	return func(yield func(jsonstream.Message, error) bool) {}
+}
+
+func (fakePullResponse) Wait(ctx context.Context) error {
+	return nil
+}
+
+func (f *fakeDockerClient) ImagePull(ctx context.Context, refStr string, options client.ImagePullOptions) (client.ImagePullResponse, error) {
+	f.calls = append(f.calls, "pull "+refStr)
+	if pulled, ok := f.pulls[refStr]; ok {
+		f.images = slices.DeleteFunc(f.images, func(img image.Summary) bool { return slices.Contains(img.RepoTags, refStr) })
+		f.images = append(f.images, pulled)
+	}
+	return fakePullResponse{io.NopCloser(strings.NewReader(""))}, nil
+}
+
+func (f *fakeDockerClient) ImageBuild(ctx context.Context, buildContext io.Reader, options client.ImageBuildOptions) (client.ImageBuildResult, error) {
+	f.builds = append(f.builds, options)
+	f.calls = append(f.calls, "build "+strings.Join(options.Tags, ","))
+	if f.buildErr != nil {
+		return client.ImageBuildResult{}, f.buildErr
+	}
+	return client.ImageBuildResult{Body: io.NopCloser(strings.NewReader(""))}, nil
+}
+
+func (f *fakeDockerClient) ImageInspect(ctx context.Context, imageID string, inspectOpts ...client.ImageInspectOption) (client.ImageInspectResult, error) {
+	for _, img := range f.images {
+		for _, tag := range img.RepoTags {
+			if tag == imageID {
+				config := &dockerspec.DockerOCIImageConfig{}
+				config.Labels = img.Labels
+				return client.ImageInspectResult{InspectResponse: image.InspectResponse{ID: img.ID, RepoDigests: img.RepoDigests, Config: config}}, nil
+			}
+		}
+	}
+	return client.ImageInspectResult{}, errors.New("no such image")
+}
+
+// ImageList returns the untagged images for a dangling filter and the tagged
+// ones otherwise
+func (f *fakeDockerClient) ImageList(ctx context.Context, options client.ImageListOptions) (client.ImageListResult, error) {
+	dangling := options.Filters["dangling"]["true"]
+	var items []image.Summary
+	for _, img := range f.images {
+		if (len(img.RepoTags) == 0) == dangling {
+			items = append(items, img)
+		}
+	}
+	return client.ImageListResult{Items: items}, nil
+}
+
+func (f *fakeDockerClient) ImageRemove(ctx context.Context, imageID string, options client.ImageRemoveOptions) (client.ImageRemoveResult, error) {
+	if err := f.removeErrs[imageID]; err != nil {
+		return client.ImageRemoveResult{}, err
+	}
+	f.removedImages = append(f.removedImages, imageID)
+	return client.ImageRemoveResult{Items: []image.DeleteResponse{{Untagged: imageID}}}, nil
+}
+
+func (f *fakeDockerClient) ImageTag(ctx context.Context, options client.ImageTagOptions) (client.ImageTagResult, error) {
+	f.calls = append(f.calls, fmt.Sprintf("tag %s %s", options.Source, options.Target))
+	return client.ImageTagResult{}, nil
+}
+
+func TestVerifyPackages_Missing(t *testing.T) {
+	cli := &fakeDockerClient{containerLogs: "missing: libfoo\r\nmissing: gti\r\n"}
+
+	err := verifyPackages(context.Background(), cli, "debian:12-slim", packageManagerApt, []string{"curl", "libfoo", "gti"})
+	if err == nil {
+		t.Fatal("expected error for missing packages")
+	}
+	if want := "packages not found in debian:12-slim: libfoo, gti"; err.Error() != want {
+		t.Errorf("expected %q, got %q", want, err.Error())
+	}
+
+	want := []string{"pull debian:12-slim", "create container-1", "start container-1", "remove container-1"}
+	if diff := cmp.Diff(want, cli.calls); diff != "" {
+		t.Errorf("unexpected calls (-want +got):\n%s", diff)
+	}
+	cfg := cli.containers[0].Config
+	if cfg.Image != "debian:12-slim" || !cfg.Tty {
+		t.Errorf("unexpected container config: %+v", cfg)
+	}
+	if script := cfg.Cmd[len(cfg.Cmd)-1]; !strings.Contains(script, "apt-cache show") || !strings.Contains(script, "'libfoo'") {
+		t.Errorf("unexpected check script: %s", script)
+	}
+}
+
+func TestVerifyPackages_AllFound(t *testing.T) {
+	cli := &fakeDockerClient{images: []image.Summary{{RepoTags: []string{"alpine:3.19"}}}}
+
+	if err := verifyPackages(context.Background(), cli, "alpine:3.19", packageManagerApk, []string{"git"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if slices.Contains(cli.calls, "pull alpine:3.19") {
+		t.Error("expected a local base image not to be pulled")
+	}
+	if script := cli.containers[0].Config.Cmd[2]; !strings.Contains(script, "apk search -x") {
+		t.Errorf("expected apk check script, got: %s", script)
+	}
+	if len(cli.removed) != 1 {
+		t.Errorf("expected the check container to be removed, got %v", cli.removed)
+	}
+}
+
+func TestVerifyPackages_CheckFailed(t *testing.T) {
+	cli := &fakeDockerClient{containerLogs: "E: Could not resolve deb.debian.org", containerExit: 100}
+
+	err := verifyPackages(context.Background(), cli, "debian:12-slim", packageManagerApt, []string{"git"})
+	if err == nil || !strings.Contains(err.Error(), "exit code 100") || !strings.Contains(err.Error(), "Could not resolve") {
+		t.Errorf("expected check failure with output, got %v", err)
+	}
+}
+
+func TestFindAgentImages(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+
+	cli := &fakeDockerClient{images: []image.Summary{
+		{
+			RepoTags: []string{"mheap/agent-en-place:node-20-npm-anthropic-ai-claude-code-latest"},
+			Created:  100,
+			Labels:   map[string]string{labelPrefix + "claude-code": "latest", labelPrefix + "node": "20"},
+		},
+		{
+			RepoTags: []string{"mheap/agent-en-place:node-latest-npm-openai-codex-latest"},
+			Created:  300,
+			Labels:   map[string]string{labelPrefix + "codex": "latest", labelPrefix + "node": "latest"},
+		},
+		{
+			RepoTags: []string{"mheap/agent-en-place:node-22"},
+			Created:  200,
+			Labels:   map[string]string{labelPrefix + "claude-code": "latest", labelPrefix + "node": "22", labelPrefix + "git.sha": "abc123", labelPrefix + "git.dirty": "false"},
+		},
+	}}
+
+	images, err := findAgentImages(context.Background(), cli, spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var tags []string
+	for _, img := range images {
+		tags = append(tags, img.tag)
+	}
+	want := []string{
+		"mheap/agent-en-place:node-22",
+		"mheap/agent-en-place:node-20-npm-anthropic-ai-claude-code-latest",
+	}
+	if diff := cmp.Diff(want, tags); diff != "" {
+		t.Errorf("unexpected images, newest first (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"claude-code=latest", "node=22"}, images[0].tools); diff != "" {
+		t.Errorf("unexpected tools (-want +got):\n%s", diff)
+	}
+}
+
+func TestPrintAgentImages_NoImages(t *testing.T) {
+	var buf bytes.Buffer
+	printAgentImages(&buf, "claude", nil)
+
+	if buf.String() != "No local images found for claude\n" {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+}
+
+func pruneTestImages() []image.Summary {
+	day := int64(24 * 60 * 60)
+	now := time.Now().Unix()
+	return []image.Summary{
+		{
+			RepoTags: []string{"mheap/agent-en-place:node-20-npm-anthropic-ai-claude-code-latest"},
+			Created:  now - 30*day,
+			Size:     1_500_000_000,
+			Labels:   map[string]string{labelPrefix + "claude-code": "latest", labelPrefix + "node": "20"},
+		},
+		{
+			RepoTags: []string{"mheap/agent-en-place:node-22-npm-anthropic-ai-claude-code-latest"},
+			Created:  now - 2*day,
+			Size:     1_600_000_000,
+			Labels:   map[string]string{labelPrefix + "claude-code": "latest", labelPrefix + "node": "22"},
+		},
+		{
+			RepoTags: []string{"mheap/agent-en-place:node-22-npm-anthropic-ai-claude-code-latest-linux-arm64"},
+			Created:  now - 20*day,
+			Size:     1_400_000_000,
+			Labels:   map[string]string{labelPrefix + "claude-code": "latest", labelPrefix + "platform": "linux/arm64"},
+		},
+		{
+			RepoTags: []string{"mheap/agent-en-place:node-latest-npm-openai-codex-latest", "my/codex:latest"},
+			Created:  now - 10*day,
+			Size:     1_000_000_000,
+			Labels:   map[string]string{labelPrefix + "codex": "latest", labelPrefix + "node": "latest"},
+		},
+		{
+			RepoTags: []string{"mheap/agent-en-place:node-18-npm-openai-codex-latest"},
+			Created:  now - 40*day,
+			Size:     900_000_000,
+			Labels:   map[string]string{labelPrefix + "codex": "latest", labelPrefix + "node": "18"},
+		},
+	}
+}
+
+// supersededTestImages are pruneTestImages plus untagged images left behind
+// when their tags were rebuilt, and an untagged image from another tool
+func supersededTestImages() []image.Summary {
+	day := int64(24 * 60 * 60)
+	now := time.Now().Unix()
+	return append(pruneTestImages(),
+		image.Summary{
+			ID:      "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+			Created: now - 50*day,
+			Size:    1_200_000_000,
+			Labels:  map[string]string{labelPrefix + "claude-code": "latest", labelPrefix + "node": "20"},
+		},
+		image.Summary{
+			ID:      "sha256:2222222222222222222222222222222222222222222222222222222222222222",
+			Created: now - 5*day,
+			Size:    800_000_000,
+			Labels:  map[string]string{labelPrefix + "codex": "latest", labelPrefix + "node": "22"},
+		},
+		image.Summary{
+			ID:      "sha256:3333333333333333333333333333333333333333333333333333333333333333",
+			Created: now - 60*day,
+			Size:    100_000_000,
+			Labels:  map[string]string{"org.example.other": "true"},
+		},
+	)
+}
+
+func TestPruneImages_RemovesSupersededImages(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	cli := &fakeDockerClient{images: supersededTestImages()}
+
+	var buf bytes.Buffer
+	if err := pruneImages(context.Background(), cli, &buf, imgCfg.Agents, pruneOptions{yes: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Every tag may be the current image of some project, so only untagged
+	// images agent-en-place built are removed
+	want := []string{
+		"sha256:1111111111111111111111111111111111111111111111111111111111111111",
+		"sha256:2222222222222222222222222222222222222222222222222222222222222222",
+	}
+	if diff := cmp.Diff(want, cli.removedImages); diff != "" {
+		t.Errorf("unexpected removed images (-want +got):\n%s", diff)
+	}
+	wantOutput := "Deleted 111111111111\n" +
+		"Deleted 222222222222\n" +
+		"Reclaimed up to 2.00GB\n"
+	if diff := cmp.Diff(wantOutput, buf.String()); diff != "" {
+		t.Errorf("unexpected output (-want +got):\n%s", diff)
+	}
+}
+
+func TestPruneImages_Confirmation(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	preview := "Would delete 111111111111\n" +
+		"Would delete 222222222222\n" +
+		"Would reclaim up to 2.00GB\n"
+
+	// Without a terminal to ask on, nothing is removed without --yes
+	cli := &fakeDockerClient{images: supersededTestImages()}
+	var buf bytes.Buffer
+	err := pruneImages(context.Background(), cli, &buf, imgCfg.Agents, pruneOptions{})
+	if err == nil || !strings.Contains(err.Error(), "pass --yes") {
+		t.Errorf("expected a refusal mentioning --yes, got %v", err)
+	}
+	if len(cli.removedImages) != 0 {
+		t.Errorf("expected no images removed without --yes, got %v", cli.removedImages)
+	}
+	if diff := cmp.Diff(preview, buf.String()); diff != "" {
+		t.Errorf("expected the images to be listed (-want +got):\n%s", diff)
+	}
+
+	// Declining at the prompt removes nothing
+	var prompts bytes.Buffer
+	cli = &fakeDockerClient{images: supersededTestImages()}
+	buf.Reset()
+	opts := pruneOptions{confirm: promptConfirm(strings.NewReader("n\n"), &prompts)}
+	if err := pruneImages(context.Background(), cli, &buf, imgCfg.Agents, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cli.removedImages) != 0 {
+		t.Errorf("expected no images removed when declined, got %v", cli.removedImages)
+	}
+	if prompts.String() != "Delete 2 images? [y/N] " {
+		t.Errorf("unexpected prompt: %q", prompts.String())
+	}
+	if !strings.HasSuffix(buf.String(), "No images deleted\n") {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+
+	// Confirming removes them
+	cli = &fakeDockerClient{images: supersededTestImages()}
+	buf.Reset()
+	opts = pruneOptions{confirm: promptConfirm(strings.NewReader("yes\n"), io.Discard)}
+	if err := pruneImages(context.Background(), cli, &buf, imgCfg.Agents, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cli.removedImages) != 2 {
+		t.Errorf("expected both images removed once confirmed, got %v", cli.removedImages)
+	}
+	if !strings.HasPrefix(buf.String(), preview) || !strings.HasSuffix(buf.String(), "Reclaimed up to 2.00GB\n") {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+}
+
+func TestTerminalConfirm_RequiresTerminal(t *testing.T) {
+	// Pipes stand in for a script's redirected output and input
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if confirm := terminalConfirm(r, w); confirm != nil {
+		t.Error("expected no prompt when stdout isn't a terminal")
+	}
+
+	imgCfg := loadTestConfig(t)
+	cli := &fakeDockerClient{images: supersededTestImages()}
+	var buf bytes.Buffer
+	err = pruneImages(context.Background(), cli, &buf, imgCfg.Agents, pruneOptions{confirm: terminalConfirm(r, w)})
+	if err == nil || !strings.Contains(err.Error(), "isn't an interactive terminal; pass --yes") {
+		t.Errorf("expected a refusal mentioning --yes, got %v", err)
+	}
+	if len(cli.removedImages) != 0 {
+		t.Errorf("expected no images removed without --yes, got %v", cli.removedImages)
+	}
+	if !strings.Contains(buf.String(), "Would delete ") {
+		t.Errorf("expected the images that would be removed to be listed, got %q", buf.String())
+	}
+}
+
+func TestPruneImages_OlderThan(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	cli := &fakeDockerClient{
+		images:     pruneTestImages(),
+		removeErrs: map[string]error{"mheap/agent-en-place:node-18-npm-openai-codex-latest": errors.New("image is being used by a running container")},
+	}
+
+	logged := captureLog(t, "text")
+
+	var buf bytes.Buffer
+	if err := pruneImages(context.Background(), cli, &buf, imgCfg.Agents, pruneOptions{olderThan: 7 * 24 * time.Hour, yes: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The codex image is also tagged outside imageRepository, so untagging it
+	// frees no space
+	want := []string{
+		"mheap/agent-en-place:node-20-npm-anthropic-ai-claude-code-latest",
+		"mheap/agent-en-place:node-22-npm-anthropic-ai-claude-code-latest-linux-arm64",
+		"mheap/agent-en-place:node-latest-npm-openai-codex-latest",
+	}
+	if diff := cmp.Diff(want, cli.removedImages); diff != "" {
+		t.Errorf("unexpected removed images (-want +got):\n%s", diff)
+	}
+	if !strings.Contains(buf.String(), "Reclaimed up to 2.90GB\n") {
+		t.Errorf("unexpected reclaimed size in output: %q", buf.String())
+	}
+	if !strings.Contains(logged.String(), "failed to remove mheap/agent-en-place:node-18-npm-openai-codex-latest") {
+		t.Errorf("expected a warning for the image in use, got %q", logged.String())
+	}
+}
+
+func TestPruneImages_DryRun(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	cli := &fakeDockerClient{images: pruneTestImages()}
+
+	var buf bytes.Buffer
+	// --yes doesn't override a dry run
+	if err := pruneImages(context.Background(), cli, &buf, imgCfg.Agents, pruneOptions{olderThan: 15 * 24 * time.Hour, dryRun: true, yes: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(cli.removedImages) != 0 {
+		t.Errorf("expected no images removed in a dry run, got %v", cli.removedImages)
+	}
+	wantOutput := "Would delete mheap/agent-en-place:node-18-npm-openai-codex-latest\n" +
+		"Would delete mheap/agent-en-place:node-20-npm-anthropic-ai-claude-code-latest\n" +
+		"Would delete mheap/agent-en-place:node-22-npm-anthropic-ai-claude-code-latest-linux-arm64\n" +
+		"Would reclaim up to 3.80GB\n"
+	if diff := cmp.Diff(wantOutput, buf.String()); diff != "" {
+		t.Errorf("unexpected output (-want +got):\n%s", diff)
+	}
+}
+
+func TestPruneImages_Outdated(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	day := int64(24 * 60 * 60)
+	now := time.Now().Unix()
+	claudeImage := func(tag string, age int64, version string) image.Summary {
+		return image.Summary{
+			RepoTags: []string{"mheap/agent-en-place:" + tag},
+			Created:  now - age*day,
+			Size:     1_000_000_000,
+			Labels:   map[string]string{labelPrefix + "claude-code": version, labelPrefix + "node": "22"},
+		}
+	}
+	cli := &fakeDockerClient{images: []image.Summary{
+		claudeImage("claude-1.0.30", 30, "1.0.30"),
+		claudeImage("claude-latest", 20, "latest"),
+		claudeImage("claude-1.0.45", 25, "1.0.45"),
+		claudeImage("claude-1.0.10", 2, "1.0.10"), // newest, so kept even though it's outdated
+		{
+			RepoTags: []string{"mheap/agent-en-place:codex-0.1.0"},
+			Created:  now - 40*day,
+			Size:     500_000_000,
+			Labels:   map[string]string{labelPrefix + "codex": "0.1.0"},
+		},
+		{
+			RepoTags: []string{"mheap/agent-en-place:codex-0.2.0"},
+			Created:  now - 10*day,
+			Labels:   map[string]string{labelPrefix + "codex": "0.2.0"},
+		},
+	}}
+
+	lookups := map[string]int{}
+	latest := func(packageName string) (string, error) {
+		lookups[packageName]++
+		switch packageName {
+		case "npm:@anthropic-ai/claude-code":
+			return "1.0.45", nil
+		case "npm:@openai/codex":
+			return "0.2.0", nil
+		}
+		return "", fmt.Errorf("unexpected lookup of %s", packageName)
+	}
+
+	var buf bytes.Buffer
+	opts := pruneOptions{outdated: true, latestVersion: latest, dryRun: true}
+	if err := pruneImages(context.Background(), cli, &buf, imgCfg.Agents, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	wantOutput := "Would delete mheap/agent-en-place:codex-0.1.0\n" +
+		"Would delete mheap/agent-en-place:claude-1.0.30\n" +
+		"Would reclaim up to 1.50GB\n"
+	if diff := cmp.Diff(wantOutput, buf.String()); diff != "" {
+		t.Errorf("unexpected output (-want +got):\n%s", diff)
+	}
+	if len(cli.removedImages) != 0 {
+		t.Errorf("expected no images removed in a dry run, got %v", cli.removedImages)
+	}
+	wantLookups := map[string]int{"npm:@anthropic-ai/claude-code": 1, "npm:@openai/codex": 1}
+	if diff := cmp.Diff(wantLookups, lookups); diff != "" {
+		t.Errorf("expected the latest version to be looked up once per agent (-want +got):\n%s", diff)
+	}
+
+	// Without --yes the outdated images are only listed, even when the user
+	// could be asked
+	cli.removedImages = nil
+	buf.Reset()
+	opts = pruneOptions{outdated: true, latestVersion: latest, confirm: func(string) bool { return true }}
+	if err := pruneImages(context.Background(), cli, &buf, imgCfg.Agents, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cli.removedImages) != 0 {
+		t.Errorf("expected no images removed without --yes, got %v", cli.removedImages)
+	}
+	if !strings.HasSuffix(buf.String(), "Pass --yes to delete these images\n") {
+		t.Errorf("expected a hint to pass --yes, got %q", buf.String())
+	}
+
+	// --yes deletes them
+	buf.Reset()
+	opts = pruneOptions{outdated: true, latestVersion: latest, yes: true}
+	if err := pruneImages(context.Background(), cli, &buf, imgCfg.Agents, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"mheap/agent-en-place:codex-0.1.0", "mheap/agent-en-place:claude-1.0.30"}, cli.removedImages); diff != "" {
+		t.Errorf("unexpected removed images (-want +got):\n%s", diff)
+	}
+
+	// An agent whose latest version can't be looked up keeps all its images
+	logs := captureLog(t, "text")
+	failing := func(string) (string, error) { return "", errors.New("mise not found") }
+	if got := selectOutdatedImages(context.Background(), cli, cli.images, imgCfg.Agents, failing); len(got) != 0 {
+		t.Errorf("expected no images selected without a latest version, got %v", got)
+	}
+	if !strings.Contains(logs.String(), "keeping claude images: mise not found") {
+		t.Errorf("expected a warning about the failed lookup, got %q", logs.String())
+	}
+}
+
+func TestPruneImages_NothingToPrune(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	cli := &fakeDockerClient{images: pruneTestImages()[1:2]}
+
+	var buf bytes.Buffer
+	if err := pruneImages(context.Background(), cli, &buf, imgCfg.Agents, pruneOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if buf.String() != "No images to prune\n" {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+}
+
+func TestCollectToolSpecs_Precedence(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+
+	t.Setenv("AGENT_EN_PLACE_TOOLS", "")
+	t.Setenv("AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY", "")
+
+	toolFile := &fileSpec{path: ".tool-versions", data: []byte("node 18.0.0\n")}
+	miseFile := &fileSpec{path: "mise.toml", data: []byte("[tools]\nnode = \"20.0.0\"\n")}
+
+	nodeVersion := func(collection collectResult) string {
+		for _, s := range collection.specs {
+			if s.name == "node" {
+				return s.version
+			}
+		}
+		return ""
+	}
+
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+
+	// Default precedence: .tool-versions wins
+	collection := collectToolSpecs(toolFile, miseFile, spec, imgCfg, "claude", collectOptions{})
+	if got := nodeVersion(collection); got != "18.0.0" {
+		t.Errorf("expected .tool-versions to win by default, got node %q", got)
+	}
+
+	// Flipped precedence: mise.toml wins
+	imgCfg.Precedence = []string{"mise-toml", "tool-versions"}
+	collection = collectToolSpecs(toolFile, miseFile, spec, imgCfg, "claude", collectOptions{})
+	if got := nodeVersion(collection); got != "20.0.0" {
+		t.Errorf("expected mise.toml to win with flipped precedence, got node %q", got)
+	}
+}
+
+func TestAgentMiseConfig_Precedence(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	captureLog(t, "text")
+
+	t.Setenv("AGENT_EN_PLACE_TOOLS", "")
+	t.Setenv("AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY", "")
+	os.WriteFile(".nvmrc", []byte("22\n"), 0644)
+
+	toolFile := &fileSpec{path: ".tool-versions", data: []byte("node 18.0.0\n")}
+	miseFile := &fileSpec{path: "mise.toml", data: []byte("[tools]\nnode = \"20.0.0\"\n")}
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+
+	// The version the image is tagged with has to be the one mise installs,
+	// so the winner is written to mise.agent.toml, which overrides mise.toml,
+	// .tool-versions and .nvmrc
+	tests := []struct {
+		name       string
+		precedence []string
+		want       string
+	}{
+		{"default", nil, `node = "18.0.0"`},
+		{"mise.toml first", []string{"mise-toml"}, `node = "20.0.0"`},
+		{"idiomatic first", []string{"idiomatic"}, `node = "22"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imgCfg.Precedence = tt.precedence
+			collection := collectToolSpecs(toolFile, miseFile, spec, imgCfg, "claude", collectOptions{})
+			data, err := agentMiseConfig(miseFile.data, collection, spec, imgCfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !strings.Contains(string(data), tt.want+"\n") {
+				t.Errorf("expected mise.agent.toml to pin %s, got:\n%s", tt.want, data)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_ToolsPrecedence(t *testing.T) {
+	cfg, err := loadDefaultConfig([]byte("tools:\n  precedence:\n    - mise-toml\n  python:\n    version: \"3.12\"\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"mise-toml"}, cfg.Precedence); diff != "" {
+		t.Errorf("expected tools.precedence to be read from the config (-want +got):\n%s", diff)
+	}
+	if _, ok := cfg.Tools["precedence"]; ok {
+		t.Error("expected precedence not to be treated as a tool")
+	}
+	if _, ok := cfg.Tools["python"]; !ok {
+		t.Error("expected the python tool entry to be kept")
+	}
+
+	merged := mergeConfigs(mergeConfigs(&ImageConfig{}, cfg), &ImageConfig{})
+	if diff := cmp.Diff([]string{"mise-toml"}, merged.Precedence); diff != "" {
+		t.Errorf("expected tools.precedence to survive a config that doesn't set it (-want +got):\n%s", diff)
+	}
+}
+
+func TestResolvePrecedence(t *testing.T) {
+	tests := []struct {
+		name       string
+		precedence []string
+		want       []string
+		wantErr    bool
+	}{
+		{"default", nil, []string{"tool-versions", "mise-toml", "idiomatic"}, false},
+		{"full order", []string{"idiomatic", "mise-toml", "tool-versions"}, []string{"idiomatic", "mise-toml", "tool-versions"}, false},
+		{"partial order appends the rest", []string{"idiomatic"}, []string{"idiomatic", "tool-versions", "mise-toml"}, false},
+		{"unknown source", []string{"package-json"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := (&ImageConfig{Precedence: tt.precedence}).ResolvePrecedence()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolvePrecedence() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("unexpected order (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLocalBinaryAgent(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+
+	t.Setenv("AGENT_EN_PLACE_TOOLS", "")
+	t.Setenv("AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY", "")
+
+	binary := filepath.Join(tmpDir, "my-agent-linux")
+	if err := os.WriteFile(binary, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("failed to write binary: %v", err)
+	}
+
+	imgCfg := loadTestConfig(t)
+	imgCfg.Agents["local"] = AgentConfig{
+		LocalBinary: binary,
+		Command:     "my-agent --yolo",
+		ConfigDir:   ".my-agent",
+		Depends:     []string{"node"},
+	}
+	spec := getToolSpec(t, imgCfg, "local")
+
+	resolved, err := resolveLocalBinary(spec.LocalBinary, tmpDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	spec.LocalBinary = resolved
+
+	collection := collectToolSpecs(nil, nil, spec, imgCfg, "local", collectOptions{})
+	var names []string
+	for _, s := range collection.specs {
+		names = append(names, s.name)
+	}
+	if diff := cmp.Diff([]string{"node"}, names); diff != "" {
+		t.Errorf("expected only runtime deps in specs (-want +got):\n%s", diff)
+	}
+
+	data, err := buildAgentMiseConfig(nil, collection, spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(data) != "[tools]\nnode = \"latest\"\n" {
+		t.Errorf("expected no agent package in mise.agent.toml, got:\n%s", data)
+	}
+
+	binds := buildRunBinds(spec, "/project", "/home/user")
+	want := fmt.Sprintf("%s:/usr/local/bin/my-agent:ro", binary)
+	if !slices.Contains(binds, want) {
+		t.Errorf("expected %q in run binds, got %v", want, binds)
+	}
+}
+
+func TestResolveLocalBinary_Invalid(t *testing.T) {
+	tmpDir := t.TempDir()
+	notExecutable := filepath.Join(tmpDir, "agent")
+	if err := os.WriteFile(notExecutable, []byte("data"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	if _, err := resolveLocalBinary(filepath.Join(tmpDir, "missing"), tmpDir); err == nil {
+		t.Error("expected error for missing binary")
+	}
+	if _, err := resolveLocalBinary(notExecutable, tmpDir); err == nil {
+		t.Error("expected error for non-executable binary")
+	}
+	if _, err := resolveLocalBinary(tmpDir, tmpDir); err == nil {
+		t.Error("expected error for directory")
+	}
+}
+
+func TestResolveLocalBinary_ExpandsHome(t *testing.T) {
+	home := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(home, "bin"), 0755); err != nil {
+		t.Fatalf("failed to create bin dir: %v", err)
+	}
+	binary := filepath.Join(home, "bin", "agent")
+	if err := os.WriteFile(binary, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("failed to write binary: %v", err)
+	}
+
+	got, err := resolveLocalBinary("~/bin/agent", home)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != binary {
+		t.Errorf("expected %q, got %q", binary, got)
+	}
+}
+
+func TestIdiomaticFiles_Bun(t *testing.T) {
+	tests := []struct {
+		name        string
+		files       map[string]string
+		wantVersion string
+		wantPath    string
+	}{
+		{
+			name:        "bun-version takes precedence",
+			files:       map[string]string{".bun-version": "1.1.0\n", "bunfig.toml": "[install]\noptional = true\n", "bun.lockb": "\x00\x01"},
+			wantVersion: "1.1.0",
+			wantPath:    ".bun-version",
+		},
+		{
+			name:        "bunfig before lockfile",
+			files:       map[string]string{"bunfig.toml": "[install]\noptional = true\n", "bun.lockb": "\x00\x01"},
+			wantVersion: "latest",
+			wantPath:    "bunfig.toml",
+		},
+		{
+			name:        "lockfile only",
+			files:       map[string]string{"bun.lockb": "\x00\x01\x02"},
+			wantVersion: "latest",
+			wantPath:    "bun.lockb",
+		},
+		{
+			name:        "invalid bunfig falls back to lockfile",
+			files:       map[string]string{"bunfig.toml": "[install", "bun.lockb": "\x00"},
+			wantVersion: "latest",
+			wantPath:    "bun.lockb",
+		},
+		{
+			name:  "no bun files",
+			files: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			oldWd, _ := os.Getwd()
+			defer os.Chdir(oldWd)
+			os.Chdir(tmpDir)
+
+			for name, content := range tt.files {
+				if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+					t.Fatalf("failed to write %s: %v", name, err)
+				}
+			}
+
+			var bun *idiomaticInfo
+			infos := parseIdiomaticFiles(collectOptions{})
+			for i := range infos {
+				if infos[i].tool == "bun" {
+					bun = &infos[i]
+				}
+			}
+
+			if tt.wantPath == "" {
+				if bun != nil {
+					t.Errorf("expected no bun detection, got %+v", *bun)
+				}
+				return
+			}
+			if bun == nil {
+				t.Fatal("expected bun to be detected")
+			}
+			if bun.version != tt.wantVersion || bun.path != tt.wantPath {
+				t.Errorf("expected bun %s from %s, got %s from %s", tt.wantVersion, tt.wantPath, bun.version, bun.path)
+			}
+		})
+	}
+}
+
+func TestIdiomaticFiles_Rust(t *testing.T) {
+	tests := []struct {
+		name        string
+		files       map[string]string
+		wantVersion string
+		wantPath    string
+	}{
+		{
+			name:        "rust-toolchain.toml channel",
+			files:       map[string]string{"rust-toolchain.toml": "[toolchain]\nchannel = \"1.75.0\"\ncomponents = [\"rustfmt\"]\n"},
+			wantVersion: "1.75.0",
+			wantPath:    "rust-toolchain.toml",
+		},
+		{
+			name:        "toml takes precedence over legacy file",
+			files:       map[string]string{"rust-toolchain.toml": "[toolchain]\nchannel = \"stable\"\n", "rust-toolchain": "1.70.0\n"},
+			wantVersion: "stable",
+			wantPath:    "rust-toolchain.toml",
+		},
+		{
+			name:        "legacy plain text",
+			files:       map[string]string{"rust-toolchain": "nightly-2024-01-15\n"},
+			wantVersion: "nightly-2024-01-15",
+			wantPath:    "rust-toolchain",
+		},
+		{
+			name:        "legacy file in toml format",
+			files:       map[string]string{"rust-toolchain": "[toolchain]\nchannel = \"1.76.0\"\n"},
+			wantVersion: "1.76.0",
+			wantPath:    "rust-toolchain",
+		},
+		{
+			name:  "toml without channel",
+			files: map[string]string{"rust-toolchain.toml": "[toolchain]\npath = \"/opt/rust\"\n"},
+		},
+		{
+			name:  "no rust files",
+			files: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			oldWd, _ := os.Getwd()
+			defer os.Chdir(oldWd)
+			os.Chdir(tmpDir)
+
+			for name, content := range tt.files {
+				if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+					t.Fatalf("failed to write %s: %v", name, err)
+				}
+			}
+
+			var rust *idiomaticInfo
+			infos := parseIdiomaticFiles(collectOptions{})
+			for i := range infos {
+				if infos[i].tool == "rust" {
+					rust = &infos[i]
+				}
+			}
+
+			if tt.wantPath == "" {
+				if rust != nil {
+					t.Errorf("expected no rust detection, got %+v", *rust)
+				}
+				return
+			}
+			if rust == nil {
+				t.Fatal("expected rust to be detected")
+			}
+			if rust.version != tt.wantVersion || rust.path != tt.wantPath {
+				t.Errorf("expected rust %s from %s, got %s from %s", tt.wantVersion, tt.wantPath, rust.version, rust.path)
+			}
+		})
+	}
+}
+
+func TestIdiomaticFiles_TerraformAndDotnet(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  map[string]string
+	}{
+		{
+			name:  ".terraform-version",
+			files: map[string]string{".terraform-version": "1.7.5\n"},
+			want:  map[string]string{"terraform": "1.7.5"},
+		},
+		{
+			name:  "global.json sdk version",
+			files: map[string]string{"global.json": `{"sdk": {"version": "8.0.100", "rollForward": "latestFeature"}}`},
+			want:  map[string]string{"dotnet": "8.0.100"},
+		},
+		{
+			name:  "global.json without sdk",
+			files: map[string]string{"global.json": `{"msbuild-sdks": {"Microsoft.Build.Traversal": "3.0.0"}}`},
+			want:  map[string]string{},
+		},
+		{
+			name:  "invalid global.json does not stop detection",
+			files: map[string]string{"global.json": `{"sdk": {`, ".terraform-version": "1.6.0\n"},
+			want:  map[string]string{"terraform": "1.6.0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			oldWd, _ := os.Getwd()
+			defer os.Chdir(oldWd)
+			os.Chdir(tmpDir)
+
+			for name, content := range tt.files {
+				if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+					t.Fatalf("failed to write %s: %v", name, err)
+				}
+			}
+
+			got := make(map[string]string)
+			for _, info := range parseIdiomaticFiles(collectOptions{}) {
+				got[info.tool] = info.version
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("detected tools mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDockerfile_Claude_WithInstallArgs(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	imgCfg.Tools["node"] = ToolConfigEntry{Version: "20", InstallArgs: []string{"--jobs", "1"}}
+	imgCfg.Tools["npm:@scope/pkg"] = ToolConfigEntry{InstallArgs: []string{"--before", "2024-01-01 00:00"}}
+	spec := getToolSpec(t, imgCfg, "claude")
+
+	collection := collectResult{
+		specs: dedupeToolSpecs([]toolDescriptor{
+			{name: "node", version: "20", labelName: "node"},
+			{name: "npm:@scope/pkg", version: "1.2.0"},
+			{name: spec.MiseToolName, version: "latest", labelName: "claude"},
+		}),
+		idiomaticInfos: []idiomaticInfo{
+			{tool: "node", version: "20", configKey: "node"},
+			{tool: spec.MiseToolName, version: "latest", configKey: spec.ConfigKey},
+		},
+	}
+
+	got := buildDockerfile(false, false, collection, spec, imgCfg, "claude", nil)
+
+	custom := strings.Index(got, "RUN mise install --env agent --jobs 1 node\n")
+	blanket := strings.Index(got, "RUN mise install --env agent\n")
+	if custom == -1 || blanket == -1 || custom > blanket {
+		t.Errorf("expected custom node install before blanket install, got:\n%s", got)
+	}
+	// Backend tools are found by their config key and installed by their
+	// real name, with arguments quoted
+	if !strings.Contains(got, "RUN mise install --env agent --before '2024-01-01 00:00' npm:@scope/pkg\n") {
+		t.Errorf("expected the scoped npm tool to be installed with its args, got:\n%s", got)
+	}
+
+	goldenTest(t, "dockerfile_claude_with_install_args.golden", got)
+}
+
+func TestMakeBuildContext_Reproducible(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+
+	files := map[string]string{
+		".nvmrc":          "20.11.0\n",
+		".python-version": "3.12.0\n",
+		".ruby-version":   "3.3.0\n",
+		".go-version":     "1.22.0\n",
+		".bun-version":    "1.1.0\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+	miseFile := &fileSpec{path: "mise.toml", data: []byte("[tools]\njq = \"1.7\"\nterraform = \"1.8\"\nyq = \"4\"\nshellcheck = \"0.10\"\n"), mode: 0644}
+
+	build := func() []byte {
+		collection := collectToolSpecs(nil, miseFile, spec, imgCfg, "claude", collectOptions{})
+		buildCtx, err := makeBuildContext(nil, miseFile, collection, spec, imgCfg, "claude")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		data, err := io.ReadAll(buildCtx)
+		if err != nil {
+			t.Fatalf("failed to read build context: %v", err)
+		}
+		return data
+	}
+
+	first := build()
+	for i := 0; i < 10; i++ {
+		if !bytes.Equal(first, build()) {
+			t.Fatalf("build context differs between runs (attempt %d)", i+1)
+		}
+	}
+}
+
+func TestRunIdentity(t *testing.T) {
+	tests := []struct {
+		name         string
+		cfg          Config
+		run          RunSettings
+		cwd          string
+		wantHostname string
+		wantName     string
+	}{
+		{
+			name:         "defaults to agent name",
+			cfg:          Config{Tool: "claude"},
+			cwd:          "/home/user/my-project",
+			wantHostname: "claude",
+		},
+		{
+			name:         "config hostname",
+			cfg:          Config{Tool: "claude"},
+			run:          RunSettings{Hostname: "dev-box"},
+			cwd:          "/home/user/my-project",
+			wantHostname: "dev-box",
+		},
+		{
+			name:         "flag overrides config hostname",
+			cfg:          Config{Tool: "claude", Hostname: "cli-box"},
+			run:          RunSettings{Hostname: "dev-box"},
+			cwd:          "/home/user/my-project",
+			wantHostname: "cli-box",
+		},
+		{
+			name:         "workdir name",
+			cfg:          Config{Tool: "codex", WorkdirName: true},
+			cwd:          "/home/user/My Project_v2/",
+			wantHostname: "codex",
+			wantName:     "myproject-v2-codex",
+		},
+		{
+			name:         "workdir name at root",
+			cfg:          Config{Tool: "codex", WorkdirName: true},
+			cwd:          "/",
+			wantHostname: "codex",
+			wantName:     "workdir-codex",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostname, name := runIdentity(tt.cfg, tt.run, tt.cwd)
+			if hostname != tt.wantHostname || name != tt.wantName {
+				t.Errorf("runIdentity() = %q, %q; want %q, %q", hostname, name, tt.wantHostname, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestMergeConfigs_RunHostname(t *testing.T) {
+	base := &ImageConfig{Run: RunSettings{Hostname: "base"}}
+
+	if got := mergeConfigs(base, &ImageConfig{}).Run.Hostname; got != "base" {
+		t.Errorf("expected base hostname to be kept, got %q", got)
+	}
+	if got := mergeConfigs(base, &ImageConfig{Run: RunSettings{Hostname: "user"}}).Run.Hostname; got != "user" {
+		t.Errorf("expected user hostname to win, got %q", got)
+	}
+}
+
+func TestValidateHostname(t *testing.T) {
+	tests := []struct {
+		hostname string
+		valid    bool
+	}{
+		{"", true},
+		{"dev-box", true},
+		{"dev-box.example.com", true},
+		{"1box", true},
+		{"-box", false},
+		{"box-", false},
+		{"dev_box", false},
+		{"dev box", false},
+		{"box;rm -rf ~", false},
+		{"dev..box", false},
+		{strings.Repeat("a", 64), false},
+		{strings.Repeat(strings.Repeat("a", 60)+".", 5), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			err := validateHostname("--hostname", tt.hostname)
+			if tt.valid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("expected %q to be rejected", tt.hostname)
+			}
+		})
+	}
+}
+
+func TestRun_InvalidHostname(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	project := t.TempDir()
+
+	err := Run(Config{Tool: "claude", DockerfileOnly: true, Project: project, Hostname: "dev box"})
+	if err == nil || !strings.Contains(err.Error(), "--hostname must be a valid hostname") {
+		t.Errorf("expected an invalid --hostname error, got %v", err)
+	}
+
+	os.WriteFile(filepath.Join(project, ".agent-en-place.yaml"), []byte("run:\n  hostname: dev_box\n"), 0644)
+	err = Run(Config{Tool: "claude", DockerfileOnly: true, Project: project})
+	if err == nil || !strings.Contains(err.Error(), "run.hostname must be a valid hostname") {
+		t.Errorf("expected an invalid run.hostname error, got %v", err)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := map[string]string{
+		"claude":     "claude",
+		"dev-box.io": "dev-box.io",
+		"my agent":   "'my agent'",
+		"it's":       `'it'\''s'`,
+	}
+	for value, want := range tests {
+		if got := shellQuote(value); got != want {
+			t.Errorf("shellQuote(%q) = %s, want %s", value, got, want)
+		}
+	}
+}
+
+func TestMergeConfigs_DefaultAgent(t *testing.T) {
+	base := &ImageConfig{DefaultAgent: "claude"}
+
+	if got := mergeConfigs(base, &ImageConfig{}).DefaultAgent; got != "claude" {
+		t.Errorf("expected base default agent to be kept, got %q", got)
+	}
+	if got := mergeConfigs(base, &ImageConfig{DefaultAgent: "codex"}).DefaultAgent; got != "codex" {
+		t.Errorf("expected user default agent to win, got %q", got)
+	}
+}
+
+func TestResolveDefaultAgent(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+
+	t.Setenv("AGENT_EN_PLACE_DEFAULT_AGENT", "")
+	if _, err := resolveDefaultAgent(imgCfg); err == nil || !strings.Contains(err.Error(), "no agent given") {
+		t.Errorf("expected error without a default agent, got %v", err)
+	}
+
+	imgCfg.DefaultAgent = "codex"
+	if got, err := resolveDefaultAgent(imgCfg); err != nil || got != "codex" {
+		t.Errorf("expected defaultAgent from config, got %q (%v)", got, err)
+	}
+
+	t.Setenv("AGENT_EN_PLACE_DEFAULT_AGENT", "Gemini")
+	if got, err := resolveDefaultAgent(imgCfg); err != nil || got != "gemini" {
+		t.Errorf("expected env var to take priority, got %q (%v)", got, err)
+	}
+}
+
+func TestRun_DefaultAgent(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "config.yaml"), []byte("defaultAgent: codex\n"), 0644)
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("AGENT_EN_PLACE_DEFAULT_AGENT", "")
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	runErr := Run(Config{DockerfileOnly: true, Project: dir, ConfigPath: filepath.Join(dir, "config.yaml")})
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	if runErr != nil {
+		t.Fatalf("unexpected error: %v", runErr)
+	}
+	if !strings.Contains(string(out), `CMD ["codex",`) {
+		t.Errorf("expected the default agent to be built, got:\n%s", out)
+	}
+}
+
+func TestGetLabelName(t *testing.T) {
+	tests := []struct {
+		tool string
+		want string
+	}{
+		{"node", "node"},
+		{"npm:@openai/codex", "codex"},
+		{"npm:opencode-ai", "opencode-ai"},
+		{"cargo:ripgrep", "ripgrep"},
+		{"go:github.com/golangci/golangci-lint/cmd/golangci-lint", "golangci-lint"},
+		{"ubi:BurntSushi/ripgrep[exe=rg]", "ripgrep"},
+		{"cargo:https://github.com/BurntSushi/ripgrep.git", "ripgrep"},
+		{"pipx:Black", "black"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.tool, func(t *testing.T) {
+			if got := getLabelName(tt.tool); got != tt.want {
+				t.Errorf("getLabelName(%q) = %q, want %q", tt.tool, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToolVersions_BackendPrefixedTools(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+	toolFile := &fileSpec{path: ".tool-versions", data: []byte("cargo:ripgrep 14.0.0\nnpm:prettier 3.0.0\nnode 20\n"), mode: 0644}
+
+	collection := collectToolSpecs(toolFile, nil, spec, imgCfg, "claude", collectOptions{})
+
+	var ripgrep *toolDescriptor
+	for i := range collection.specs {
+		if collection.specs[i].name == "cargo-ripgrep" {
+			ripgrep = &collection.specs[i]
+		}
+	}
+	if ripgrep == nil {
+		t.Fatalf("expected cargo:ripgrep in specs, got %+v", collection.specs)
+	}
+	if ripgrep.version != "14.0.0" || ripgrep.labelName != "ripgrep" {
+		t.Errorf("unexpected ripgrep spec: %+v", *ripgrep)
+	}
+
+	imageName := buildImageName(collection.specs)
+	if !strings.Contains(imageName, ":cargo-ripgrep-14.0.0-npm-prettier-3.0.0-node-20") {
+		t.Errorf("expected backend tools in image tag, got %s", imageName)
+	}
+
+	labels := buildToolLabels(collection.specs)
+	for _, want := range []string{
+		`LABEL com.mheap.agent-en-place.ripgrep="14.0.0"`,
+		`LABEL com.mheap.agent-en-place.prettier="3.0.0"`,
+	} {
+		if !strings.Contains(labels, want) {
+			t.Errorf("expected %s in labels, got:\n%s", want, labels)
+		}
+	}
+
+	// .tool-versions is copied into the image verbatim, so mise installs the
+	// tool with its backend prefix intact; mise.agent.toml must not repeat it
+	data, err := buildAgentMiseConfig(nil, collection, spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(string(data), "ripgrep") {
+		t.Errorf("expected ripgrep to be installed from .tool-versions, got mise.agent.toml:\n%s", data)
+	}
+}
+
+func TestParsePlatforms(t *testing.T) {
+	got, err := parsePlatforms(" linux/amd64, linux/arm64/v8 ,linux/amd64,")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"linux/amd64", "linux/arm64/v8"}, got); diff != "" {
+		t.Errorf("parsePlatforms() mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, value := range []string{"linux", "/amd64", "linux/", "linux/arm/v7/extra"} {
+		if _, err := parsePlatforms(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
+
+func TestBuildImages_MultiPlatform(t *testing.T) {
+	imageName := "mheap/agent-en-place:node-20"
+	targets := platformTargets(imageName, []string{"linux/amd64", "linux/arm64"})
+	cli := &fakeDockerClient{images: []image.Summary{
+		{RepoTags: []string{imageName + "-linux-amd64"}},
+	}}
+	newContext := func() (io.Reader, error) { return strings.NewReader(""), nil }
+
+	if err := buildImages(context.Background(), cli, targets, buildOptions{}, newContext); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cli.builds) != 1 {
+		t.Fatalf("expected only the missing platform to be built, got %d builds", len(cli.builds))
+	}
+	opts := cli.builds[0]
+	if diff := cmp.Diff([]string{imageName + "-linux-arm64"}, opts.Tags); diff != "" {
+		t.Errorf("unexpected tags (-want +got):\n%s", diff)
+	}
+	if len(opts.Platforms) != 1 || opts.Platforms[0].OS != "linux" || opts.Platforms[0].Architecture != "arm64" {
+		t.Errorf("unexpected platforms: %+v", opts.Platforms)
+	}
+	if got := opts.Labels[labelPrefix+"platform"]; got != "linux/arm64" {
+		t.Errorf("expected platform label linux/arm64, got %q", got)
+	}
+
+	cli.builds = nil
+	if err := buildImages(context.Background(), cli, targets, buildOptions{rebuild: true}, newContext); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cli.builds) != 2 {
+		t.Errorf("expected rebuild to build every platform, got %d builds", len(cli.builds))
+	}
+
+	cli.buildErr = errors.New("daemon does not support platform")
+	err := buildImages(context.Background(), cli, targets, buildOptions{rebuild: true}, newContext)
+	if err == nil || !strings.Contains(err.Error(), "linux/amd64") {
+		t.Errorf("expected error naming the platform, got %v", err)
+	}
+}
+
+func TestBuildImages_NativePlatform(t *testing.T) {
+	cli := &fakeDockerClient{}
+	targets := platformTargets("mheap/agent-en-place:node-20", nil)
+	newContext := func() (io.Reader, error) { return strings.NewReader(""), nil }
+
+	if err := buildImages(context.Background(), cli, targets, buildOptions{}, newContext); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cli.builds) != 1 {
+		t.Fatalf("expected one build, got %d", len(cli.builds))
+	}
+	if opts := cli.builds[0]; len(opts.Platforms) != 0 || opts.Labels != nil || opts.Tags[0] != "mheap/agent-en-place:node-20" {
+		t.Errorf("expected a plain native build, got %+v", opts)
+	}
+}
+
+func TestMergeConfigs_TagArch(t *testing.T) {
+	enabled, disabled := true, false
+
+	result := mergeConfigs(&ImageConfig{}, &ImageConfig{Image: ImageSettings{TagArch: &enabled}})
+	if !result.Image.TagHostArch() {
+		t.Error("expected tagArch to be enabled")
+	}
+	result = mergeConfigs(result, &ImageConfig{})
+	if !result.Image.TagHostArch() {
+		t.Error("expected tagArch to stay enabled when a config leaves it unset")
+	}
+	result = mergeConfigs(result, &ImageConfig{Image: ImageSettings{TagArch: &disabled}})
+	if result.Image.TagHostArch() {
+		t.Error("expected tagArch: false to override an earlier true")
+	}
+}
+
+func TestMergeConfigs_BoolsCanBeTurnedOff(t *testing.T) {
+	tests := []struct {
+		name    string
+		enable  string
+		disable string
+		get     func(*ImageConfig) bool
+	}{
+		{"image.excludeAgentFromTag", "image:\n  excludeAgentFromTag: true\n", "image:\n  excludeAgentFromTag: false\n", func(c *ImageConfig) bool { return c.Image.OmitAgentFromTag() }},
+		{"image.loginShell", "image:\n  loginShell: true\n", "image:\n  loginShell: false\n", func(c *ImageConfig) bool { return c.Image.UseLoginShell() }},
+		{"mise.inheritUserEnv", "mise:\n  inheritUserEnv: true\n", "mise:\n  inheritUserEnv: false\n", func(c *ImageConfig) bool { return c.Mise.InheritProjectEnv() }},
+		{"detection.cache", "detection:\n  cache: true\n", "detection:\n  cache: false\n", func(c *ImageConfig) bool { return c.Detection.CacheEnabled() }},
+		{"image_customizations.strict", "image_customizations:\n  strict: true\n", "image_customizations:\n  strict: false\n", func(c *ImageConfig) bool { return c.ImageCustomizations.FailOnMissingTarget() }},
+		{"tools.specifiedOnly", "tools:\n  specifiedOnly: true\n", "tools:\n  specifiedOnly: false\n", func(c *ImageConfig) bool { return c.ToolsSpecifiedOnly() }},
+	}
+	parse := func(t *testing.T, data string) *ImageConfig {
+		t.Helper()
+		cfg, err := loadDefaultConfig([]byte(data))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return cfg
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := mergeConfigs(&ImageConfig{}, parse(t, tt.enable))
+			if !tt.get(result) {
+				t.Fatalf("expected %s to be enabled", tt.name)
+			}
+			result = mergeConfigs(result, &ImageConfig{})
+			if !tt.get(result) {
+				t.Errorf("expected %s to stay enabled when a config leaves it unset", tt.name)
+			}
+			result = mergeConfigs(result, parse(t, tt.disable))
+			if tt.get(result) {
+				t.Errorf("expected %s: false to override an earlier true", tt.name)
+			}
+		})
+	}
+}
+
+func TestBuildPlatforms_TagArch(t *testing.T) {
+	name := "mheap/agent-en-place:node-20"
+
+	targets := platformTargets(name, buildPlatforms(nil, true))
+	want := name + "-linux-" + runtime.GOARCH
+	if len(targets) != 1 || targets[0].tag != want || targets[0].platform != "linux/"+runtime.GOARCH {
+		t.Errorf("expected a single %s target for the host, got %+v", want, targets)
+	}
+
+	if targets := platformTargets(name, buildPlatforms(nil, false)); targets[0].tag != name {
+		t.Errorf("expected no arch suffix without tagArch, got %s", targets[0].tag)
+	}
+
+	// Explicit platforms are left alone
+	platforms := buildPlatforms([]string{"linux/arm64", "linux/amd64"}, true)
+	if diff := cmp.Diff([]string{"linux/arm64", "linux/amd64"}, platforms); diff != "" {
+		t.Errorf("platforms mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestDockerfile_Claude_LoginShell(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	enabled := true
+	imgCfg.Image.LoginShell = &enabled
+	spec := getToolSpec(t, imgCfg, "claude")
+	collection := buildDefaultCollection("claude", spec)
+
+	got := buildDockerfile(false, false, collection, spec, imgCfg, "claude", nil)
+
+	if err := validateDockerfile(got); err != nil {
+		t.Errorf("expected valid Dockerfile, got: %v", err)
+	}
+	profile := `RUN printf 'export PATH="/home/agent/.local/share/mise/shims:/home/agent/.local/bin:$PATH"\n' > /etc/profile.d/agent-en-place.sh`
+	profileIdx := strings.Index(got, profile)
+	if profileIdx == -1 {
+		t.Errorf("expected mise shims on PATH via profile.d, got:\n%s", got)
+	}
+	if userIdx := strings.Index(got, "USER agent\n"); profileIdx > userIdx {
+		t.Errorf("expected profile.d script to be written as root before USER agent")
+	}
+	if !strings.Contains(got, `ENTRYPOINT ["/bin/bash", "-lc", "exec /usr/local/bin/agent-entrypoint \"$@\"", "agent-entrypoint"]`) {
+		t.Errorf("expected login shell entrypoint, got:\n%s", got)
+	}
+
+	goldenTest(t, "dockerfile_claude_login_shell.golden", got)
+}
+
+func TestConstraintFloor(t *testing.T) {
+	tests := []struct {
+		constraint string
+		want       string
+		wantOK     bool
+	}{
+		{"8.3", "8.3", true},
+		{"^8.3", "8.3", true},
+		{"~8.2.1", "8.2.1", true},
+		{">=8.1 <9.0", "8.1", true},
+		{">=8.1,<9.0", "8.1", true},
+		{"8.2.*", "8.2", true},
+		{"^8.1 || ^8.2", "8.1", true},
+		{"<9.0", "", false},
+		{"*", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.constraint, func(t *testing.T) {
+			got, ok := constraintFloor(tt.constraint)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("constraintFloor(%q) = %q, %v; want %q, %v", tt.constraint, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestIdiomaticFiles_Php(t *testing.T) {
+	tests := []struct {
+		name        string
+		files       map[string]string
+		wantVersion string
+		wantPath    string
+	}{
+		{
+			name:        "php-version takes precedence",
+			files:       map[string]string{".php-version": "8.2\n", "composer.json": `{"require": {"php": "^8.3"}}`},
+			wantVersion: "8.2",
+			wantPath:    ".php-version",
+		},
+		{
+			name:        "composer platform override",
+			files:       map[string]string{"composer.json": `{"require": {"php": "^8.1"}, "config": {"platform": {"php": "8.3.4"}}}`},
+			wantVersion: "8.3.4",
+			wantPath:    "composer.json",
+		},
+		{
+			name:        "composer range constraint resolves to floor",
+			files:       map[string]string{"composer.json": `{"require": {"php": ">=8.1 <9.0", "laravel/framework": "^11.0"}}`},
+			wantVersion: "8.1",
+			wantPath:    "composer.json",
+		},
+		{
+			name:  "composer without php",
+			files: map[string]string{"composer.json": `{"require": {"laravel/framework": "^11.0"}}`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			oldWd, _ := os.Getwd()
+			defer os.Chdir(oldWd)
+			os.Chdir(tmpDir)
+
+			for name, content := range tt.files {
+				if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+					t.Fatalf("failed to write %s: %v", name, err)
+				}
+			}
+
+			var php *idiomaticInfo
+			infos := parseIdiomaticFiles(collectOptions{})
+			for i := range infos {
+				if infos[i].tool == "php" {
+					php = &infos[i]
+				}
+			}
+
+			if tt.wantPath == "" {
+				if php != nil {
+					t.Errorf("expected no php detection, got %+v", *php)
+				}
+				return
+			}
+			if php == nil {
+				t.Fatal("expected php to be detected")
+			}
+			if php.version != tt.wantVersion || php.path != tt.wantPath {
+				t.Errorf("expected php %s from %s, got %s from %s", tt.wantVersion, tt.wantPath, php.version, php.path)
+			}
+		})
+	}
+}
+
+func TestDockerfile_Claude_BashrcExtra(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	imgCfg.Image.BashrcExtra = []string{
+		`alias ll="ls -la"`,
+		`export PS1='\''\w $ '\''`,
+		`export PROGRESS="100%"`,
+	}
+	spec := getToolSpec(t, imgCfg, "claude")
+	collection := buildDefaultCollection("claude", spec)
+
+	got := buildDockerfile(false, false, collection, spec, imgCfg, "claude", nil)
+	if err := validateDockerfile(got); err != nil {
+		t.Errorf("expected valid Dockerfile, got: %v", err)
+	}
+	goldenTest(t, "dockerfile_claude_bashrc_extra.golden", got)
+
+	// Login shells get the extra lines in the profile.d script instead
+	enabled := true
+	imgCfg.Image.LoginShell = &enabled
+	got = buildDockerfile(false, false, collection, spec, imgCfg, "claude", nil)
+	want := `$PATH"\nalias ll="ls -la"\n`
+	if !strings.Contains(got, want+`export PS1='\''\\w $ '\''\nexport PROGRESS="100%%"\n' > /etc/profile.d/agent-en-place.sh`) {
+		t.Errorf("expected extra lines in the profile.d script, got:\n%s", got)
+	}
+}
+
+func TestValidateBashrcExtra(t *testing.T) {
+	if err := validateBashrcExtra([]string{`alias gs="git status"`, `echo '\''quoted'\''`}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := validateBashrcExtra([]string{"export A=1", "alias x='ls'"}); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected unescaped quote error on line 2, got %v", err)
+	}
+	if err := validateBashrcExtra([]string{"a\nb"}); err == nil {
+		t.Error("expected error for an embedded newline")
+	}
+}
+
+func TestDockerfile_Claude_AptOptions(t *testing.T) {
+	tests := []struct {
+		name              string
+		installRecommends bool
+		aptClean          bool
+		golden            string
+	}{
+		{"recommends", true, true, "dockerfile_claude_install_recommends.golden"},
+		{"no clean", false, false, "dockerfile_claude_no_apt_clean.golden"},
+		{"recommends no clean", true, false, "dockerfile_claude_install_recommends_no_apt_clean.golden"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imgCfg := loadTestConfig(t)
+			imgCfg.Image.InstallRecommends = &tt.installRecommends
+			imgCfg.Image.AptClean = &tt.aptClean
+			spec := getToolSpec(t, imgCfg, "claude")
+			collection := buildDefaultCollection("claude", spec)
+
+			got := buildDockerfile(false, false, collection, spec, imgCfg, "claude", nil)
+			if err := validateDockerfile(got); err != nil {
+				t.Errorf("expected valid Dockerfile, got: %v", err)
+			}
+			goldenTest(t, tt.golden, got)
+		})
+	}
+}
+
+func TestMergeConfigs_AptOptions(t *testing.T) {
+	enabled, disabled := true, false
+	base := &ImageConfig{}
+
+	result := mergeConfigs(base, &ImageConfig{Image: ImageSettings{InstallRecommends: &enabled}})
+	if !result.Image.InstallRecommendedPackages() || !result.Image.CleanAptLists() {
+		t.Errorf("expected recommends enabled and apt cleanup kept by default, got %+v", result.Image)
+	}
+
+	result = mergeConfigs(result, &ImageConfig{Image: ImageSettings{AptClean: &disabled}})
+	if !result.Image.InstallRecommendedPackages() {
+		t.Error("expected installRecommends to stay enabled")
+	}
+	if result.Image.CleanAptLists() {
+		t.Error("expected aptClean: false to disable the cleanup")
+	}
+
+	// A later config can turn off what an earlier one enabled
+	result = mergeConfigs(result, &ImageConfig{Image: ImageSettings{InstallRecommends: &disabled}})
+	if result.Image.InstallRecommendedPackages() {
+		t.Error("expected installRecommends: false to override an earlier true")
+	}
+}
+
+func TestDockerfile_Claude_DefaultCommand(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+	collection := buildDefaultCollection("claude", spec)
+
+	got := buildDockerfile(false, false, collection, spec, imgCfg, "claude", nil)
+	if !strings.HasSuffix(got, "CMD [\"claude\", \"--dangerously-skip-permissions\"]\n") {
+		t.Errorf("expected CMD derived from the agent command, got:\n%s", got)
+	}
+
+	imgCfg.Image.DefaultCommand = "claude --continue"
+	got = buildDockerfile(false, false, collection, spec, imgCfg, "claude", nil)
+	goldenTest(t, "dockerfile_claude_default_command.golden", got)
+}
+
+func TestRefreshBaseImages(t *testing.T) {
+	captureLog(t, "text")
+	imageName := "mheap/agent-en-place:node-20"
+	base := "debian:12-slim"
+	targets := platformTargets(imageName, nil)
+	newContext := func() (io.Reader, error) { return strings.NewReader(""), nil }
+
+	t.Run("new base triggers a rebuild after the pull", func(t *testing.T) {
+		cli := &fakeDockerClient{
+			images: []image.Summary{
+				{RepoTags: []string{imageName}},
+				{RepoTags: []string{base}, RepoDigests: []string{"debian@sha256:old"}},
+			},
+			pulls: map[string]image.Summary{
+				base: {RepoTags: []string{base}, RepoDigests: []string{"debian@sha256:new"}},
+			},
+		}
+
+		changed, err := refreshBaseImages(context.Background(), cli, base, targets)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !changed {
+			t.Fatal("expected base image change to be detected")
+		}
+		if err := buildImages(context.Background(), cli, targets, buildOptions{rebuild: changed}, newContext); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if diff := cmp.Diff([]string{"pull " + base, "build " + imageName}, cli.calls); diff != "" {
+			t.Errorf("unexpected call order (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("unchanged base keeps the existing image", func(t *testing.T) {
+		current := image.Summary{RepoTags: []string{base}, RepoDigests: []string{"debian@sha256:old"}}
+		cli := &fakeDockerClient{
+			images: []image.Summary{{RepoTags: []string{imageName}}, current},
+			pulls:  map[string]image.Summary{base: current},
+		}
+
+		changed, err := refreshBaseImages(context.Background(), cli, base, targets)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if changed {
+			t.Error("expected base image to be reported unchanged")
+		}
+		if err := buildImages(context.Background(), cli, targets, buildOptions{rebuild: changed}, newContext); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if diff := cmp.Diff([]string{"pull " + base}, cli.calls); diff != "" {
+			t.Errorf("unexpected calls (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestBuildAgentMiseConfig_SdkmanrcCandidates(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+
+	sdkmanrc := "# Enable auto-env through the sdkman_auto_env config\njava=17.0.2\ngradle=8.5\nkotlin=1.9.22\nvisualvm=2.1\n"
+	if err := os.WriteFile(".sdkmanrc", []byte(sdkmanrc), 0644); err != nil {
+		t.Fatalf("failed to write .sdkmanrc: %v", err)
+	}
+
+	infos := parseIdiomaticFiles(collectOptions{})
+	got := make(map[string]string)
+	for _, info := range infos {
+		got[info.tool] = info.version
+	}
+	want := map[string]string{"java": "17.0.2", "gradle": "8.5", "kotlin": "1.9.22"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected tools from .sdkmanrc (-want +got):\n%s", diff)
+	}
+
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+	collection := collectToolSpecs(nil, nil, spec, imgCfg, "claude", collectOptions{})
+	data, err := buildAgentMiseConfig(nil, collection, spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Golden files are resolved relative to the package directory
+	os.Chdir(oldWd)
+	goldenTest(t, "mise_agent_claude_sdkmanrc.golden", string(data))
+}
+
+func TestIdiomaticFiles_JavaVersionBeatsSdkmanrc(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+
+	os.WriteFile(".java-version", []byte("21\n"), 0644)
+	os.WriteFile(".sdkmanrc", []byte("java=17\ngradle=8.5\n"), 0644)
+
+	got := make(map[string]string)
+	for _, info := range parseIdiomaticFiles(collectOptions{}) {
+		got[info.tool] = info.version
+	}
+	want := map[string]string{"java": "21", "gradle": "8.5"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected tools (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseBuildArgs(t *testing.T) {
+	t.Setenv("FROM_ENV", "env-value")
+
+	got, err := parseBuildArgs([]string{"MISE_VERSION=2024.1.0", "EMPTY=", "FROM_ENV", "EQUALS=a=b"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]string{"MISE_VERSION": "2024.1.0", "EMPTY": "", "FROM_ENV": "env-value", "EQUALS": "a=b"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parseBuildArgs() mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, value := range []string{"=value", "NOT_SET_ANYWHERE_1730"} {
+		if _, err := parseBuildArgs([]string{value}); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
+
+func TestBuildArgs_FlagsOverrideConfig(t *testing.T) {
+	got := mergeBuildArgs(map[string]string{"A": "config", "B": "config"}, map[string]string{"B": "flag", "C": "flag"})
+	want := map[string]string{"A": "config", "B": "flag", "C": "flag"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mergeBuildArgs() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestDockerfile_BuildArgs(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	imgCfg.Image.Base = "debian:${DEBIAN_TAG}"
+	imgCfg.Mise.Install = []string{"curl https://mise.run | MISE_VERSION=$MISE_VERSION sh"}
+	imgCfg.Image.BuildArgs = map[string]string{"DEBIAN_TAG": "12-slim", "MISE_VERSION": "v2024.1.0", "UNUSED": "secret"}
+	spec := getToolSpec(t, imgCfg, "claude")
+	collection := buildDefaultCollection("claude", spec)
+
+	got := buildDockerfile(false, false, collection, spec, imgCfg, "claude", nil)
+
+	if !strings.HasPrefix(got, "ARG DEBIAN_TAG\nFROM debian:${DEBIAN_TAG}\nARG MISE_VERSION\n") {
+		t.Errorf("expected ARG declarations around FROM, got:\n%s", got)
+	}
+	if strings.Contains(got, "UNUSED") || strings.Contains(got, "secret") {
+		t.Errorf("expected unreferenced build args to stay out of the Dockerfile, got:\n%s", got)
+	}
+	if err := validateDockerfile(got); err != nil {
+		t.Errorf("expected valid Dockerfile, got: %v", err)
+	}
+
+	// Build args never affect the image tag or labels
+	if name := buildImageName(collection.specs); strings.Contains(name, "2024") {
+		t.Errorf("expected build args to stay out of the image tag, got %s", name)
+	}
+}
+
+func TestGitLabels(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	if labels := gitLabels(dir); labels != nil {
+		t.Errorf("expected no labels outside a git repo, got %v", labels)
+	}
+
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q")
+	os.WriteFile(filepath.Join(dir, ".tool-versions"), []byte("node 20\n"), 0644)
+	git("add", ".")
+	git("commit", "-q", "-m", "initial")
+	sha := git("rev-parse", "HEAD")
+
+	want := map[string]string{labelPrefix + "git.sha": sha, labelPrefix + "git.dirty": "false"}
+	if diff := cmp.Diff(want, gitLabels(dir)); diff != "" {
+		t.Errorf("unexpected labels for a clean tree (-want +got):\n%s", diff)
+	}
+
+	os.WriteFile(filepath.Join(dir, ".tool-versions"), []byte("node 22\n"), 0644)
+	if got := gitLabels(dir)[labelPrefix+"git.dirty"]; got != "true" {
+		t.Errorf("expected dirty tree to be labelled, got %q", got)
+	}
+}
+
+func TestBuildImages_Labels(t *testing.T) {
+	cli := &fakeDockerClient{}
+	targets := platformTargets("mheap/agent-en-place:node-20", []string{"linux/arm64"})
+	newContext := func() (io.Reader, error) { return strings.NewReader(""), nil }
+
+	opts := buildOptions{labels: map[string]string{labelPrefix + "git.sha": "abc123", labelPrefix + "git.dirty": "true"}}
+	if err := buildImages(context.Background(), cli, targets, opts, newContext); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]string{
+		labelPrefix + "platform":  "linux/arm64",
+		labelPrefix + "git.sha":   "abc123",
+		labelPrefix + "git.dirty": "true",
+	}
+	if diff := cmp.Diff(want, cli.builds[0].Labels); diff != "" {
+		t.Errorf("unexpected labels (-want +got):\n%s", diff)
+	}
+	if strings.Contains(cli.builds[0].Tags[0], "abc123") {
+		t.Errorf("expected git labels to stay out of the tag, got %s", cli.builds[0].Tags[0])
+	}
+}
+
+func TestBuildInputsHash_CoversBuildContext(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+	spec.ConfigDir = ".claude"
+	spec.SeedFiles = []string{"settings.json"}
+	collection := buildDefaultCollection("claude", spec)
+	os.MkdirAll(filepath.Join(home, ".claude"), 0755)
+	seed := filepath.Join(home, ".claude", "settings.json")
+	inputsHash := func() string {
+		t.Helper()
+		hash, err := buildInputsHash(nil, nil, collection, spec, imgCfg, "claude", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return hash
+	}
+
+	os.WriteFile(seed, []byte(`{"theme": "dark"}`), 0644)
+	base := inputsHash()
+	if again := inputsHash(); again != base {
+		t.Fatalf("expected the same inputs to give the same hash, got %s and %s", base, again)
+	}
+
+	os.WriteFile(seed, []byte(`{"theme": "light"}`), 0644)
+	seeded := inputsHash()
+	if seeded == base {
+		t.Error("expected changing a seed file to change the hash")
+	}
+
+	oldScript := agentEntrypointScript
+	t.Cleanup(func() { agentEntrypointScript = oldScript })
+	agentEntrypointScript = append(slices.Clone(oldScript), []byte("# changed\n")...)
+	if inputsHash() == seeded {
+		t.Error("expected changing the entrypoint to change the hash")
+	}
+}
+
+func TestAgentImageName_IncludesInputsHash(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+	collection := buildDefaultCollection("claude", spec)
+	imageName := func(toolFile *fileSpec) (string, string) {
+		t.Helper()
+		name, hash, err := agentImageName(toolFile, nil, collection, spec, imgCfg, "claude", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return name, hash
+	}
+
+	first, firstHash := imageName(&fileSpec{path: ".tool-versions", data: []byte("nodejs 20\n")})
+	second, _ := imageName(&fileSpec{path: ".tool-versions", data: []byte("# pinned\nnodejs 20\n")})
+	base := buildImageName(imageTagSpecs(collection.specs, spec, imgCfg))
+	if want := base + "-" + firstHash[:inputsTagLength]; first != want {
+		t.Errorf("expected %s, got %s", want, first)
+	}
+	if first == second {
+		t.Errorf("expected projects with different inputs to get different tags, both got %s", first)
+	}
+	if !strings.HasPrefix(second, base+"-") {
+		t.Errorf("expected %s to start with the tool tag %s", second, base)
+	}
+}
+
+func TestBuildImages_HashInputs(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	captureLog(t, "text")
+
+	imgCfg := loadTestConfig(t)
+	imgCfg.Build.HashInputs = []string{"package.json"}
+	spec := getToolSpec(t, imgCfg, "claude")
+	collection := collectToolSpecs(nil, nil, spec, imgCfg, "claude", collectOptions{})
+	inputsHash := func() string {
+		t.Helper()
+		hash, err := buildInputsHash(nil, nil, collection, spec, imgCfg, "claude", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return hash
+	}
+
+	missing := inputsHash()
+	if err := os.WriteFile("package.json", []byte(`{"dependencies": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	built := inputsHash()
+	if built == missing {
+		t.Error("expected creating a hash input to change the hash")
+	}
+
+	imageName := "mheap/agent-en-place:node-20"
+	cli := &fakeDockerClient{images: []image.Summary{
+		{RepoTags: []string{imageName}, Labels: map[string]string{inputsLabel: built}},
+	}}
+	targets := platformTargets(imageName, nil)
+	newContext := func() (io.Reader, error) { return strings.NewReader(""), nil }
+
+	if err := buildImages(context.Background(), cli, targets, buildOptions{inputsHash: inputsHash()}, newContext); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cli.builds) != 0 {
+		t.Fatalf("expected an image with unchanged inputs to be reused, got %d builds", len(cli.builds))
+	}
+
+	if err := os.WriteFile("package.json", []byte(`{"dependencies": {"left-pad": "1.3.0"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := buildOptions{inputsHash: inputsHash(), labels: map[string]string{inputsLabel: inputsHash()}}
+	if err := buildImages(context.Background(), cli, targets, opts, newContext); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cli.builds) != 1 {
+		t.Fatalf("expected touching a hash input to force a rebuild, got %d builds", len(cli.builds))
+	}
+	if got := cli.builds[0].Labels[inputsLabel]; got != opts.inputsHash {
+		t.Errorf("expected the rebuilt image to record the new inputs hash, got %q", got)
+	}
+}
+
+func TestBuildImages_AliasTag(t *testing.T) {
+	imageName := "mheap/agent-en-place:node-20-npm-anthropic-ai-claude-code-latest"
+	cli := &fakeDockerClient{}
+	targets := withAliasTag(platformTargets(imageName, []string{"linux/arm64"}), imageName, aliasTagName("{project}-{agent}", "claude", "My_Project"))
+	newContext := func() (io.Reader, error) { return strings.NewReader(""), nil }
+
+	if err := buildImages(context.Background(), cli, targets, buildOptions{}, newContext); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cli.builds) != 1 {
+		t.Fatalf("expected 1 build, got %d", len(cli.builds))
+	}
+	want := []string{imageName + "-linux-arm64", "mheap/agent-en-place:my-project-claude-linux-arm64"}
+	if diff := cmp.Diff(want, cli.builds[0].Tags); diff != "" {
+		t.Errorf("unexpected build tags (-want +got):\n%s", diff)
+	}
+
+	// An existing image isn't rebuilt but the alias is pointed back at it
+	cli = &fakeDockerClient{images: []image.Summary{{RepoTags: []string{imageName + "-linux-arm64"}}}}
+	if err := buildImages(context.Background(), cli, targets, buildOptions{}, newContext); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wantCalls := []string{"tag " + want[0] + " " + want[1]}
+	if diff := cmp.Diff(wantCalls, cli.calls); diff != "" {
+		t.Errorf("unexpected calls (-want +got):\n%s", diff)
+	}
+}
+
+func TestValidateAliasTag(t *testing.T) {
+	if err := validateAliasTag("{agent}-latest"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := validateAliasTag("{user}-latest"); err == nil || !strings.Contains(err.Error(), "unknown placeholder {user}") {
+		t.Errorf("expected an unknown placeholder error, got %v", err)
+	}
+	if err := validateAliasTag("!!!"); err == nil {
+		t.Error("expected an error for a pattern without valid tag characters")
+	}
+}
+
+func TestBuildImages_BuildArgs(t *testing.T) {
+	cli := &fakeDockerClient{}
+	targets := platformTargets("mheap/agent-en-place:node-20", nil)
+	newContext := func() (io.Reader, error) { return strings.NewReader(""), nil }
+
+	opts := buildOptions{buildArgs: map[string]string{"MISE_VERSION": "v2024.1.0", "HTTP_PROXY": "http://proxy:3128"}}
+	if err := buildImages(context.Background(), cli, targets, opts, newContext); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cli.builds) != 1 {
+		t.Fatalf("expected one build, got %d", len(cli.builds))
+	}
+	got := make(map[string]string)
+	for key, value := range cli.builds[0].BuildArgs {
+		got[key] = *value
+	}
+	if diff := cmp.Diff(opts.buildArgs, got); diff != "" {
+		t.Errorf("unexpected build args (-want +got):\n%s", diff)
+	}
+	if len(cli.builds[0].Labels) != 0 {
+		t.Errorf("expected no labels from build args, got %v", cli.builds[0].Labels)
+	}
+}
+
+func TestBuildImages_BuildNetwork(t *testing.T) {
+	var cli dockerClient = &fakeDockerClient{}
+	targets := platformTargets("mheap/agent-en-place:node-20", nil)
+	newContext := func() (io.Reader, error) { return strings.NewReader(""), nil }
+
+	if err := buildImages(context.Background(), cli, targets, buildOptions{network: "host"}, newContext); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := buildImages(context.Background(), cli, targets, buildOptions{rebuild: true}, newContext); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	builds := cli.(*fakeDockerClient).builds
+	if len(builds) != 2 {
+		t.Fatalf("expected two builds, got %d", len(builds))
+	}
+	if builds[0].NetworkMode != "host" {
+		t.Errorf("expected the build network to reach the build, got %q", builds[0].NetworkMode)
+	}
+	if builds[1].NetworkMode != "" {
+		t.Errorf("expected the daemon default without a build network, got %q", builds[1].NetworkMode)
+	}
+}
+
+func TestBuildImages_NoCache(t *testing.T) {
+	imageName := "mheap/agent-en-place:node-20"
+	cli := &fakeDockerClient{images: []image.Summary{{RepoTags: []string{imageName}}}}
+	targets := platformTargets(imageName, nil)
+	newContext := func() (io.Reader, error) { return strings.NewReader(""), nil }
+
+	if err := buildImages(context.Background(), cli, targets, buildOptions{}, newContext); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cli.builds) != 0 {
+		t.Fatalf("expected the existing image to be reused, got %d builds", len(cli.builds))
+	}
+	if err := buildImages(context.Background(), cli, targets, buildOptions{noCache: true}, newContext); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cli.builds) != 1 {
+		t.Fatalf("expected --no-cache to build an existing image, got %d builds", len(cli.builds))
+	}
+	if !cli.builds[0].NoCache {
+		t.Error("expected NoCache to be set on the build")
+	}
+}
+
+func TestValidateBuildNetwork(t *testing.T) {
+	for _, mode := range []string{"default", "bridge", "host", "none", "corp-proxy_net.1"} {
+		if err := validateBuildNetwork(mode); err != nil {
+			t.Errorf("expected %q to be valid, got %v", mode, err)
+		}
+	}
+	for _, mode := range []string{"container:proxy", "-host", "my net"} {
+		if err := validateBuildNetwork(mode); err == nil {
+			t.Errorf("expected %q to be rejected", mode)
+		}
+	}
+}
+
+func TestRun_ProjectDir(t *testing.T) {
+	project := t.TempDir()
+	os.WriteFile(filepath.Join(project, ".python-version"), []byte("3.12.1\n"), 0644)
+	os.WriteFile(filepath.Join(project, ".tool-versions"), []byte("terraform 1.8.0\n"), 0644)
+
+	elsewhere := t.TempDir()
+	os.WriteFile(filepath.Join(elsewhere, ".python-version"), []byte("3.9.0\n"), 0644)
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(elsewhere)
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	runErr := Run(Config{Tool: "claude", DockerfileOnly: true, Project: project})
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	if runErr != nil {
+		t.Fatalf("unexpected error: %v", runErr)
+	}
+	for _, want := range []string{
+		`LABEL com.mheap.agent-en-place.python="3.12.1"`,
+		`LABEL com.mheap.agent-en-place.terraform="1.8.0"`,
+		"COPY .tool-versions .tool-versions",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("expected %q from the project dir, got:\n%s", want, out)
+		}
+	}
+	if strings.Contains(string(out), "3.9.0") {
+		t.Errorf("expected tools from the process cwd to be ignored, got:\n%s", out)
+	}
+
+	wd, _ := os.Getwd()
+	if resolved, _ := filepath.EvalSymlinks(elsewhere); wd != elsewhere && wd != resolved {
+		t.Errorf("expected working directory to be restored to %s, got %s", elsewhere, wd)
+	}
+}
+
+func TestAbsSecurityOpts(t *testing.T) {
+	dir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(dir)
+	os.WriteFile("profile.json", []byte("{}"), 0644)
+	wd, _ := os.Getwd()
+
+	got, err := absSecurityOpts([]string{"seccomp=./profile.json", "apparmor=docker-default", "no-new-privileges", "seccomp=unconfined"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{
+		"seccomp=" + filepath.Join(wd, "profile.json"),
+		"apparmor=docker-default",
+		"no-new-privileges",
+		"seccomp=unconfined",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected security options (-want +got):\n%s", diff)
+	}
+
+	if _, err := absSecurityOpts([]string{"seccomp=missing.json"}); err == nil || !strings.Contains(err.Error(), "missing.json") {
+		t.Errorf("expected missing profile error, got %v", err)
+	}
+	if _, err := absSecurityOpts([]string{"seccomp=" + dir}); err == nil {
+		t.Error("expected error for a directory profile")
+	}
+}
+
+func TestFixWorkdirPermsPlumbing(t *testing.T) {
+	run := runSpec{hostname: "claude"}
+	run.fixWorkdirPerms()
+	want := []string{"--hostname claude", "--user 0", "-e AGENT_EN_PLACE_FIX_WORKDIR_PERMS=1"}
+	if diff := cmp.Diff(want, run.printArgs()); diff != "" {
+		t.Errorf("unexpected run args (-want +got):\n%s", diff)
+	}
+
+	// The entrypoint must check the same variable the run command sets, and
+	// only act when started as root
+	script := string(agentEntrypointScript)
+	check := fmt.Sprintf(`[ "${%s:-}" = "1" ] && [ "$(id -u)" = "0" ]`, fixWorkdirPermsEnv)
+	if !strings.Contains(script, check) {
+		t.Errorf("expected entrypoint to check %s, got:\n%s", fixWorkdirPermsEnv, script)
+	}
+	for _, want := range []string{"stat -c %u /workdir", `exec setpriv --reuid="$uid" --regid="$gid" --clear-groups /bin/bash "$0" "$@"`, `exec su-exec "$uid:$gid" /bin/bash "$0" "$@"`} {
+		if !strings.Contains(script, want) {
+			t.Errorf("expected entrypoint to contain %q", want)
+		}
+	}
+	// The bind-mounted project belongs to the host and must never be re-owned
+	if strings.Contains(script, "chown -R agent:agent /workdir") || regexp.MustCompile(`chown[^\n]*/workdir`).MatchString(script) {
+		t.Errorf("expected entrypoint not to chown /workdir, got:\n%s", script)
+	}
+}
+
+func TestEntrypointChownTree_SkipsMounts(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not installed")
+	}
+	if _, err := exec.LookPath("find"); err != nil {
+		t.Skip("find not installed")
+	}
+	script := string(agentEntrypointScript)
+	start := strings.Index(script, "chown_tree() {")
+	end := strings.Index(script[start:], "\n}\n")
+	if start < 0 || end < 0 {
+		t.Fatalf("expected the entrypoint to define chown_tree, got:\n%s", script)
+	}
+	fn := script[start : start+end+3]
+
+	// /home/agent with the config dir, a config file and a --mount target
+	// bind-mounted from the host
+	tmp := t.TempDir()
+	home := filepath.Join(tmp, "home", "agent")
+	for _, dir := range []string{".cache", ".claude/projects", "my data"} {
+		os.MkdirAll(filepath.Join(home, dir), 0755)
+	}
+	os.WriteFile(filepath.Join(home, ".bashrc"), nil, 0644)
+	os.WriteFile(filepath.Join(home, ".claude.json"), nil, 0644)
+	os.WriteFile(filepath.Join(home, ".claude", "settings.json"), nil, 0644)
+	os.WriteFile(filepath.Join(home, "my data", "notes"), nil, 0644)
+	mountinfo := filepath.Join(tmp, "mountinfo")
+	os.WriteFile(mountinfo, []byte(strings.Join([]string{
+		"1 0 0:1 / / rw - overlay overlay rw",
+		"2 1 8:1 /src " + filepath.Join(home, ".claude") + " rw - ext4 /dev/sda1 rw",
+		"3 1 8:1 /src.json " + filepath.Join(home, ".claude.json") + " rw - ext4 /dev/sda1 rw",
+		"4 1 8:1 /data " + filepath.Join(home, `my\040data`) + " rw - ext4 /dev/sda1 rw",
+		"5 1 8:1 /workdir /workdir rw - ext4 /dev/sda1 rw",
+	}, "\n")+"\n"), 0644)
+
+	// Record what chown is called with rather than changing owners
+	bin := filepath.Join(tmp, "bin")
+	os.MkdirAll(bin, 0755)
+	log := filepath.Join(tmp, "chown.log")
+	os.WriteFile(filepath.Join(bin, "chown"), []byte("#!/bin/sh\nshift 2\nprintf '%s\\n' \"$@\" >> "+log+"\n"), 0755)
+
+	cmd := exec.Command("bash", "-c", fn+"\nchown_tree 1234:1234 \"$1\" \"$2\"", "bash", home, mountinfo)
+	cmd.Env = append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("chown_tree failed: %v\n%s", err, out)
+	}
+	data, _ := os.ReadFile(log)
+	var got []string
+	for _, path := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		rel, _ := filepath.Rel(home, path)
+		got = append(got, rel)
+	}
+	sort.Strings(got)
+	want := []string{".", ".bashrc", ".cache"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected chowned paths (-want +got):\n%s", diff)
+	}
+}
+
+func TestBuildSecurityArgs(t *testing.T) {
+	got := buildSecurityArgs([]string{"seccomp=/etc/profile.json", "apparmor=custom"})
+	want := []string{"--security-opt seccomp=/etc/profile.json", "--security-opt apparmor=custom"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected args (-want +got):\n%s", diff)
+	}
+	if got := buildSecurityArgs(nil); len(got) != 0 {
+		t.Errorf("expected no args, got %v", got)
+	}
+}
+
+func TestMergeConfigs_RunSecurityOpt(t *testing.T) {
+	base := &ImageConfig{Run: RunSettings{SecurityOpt: []string{"no-new-privileges"}}}
+
+	if got := mergeConfigs(base, &ImageConfig{}).Run.SecurityOpt; !slices.Equal(got, []string{"no-new-privileges"}) {
+		t.Errorf("expected base security options to be kept, got %v", got)
+	}
+	user := &ImageConfig{Run: RunSettings{SecurityOpt: []string{"apparmor=custom"}}}
+	if got := mergeConfigs(base, user).Run.SecurityOpt; !slices.Equal(got, []string{"apparmor=custom"}) {
+		t.Errorf("expected user security options to replace the base, got %v", got)
+	}
+}
+
+func TestLoadMergedConfig_SeccompRelativeToConfigFile(t *testing.T) {
+	xdgDir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", xdgDir)
+	os.WriteFile(filepath.Join(xdgDir, "agent-en-place.yaml"), []byte("run:\n  securityOpt:\n    - seccomp=profiles/agent.json\n    - seccomp=unconfined\n"), 0644)
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(t.TempDir())
+
+	imgCfg, err := LoadMergedConfig(defaultConfigYAML, LoadOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"seccomp=" + filepath.Join(xdgDir, "profiles", "agent.json"), "seccomp=unconfined"}
+	if diff := cmp.Diff(want, imgCfg.Run.SecurityOpt); diff != "" {
+		t.Errorf("security options mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestEnterProjectDir_Invalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, []byte(""), 0644)
+
+	if _, err := enterProjectDir(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error for missing directory")
+	}
+	if _, err := enterProjectDir(file); err == nil {
+		t.Error("expected error for a file")
+	}
+}
+
+func TestDockerfile_AptCleanupInSameLayer(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+	collection := buildDefaultCollection("claude", spec)
+
+	got := buildDockerfile(false, false, collection, spec, imgCfg, "claude", nil)
+
+	for _, line := range strings.Split(got, "\n") {
+		if !strings.Contains(line, "apt-get update") {
+			continue
+		}
+		if !strings.HasSuffix(line, "&& rm -rf /var/lib/apt/lists/*") {
+			t.Errorf("expected apt lists to be removed in the same RUN, got: %s", line)
+		}
+	}
+	if strings.Contains(got, "RUN rm -rf /var/lib/apt/lists/*") {
+		t.Errorf("expected no separate cleanup RUN, got:\n%s", got)
+	}
+}
+
+func TestDockerfile_Claude_MiseDataDir(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	imgCfg.Mise.DataDir = "/opt/mise/"
+	enabled := true
+	imgCfg.Image.LoginShell = &enabled
+	spec := getToolSpec(t, imgCfg, "claude")
+	collection := buildDefaultCollection("claude", spec)
+
+	got := buildDockerfile(false, false, collection, spec, imgCfg, "claude", nil)
+
+	if !strings.Contains(got, "ENV MISE_DATA_DIR=/opt/mise\n") {
+		t.Errorf("expected MISE_DATA_DIR to be set, got:\n%s", got)
+	}
+	if !strings.Contains(got, `ENV PATH="/opt/mise/shims:/home/agent/.local/bin:${PATH}"`) {
+		t.Errorf("expected PATH to use the relocated shims, got:\n%s", got)
+	}
+	if strings.Contains(got, ".local/share/mise") {
+		t.Errorf("expected no references to the default data dir, got:\n%s", got)
+	}
+
+	goldenTest(t, "dockerfile_claude_mise_data_dir.golden", got)
+}
+
+func TestLoadMergedConfig_RelativeMiseDataDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte("mise:\n  dataDir: mise-data\n"), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	_, err := LoadMergedConfig(defaultConfigYAML, LoadOptions{ConfigPath: configPath})
+	if err == nil || !strings.Contains(err.Error(), "mise.dataDir") {
+		t.Errorf("expected error for relative mise.dataDir, got: %v", err)
+	}
+}
+
+func TestPrepareConfigDir(t *testing.T) {
+	spec := ToolSpec{ConfigDir: ".claude"}
+
+	t.Run("existing dir is mounted", func(t *testing.T) {
+		home := t.TempDir()
+		os.Mkdir(filepath.Join(home, ".claude"), 0755)
+
+		mount, err := prepareConfigDir(home, spec, false, os.Getuid(), 0)
+		if err != nil || !mount {
+			t.Errorf("expected existing dir to be mounted, got %v, %v", mount, err)
+		}
+	})
+
+	t.Run("missing dir is created", func(t *testing.T) {
+		home := t.TempDir()
+
+		mount, err := prepareConfigDir(home, spec, true, os.Getuid(), 0)
+		if err != nil || !mount {
+			t.Fatalf("expected created dir to be mounted, got %v, %v", mount, err)
+		}
+		info, err := os.Stat(filepath.Join(home, ".claude"))
+		if err != nil || !info.IsDir() {
+			t.Fatalf("expected config dir to be created: %v", err)
+		}
+		if perm := info.Mode().Perm(); perm != 0700 {
+			t.Errorf("expected mode 0700, got %o", perm)
+		}
+	})
+
+	t.Run("created dir is given to another agent uid", func(t *testing.T) {
+		home := t.TempDir()
+		logs := captureLog(t, "text")
+
+		mount, err := prepareConfigDir(home, spec, true, os.Getuid()+1, 0)
+		if err != nil || !mount {
+			t.Fatalf("expected created dir to be mounted, got %v, %v", mount, err)
+		}
+		info, err := os.Stat(filepath.Join(home, ".claude"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The credentials dir stays private either way
+		if perm := info.Mode().Perm(); perm != 0700 {
+			t.Errorf("expected mode 0700, got %o", perm)
+		}
+		// Only root can chown; other users are told how to match the agent's uid
+		if os.Getuid() == 0 {
+			if logs.Len() != 0 {
+				t.Errorf("expected a chowned dir without a warning, got %q", logs.String())
+			}
+		} else if want := fmt.Sprintf("pass --uid %d --gid %d", os.Getuid(), os.Getgid()); !strings.Contains(logs.String(), want) {
+			t.Errorf("expected a warning suggesting %q, got %q", want, logs.String())
+		}
+	})
+
+	t.Run("missing dir is skipped with a warning", func(t *testing.T) {
+		home := t.TempDir()
+		logs := captureLog(t, "text")
+
+		mount, err := prepareConfigDir(home, spec, false, os.Getuid(), 0)
+		if err != nil || mount {
+			t.Fatalf("expected missing dir not to be mounted, got %v, %v", mount, err)
+		}
+		if _, err := os.Stat(filepath.Join(home, ".claude")); !os.IsNotExist(err) {
+			t.Errorf("expected config dir not to be created")
+		}
+		if !strings.Contains(logs.String(), "does not exist") {
+			t.Errorf("expected a warning, got %q", logs.String())
+		}
+
+		binds := buildRunBinds(ToolSpec{}, "/project", home)
+		for _, bind := range binds {
+			if strings.Contains(bind, "/home/agent") {
+				t.Errorf("expected no config mount without a config dir, got %v", binds)
+			}
+		}
+	})
+
+	t.Run("file in place of dir", func(t *testing.T) {
+		home := t.TempDir()
+		os.WriteFile(filepath.Join(home, ".claude"), []byte(""), 0644)
+
+		if _, err := prepareConfigDir(home, spec, true, os.Getuid(), 0); err == nil {
+			t.Error("expected error when the config path is a file")
+		}
+	})
+
+	t.Run("noConfigMount skips the dir", func(t *testing.T) {
+		home := t.TempDir()
+		logs := captureLog(t, "text")
+
+		mount, err := prepareConfigDir(home, ToolSpec{ConfigDir: ".claude", NoConfigMount: true}, true, os.Getuid(), 0)
+		if err != nil || mount {
+			t.Fatalf("expected the config dir not to be mounted, got %v, %v", mount, err)
+		}
+		if _, err := os.Stat(filepath.Join(home, ".claude")); !os.IsNotExist(err) {
+			t.Errorf("expected config dir not to be created")
+		}
+		if logs.Len() != 0 {
+			t.Errorf("expected no warning, got %q", logs.String())
+		}
+	})
+}
+
+func TestBuildRunBinds_NoConfigMount(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	agent := imgCfg.Agents["opencode"]
+	agent.NoConfigMount = true
+	spec := agent.ToToolSpec()
+
+	binds := buildRunBinds(spec, "/project", "/home/user")
+	want := []string{
+		"/project:/workdir",
+		"/home/user/.local/share/opencode:/home/agent/.local/share/opencode",
+	}
+	if diff := cmp.Diff(want, binds); diff != "" {
+		t.Errorf("expected the config mount to be skipped and other mounts kept (-want +got):\n%s", diff)
+	}
+}
+
+func TestRun_AgentAliases(t *testing.T) {
+	project := t.TempDir()
+	config := `agents:
+  claude-code:
+    packageName: npm:@team/claude-wrapper
+    command: claude
+    configDir: .claude
+    depends:
+      - node
+agentAliases:
+  claude: claude-code
+`
+	os.WriteFile(filepath.Join(project, ".agent-en-place.yaml"), []byte(config), 0644)
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("AGENT_EN_PLACE_TOOLS", "")
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	runErr := Run(Config{Tool: "claude", PlanJSON: true, Project: project})
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	if runErr != nil {
+		t.Fatalf("unexpected error: %v", runErr)
+	}
+	var plan buildPlan
+	if err := json.Unmarshal(out, &plan); err != nil {
+		t.Fatalf("expected JSON plan, got %v:\n%s", err, out)
+	}
+	if plan.Agent != "claude-code" {
+		t.Errorf("expected claude to run the claude-code agent, got %q", plan.Agent)
+	}
+	if !strings.Contains(plan.Image, "team-claude-wrapper") || strings.Contains(plan.Image, "anthropic") {
+		t.Errorf("expected the image to be built for the remapped agent, got %s", plan.Image)
+	}
+}
+
+func TestLoadMergedConfig_AgentAliasToUnknownAgent(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte("agentAliases:\n  cc: claude-code\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadMergedConfig(defaultConfigYAML, LoadOptions{ConfigPath: configPath, NoUserConfig: true})
+	if err == nil || !strings.Contains(err.Error(), `agentAliases.cc: unknown agent "claude-code"`) {
+		t.Errorf("expected an unknown agent error, got %v", err)
+	}
+}
+
+func TestRun_PlanJSON(t *testing.T) {
+	project := t.TempDir()
+	os.WriteFile(filepath.Join(project, ".tool-versions"), []byte("python 3.12.1\n"), 0644)
+	os.WriteFile(filepath.Join(project, ".nvmrc"), []byte("20\n"), 0644)
+	os.WriteFile(filepath.Join(project, ".agent-en-place.yaml"), []byte("mise:\n  env:\n    python_compile: false\n"), 0644)
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("AGENT_EN_PLACE_TOOLS", "ripgrep@14")
+	t.Setenv("MISE_PYTHON_COMPILE", "")
+	os.Unsetenv("MISE_PYTHON_COMPILE")
+	t.Setenv("MISE_EXPERIMENTAL", "1")
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	runErr := Run(Config{Tool: "claude", PlanJSON: true, Project: project})
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	if runErr != nil {
+		t.Fatalf("unexpected error: %v", runErr)
+	}
+	var plan buildPlan
+	if err := json.Unmarshal(out, &plan); err != nil {
+		t.Fatalf("expected JSON plan, got %v:\n%s", err, out)
+	}
+
+	if plan.Agent != "claude" || !strings.HasPrefix(plan.Image, "mheap/agent-en-place:") {
+		t.Errorf("unexpected agent or image: %s, %s", plan.Agent, plan.Image)
+	}
+
+	sources := map[string]string{}
+	for _, tool := range plan.Tools {
+		sources[tool.Name] = tool.Source + " " + tool.Origin + " " + tool.Version + " " + tool.LabelName
+	}
+	want := map[string]string{
+		"ripgrep":                       "env AGENT_EN_PLACE_TOOLS 14 ripgrep",
+		"python":                        "user .tool-versions 3.12.1 python",
+		"node":                          "idiomatic .nvmrc 20 node",
+		"npm:@anthropic-ai/claude-code": "config agent latest claude-code",
+	}
+	for name, source := range want {
+		if sources[name] != source {
+			t.Errorf("expected %s to be %q, got %q", name, source, sources[name])
+		}
+	}
+
+	if !slices.Contains(plan.Packages, "git") || !slices.Contains(plan.Packages, "libatomic1") {
+		t.Errorf("expected image and node packages, got %v", plan.Packages)
+	}
+	env := map[string]string{}
+	for _, kv := range plan.MiseEnv {
+		env[kv.Name] = kv.Value
+	}
+	if env["MISE_PYTHON_COMPILE"] != "false" || env["MISE_EXPERIMENTAL"] != "1" {
+		t.Errorf("expected config and host mise env vars, got %v", plan.MiseEnv)
+	}
+	if diff := cmp.Diff([]string{".nvmrc"}, plan.IdiomaticFiles); diff != "" {
+		t.Errorf("unexpected idiomatic files (-want +got):\n%s", diff)
+	}
+}
+
+func TestRun_ReportJSON(t *testing.T) {
+	project := t.TempDir()
+	os.WriteFile(filepath.Join(project, ".tool-versions"), []byte("node 22.1.0\n"), 0644)
+	os.WriteFile(filepath.Join(project, ".nvmrc"), []byte("20\n"), 0644)
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	runErr := Run(Config{Tool: "claude", Report: "json", Project: project})
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	if runErr != nil {
+		t.Fatalf("unexpected error: %v", runErr)
+	}
+	var report toolReport
+	if err := json.Unmarshal(out, &report); err != nil {
+		t.Fatalf("expected JSON report, got %v:\n%s", err, out)
+	}
+
+	if !strings.HasPrefix(report.Image, "mheap/agent-en-place:node-22.1.0-") {
+		t.Errorf("unexpected image name: %s", report.Image)
+	}
+
+	sources := map[string]reportSource{}
+	for _, source := range report.Sources {
+		sources[source.Name] = source
+	}
+	if !sources[".nvmrc"].Found || sources[".node-version"].Found {
+		t.Errorf("expected .nvmrc found and .node-version not found, got %+v and %+v", sources[".nvmrc"], sources[".node-version"])
+	}
+	if _, ok := sources["mise.toml"]; !ok {
+		t.Error("expected missing mise.toml to be reported")
+	}
+	// Each source lists what detection took from it
+	if diff := cmp.Diff([]reportVersion{{Name: "node", Version: "20"}}, sources[".nvmrc"].Tools); diff != "" {
+		t.Errorf("unexpected .nvmrc tools (-want +got):\n%s", diff)
+	}
+
+	var node reportTool
+	for _, tool := range report.Tools {
+		if tool.Name == "node" {
+			node = tool
+		}
+	}
+	want := reportTool{
+		Name:    "node",
+		Version: "22.1.0",
+		Source:  ".tool-versions",
+		Overridden: []reportCandidate{
+			{Version: "20", Source: ".nvmrc"},
+			{Version: "latest", Source: "config"},
+		},
+	}
+	if diff := cmp.Diff(want, node); diff != "" {
+		t.Errorf("unexpected node resolution (-want +got):\n%s", diff)
+	}
+
+	packages := map[string]string{}
+	for _, pkg := range report.Packages {
+		packages[pkg.Name] = pkg.Source
+	}
+	if packages["git"] != "image.packages" {
+		t.Errorf("expected git from image.packages, got %q", packages["git"])
+	}
+	if packages["libatomic1"] != "tools.node.additionalPackages" {
+		t.Errorf("expected libatomic1 from node, got %q", packages["libatomic1"])
+	}
+}
+
+func TestRun_ReportUnknownFormat(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	err := Run(Config{Tool: "claude", Report: "yaml"})
+	if err == nil || !strings.Contains(err.Error(), "unknown report format") {
+		t.Errorf("expected unknown format error, got %v", err)
+	}
+}
+
+func TestResolveRunMode(t *testing.T) {
+	tests := []struct {
+		flag   string
+		config string
+		want   string
+	}{
+		{"", "", "print"},
+		{"", "run", "run"},
+		{"print", "run", "print"},
+		{"run", "print", "run"},
+	}
+	for _, tt := range tests {
+		got, err := resolveRunMode(tt.flag, RunSettings{Mode: tt.config})
+		if err != nil {
+			t.Fatalf("resolveRunMode(%q, %q): unexpected error: %v", tt.flag, tt.config, err)
+		}
+		if got != tt.want {
+			t.Errorf("resolveRunMode(%q, %q) = %q, want %q", tt.flag, tt.config, got, tt.want)
+		}
+	}
+	if _, err := resolveRunMode("exec", RunSettings{}); err == nil {
+		t.Error("expected error for unknown run mode")
+	}
+}
+
+func TestLoadMergedConfig_InvalidRunMode(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte("run:\n  mode: exec\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadMergedConfig(defaultConfigYAML, LoadOptions{ConfigPath: configPath, NoUserConfig: true})
+	if err == nil || !strings.Contains(err.Error(), `unknown run.mode "exec"`) {
+		t.Errorf("expected run.mode error, got %v", err)
+	}
+}
+
+func TestRunSpec(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "sk-test")
+	t.Setenv("AGENT_EN_PLACE_TEST_HOME", "/home/me")
+	os.Unsetenv("AGENT_EN_PLACE_UNSET_VAR")
+	os.Unsetenv("GH_TOKEN")
+	logs := captureLog(t, "text")
+	profile := filepath.Join(t.TempDir(), "profile.json")
+	os.WriteFile(profile, []byte("{\n  \"defaultAction\": \"SCMP_ACT_ERRNO\"\n}\n"), 0644)
+	run := runSpec{
+		image:        "mheap/agent-en-place:claude",
+		command:      `claude --append-system-prompt "be brief"`,
+		platform:     "linux/arm64",
+		hostname:     "claude",
+		name:         "my-app-claude",
+		user:         "0",
+		securityOpts: []string{"seccomp=" + profile, "no-new-privileges"},
+		env: []string{
+			"AGENT_EN_PLACE_FIX_WORKDIR_PERMS=1",
+			"MISE_ENV=agent",
+			"ANTHROPIC_API_KEY",
+			"AGENT_EN_PLACE_UNSET_VAR",
+			`GH_TOKEN="$(gh auth token)"`,
+			`CACHE_DIR="${AGENT_EN_PLACE_TEST_HOME}/cache dir"`,
+			`LITERAL='$HOME'`,
+		},
+		binds: []string{"/home/me/my app:/workdir", "/home/me/.claude:/home/agent/.claude"},
+	}
+
+	wantArgs := []string{
+		"--platform linux/arm64",
+		"--hostname claude",
+		"--name my-app-claude",
+		"--security-opt seccomp=" + profile,
+		"--security-opt no-new-privileges",
+		"--user 0",
+		"-e AGENT_EN_PLACE_FIX_WORKDIR_PERMS=1",
+		"-e MISE_ENV=agent",
+		"-e ANTHROPIC_API_KEY",
+		"-e AGENT_EN_PLACE_UNSET_VAR",
+		`-e GH_TOKEN="$(gh auth token)"`,
+		`-e CACHE_DIR="${AGENT_EN_PLACE_TEST_HOME}/cache dir"`,
+		`-e LITERAL='$HOME'`,
+		"-v /home/me/my app:/workdir",
+		"-v /home/me/.claude:/home/agent/.claude",
+	}
+	if diff := cmp.Diff(wantArgs, run.printArgs()); diff != "" {
+		t.Errorf("print args mismatch (-want +got):\n%s", diff)
+	}
+
+	options, err := run.createOptions()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The entrypoint runs the command with bash -c, keeping its quoting
+	if diff := cmp.Diff([]string{`claude --append-system-prompt "be brief"`}, []string(options.Config.Cmd)); diff != "" {
+		t.Errorf("cmd mismatch (-want +got):\n%s", diff)
+	}
+	wantEnv := []string{"AGENT_EN_PLACE_FIX_WORKDIR_PERMS=1", "MISE_ENV=agent", "ANTHROPIC_API_KEY=sk-test", "CACHE_DIR=/home/me/cache dir", "LITERAL=$HOME"}
+	if diff := cmp.Diff(wantEnv, options.Config.Env); diff != "" {
+		t.Errorf("env mismatch (-want +got):\n%s", diff)
+	}
+	if !strings.Contains(logs.String(), "GH_TOKEN isn't passed to the agent") {
+		t.Errorf("expected a warning for the skipped command substitution, got %q", logs.String())
+	}
+	wantBinds := []string{"/home/me/my app:/workdir", "/home/me/.claude:/home/agent/.claude"}
+	if diff := cmp.Diff(wantBinds, options.HostConfig.Binds); diff != "" {
+		t.Errorf("binds mismatch (-want +got):\n%s", diff)
+	}
+	if options.Config.Image != "mheap/agent-en-place:claude" || options.Config.Hostname != "claude" || options.Name != "my-app-claude" || options.Config.User != "0" {
+		t.Errorf("unexpected identity: image=%q hostname=%q name=%q user=%q", options.Config.Image, options.Config.Hostname, options.Name, options.Config.User)
+	}
+	// The Engine API takes the profile's JSON rather than its path
+	wantSecurity := []string{`seccomp={"defaultAction":"SCMP_ACT_ERRNO"}`, "no-new-privileges"}
+	if diff := cmp.Diff(wantSecurity, options.HostConfig.SecurityOpt); diff != "" {
+		t.Errorf("security opts mismatch (-want +got):\n%s", diff)
+	}
+	if options.Platform == nil || options.Platform.OS != "linux" || options.Platform.Architecture != "arm64" {
+		t.Errorf("expected linux/arm64 platform, got %+v", options.Platform)
+	}
+	if !options.Config.Tty || !options.Config.OpenStdin || !options.Config.AttachStdin {
+		t.Error("expected an interactive TTY")
+	}
+}
+
+func TestResolveRunEnv_CommandSubstitutionFromHost(t *testing.T) {
+	t.Setenv("GH_TOKEN", "gho-host")
+	marker := filepath.Join(t.TempDir(), "ran")
+	got, ok := resolveRunEnv(`GH_TOKEN="$(touch ` + marker + `)"`)
+	if !ok || got != "GH_TOKEN=gho-host" {
+		t.Errorf("expected the host GH_TOKEN, got %q, %v", got, ok)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Error("expected the command in the value not to be run")
+	}
+}
+
+func TestRunContainer(t *testing.T) {
+	cli := &fakeDockerClient{containerLogs: "hello from the agent\r\n", containerExit: 3}
+	options, err := runSpec{image: "mheap/agent-en-place:claude", command: "claude", env: []string{"MISE_ENV=agent"}}.createOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout bytes.Buffer
+	code, err := runContainer(context.Background(), cli, options, strings.NewReader(""), &stdout)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if code != 3 {
+		t.Errorf("expected exit code 3, got %d", code)
+	}
+	if stdout.String() != "hello from the agent\r\n" {
+		t.Errorf("expected container output to be streamed, got %q", stdout.String())
+	}
+	wantCalls := []string{"create container-1", "attach container-1", "start container-1", "remove container-1"}
+	if diff := cmp.Diff(wantCalls, cli.calls); diff != "" {
+		t.Errorf("calls mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestApplyImageCustomizations_PackageSources(t *testing.T) {
+	cfg := &ImageConfig{
+		Image: ImageSettings{
+			Packages: []string{"curl", "git", "gnupg"},
+		},
+		ImageCustomizations: ImageCustomizations{
+			Packages: []ImageCustomization{
+				{Op: "add", Value: "vim"},
+				{Op: "add", Value: "htop"},
+				{Op: "remove", Value: "htop"},
+				{Op: "remove", Value: "gnupg"},
+				{Op: "remove", Value: "nano"},
+			},
+		},
+		Tools: map[string]ToolConfigEntry{
+			"python": {Version: "latest", AdditionalPackages: []string{"python3-venv"}},
+		},
+		Agents: map[string]AgentConfig{
+			"aider": {PackageName: "pipx:aider-chat", Depends: []string{"python"}},
+		},
+	}
+
+	result := applyImageCustomizations(cfg)
+	got := packageSources(result, "aider", nil)
+
+	want := []reportPackage{
+		{Name: "curl", Source: "image.packages"},
+		{Name: "git", Source: "image.packages"},
+		{Name: "vim", Source: "image_customizations"},
+		{Name: "python3-venv", Source: "tools.python.additionalPackages"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected packages (-want +got):\n%s", diff)
+	}
+
+	wantApplied := []string{"add vim", "add htop", "remove htop", "remove gnupg", "remove nano (not found)"}
+	if diff := cmp.Diff(wantApplied, result.appliedCustomizations); diff != "" {
+		t.Errorf("unexpected applied customizations (-want +got):\n%s", diff)
+	}
+}
+
+func TestRun_ShowPackages(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	project := t.TempDir()
+	config := "image_customizations:\n  packages:\n    - op: add\n      value: jq\n    - op: add\n      value: htop\n    - op: remove\n      value: htop\n"
+	if err := os.WriteFile(filepath.Join(project, ".agent-en-place.yaml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	runErr := Run(Config{Tool: "claude", ShowPackages: true, Project: project})
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	if runErr != nil {
+		t.Fatalf("unexpected error: %v", runErr)
+	}
+	lines := strings.Split(string(out), "\n")
+	if !strings.HasPrefix(lines[0], "PACKAGE ") {
+		t.Errorf("expected a package table, got:\n%s", out)
+	}
+	var jq string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "htop" {
+			t.Errorf("expected added-then-removed htop to be absent, got:\n%s", out)
+		}
+		if len(fields) == 2 && fields[0] == "jq" {
+			jq = fields[1]
+		}
+	}
+	if jq != "image_customizations" {
+		t.Errorf("expected jq from image_customizations, got %q:\n%s", jq, out)
+	}
+	if !strings.Contains(string(out), "image_customizations:\n  add jq\n  add htop\n  remove htop\n") {
+		t.Errorf("expected applied customizations to be listed, got:\n%s", out)
+	}
+}
+
+func TestDockerfile_Claude_NpmRegistry(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	imgCfg.Image.NpmRegistry = "https://npm.example.com/"
+	agent := imgCfg.Agents["claude"]
+	agent.NpmRegistry = "https://npm.internal.example.com/"
+	imgCfg.Agents["claude"] = agent
+	spec := getToolSpec(t, imgCfg, "claude")
+	collection := buildDefaultCollection("claude", spec)
+
+	got := buildDockerfile(false, false, collection, spec, imgCfg, "claude", nil)
+	if err := validateDockerfile(got); err != nil {
+		t.Errorf("expected valid Dockerfile, got: %v", err)
+	}
+	goldenTest(t, "dockerfile_claude_npm_registry.golden", got)
+}
+
+func TestNpmrcLines_ToolScopes(t *testing.T) {
+	imgCfg := &ImageConfig{
+		Agents: map[string]AgentConfig{"mine": {PackageName: "npm:@org/agent", NpmRegistry: "https://agents.example.com/"}},
+		Tools: map[string]ToolConfigEntry{
+			"npm:@tools/cli":   {NpmRegistry: "https://tools.example.com/%7Enpm/"},
+			"npm:@org/helper":  {NpmRegistry: "https://other.example.com/"},
+			"npm:@public/tool": {},
+		},
+	}
+	// Collected specs have sanitized names, so the scope comes from the tool
+	// as written
+	specs := dedupeToolSpecs([]toolDescriptor{{name: "npm:@tools/cli"}, {name: "npm:@org/helper"}, {name: "npm:@public/tool"}})
+
+	got := npmrcLines(imgCfg, "mine", specs)
+	want := []string{
+		`@org:registry=https://agents.example.com/\n`,
+		`@tools:registry=https://tools.example.com/%%7Enpm/\n`,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected .npmrc lines (-want +got):\n%s", diff)
+	}
+}
+
+func TestLoadMergedConfig_NpmRegistryValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{"valid", "image:\n  npmRegistry: https://npm.example.com/\n", ""},
+		{"not a url", "image:\n  npmRegistry: npm.example.com\n", "image.npmRegistry must be an http or https URL"},
+		{"quote", "image:\n  npmRegistry: \"https://npm.example.com/'x\"\n", "must not contain quotes"},
+		{"unscoped agent", "agents:\n  claude:\n    npmRegistry: https://npm.example.com/\n", "agents.claude.npmRegistry requires a scoped npm packageName"},
+		{"unscoped tool", "tools:\n  npm:trello-cli:\n    npmRegistry: https://npm.example.com/\n", "tools.npm:trello-cli.npmRegistry requires a scoped npm tool"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configPath, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadMergedConfig(defaultConfigYAML, LoadOptions{ConfigPath: configPath, NoUserConfig: true})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestWriteBundle(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	imgCfg.Image.BuildArgs = map[string]string{"NPM_TOKEN": "npm-build-secret"}
+	imgCfg.Mise.Env = map[string]any{"github_token": "ghp-config-secret"}
+	agent := imgCfg.Agents["claude"]
+	enabled := true
+	imgCfg.Mise.InheritUserEnv = &enabled
+	agent.EnvVars = append(agent.EnvVars, `INLINE_TOKEN="inline-secret"`)
+	agent.PassEnv = append(agent.PassEnv, "PASSED_TOKEN")
+	imgCfg.Agents["claude"] = agent
+	spec := getToolSpec(t, imgCfg, "claude")
+	collection := buildDefaultCollection("claude", spec)
+	toolFile := &fileSpec{path: ".tool-versions", data: []byte("node 20.11.0\n"), mode: 0644}
+	miseFile := &fileSpec{path: "mise.toml", data: []byte("[tools]\nnode = \"20\"\n\n[env]\nDATABASE_URL = \"postgres://user:mise-env-secret@db\"\n_.path = [\"./bin\"]\n\n[tasks.deploy.env]\nDEPLOY_KEY = \"task-env-secret\"\n"), mode: 0644}
+
+	buildLog := `{"stream":"Step 1/12 : FROM debian:12-slim\n"}
+{"stream":"token is ghp-host-secret\n"}
+{"stream":"connecting to postgres://user:mise-env-secret@db with passed-secret\n"}
+{"error":"The command '/bin/sh -c mise install' returned a non-zero code: 1"}
+`
+	var buf bytes.Buffer
+	err := writeBundle(&buf, bundleInput{
+		toolFile:   toolFile,
+		miseFile:   miseFile,
+		collection: collection,
+		spec:       spec,
+		imgCfg:     imgCfg,
+		agentName:  "claude",
+		env:        []string{"MISE_GITHUB_TOKEN=ghp-host-secret", "ANTHROPIC_API_KEY=sk-ant-secret", "PASSED_TOKEN=passed-secret", "HOME=/root"},
+		buildLog:   []byte(buildLog),
+		buildErr:   errors.New("Error building docker image: npm-build-secret rejected"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("expected gzip output: %v", err)
+	}
+	files := make(map[string]string)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(tr)
+		files[header.Name] = string(data)
+	}
+
+	for _, name := range []string{"Dockerfile", "mise.agent.toml", "mise.toml", ".tool-versions", "config.yaml", "plan.json", "build.log", "error.txt"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("expected %s in bundle, got %v", name, slices.Sorted(maps.Keys(files)))
+		}
+	}
+	for name, content := range files {
+		for _, secret := range []string{"npm-build-secret", "ghp-config-secret", "inline-secret", "ghp-host-secret", "sk-ant-secret", "mise-env-secret", "task-env-secret", "passed-secret"} {
+			if strings.Contains(content, secret) {
+				t.Errorf("expected %s to be redacted from %s:\n%s", secret, name, content)
+			}
+		}
+	}
+	if !strings.Contains(files["Dockerfile"], `ENV MISE_GITHUB_TOKEN="REDACTED"`) {
+		t.Errorf("expected host MISE_ variable names to be kept, got:\n%s", files["Dockerfile"])
+	}
+	for _, name := range []string{"mise.toml", "mise.agent.toml"} {
+		if !strings.Contains(files[name], "DATABASE_URL = 'REDACTED'") {
+			t.Errorf("expected [env] keys to be kept in %s, got:\n%s", name, files[name])
+		}
+	}
+	if !strings.Contains(files["mise.toml"], "./bin") {
+		t.Errorf("expected the _.path directive to be kept, got:\n%s", files["mise.toml"])
+	}
+	if !strings.Contains(files["build.log"], "Step 1/12") || !strings.Contains(files["build.log"], "ERROR: The command") {
+		t.Errorf("expected build output in build.log, got:\n%s", files["build.log"])
+	}
+	if !strings.Contains(files["config.yaml"], "NPM_TOKEN: REDACTED") {
+		t.Errorf("expected build arg keys to be kept, got:\n%s", files["config.yaml"])
+	}
+	if !strings.Contains(files["plan.json"], `"agent": "claude"`) {
+		t.Errorf("expected tool plan, got:\n%s", files["plan.json"])
+	}
+}
+
+func TestBuildTmpfsArgs(t *testing.T) {
+	got := buildTmpfsArgs([]TmpfsMount{
+		{Path: "/tmp", Size: "512m", Mode: "1777"},
+		{Path: "/home/agent/.cache", Size: "2g"},
+		{Path: "/scratch"},
+	})
+	want := []string{
+		"--tmpfs /tmp:size=512m,mode=1777",
+		"--tmpfs /home/agent/.cache:size=2g",
+		"--tmpfs /scratch",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected args (-want +got):\n%s", diff)
+	}
+	if got := buildTmpfsArgs(nil); len(got) != 0 {
+		t.Errorf("expected no args, got %v", got)
+	}
+
+	options, err := runSpec{image: "img", tmpfs: []TmpfsMount{
+		{Path: "/tmp", Size: "512m", Mode: "1777"},
+		{Path: "/home/agent/.cache", Size: "2g"},
+		{Path: "/scratch"},
+	}}.createOptions()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wantTmpfs := map[string]string{"/tmp": "size=512m,mode=1777", "/home/agent/.cache": "size=2g", "/scratch": ""}
+	if diff := cmp.Diff(wantTmpfs, options.HostConfig.Tmpfs); diff != "" {
+		t.Errorf("unexpected --run tmpfs mounts (-want +got):\n%s", diff)
+	}
+}
+
+func TestNoColorEnv(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+
+	want := []string{"NO_COLOR=1", "TERM=dumb"}
+	if diff := cmp.Diff(want, noColorEnv(imgCfg.Run, spec)); diff != "" {
+		t.Errorf("unexpected default env (-want +got):\n%s", diff)
+	}
+
+	run := RunSettings{NoColorEnv: []string{"NO_COLOR=1", "FORCE_COLOR=0"}}
+	spec.NoColorEnv = []string{"CLAUDE_CODE_DISABLE_TERMINAL_TITLE=1"}
+	got := noColorEnv(run, spec)
+	want = []string{"NO_COLOR=1", "FORCE_COLOR=0", "CLAUDE_CODE_DISABLE_TERMINAL_TITLE=1"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected configured env (-want +got):\n%s", diff)
+	}
+
+	// The no-color vars follow the agent's envVars so --run sets them last
+	env := append(buildRunEnv(ToolSpec{EnvVars: []string{"TERM=xterm-256color"}}), noColorEnv(imgCfg.Run, ToolSpec{})...)
+	options, err := runSpec{image: "img", env: env}.createOptions()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wantEnv := []string{"MISE_ENV=agent", "TERM=xterm-256color", "NO_COLOR=1", "TERM=dumb"}
+	if diff := cmp.Diff(wantEnv, options.Config.Env); diff != "" {
+		t.Errorf("unexpected --run env (-want +got):\n%s", diff)
+	}
+}
+
+func TestMergeConfigs_NoColorEnv(t *testing.T) {
+	base := &ImageConfig{Run: RunSettings{NoColorEnv: []string{"NO_COLOR=1"}}}
+	merged := mergeConfigs(base, &ImageConfig{})
+	if diff := cmp.Diff([]string{"NO_COLOR=1"}, merged.Run.NoColorEnv); diff != "" {
+		t.Errorf("expected base noColorEnv to be kept (-want +got):\n%s", diff)
+	}
+	merged = mergeConfigs(base, &ImageConfig{Run: RunSettings{NoColorEnv: []string{"TERM=dumb"}}})
+	if diff := cmp.Diff([]string{"TERM=dumb"}, merged.Run.NoColorEnv); diff != "" {
+		t.Errorf("expected user noColorEnv to replace the base (-want +got):\n%s", diff)
+	}
+}
+
+func TestValidateTmpfs(t *testing.T) {
+	valid := []TmpfsMount{{Path: "/tmp", Size: "512m", Mode: "1777"}, {Path: "/cache", Size: "1048576"}, {Path: "/scratch", Mode: "755"}}
+	if err := validateTmpfs(valid); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		mount   TmpfsMount
+		wantErr string
+	}{
+		{"relative path", TmpfsMount{Path: "tmp"}, "path must be absolute"},
+		{"path with colon", TmpfsMount{Path: "/tmp:rw"}, "must not contain colons"},
+		{"size unit", TmpfsMount{Path: "/tmp", Size: "512MB"}, `invalid size "512MB"`},
+		{"negative size", TmpfsMount{Path: "/tmp", Size: "-1m"}, "invalid size"},
+		{"zero size", TmpfsMount{Path: "/tmp", Size: "0"}, "invalid size"},
+		{"non-octal mode", TmpfsMount{Path: "/tmp", Mode: "rwx"}, `invalid mode "rwx"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTmpfs([]TmpfsMount{tt.mount})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	if err := validateTmpfs([]TmpfsMount{{Path: "/tmp"}, {Path: "/tmp/"}}); err == nil {
+		t.Error("expected error for duplicate mount")
+	}
+}
+
+func TestLoadMergedConfig_RunTmpfs(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	config := "run:\n  tmpfs:\n    - path: /tmp\n      size: 512m\n      mode: 1777\n    - path: /data\n      mode: 0755\n"
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadMergedConfig(defaultConfigYAML, LoadOptions{ConfigPath: configPath, NoUserConfig: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []TmpfsMount{{Path: "/tmp", Size: "512m", Mode: "1777"}, {Path: "/data", Mode: "0755"}}
+	if diff := cmp.Diff(want, cfg.Run.Tmpfs); diff != "" {
+		t.Errorf("unexpected tmpfs mounts (-want +got):\n%s", diff)
+	}
+}
+
+func TestConfigDigest(t *testing.T) {
+	digest := func(nodeVersion string, env []string) string {
+		t.Helper()
+		imgCfg := loadTestConfig(t)
+		spec := getToolSpec(t, imgCfg, "claude")
+		toolFile := &fileSpec{path: ".tool-versions", data: []byte("node " + nodeVersion + "\n")}
+		collection := collectToolSpecs(toolFile, nil, spec, imgCfg, "claude", collectOptions{})
+		d, err := configDigest(toolFile, nil, collection, spec, imgCfg, "claude", env)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return d
+	}
+
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+
+	first := digest("20.11.0", []string{"MISE_JOBS=2", "MISE_VERBOSE=1"})
+	if len(first) != 64 {
+		t.Fatalf("expected a hex sha256, got %q", first)
+	}
+	for i := 0; i < 5; i++ {
+		if got := digest("20.11.0", []string{"MISE_VERBOSE=1", "MISE_JOBS=2"}); got != first {
+			t.Fatalf("digest changed between runs with identical inputs: %s != %s", got, first)
+		}
+	}
+	if got := digest("22.1.0", []string{"MISE_JOBS=2", "MISE_VERBOSE=1"}); got == first {
+		t.Error("expected digest to change with the node version")
+	}
+	if got := digest("20.11.0", []string{"MISE_JOBS=4", "MISE_VERBOSE=1"}); got == first {
+		t.Error("expected digest to change with MISE_* variables baked into the Dockerfile")
+	}
+}
+
+func TestValidateAPIVersion(t *testing.T) {
+	for _, version := range []string{"1.44", "1.41", client.MaxAPIVersion} {
+		if err := validateAPIVersion(version); err != nil {
+			t.Errorf("expected %q to be valid, got %v", version, err)
+		}
+	}
+	for _, version := range []string{"v1.44", "1", "1.44.0", "latest", "1.99"} {
+		if err := validateAPIVersion(version); err == nil {
+			t.Errorf("expected %q to be rejected", version)
+		}
+	}
+}
+
+func TestDockerClientOptions(t *testing.T) {
+	t.Setenv("DOCKER_API_VERSION", "1.45")
+
+	cli, err := client.New(dockerClientOptions("1.44")...)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cli.ClientVersion(); got != "1.44" {
+		t.Errorf("expected pinned version 1.44 to win over DOCKER_API_VERSION, got %s", got)
+	}
+
+	cli, err = client.New(dockerClientOptions("")...)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cli.ClientVersion(); got != "1.45" {
+		t.Errorf("expected DOCKER_API_VERSION to be used without a pinned version, got %s", got)
+	}
+}
+
+func TestCheckAPIVersion(t *testing.T) {
+	ctx := context.Background()
+	server := client.ServerVersionResult{Version: "24.0.7", APIVersion: "1.43", MinAPIVersion: "1.12"}
+
+	if err := checkAPIVersion(ctx, &fakeDockerClient{serverVersion: server}, "1.43"); err != nil {
+		t.Errorf("expected 1.43 to be accepted, got %v", err)
+	}
+
+	err := checkAPIVersion(ctx, &fakeDockerClient{serverVersion: server}, "1.44")
+	if err == nil || !strings.Contains(err.Error(), "does not support API version 1.44") {
+		t.Errorf("expected unsupported version error, got %v", err)
+	}
+
+	rejected := &fakeDockerClient{serverVersionErr: fmt.Errorf("client version 1.10 is too old")}
+	err = checkAPIVersion(ctx, rejected, "1.10")
+	if err == nil || !strings.Contains(err.Error(), "rejected API version 1.10") {
+		t.Errorf("expected rejection error, got %v", err)
+	}
+}
+
+func TestResolveNodeLts(t *testing.T) {
+	aliases := map[string]string{"next": "26", "iron": "20.11"}
+	tests := []struct {
+		version string
+		want    string
+		wantOk  bool
+	}{
+		{version: "lts/*", want: "lts", wantOk: true},
+		{version: "lts/hydrogen", want: "18", wantOk: true},
+		{version: "lts/Jod", want: "22", wantOk: true},
+		{version: "lts/iron", want: "20.11", wantOk: true}, // config wins over the built-in codename
+		{version: "lts/next", want: "26", wantOk: true},
+		{version: "lts/unknown", want: "latest", wantOk: false},
+		{version: "20.11.0", want: "20.11.0", wantOk: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			got, ok := resolveNodeLts(tt.version, aliases)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("resolveNodeLts(%q) = %q, %v; want %q, %v", tt.version, got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestCollectToolSpecs_NvmrcLtsAlias(t *testing.T) {
+	tests := []struct {
+		nvmrc    string
+		want     string
+		wantWarn bool
+	}{
+		{nvmrc: "lts/*", want: "lts"},
+		{nvmrc: "lts/iron", want: "20"},
+		{nvmrc: "20.11.0", want: "20.11.0"},
+		{nvmrc: "lts/nope", want: "latest", wantWarn: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.nvmrc, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			oldWd, _ := os.Getwd()
+			defer os.Chdir(oldWd)
+			os.Chdir(tmpDir)
+			if err := os.WriteFile(".nvmrc", []byte(tt.nvmrc+"\n"), 0644); err != nil {
+				t.Fatalf("failed to write .nvmrc: %v", err)
+			}
+			logs := captureLog(t, "text")
+
+			imgCfg := loadTestConfig(t)
+			spec := getToolSpec(t, imgCfg, "claude")
+			collection := collectToolSpecs(nil, nil, spec, imgCfg, "claude", collectOptions{})
+
+			var node string
+			for _, tool := range collection.specs {
+				if tool.name == "node" {
+					node = tool.version
+				}
+			}
+			if node != tt.want {
+				t.Errorf("expected node %q, got %q", tt.want, node)
+			}
+			if image := buildImageName(imageTagSpecs(collection.specs, spec, imgCfg)); !strings.Contains(image, "node-"+tt.want+"-") {
+				t.Errorf("expected node-%s in the image tag, got %s", tt.want, image)
+			}
+			if warned := strings.Contains(logs.String(), "unknown Node.js LTS alias"); warned != tt.wantWarn {
+				t.Errorf("expected warning %v, got log %q", tt.wantWarn, logs.String())
+			}
+		})
+	}
+}
+
+func TestParseMixExs(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		wantVersion string
+		wantOk      bool
+	}{
+		{
+			name:        "pessimistic requirement",
+			content:     "defmodule MyApp.MixProject do\n  use Mix.Project\n\n  def project do\n    [\n      app: :my_app,\n      version: \"0.1.0\",\n      elixir: \"~> 1.16\",\n      deps: deps()\n    ]\n  end\nend\n",
+			wantVersion: "1.16",
+			wantOk:      true,
+		},
+		{
+			name:        "range with and",
+			content:     "[app: :my_app, elixir: \">= 1.14.0 and < 2.0.0\"]",
+			wantVersion: "1.14.0",
+			wantOk:      true,
+		},
+		{
+			name:        "alternatives use the first",
+			content:     "[app: :my_app, elixir: \"~> 1.15 or ~> 1.16\"]",
+			wantVersion: "1.15",
+			wantOk:      true,
+		},
+		{
+			name:    "no elixir requirement",
+			content: "[app: :my_app, version: \"0.1.0\"]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "mix.exs")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("failed to write mix.exs: %v", err)
+			}
+			version, ok := parseMixExs(path)
+			if version != tt.wantVersion || ok != tt.wantOk {
+				t.Errorf("parseMixExs() = %q, %v; want %q, %v", version, ok, tt.wantVersion, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestCollectToolSpecs_ElixirErlang(t *testing.T) {
+	tests := []struct {
+		name        string
+		toolVersion string
+		mixExs      string
+		want        map[string]string
+		addsErlang  bool // erlang is added for elixir rather than read from a file
+	}{
+		{
+			name:        "otp suffix picks erlang",
+			toolVersion: "elixir 1.16.0-otp-26\n",
+			want:        map[string]string{"elixir": "1.16.0-otp-26", "erlang": "26"},
+			addsErlang:  true,
+		},
+		{
+			name:        "erlang from .tool-versions is kept",
+			toolVersion: "elixir 1.16.0-otp-26\nerlang 26.2\n",
+			want:        map[string]string{"elixir": "1.16.0-otp-26", "erlang": "26.2"},
+		},
+		{
+			name:       "mix.exs requirement",
+			mixExs:     "[app: :my_app, elixir: \"~> 1.16\"]",
+			want:       map[string]string{"elixir": "1.16", "erlang": "latest"},
+			addsErlang: true,
+		},
+		{
+			name:        ".tool-versions wins over mix.exs",
+			toolVersion: "elixir 1.17.2-otp-27\n",
+			mixExs:      "[app: :my_app, elixir: \"~> 1.16\"]",
+			want:        map[string]string{"elixir": "1.17.2-otp-27", "erlang": "27"},
+			addsErlang:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			oldWd, _ := os.Getwd()
+			defer os.Chdir(oldWd)
+			os.Chdir(tmpDir)
+
+			var toolFile *fileSpec
+			if tt.toolVersion != "" {
+				toolFile = &fileSpec{path: ".tool-versions", data: []byte(tt.toolVersion)}
+			}
+			if tt.mixExs != "" {
+				if err := os.WriteFile("mix.exs", []byte(tt.mixExs), 0644); err != nil {
+					t.Fatalf("failed to write mix.exs: %v", err)
+				}
+			}
+
+			imgCfg := loadTestConfig(t)
+			spec := getToolSpec(t, imgCfg, "claude")
+			collection := collectToolSpecs(toolFile, nil, spec, imgCfg, "claude", collectOptions{})
+
+			got := make(map[string]string)
+			for _, tool := range collection.specs {
+				if tool.name == "elixir" || tool.name == "erlang" {
+					got[tool.name] = tool.version
+				}
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("elixir/erlang mismatch (-want +got):\n%s", diff)
+			}
+
+			if !tt.addsErlang {
+				return
+			}
+			// mise reads .tool-versions itself, but an added erlang has to be in mise.agent.toml
+			data, err := buildAgentMiseConfig(nil, collection, spec)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !strings.Contains(string(data), fmt.Sprintf("erlang = %q", tt.want["erlang"])) {
+				t.Errorf("expected erlang %s in mise.agent.toml, got:\n%s", tt.want["erlang"], data)
+			}
+		})
+	}
+}
+
+func TestAgentMiseConfig_InheritUserEnv(t *testing.T) {
+	userMise := []byte(`[tools]
+node = "20"
+
+[env]
+NODE_ENV = "development"
+_.file = ".env"
+
+[settings]
+experimental = true
+`)
+	spec := ToolSpec{MiseToolName: "npm:@anthropic-ai/claude-code", ConfigKey: "npm:@anthropic-ai/claude-code"}
+	collection := collectResult{}
+
+	imgCfg := loadTestConfig(t)
+	data, err := agentMiseConfig(userMise, collection, spec, imgCfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(string(data), "[env]") || strings.Contains(string(data), "NODE_ENV") {
+		t.Errorf("expected no [env] without mise.inheritUserEnv, got:\n%s", data)
+	}
+
+	enabled := true
+	imgCfg.Mise.InheritUserEnv = &enabled
+	data, err = agentMiseConfig(userMise, collection, spec, imgCfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got struct {
+		Tools    map[string]any `toml:"tools"`
+		Env      map[string]any `toml:"env"`
+		Settings map[string]any `toml:"settings"`
+	}
+	if err := toml.Unmarshal(data, &got); err != nil {
+		t.Fatalf("generated mise.agent.toml is invalid: %v\n%s", err, data)
+	}
+	want := map[string]any{"NODE_ENV": "development", "_": map[string]any{"file": ".env"}}
+	if diff := cmp.Diff(want, got.Env); diff != "" {
+		t.Errorf("[env] mismatch (-want +got):\n%s", diff)
+	}
+	if got.Tools["npm:@anthropic-ai/claude-code"] != "latest" {
+		t.Errorf("expected the agent tool to be kept, got %v", got.Tools)
+	}
+	if got.Settings != nil {
+		t.Errorf("expected [settings] to stay out of mise.agent.toml, got %v", got.Settings)
+	}
+}
+
+func TestAgentMiseConfig_PropagateSettings(t *testing.T) {
+	userMise := []byte(`[tools]
+node = "20"
+
+[env]
+NODE_ENV = "development"
+
+[settings]
+experimental = true
+python_compile = true
+verbose = true
+`)
+	spec := ToolSpec{MiseToolName: "npm:@anthropic-ai/claude-code", ConfigKey: "npm:@anthropic-ai/claude-code"}
+	imgCfg := loadTestConfig(t)
+	imgCfg.Mise.Env = map[string]any{"ruby_compile": false, "python_compile": false, "node_compile": false}
+	imgCfg.Mise.Jobs = 4
+	imgCfg.Mise.PropagateSettings = []string{"ruby_compile", "python_compile", "experimental", "jobs", "not_set"}
+
+	data, err := agentMiseConfig(userMise, collectResult{}, spec, imgCfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got struct {
+		Tools    map[string]any `toml:"tools"`
+		Env      map[string]any `toml:"env"`
+		Settings map[string]any `toml:"settings"`
+	}
+	if err := toml.Unmarshal(data, &got); err != nil {
+		t.Fatalf("generated mise.agent.toml is invalid: %v\n%s", err, data)
+	}
+	// Only listed keys are carried over, with the project's [settings] winning
+	want := map[string]any{"ruby_compile": false, "python_compile": true, "experimental": true, "jobs": int64(4)}
+	if diff := cmp.Diff(want, got.Settings); diff != "" {
+		t.Errorf("[settings] mismatch (-want +got):\n%s", diff)
+	}
+	if got.Env != nil {
+		t.Errorf("expected no [env] without mise.inheritUserEnv, got %v", got.Env)
+	}
+	if got.Tools["npm:@anthropic-ai/claude-code"] != "latest" {
+		t.Errorf("expected the agent tool to be kept, got %v", got.Tools)
+	}
+
+	imgCfg.Mise.PropagateSettings = nil
+	data, err = agentMiseConfig(userMise, collectResult{}, spec, imgCfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(string(data), "[settings]") {
+		t.Errorf("expected no [settings] without mise.propagateSettings, got:\n%s", data)
+	}
+}
+
+func TestImageConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{
+			name:   "agent depends on unknown tool",
+			config: "agents:\n  claude:\n    packageName: npm:@anthropic-ai/claude-code\n    depends: [node, ghost]\n",
+			want:   []string{`agents.claude.depends: unknown tool "ghost"`},
+		},
+		{
+			name:   "tool depends on unknown tool",
+			config: "tools:\n  ruby:\n    depends: openssl\n",
+			want:   []string{`tools.ruby.depends: unknown tool "openssl"`},
+		},
+		{
+			name:   "unknown backend",
+			config: "agents:\n  mine:\n    packageName: npmm:my-agent\n",
+			want:   []string{`agents.mine.packageName: "npmm:my-agent" uses unknown mise backend "npmm"`},
+		},
+		{
+			name:   "scoped npm package without a name",
+			config: "tools:\n  \"npm:@org\": {}\n",
+			want:   []string{`tools.npm:@org: "npm:@org" is a scoped npm package without a name`},
+		},
+		{
+			name:   "agent without a package",
+			config: "agents:\n  mine:\n    command: mine\n",
+			want:   []string{"agents.mine: one of packageName or localBinary is required"},
+		},
+		{
+			name:   "unknown customization op",
+			config: "image_customizations:\n  packages:\n    - op: upgrade\n      value: vim\n    - op: remove\n    - op: replace\n      value: neovim\n",
+			want: []string{
+				`image_customizations.packages[0]: unknown operation "upgrade"`,
+				"image_customizations.packages[1]: remove requires a value",
+				"image_customizations.packages[2]: replace requires from and value",
+			},
+		},
+		{
+			name:   "invalid mise customizations",
+			config: "image_customizations:\n  miseInstall:\n    - op: replace\n      value: mise --version\n  miseEnv:\n    - op: add\n      value: node_mirror_url\n",
+			want: []string{
+				`image_customizations.miseInstall[0]: unknown operation "replace" (expected add or remove)`,
+				"image_customizations.miseEnv[0]: add requires key=value",
+			},
+		},
+		{
+			name:   "dependency cycle",
+			config: "tools:\n  a:\n    depends: b\n  b:\n    depends: c\n  c:\n    depends: a\n",
+			want:   []string{"tools: dependency cycle a -> b -> c -> a"},
+		},
+		{
+			name:   "blank base image",
+			config: "image:\n  base: \" \"\n",
+			want:   []string{"image.base: must not be empty"},
+		},
+		{
+			name:   "load-time checks are reported together",
+			config: "run:\n  mode: sometimes\nmise:\n  jobs: -1\ndefaultAgent: nope\n",
+			want: []string{
+				`unknown run.mode "sometimes"`,
+				"mise.jobs must be a positive integer",
+				`defaultAgent: unknown agent "nope"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configPath, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			captureLog(t, "text")
+			cfg, err := mergeConfigFiles(defaultConfigYAML, LoadOptions{ConfigPath: configPath, NoUserConfig: true})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			err = cfg.Validate()
+			if err == nil {
+				t.Fatal("expected validation to fail")
+			}
+			problems := strings.Split(err.Error(), "\n")
+			if len(problems) != len(tt.want) {
+				t.Errorf("expected %d problems, got %d:\n%s", len(tt.want), len(problems), err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected problem %q, got:\n%s", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestValidate_ReportsConfigOrigin(t *testing.T) {
+	projectDir := t.TempDir()
+	xdgDir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", xdgDir)
+	captureLog(t, "text")
+
+	xdgConfig := "tools:\n  ruby:\n    depends: openssl\n"
+	if err := os.WriteFile(filepath.Join(xdgDir, "agent-en-place.yaml"), []byte(xdgConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	localConfig := "agents:\n  claude:\n    packageName: npm:@anthropic-ai/claude-code\n    depends: [ghost]\n"
+	if err := os.WriteFile(filepath.Join(projectDir, ".agent-en-place.yaml"), []byte(localConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Validate(Config{Project: projectDir})
+	if err == nil {
+		t.Fatal("expected validation to fail")
+	}
+	want := "config has 2 problem(s):\n" +
+		`  agents.claude.depends: unknown tool "ghost" (in .agent-en-place.yaml)` + "\n" +
+		`  tools.ruby.depends: unknown tool "openssl" (in ` + filepath.Join(xdgDir, "agent-en-place.yaml") + ")"
+	if diff := cmp.Diff(want, err.Error()); diff != "" {
+		t.Errorf("unexpected problems (-want +got):\n%s", diff)
+	}
+}
+
+func TestLoadMergedConfig_ExpandsEnv(t *testing.T) {
+	t.Setenv("AEP_TEST_REGISTRY", "registry.example.com")
+	t.Setenv("AEP_TEST_MIRROR", "")
+	os.Unsetenv("AEP_TEST_MIRROR")
+	t.Setenv("AEP_TEST_EMPTY", "")
+	t.Setenv("AEP_TEST_UNSET", "")
+	os.Unsetenv("AEP_TEST_UNSET")
+
+	tests := []struct {
+		name    string
+		config  string
+		check   func(t *testing.T, cfg *ImageConfig)
+		wantErr string
+	}{
+		{
+			name:   "set variable",
+			config: "image:\n  base: ${AEP_TEST_REGISTRY}/debian:12-slim\n",
+			check: func(t *testing.T, cfg *ImageConfig) {
+				if cfg.Image.Base != "registry.example.com/debian:12-slim" {
+					t.Errorf("unexpected image.base %q", cfg.Image.Base)
+				}
+			},
+		},
+		{
+			name:   "unset variable with default",
+			config: "image:\n  base: ${AEP_TEST_MIRROR:-docker.io}/debian:12-slim\nmise:\n  env:\n    node_mirror_url: ${AEP_TEST_EMPTY:-https://nodejs.org/dist}\n    python_compile: false\n",
+			check: func(t *testing.T, cfg *ImageConfig) {
+				if cfg.Image.Base != "docker.io/debian:12-slim" {
+					t.Errorf("unexpected image.base %q", cfg.Image.Base)
+				}
+				if got := cfg.Mise.Env["node_mirror_url"]; got != "https://nodejs.org/dist" {
+					t.Errorf("expected the default for an empty variable, got %v", got)
+				}
+				if got := cfg.Mise.Env["python_compile"]; got != false {
+					t.Errorf("expected non-string values to be left alone, got %v", got)
+				}
+			},
+		},
+		{
+			name:    "unset variable without default",
+			config:  "mise:\n  env:\n    github_token: ${AEP_TEST_UNSET}\n",
+			wantErr: "mise.env.github_token: environment variable AEP_TEST_UNSET is not set",
+		},
+		{
+			name:   "shell snippets are left alone",
+			config: "agents:\n  mine:\n    packageName: npm:mine\n    envVars:\n      - TOKEN=${AEP_TEST_UNSET}\n",
+			check: func(t *testing.T, cfg *ImageConfig) {
+				if got := cfg.Agents["mine"].EnvVars[0]; got != "TOKEN=${AEP_TEST_UNSET}" {
+					t.Errorf("expected envVars to be left for the shell, got %q", got)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configPath, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadMergedConfig(defaultConfigYAML, LoadOptions{ConfigPath: configPath, NoUserConfig: true})
+			if tt.wantErr != "" {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), configPath) {
+					t.Errorf("expected error naming %q and the file, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
+
+func TestLoadMergedConfig_EnvRefsToBuildArgs(t *testing.T) {
+	t.Setenv("DEBIAN_TAG", "")
+	os.Unsetenv("DEBIAN_TAG")
+	t.Setenv("AEP_TEST_UNSET", "")
+	os.Unsetenv("AEP_TEST_UNSET")
+
+	// The documented buildArgs example, with DEBIAN_TAG unset on the host
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	config := "image:\n  base: debian:${DEBIAN_TAG}\n  buildArgs:\n    DEBIAN_TAG: 12-slim\n"
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	imgCfg, err := LoadMergedConfig(defaultConfigYAML, LoadOptions{ConfigPath: configPath, NoUserConfig: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if imgCfg.Image.Base != "debian:${DEBIAN_TAG}" {
+		t.Errorf("expected the build arg reference to be left for Docker, got %q", imgCfg.Image.Base)
+	}
+	spec := getToolSpec(t, imgCfg, "claude")
+	dockerfile := buildDockerfile(false, false, buildDefaultCollection("claude", spec), spec, imgCfg, "claude", nil)
+	if !strings.HasPrefix(dockerfile, "ARG DEBIAN_TAG\nFROM debian:${DEBIAN_TAG}\n") {
+		t.Errorf("expected an ARG before FROM, got:\n%s", dockerfile)
+	}
+
+	// A build arg from another config file or --build-arg counts too, while
+	// other unset variables are still an error
+	xdgDir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", xdgDir)
+	projectDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(projectDir)
+	if err := os.WriteFile(filepath.Join(xdgDir, "agent-en-place.yaml"), []byte("image:\n  buildArgs:\n    DEBIAN_TAG: 12-slim\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(configPath, []byte("image:\n  base: ${REGISTRY}/debian:${DEBIAN_TAG}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	imgCfg, err = LoadMergedConfig(defaultConfigYAML, LoadOptions{ConfigPath: configPath, BuildArgs: []string{"REGISTRY"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if imgCfg.Image.Base != "${REGISTRY}/debian:${DEBIAN_TAG}" {
+		t.Errorf("unexpected image.base %q", imgCfg.Image.Base)
+	}
+	if err := os.WriteFile(configPath, []byte("image:\n  base: ${AEP_TEST_UNSET}/debian:${DEBIAN_TAG}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadMergedConfig(defaultConfigYAML, LoadOptions{ConfigPath: configPath})
+	if err == nil || !strings.Contains(err.Error(), "image.base: environment variable AEP_TEST_UNSET is not set") {
+		t.Errorf("expected an error for the unset variable that isn't a build arg, got %v", err)
+	}
+}
+
+func TestImageConfigValidate_DefaultConfig(t *testing.T) {
+	if err := loadTestConfig(t).Validate(); err != nil {
+		t.Errorf("expected the default config to be valid, got:\n%s", err)
+	}
+}
+
+func TestDockerfile_Claude_AgentUID(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	imgCfg.Image.AgentUID = 1001
+	imgCfg.Image.AgentGID = 1001
+	spec := getToolSpec(t, imgCfg, "claude")
+	collection := buildDefaultCollection("claude", spec)
+
+	got := buildDockerfile(false, false, collection, spec, imgCfg, "claude", nil)
+	if err := validateDockerfile(got); err != nil {
+		t.Errorf("expected valid Dockerfile, got: %v", err)
+	}
+	goldenTest(t, "dockerfile_claude_agent_uid.golden", got)
+}
+
+func TestLoadMergedConfig_NegativeAgentUID(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte("image:\n  agentUid: -1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadMergedConfig(defaultConfigYAML, LoadOptions{ConfigPath: configPath, NoUserConfig: true})
+	if err == nil || !strings.Contains(err.Error(), "image.agentUid must be a positive integer") {
+		t.Errorf("expected an agentUid error, got %v", err)
+	}
+}
+
+func TestParseMountFlags(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := parseMountFlags([]string{"/tmp/cache/:/cache", "~/shared:/data/../shared:ro", "build:/build:rw"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{
+		"/tmp/cache:/cache",
+		filepath.Join(home, "shared") + ":/shared:ro",
+		filepath.Join(cwd, "build") + ":/build:rw",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mounts mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, value := range []string{"/tmp/cache", ":/cache", "/tmp/cache:", "/tmp:cache", "/tmp:/cache:rx", "/a:/b:ro:z"} {
+		if _, err := parseMountFlags([]string{value}); err == nil || !strings.Contains(err.Error(), "invalid --mount") {
+			t.Errorf("expected an invalid --mount error for %q, got %v", value, err)
+		}
+	}
+}
+
+func TestValidateEnvFlags(t *testing.T) {
+	if err := validateEnvFlags([]string{"API_KEY=secret", "HOME_DIR", "EMPTY="}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, value := range []string{"=value", "MY KEY=value"} {
+		if err := validateEnvFlags([]string{value}); err == nil {
+			t.Errorf("expected an error for %q", value)
+		}
+	}
+}
+
+func TestMergeExtraRunSettings(t *testing.T) {
+	spec := ToolSpec{
+		ConfigDir:        ".claude",
+		AdditionalMounts: []string{".cache/claude"},
+		EnvVars:          []string{"TERM=xterm-256color", "CLAUDE_MODEL=sonnet"},
+	}
+	env, binds := buildRunEnv(spec), buildRunBinds(spec, "/project", "/home/user")
+
+	gotEnv, gotBinds := mergeExtraRunSettings(env, binds, []string{"CLAUDE_MODEL=opus", "API_KEY"}, []string{"/srv/cache:/home/agent/.cache/claude:ro", "/srv/data:/data"})
+	wantEnv := []string{"MISE_ENV=agent", "TERM=xterm-256color", "CLAUDE_MODEL=opus", "API_KEY"}
+	if diff := cmp.Diff(wantEnv, gotEnv); diff != "" {
+		t.Errorf("run env mismatch (-want +got):\n%s", diff)
+	}
+	wantBinds := []string{
+		"/project:/workdir",
+		"/home/user/.claude:/home/agent/.claude",
+		"/srv/cache:/home/agent/.cache/claude:ro",
+		"/srv/data:/data",
+	}
+	if diff := cmp.Diff(wantBinds, gotBinds); diff != "" {
+		t.Errorf("run binds mismatch (-want +got):\n%s", diff)
+	}
+
+	gotEnv, gotBinds = mergeExtraRunSettings(env, binds, nil, nil)
+	if diff := cmp.Diff(env, gotEnv); diff != "" {
+		t.Errorf("expected env unchanged without flags (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(binds, gotBinds); diff != "" {
+		t.Errorf("expected binds unchanged without flags (-want +got):\n%s", diff)
+	}
+}
+
+func TestPassEnvVars(t *testing.T) {
+	buf := captureLog(t, "text")
+	host := map[string]string{"ANTHROPIC_API_KEY": "sk-ant", "EMPTY_KEY": "", "GH_TOKEN": "gh"}
+	lookup := func(name string) (string, bool) {
+		v, ok := host[name]
+		return v, ok
+	}
+	spec := ToolSpec{
+		EnvVars: []string{`GH_TOKEN="$(gh auth token)"`},
+		PassEnv: []string{"ANTHROPIC_API_KEY", "OPENAI_API_KEY", "EMPTY_KEY", "GH_TOKEN", "ANTHROPIC_API_KEY"},
+	}
+
+	got := passEnvVars("claude", spec, lookup, false)
+	if diff := cmp.Diff([]string{"ANTHROPIC_API_KEY", "EMPTY_KEY"}, got); diff != "" {
+		t.Errorf("forwarded env vars mismatch (-want +got):\n%s", diff)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected no warning when one of the passEnv keys is set, got:\n%s", buf.String())
+	}
+
+	buf = captureLog(t, "text")
+	passEnvVars("claude", spec, lookup, true)
+	if !strings.Contains(buf.String(), "debug: OPENAI_API_KEY is not set, so it isn't passed to claude") {
+		t.Errorf("expected a debug message for the unset OPENAI_API_KEY, got:\n%s", buf.String())
+	}
+	if strings.Contains(buf.String(), "GH_TOKEN") {
+		t.Errorf("expected no message for GH_TOKEN, which is in envVars, got:\n%s", buf.String())
+	}
+
+	buf = captureLog(t, "text")
+	aider := ToolSpec{PassEnv: []string{"ANTHROPIC_API_KEY", "OPENAI_API_KEY"}}
+	if got := passEnvVars("aider", aider, func(string) (string, bool) { return "", false }, false); len(got) != 0 {
+		t.Errorf("expected nothing to be forwarded, got %v", got)
+	}
+	if want := "Warning: none of ANTHROPIC_API_KEY, OPENAI_API_KEY are set, so none are passed to aider"; !strings.Contains(buf.String(), want) {
+		t.Errorf("expected %q when no passEnv key is set, got:\n%s", want, buf.String())
+	}
+
+	buf = captureLog(t, "text")
+	passEnvVars("codex", ToolSpec{PassEnv: []string{"OPENAI_API_KEY"}}, func(string) (string, bool) { return "", false }, false)
+	if !strings.Contains(buf.String(), "OPENAI_API_KEY is not set, so it isn't passed to codex") {
+		t.Errorf("expected a warning for the unset OPENAI_API_KEY, got:\n%s", buf.String())
+	}
+}
+
+func TestValidate_PassEnv(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	agent := imgCfg.Agents["claude"]
+	agent.PassEnv = []string{"ANTHROPIC_API_KEY=sk-ant"}
+	imgCfg.Agents["claude"] = agent
+	err := imgCfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), `agents.claude.passEnv: "ANTHROPIC_API_KEY=sk-ant" is not an env var name`) {
+		t.Errorf("expected a passEnv error, got %v", err)
+	}
+}
+
+func TestRun_DryRun(t *testing.T) {
+	project := t.TempDir()
+	os.WriteFile(filepath.Join(project, ".tool-versions"), []byte("python 3.12.1\n"), 0644)
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("AGENT_EN_PLACE_TOOLS", "")
+	// Any attempt to reach Docker fails against a socket that doesn't exist
+	t.Setenv("DOCKER_HOST", "unix://"+filepath.Join(t.TempDir(), "docker.sock"))
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	runErr := Run(Config{Tool: "claude", DryRun: true, Project: project})
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	if runErr != nil {
+		t.Fatalf("unexpected error: %v", runErr)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if !strings.HasPrefix(lines[0], "Dry run: build context for mheap/agent-en-place:") {
+		t.Errorf("expected the image name first, got %q", lines[0])
+	}
+	for _, file := range []string{"Dockerfile", "mise.agent.toml", ".tool-versions"} {
+		if !regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(file) + `\s+\d{4}\s+\d+$`).Match(out) {
+			t.Errorf("expected %s to be listed with its mode and size, got:\n%s", file, out)
+		}
+	}
+	var files, size int
+	if _, err := fmt.Sscanf(lines[len(lines)-1], "%d files, %d bytes", &files, &size); err != nil {
+		t.Fatalf("expected a files and bytes summary, got %q", lines[len(lines)-1])
+	}
+	if files != len(lines)-3 || size == 0 || size%512 != 0 {
+		t.Errorf("unexpected summary %q for:\n%s", lines[len(lines)-1], out)
+	}
+}
+
+func TestRun_DryRunValidatesDockerfile(t *testing.T) {
+	project := t.TempDir()
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(config, []byte("mise:\n  install:\n    - apt-get install -y\n"), 0644)
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("AGENT_EN_PLACE_TOOLS", "")
+	t.Setenv("DOCKER_HOST", "unix://"+filepath.Join(t.TempDir(), "docker.sock"))
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	runErr := Run(Config{Tool: "claude", DryRun: true, Project: project, ConfigPath: config})
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	if runErr == nil || !strings.Contains(runErr.Error(), "package install has no packages") {
+		t.Errorf("expected --dry-run to reject the Dockerfile, got %v", runErr)
+	}
+	if len(out) != 0 {
+		t.Errorf("expected nothing printed for an invalid Dockerfile, got:\n%s", out)
+	}
+}
+
+func TestCollectToolSpecs_WarnsOnVersionConflicts(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	t.Setenv("AGENT_EN_PLACE_TOOLS", "")
+	t.Setenv("AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY", "")
+
+	if err := os.WriteFile(".nvmrc", []byte("v20.11.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(".python-version", []byte("3.12\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+	toolFile := &fileSpec{path: ".tool-versions", data: []byte("node 18\npython 3.12.1\n"), mode: 0644}
+	miseFile := &fileSpec{path: "mise.toml", data: []byte("[tools]\nnode = \"20\"\n"), mode: 0644}
+
+	buf := captureLog(t, "text")
+	collection := collectToolSpecs(toolFile, miseFile, spec, imgCfg, "claude", collectOptions{})
+
+	want := "node has conflicting versions: 18 (.tool-versions), 20 (mise.toml), 20.11.1 (.nvmrc); using 18 from .tool-versions"
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("expected warning %q, got:\n%s", want, buf.String())
+	}
+	if strings.Contains(buf.String(), "python has conflicting versions") {
+		t.Errorf("expected 3.12 and 3.12.1 to agree, got:\n%s", buf.String())
+	}
+	// The warning doesn't change which version wins
+	for _, tool := range collection.specs {
+		if tool.name == "node" && tool.version != "18" {
+			t.Errorf("expected .tool-versions to win with node 18, got %s", tool.version)
+		}
+	}
+}
+
+func TestVersionsAgree(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"20", "20", true},
+		{"20", "20.11.1", true},
+		{"20.11.1", "20", true},
+		{"2", "20", false},
+		{"18", "20", false},
+		{"latest", "20", false},
+	}
+	for _, tt := range tests {
+		if got := versionsAgree(tt.a, tt.b); got != tt.want {
+			t.Errorf("versionsAgree(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestAgentNames_IncludesProjectAgents(t *testing.T) {
+	project := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	config := "agents:\n  my-agent:\n    packageName: npm:my-agent\n    command: my-agent\n"
+	if err := os.WriteFile(filepath.Join(project, ".agent-en-place.yaml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := AgentNames(Config{Project: project})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"aider", "claude", "codex", "copilot", "gemini", "my-agent", "opencode"}
+	if diff := cmp.Diff(want, names); diff != "" {
+		t.Errorf("agent names mismatch (-want +got):\n%s", diff)
+	}
+
+	names, err = AgentNames(Config{Project: project, NoUserConfig: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if slices.Contains(names, "my-agent") {
+		t.Errorf("expected --no-user-config to skip the project agent, got %v", names)
+	}
+}
+
+func TestWriteAgentList(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	imgCfg.Agents["my-agent"] = AgentConfig{LocalBinary: "/opt/my-agent/bin/my-agent", Command: "my-agent"}
+	imgCfg.AgentAliases = map[string]string{"cc": "claude", "ai": "aider"}
+
+	var out bytes.Buffer
+	writeAgentList(&out, imgCfg)
+	goldenTest(t, "list_agents.golden", out.String())
+}
+
+func TestFindMiseFileSpec(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		wantPath string
+		wantWarn bool
+	}{
+		{
+			name:     "dotfile",
+			files:    map[string]string{".mise.toml": "[tools]\nnode = \"20\"\n"},
+			wantPath: ".mise.toml",
+		},
+		{
+			name:     "mise directory",
+			files:    map[string]string{"mise/config.toml": "[tools]\nnode = \"20\"\n"},
+			wantPath: filepath.Join("mise", "config.toml"),
+		},
+		{
+			name: "dotfile wins over mise.toml",
+			files: map[string]string{
+				"mise.toml":  "[tools]\nnode = \"18\"\n",
+				".mise.toml": "[tools]\nnode = \"20\"\n",
+			},
+			wantPath: ".mise.toml",
+			wantWarn: true,
+		},
+		{
+			name:  "none",
+			files: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tt.files {
+				path := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			buf := captureLog(t, "text")
+
+			file, err := findMiseFileSpec(dir)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantPath == "" {
+				if file != nil {
+					t.Fatalf("expected no mise config, got %s", file.path)
+				}
+				return
+			}
+			if file == nil || file.path != filepath.Join(dir, tt.wantPath) {
+				t.Fatalf("expected %s, got %+v", tt.wantPath, file)
+			}
+			tools := parseMiseToml(file)
+			if len(tools) != 1 || tools[0].name != "node" || tools[0].version != "20" {
+				t.Errorf("expected node 20 from %s, got %+v", tt.wantPath, tools)
+			}
+			if warned := strings.Contains(buf.String(), "found several mise config files"); warned != tt.wantWarn {
+				t.Errorf("expected warning %v, got:\n%s", tt.wantWarn, buf.String())
+			}
+		})
+	}
+}
+
+func TestRun_DotMiseTomlCopiedAsMiseToml(t *testing.T) {
+	project := t.TempDir()
+	os.WriteFile(filepath.Join(project, ".mise.toml"), []byte("[tools]\npython = \"3.12\"\n"), 0644)
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("AGENT_EN_PLACE_TOOLS", "")
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	runErr := Run(Config{Tool: "claude", DockerfileOnly: true, Project: project})
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	if runErr != nil {
+		t.Fatalf("unexpected error: %v", runErr)
+	}
+	if !strings.Contains(string(out), "COPY mise.toml /home/agent/.config/mise/config.toml") {
+		t.Errorf("expected the .mise.toml to be copied as the user mise config, got:\n%s", out)
+	}
+	if !strings.Contains(string(out), `com.mheap.agent-en-place.python="3.12"`) {
+		t.Errorf("expected python from .mise.toml to be detected, got:\n%s", out)
+	}
+}
+
+func TestValidateResourceLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		memory  string
+		cpus    string
+		wantErr string
+	}{
+		{name: "unset"},
+		{name: "both", memory: "2g", cpus: "1.5"},
+		{name: "memory only", memory: "512M"},
+		{name: "cpus only", cpus: "2"},
+		{name: "fractional memory", memory: "1.5g"},
+		{name: "bad memory unit", memory: "2gb", wantErr: `invalid --memory "2gb"`},
+		{name: "memory too small", memory: "4m", wantErr: "the minimum is 6m"},
+		{name: "negative cpus", cpus: "-1", wantErr: `invalid --cpus "-1"`},
+		{name: "zero cpus", cpus: "0", wantErr: `invalid --cpus "0"`},
+		{name: "cpus not a number", cpus: "two", wantErr: `invalid --cpus "two"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateResourceLimits(tt.memory, tt.cpus)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestRunSpec_Resources(t *testing.T) {
+	run := runSpec{image: "mheap/agent-en-place:test", command: "claude", hostname: "claude", memory: "1.5g", cpus: "0.5"}
+	if diff := cmp.Diff([]string{"--hostname claude", "--memory 1.5g", "--cpus 0.5"}, run.printArgs()); diff != "" {
+		t.Errorf("print args mismatch (-want +got):\n%s", diff)
+	}
+	options, err := run.createOptions()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if options.HostConfig.Memory != 1536*1024*1024 {
+		t.Errorf("expected 1.5g in bytes, got %d", options.HostConfig.Memory)
+	}
+	if options.HostConfig.NanoCPUs != 500000000 {
+		t.Errorf("expected 0.5 CPUs as nano CPUs, got %d", options.HostConfig.NanoCPUs)
+	}
+}
+
+func TestCollectToolSpecs_PinnedAgentVersion(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	t.Setenv("AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY", "")
+
+	imgCfg := loadTestConfig(t)
+	agent := imgCfg.Agents["claude"]
+	agent.PackageVersion = "1.0.100"
+	imgCfg.Agents["claude"] = agent
+	spec := getToolSpec(t, imgCfg, "claude")
+
+	tests := []struct {
+		name     string
+		envTools string
+		want     string
+	}{
+		{"config", "", "1.0.100"},
+		{"env overrides config", "npm:@anthropic-ai/claude-code@1.2.0", "1.2.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AGENT_EN_PLACE_TOOLS", tt.envTools)
+			collection := collectToolSpecs(nil, nil, spec, imgCfg, "claude", collectOptions{})
+
+			imageName := buildImageName(imageTagSpecs(collection.specs, spec, imgCfg))
+			if !strings.Contains(imageName, "npm-anthropic-ai-claude-code-"+tt.want) {
+				t.Errorf("expected the pinned version in the image tag, got %s", imageName)
+			}
+
+			data, err := agentMiseConfig(nil, collection, spec, imgCfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !strings.Contains(string(data), `"npm:@anthropic-ai/claude-code" = "`+tt.want+`"`) {
+				t.Errorf("expected the pinned version in mise.agent.toml, got:\n%s", data)
+			}
+		})
+	}
+}
+
+func TestValidate_PackageVersionWithoutPackage(t *testing.T) {
+	imgCfg := loadTestConfig(t)
+	imgCfg.Agents["my-agent"] = AgentConfig{LocalBinary: "/usr/local/bin/my-agent", PackageVersion: "1.0.0", Command: "my-agent"}
+	err := imgCfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "agents.my-agent: packageVersion needs a packageName") {
+		t.Errorf("expected a packageVersion error, got %v", err)
+	}
+}
+
+func TestCollectToolSpecsCached_HitAndMiss(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(tmpDir, "cache"))
+	t.Setenv("HOME", tmpDir)
+	t.Setenv("AGENT_EN_PLACE_TOOLS", "")
+	t.Setenv("AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY", "")
+
+	if err := os.WriteFile(".nvmrc", []byte("20\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	imgCfg := loadTestConfig(t)
+	enabled := true
+	imgCfg.Detection.Cache = &enabled
+	spec := getToolSpec(t, imgCfg, "claude")
+	miseFile := &fileSpec{path: "mise.toml", data: []byte("[tools]\npython = \"3.12\"\n"), mode: 0644}
+	opts := collectOptions{debug: true}
+	unexported := cmp.AllowUnexported(collectResult{}, toolDescriptor{}, idiomaticInfo{})
+
+	collect := func() (collectResult, bool) {
+		t.Helper()
+		buf := captureLog(t, "text")
+		collection := collectToolSpecsCached(nil, miseFile, spec, imgCfg, "claude", opts)
+		return collection, strings.Contains(buf.String(), "using cached tool detection")
+	}
+
+	want := collectToolSpecs(nil, miseFile, spec, imgCfg, "claude", collectOptions{})
+	if got, hit := collect(); hit {
+		t.Fatal("expected a miss on the first run")
+	} else if diff := cmp.Diff(want, got, unexported); diff != "" {
+		t.Errorf("collection mismatch (-want +got):\n%s", diff)
+	}
+	got, hit := collect()
+	if !hit {
+		t.Fatal("expected a hit when nothing changed")
+	}
+	if diff := cmp.Diff(want, got, unexported); diff != "" {
+		t.Errorf("cached collection mismatch (-want +got):\n%s", diff)
+	}
+
+	// Changing an idiomatic version file misses, even when its size doesn't change
+	future := time.Now().Add(time.Hour)
+	if err := os.WriteFile(".nvmrc", []byte("22\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(".nvmrc", future, future); err != nil {
+		t.Fatal(err)
+	}
+	got, hit = collect()
+	if hit {
+		t.Error("expected a miss after .nvmrc changed")
+	}
+	for _, tool := range got.specs {
+		if tool.name == "node" && tool.version != "22" {
+			t.Errorf("expected node 22 from the changed .nvmrc, got %s", tool.version)
+		}
+	}
+	if _, hit := collect(); !hit {
+		t.Error("expected a hit after the changed .nvmrc was cached")
+	}
+
+	// Creating a version file that wasn't there before misses
+	if err := os.WriteFile(".ruby-version", []byte("3.3.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, hit := collect(); hit {
+		t.Error("expected a miss after .ruby-version was created")
+	}
+
+	// So do changes to the mise config and the merged config
+	miseFile = &fileSpec{path: "mise.toml", data: []byte("[tools]\npython = \"3.13\"\n"), mode: 0644}
+	if _, hit := collect(); hit {
+		t.Error("expected a miss after mise.toml changed")
+	}
+	imgCfg.Image.Packages = append(imgCfg.Image.Packages, "jq")
+	if _, hit := collect(); hit {
+		t.Error("expected a miss after the config changed")
+	}
+
+	// --debug doesn't change the key
+	opts.debug = false
+	collectToolSpecsCached(nil, miseFile, spec, imgCfg, "claude", opts)
+	opts.debug = true
+	if _, hit := collect(); !hit {
+		t.Error("expected --debug to share cache entries with normal runs")
+	}
+}
+
+func TestCollectToolSpecsCached_WorkflowVersionFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(tmpDir, "cache"))
+	t.Setenv("HOME", tmpDir)
+	t.Setenv("AGENT_EN_PLACE_TOOLS", "")
+	t.Setenv("AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY", "")
+
+	if err := os.MkdirAll(filepath.Join(workflowsDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	workflow := "jobs:\n  test:\n    steps:\n      - uses: actions/setup-node@v4\n        with:\n          node-version-file: frontend/node-version\n"
+	if err := os.WriteFile(filepath.Join(workflowsDir, "ci.yml"), []byte(workflow), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir("frontend", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("frontend/node-version", []byte("20\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	imgCfg := loadTestConfig(t)
+	enabled := true
+	imgCfg.Detection.Cache = &enabled
+	spec := getToolSpec(t, imgCfg, "claude")
+	opts := collectOptions{fromWorkflows: true}
+
+	nodeVersion := func() string {
+		t.Helper()
+		for _, tool := range collectToolSpecsCached(nil, nil, spec, imgCfg, "claude", opts).specs {
+			if tool.name == "node" {
+				return tool.version
+			}
+		}
+		return ""
+	}
+	if got := nodeVersion(); got != "20" {
+		t.Fatalf("expected node 20 from the workflow, got %q", got)
+	}
+
+	// The version file isn't an idiomatic file, but changing it still misses
+	future := time.Now().Add(time.Hour)
+	if err := os.WriteFile("frontend/node-version", []byte("22\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes("frontend/node-version", future, future); err != nil {
+		t.Fatal(err)
+	}
+	if got := nodeVersion(); got != "22" {
+		t.Errorf("expected node 22 after the version file changed, got %q", got)
+	}
+}
+
+func TestCollectToolSpecsCached_MissesOnOtherInputs(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(tmpDir, "cache"))
+	t.Setenv("HOME", tmpDir)
+	t.Setenv("AGENT_EN_PLACE_TOOLS", "")
+	t.Setenv("AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY", "")
+	t.Setenv("AGENT_EN_PLACE_GO_TOOLCHAIN", "")
+
+	imgCfg := loadTestConfig(t)
+	enabled := true
+	imgCfg.Detection.Cache = &enabled
+	spec := getToolSpec(t, imgCfg, "claude")
+	version := func(name string) string {
+		t.Helper()
+		for _, tool := range collectToolSpecsCached(nil, nil, spec, imgCfg, "claude", collectOptions{}).specs {
+			if tool.name == name {
+				return tool.version
+			}
+		}
+		return ""
+	}
+	future := time.Now().Add(time.Hour)
+
+	// .sdkmanrc is read through multiToolFiles rather than idiomaticToolFiles
+	if err := os.WriteFile(".sdkmanrc", []byte("java=17\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := version("java"); got != "17" {
+		t.Fatalf("expected java 17 from .sdkmanrc, got %q", got)
+	}
+	if err := os.WriteFile(".sdkmanrc", []byte("java=21\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(".sdkmanrc", future, future); err != nil {
+		t.Fatal(err)
+	}
+	if got := version("java"); got != "21" {
+		t.Errorf("expected a miss giving java 21 after .sdkmanrc changed, got %q", got)
+	}
+
+	// AGENT_EN_PLACE_GO_TOOLCHAIN changes how go.mod is read
+	if err := os.WriteFile("go.mod", []byte("module example\n\ngo 1.22\n\ntoolchain go1.23.4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := version("go"); got != "1.22" {
+		t.Fatalf("expected go 1.22 from go.mod, got %q", got)
+	}
+	t.Setenv("AGENT_EN_PLACE_GO_TOOLCHAIN", "1")
+	if got := version("go"); got != "1.23.4" {
+		t.Errorf("expected a miss giving the go.mod toolchain after AGENT_EN_PLACE_GO_TOOLCHAIN was set, got %q", got)
+	}
+
+	// Files matching a `when` glob decide whether a dependency is installed
+	imgCfg.Tools["python"] = ToolConfigEntry{Version: "3.12", When: []string{"*.py"}}
+	agentCfg := imgCfg.Agents["claude"]
+	agentCfg.Depends = []string{"python"}
+	imgCfg.Agents["claude"] = agentCfg
+	spec = getToolSpec(t, imgCfg, "claude")
+	if got := version("python"); got != "" {
+		t.Fatalf("expected no python without a matching file, got %q", got)
+	}
+	if err := os.WriteFile("main.py", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := version("python"); got != "3.12" {
+		t.Errorf("expected a miss giving python once main.py exists, got %q", got)
+	}
+}
+
+func TestCollectToolSpecsCached_Disabled(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	cacheDir := filepath.Join(tmpDir, "cache")
+	t.Setenv("XDG_CACHE_HOME", cacheDir)
+	t.Setenv("HOME", tmpDir)
+
+	imgCfg := loadTestConfig(t)
+	spec := getToolSpec(t, imgCfg, "claude")
+	collectToolSpecsCached(nil, nil, spec, imgCfg, "claude", collectOptions{})
+
+	if _, err := os.Stat(cacheDir); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be cached without detection.cache, got %v", err)
+	}
+}
+
+func benchmarkCollection(b *testing.B, cache bool, opts collectOptions) {
+	tmpDir := b.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	b.Setenv("XDG_CACHE_HOME", filepath.Join(tmpDir, "cache"))
+	b.Setenv("HOME", tmpDir)
+	b.Setenv("AGENT_EN_PLACE_TOOLS", "")
+	b.Setenv("AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY", "")
+
+	for _, file := range []string{".nvmrc", ".python-version", ".ruby-version"} {
+		if err := os.WriteFile(file, []byte("3\n"), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(workflowsDir, 0755); err != nil {
+		b.Fatal(err)
+	}
+	for i := range 5 {
+		workflow := fmt.Sprintf("jobs:\n  test:\n    runs-on: ubuntu-latest\n    steps:\n      - uses: actions/checkout@v4\n      - uses: actions/setup-node@v4\n        with:\n          node-version: %d\n      - uses: actions/setup-go@v5\n        with:\n          go-version: \"1.2%d\"\n      - run: make test\n", 18+i, i)
+		if err := os.WriteFile(filepath.Join(workflowsDir, fmt.Sprintf("ci%d.yml", i)), []byte(workflow), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	imgCfg, err := LoadMergedConfig(defaultConfigYAML, LoadOptions{NoUserConfig: true})
+	if err != nil {
+		b.Fatal(err)
+	}
+	imgCfg.Detection.Cache = &cache
+	agentCfg, _ := imgCfg.GetAgent("claude")
+	spec := agentCfg.ToToolSpec()
+	miseFile := &fileSpec{path: "mise.toml", data: []byte("[tools]\ngo = \"1.23\"\n"), mode: 0644}
+	logOutput = io.Discard
+	defer func() { logOutput = os.Stderr }()
+
+	b.ResetTimer()
+	for b.Loop() {
+		collectToolSpecsCached(nil, miseFile, spec, imgCfg, "claude", opts)
+	}
+}
+
+func BenchmarkCollectToolSpecs(b *testing.B) {
+	benchmarkCollection(b, false, collectOptions{})
+}
+
+func BenchmarkCollectToolSpecsCached(b *testing.B) {
+	benchmarkCollection(b, true, collectOptions{})
+}
+
+func BenchmarkCollectToolSpecs_FromWorkflows(b *testing.B) {
+	benchmarkCollection(b, false, collectOptions{fromWorkflows: true})
+}
+
+func BenchmarkCollectToolSpecsCached_FromWorkflows(b *testing.B) {
+	benchmarkCollection(b, true, collectOptions{fromWorkflows: true})
+}
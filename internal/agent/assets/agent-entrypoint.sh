@@ -1,4 +1,60 @@
 #!/bin/bash
+# With --fix-workdir-perms the container starts as root so the agent user can
+# be given the uid and gid that own the bind-mounted workdir before dropping
+# privileges. Only files in the image are re-owned: the workdir is left alone
+# and chown_tree skips anything mounted from the host, such as the agent's
+# config dir.
+
+# chown_tree gives dir and everything in it to owner, skipping the mount
+# points under dir listed in mountinfo (/proc/self/mountinfo by default) and
+# never crossing into another filesystem
+chown_tree() {
+  local owner=$1 dir=$2 mountinfo=${3:-/proc/self/mountinfo}
+  local prune=() mnt
+  while read -r _ _ _ _ mnt _; do
+    # mountinfo escapes spaces and other whitespace as octal, e.g. \040
+    mnt=$(printf '%b' "$mnt")
+    case "$mnt" in
+      "$dir"/*) prune+=(-path "$mnt" -o) ;;
+    esac
+  done < "$mountinfo"
+  if [ ${#prune[@]} -eq 0 ]; then
+    find "$dir" -xdev -exec chown -h "$owner" {} +
+    return
+  fi
+  unset 'prune[${#prune[@]}-1]'
+  find "$dir" -xdev \( "${prune[@]}" \) -prune -o -exec chown -h "$owner" {} +
+}
+
+if [ "${AGENT_EN_PLACE_FIX_WORKDIR_PERMS:-}" = "1" ] && [ "$(id -u)" = "0" ]; then
+  uid=$(stat -c %u /workdir)
+  gid=$(stat -c %g /workdir)
+  if [ "$uid" = "0" ]; then
+    echo "agent-en-place: /workdir is owned by root, keeping the agent user's uid" >&2
+    uid=$(id -u agent)
+    gid=$(id -g agent)
+  elif [ "$uid" != "$(id -u agent)" ] || [ "$gid" != "$(id -g agent)" ]; then
+    # Edit the account files directly, as usermod and groupmod aren't
+    # available on every base image
+    sed -i "s/^agent:\([^:]*\):[0-9]*:[0-9]*:/agent:\1:$uid:$gid:/" /etc/passwd
+    sed -i "s/^agent:\([^:]*\):[0-9]*:/agent:\1:$gid:/" /etc/group
+    chown_tree "$uid:$gid" /home/agent
+    if [ -n "${MISE_DATA_DIR:-}" ] && [ -d "$MISE_DATA_DIR" ]; then
+      chown_tree "$uid:$gid" "$MISE_DATA_DIR"
+    fi
+  fi
+
+  if command -v setpriv >/dev/null 2>&1; then
+    exec setpriv --reuid="$uid" --regid="$gid" --clear-groups /bin/bash "$0" "$@"
+  elif command -v su-exec >/dev/null 2>&1; then
+    exec su-exec "$uid:$gid" /bin/bash "$0" "$@"
+  elif command -v gosu >/dev/null 2>&1; then
+    exec gosu "$uid:$gid" /bin/bash "$0" "$@"
+  fi
+  echo "agent-en-place: --fix-workdir-perms needs setpriv, su-exec or gosu in the image; add one to image.packages" >&2
+  exit 1
+fi
+
 if [ $# -eq 0 ]; then
   exec /bin/bash --login -i
 else
@@ -0,0 +1,302 @@
+package agent
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// redactedValue replaces values that may hold secrets in a --bundle
+const redactedValue = "REDACTED"
+
+// bundleInput is everything written to a --bundle reproduction archive
+type bundleInput struct {
+	toolFile   *fileSpec
+	miseFile   *fileSpec
+	collection collectResult
+	spec       ToolSpec
+	imgCfg     *ImageConfig
+	agentName  string
+	imageName  string
+	opts       collectOptions
+	env        []string // host environment, only used for its variable names
+	buildLog   []byte   // raw JSON messages from the image build
+	buildErr   error
+}
+
+// saveBundle writes the --bundle archive to path
+func saveBundle(path string, in bundleInput) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create bundle: %w", err)
+	}
+	if err := writeBundle(f, in); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	return f.Close()
+}
+
+// writeBundle writes a gzipped tar with what a maintainer needs to reproduce
+// a build: the generated Dockerfile and mise config, the project's tool files,
+// the merged config, the resolved tool plan and the build output. Env var
+// values, build args, mise.env values and the [env] values of mise configs are
+// redacted since they may hold tokens.
+func writeBundle(w io.Writer, in bundleInput) error {
+	var userMiseData []byte
+	if in.miseFile != nil {
+		userMiseData = in.miseFile.data
+	}
+	agentMiseData, err := agentMiseConfig(userMiseData, in.collection, in.spec, in.imgCfg)
+	if err != nil {
+		return fmt.Errorf("failed to build mise.agent.toml: %w", err)
+	}
+	redactedUserMise, userEnvValues, err := redactMiseConfig(userMiseData)
+	if err != nil {
+		return fmt.Errorf("failed to redact %s: %w", in.miseFile.path, err)
+	}
+	redactedAgentMise, agentEnvValues, err := redactMiseConfig(agentMiseData)
+	if err != nil {
+		return fmt.Errorf("failed to redact mise.agent.toml: %w", err)
+	}
+	// Build steps may echo the values baked into the image
+	redact := secretRedactor(in.imgCfg, in.env, append(userEnvValues, agentEnvValues...))
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	cfg := sanitizeConfig(in.imgCfg)
+	dockerfile := buildDockerfile(in.toolFile != nil, in.miseFile != nil, in.collection, in.spec, cfg, in.agentName, redactEnv(in.env))
+	if err := writeFileToTar(tw, "Dockerfile", []byte(dockerfile), 0644); err != nil {
+		return err
+	}
+
+	if err := writeFileToTar(tw, "mise.agent.toml", redactedAgentMise, 0644); err != nil {
+		return err
+	}
+	if in.miseFile != nil {
+		if err := writeFileToTar(tw, in.miseFile.path, redactedUserMise, 0644); err != nil {
+			return err
+		}
+	}
+	if in.toolFile != nil {
+		if err := writeFileToTar(tw, in.toolFile.path, in.toolFile.data, 0644); err != nil {
+			return err
+		}
+	}
+	if err := writeIdiomaticFiles(tw, in.collection.idiomaticPaths); err != nil {
+		return err
+	}
+
+	configData, err := yaml.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	if err := writeFileToTar(tw, "config.yaml", configData, 0644); err != nil {
+		return err
+	}
+
+	var plan bytes.Buffer
+	if err := writeToolReport(&plan, buildToolReport(in.toolFile, in.miseFile, in.collection, in.spec, cfg, in.agentName, in.imageName, in.opts)); err != nil {
+		return err
+	}
+	if err := writeFileToTar(tw, "plan.json", plan.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	if err := writeFileToTar(tw, "build.log", []byte(redact.Replace(buildLogText(in.buildLog))), 0644); err != nil {
+		return err
+	}
+	if in.buildErr != nil {
+		if err := writeFileToTar(tw, "error.txt", []byte(redact.Replace(in.buildErr.Error())+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// sanitizeConfig returns a copy of the config with values that may be secrets
+// replaced: agent env var values, build args and mise.env values. Keys are
+// kept so the shape of the config is still visible.
+func sanitizeConfig(cfg *ImageConfig) *ImageConfig {
+	clean := *cfg
+
+	clean.Agents = make(map[string]AgentConfig, len(cfg.Agents))
+	for name, agent := range cfg.Agents {
+		envVars := make([]string, len(agent.EnvVars))
+		for i, env := range agent.EnvVars {
+			if key, _, ok := strings.Cut(env, "="); ok {
+				env = key + "=" + redactedValue
+			}
+			envVars[i] = env
+		}
+		agent.EnvVars = envVars
+		clean.Agents[name] = agent
+	}
+
+	if cfg.Image.BuildArgs != nil {
+		clean.Image.BuildArgs = make(map[string]string, len(cfg.Image.BuildArgs))
+		for key := range cfg.Image.BuildArgs {
+			clean.Image.BuildArgs[key] = redactedValue
+		}
+	}
+	if cfg.Mise.Env != nil {
+		clean.Mise.Env = make(map[string]any, len(cfg.Mise.Env))
+		for key := range cfg.Mise.Env {
+			clean.Mise.Env[key] = redactedValue
+		}
+	}
+	clean.Tools = maps.Clone(cfg.Tools)
+	return &clean
+}
+
+// redactMiseConfig replaces the values of every [env] table in a mise config,
+// including those of tasks, returning the values it replaced. Configs without
+// an [env] table are returned as they are, so their formatting is kept.
+func redactMiseConfig(data []byte) ([]byte, []string, error) {
+	if len(data) == 0 {
+		return data, nil, nil
+	}
+	var config map[string]any
+	if err := toml.Unmarshal(data, &config); err != nil {
+		return nil, nil, err
+	}
+	values := redactEnvTables(config)
+	if len(values) == 0 {
+		return data, nil, nil
+	}
+	redacted, err := toml.Marshal(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return redacted, values, nil
+}
+
+// redactEnvTables replaces the values of env tables found anywhere in table,
+// leaving mise's "_" directives such as _.path alone
+func redactEnvTables(table map[string]any) []string {
+	var values []string
+	for key, value := range table {
+		child, ok := value.(map[string]any)
+		if !ok {
+			continue
+		}
+		if key != "env" {
+			values = append(values, redactEnvTables(child)...)
+			continue
+		}
+		for name, envValue := range child {
+			if name == "_" {
+				continue
+			}
+			values = append(values, stringLeaves(envValue)...)
+			child[name] = redactedValue
+		}
+	}
+	return values
+}
+
+// stringLeaves returns every string in a decoded TOML value
+func stringLeaves(value any) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case map[string]any:
+		var leaves []string
+		for _, child := range v {
+			leaves = append(leaves, stringLeaves(child)...)
+		}
+		return leaves
+	case []any:
+		var leaves []string
+		for _, child := range v {
+			leaves = append(leaves, stringLeaves(child)...)
+		}
+		return leaves
+	}
+	return nil
+}
+
+// secretRedactor replaces the values that sanitizeConfig, redactEnv and
+// redactMiseConfig hide wherever they appear in text: build args, mise.env
+// values, [env] values from mise configs, and the host's MISE_* variables,
+// agent env vars and passEnv vars. Very short values are left alone so that
+// ordinary words in the output aren't mangled.
+func secretRedactor(cfg *ImageConfig, env []string, miseEnvValues []string) *strings.Replacer {
+	names := make(map[string]bool)
+	for _, agent := range cfg.Agents {
+		for _, entry := range agent.EnvVars {
+			name, _, _ := strings.Cut(entry, "=")
+			names[name] = true
+		}
+		for _, name := range agent.PassEnv {
+			names[name] = true
+		}
+	}
+
+	var values []string
+	for _, kv := range env {
+		name, value, ok := strings.Cut(kv, "=")
+		if ok && (strings.HasPrefix(name, "MISE_") || names[name]) {
+			values = append(values, value)
+		}
+	}
+	for _, value := range cfg.Image.BuildArgs {
+		values = append(values, value)
+	}
+	for _, value := range cfg.Mise.Env {
+		values = append(values, fmt.Sprint(value))
+	}
+	values = append(values, miseEnvValues...)
+
+	var pairs []string
+	for _, value := range values {
+		if len(value) >= 4 {
+			pairs = append(pairs, value, redactedValue)
+		}
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// redactEnv keeps the names of environment variables but drops their values
+func redactEnv(env []string) []string {
+	redacted := make([]string, 0, len(env))
+	for _, kv := range env {
+		if key, _, ok := strings.Cut(kv, "="); ok {
+			redacted = append(redacted, key+"="+redactedValue)
+		}
+	}
+	return redacted
+}
+
+// buildLogText converts the daemon's JSON build messages to plain text
+func buildLogText(raw []byte) string {
+	var b strings.Builder
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var msg dockerBuildMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			continue
+		}
+		b.WriteString(msg.Stream)
+		if msg.Error != "" {
+			b.WriteString("ERROR: " + msg.Error + "\n")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,276 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// collectionCacheVersion is part of every cache key, so changing how tools
+// are collected or stored only needs this bumped to ignore old entries
+const collectionCacheVersion = "3"
+
+// collectionEnvVars are the environment variables tool detection reads
+var collectionEnvVars = []string{
+	"AGENT_EN_PLACE_TOOLS",
+	"AGENT_EN_PLACE_SPECIFIED_TOOLS_ONLY",
+	"AGENT_EN_PLACE_GO_TOOLCHAIN",
+}
+
+// cachedCollection is the on-disk form of a collectResult
+type cachedCollection struct {
+	Specs          []cachedTool `json:"specs"`
+	IdiomaticPaths []string     `json:"idiomaticPaths"`
+	IdiomaticInfos []cachedInfo `json:"idiomaticInfos"`
+	UserTools      []string     `json:"userTools"`
+	Candidates     []cachedTool `json:"candidates"`
+	// ProjectToolsSkipped records specified-only or agent-only mode
+	ProjectToolsSkipped bool `json:"projectToolsSkipped,omitempty"`
+	// Files maps files read through workflow version file inputs to their
+	// stamp when the entry was written, as they aren't part of the key
+	Files map[string]string `json:"files,omitempty"`
+}
+
+type cachedTool struct {
+	Name      string     `json:"name"`
+	Tool      string     `json:"tool"`
+	Version   string     `json:"version"`
+	LabelName string     `json:"labelName"`
+	Source    toolSource `json:"source"`
+	Fallbacks []string   `json:"fallbacks"`
+	Origin    string     `json:"origin"`
+}
+
+func newCachedTool(tool toolDescriptor) cachedTool {
+	return cachedTool{Name: tool.name, Tool: tool.tool, Version: tool.version, LabelName: tool.labelName, Source: tool.source, Fallbacks: tool.fallbacks, Origin: tool.origin}
+}
+
+func (t cachedTool) descriptor() toolDescriptor {
+	return toolDescriptor{name: t.Name, tool: t.Tool, version: t.Version, labelName: t.LabelName, source: t.Source, fallbacks: t.Fallbacks, origin: t.Origin}
+}
+
+type cachedInfo struct {
+	Tool      string     `json:"tool"`
+	Version   string     `json:"version"`
+	Path      string     `json:"path"`
+	ConfigKey string     `json:"configKey"`
+	Source    toolSource `json:"source"`
+}
+
+// collectToolSpecsCached is collectToolSpecs, reusing the result of an
+// earlier run when detection.cache is set and none of its inputs changed.
+// Warnings from detection, such as version conflicts, are only shown when
+// the tools are collected rather than read from the cache.
+func collectToolSpecsCached(toolFile, miseFile *fileSpec, spec ToolSpec, imgCfg *ImageConfig, agentName string, opts collectOptions) collectResult {
+	if !imgCfg.Detection.CacheEnabled() {
+		return collectToolSpecs(toolFile, miseFile, spec, imgCfg, agentName, opts)
+	}
+	path, err := collectionCachePath(toolFile, miseFile, spec, imgCfg, agentName, opts)
+	if err != nil {
+		if opts.debug {
+			logDebug(fmt.Sprintf("not caching tool detection: %v", err))
+		}
+		return collectToolSpecs(toolFile, miseFile, spec, imgCfg, agentName, opts)
+	}
+	if collection, ok := readCollectionCache(path); ok {
+		if opts.debug {
+			logDebug(fmt.Sprintf("using cached tool detection from %s", path), "path", path)
+		}
+		return collection
+	}
+	// Stamp the files before collecting, so a change made while collecting
+	// is picked up by the next run
+	var files map[string]string
+	if opts.fromWorkflows {
+		files = make(map[string]string)
+		for _, file := range workflowVersionFiles() {
+			files[file] = fileStamp(file)
+		}
+	}
+	collection := collectToolSpecs(toolFile, miseFile, spec, imgCfg, agentName, opts)
+	if err := writeCollectionCache(path, collection, files); err != nil && opts.debug {
+		logDebug(fmt.Sprintf("failed to cache tool detection: %v", err))
+	}
+	return collection
+}
+
+// collectionCachePath returns where the collection for these inputs is
+// cached, named after a sha256 of everything collectToolSpecs reads: the
+// merged config, the agent, the options and env vars, the contents of the
+// tool files, the files matched by each tool's `when` globs and the size,
+// mode and modification time of every version file and workflow it may read
+func collectionCachePath(toolFile, miseFile *fileSpec, spec ToolSpec, imgCfg *ImageConfig, agentName string, opts collectOptions) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	section := func(name string, data []byte) {
+		fmt.Fprintf(h, "%s %d\n", name, len(data))
+		h.Write(data)
+	}
+	section("version", []byte(collectionCacheVersion))
+	// JSON rather than YAML, as it's an order of magnitude faster to encode
+	// and still writes map keys in a stable order
+	configData, err := json.Marshal(imgCfg)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode config: %w", err)
+	}
+	section("config", configData)
+	section("agent", []byte(agentName))
+	section("spec", []byte(fmt.Sprintf("%+v", spec)))
+	// --debug only changes logging, so it shares entries with normal runs
+	keyOpts := opts
+	keyOpts.debug = false
+	section("options", []byte(fmt.Sprintf("%+v", keyOpts)))
+	for _, name := range collectionEnvVars {
+		value, set := os.LookupEnv(name)
+		section("env "+name, []byte(fmt.Sprintf("%t %s", set, value)))
+	}
+	for _, file := range []*fileSpec{toolFile, miseFile} {
+		if file != nil {
+			section("file "+file.path, file.data)
+		}
+	}
+	for _, path := range collectionInputPaths(opts) {
+		section("stat "+path, []byte(fileStamp(path)))
+	}
+	for _, pattern := range whenPatterns(imgCfg) {
+		matches, _ := filepath.Glob(pattern)
+		section("when "+pattern, []byte(strings.Join(matches, "\n")))
+	}
+
+	key := hex.EncodeToString(h.Sum(nil))
+	return filepath.Join(cacheDir, "agent-en-place", "collections", key+".json"), nil
+}
+
+// collectionInputPaths lists the files tool detection may read besides
+// .tool-versions and the mise config, whose contents are hashed directly
+func collectionInputPaths(opts collectOptions) []string {
+	var paths []string
+	for _, files := range idiomaticToolFiles {
+		paths = append(paths, files...)
+	}
+	for _, file := range multiToolFiles {
+		paths = append(paths, file.path)
+	}
+	if opts.fromWorkflows {
+		paths = append(paths, workflowsDir)
+		paths = append(paths, workflowPaths()...)
+	}
+	sort.Strings(paths)
+	return slices.Compact(paths)
+}
+
+// whenPatterns returns every `when` glob in the config, as whether a tool's
+// dependencies are installed depends on what they match
+func whenPatterns(imgCfg *ImageConfig) []string {
+	var patterns []string
+	for _, tool := range imgCfg.Tools {
+		patterns = append(patterns, tool.When...)
+	}
+	sort.Strings(patterns)
+	return slices.Compact(patterns)
+}
+
+// fileStamp describes a file by its size, mode and modification time, both
+// for the path itself and, for symlinks, what it points to. Missing files
+// have a stamp too, so creating one changes the cache key.
+func fileStamp(path string) string {
+	stamp := func(info os.FileInfo, err error) string {
+		if err != nil {
+			return "missing"
+		}
+		return fmt.Sprintf("%d %s %d", info.Size(), info.Mode(), info.ModTime().UnixNano())
+	}
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return stamp(info, err)
+	}
+	return stamp(info, err) + " -> " + stamp(os.Stat(path))
+}
+
+func readCollectionCache(path string) (collectResult, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return collectResult{}, false
+	}
+	var cached cachedCollection
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return collectResult{}, false
+	}
+	for file, stamp := range cached.Files {
+		if fileStamp(file) != stamp {
+			return collectResult{}, false
+		}
+	}
+
+	collection := collectResult{
+		idiomaticPaths:      cached.IdiomaticPaths,
+		userTools:           make(map[string]bool, len(cached.UserTools)),
+		projectToolsSkipped: cached.ProjectToolsSkipped,
+	}
+	for _, tool := range cached.Specs {
+		collection.specs = append(collection.specs, tool.descriptor())
+	}
+	for _, tool := range cached.Candidates {
+		collection.candidates = append(collection.candidates, tool.descriptor())
+	}
+	for _, info := range cached.IdiomaticInfos {
+		collection.idiomaticInfos = append(collection.idiomaticInfos, idiomaticInfo{tool: info.Tool, version: info.Version, path: info.Path, configKey: info.ConfigKey, source: info.Source})
+	}
+	for _, name := range cached.UserTools {
+		collection.userTools[name] = true
+	}
+	return collection, true
+}
+
+// writeCollectionCache stores a collection, writing to a temporary file first
+// so a concurrent run never reads a partial entry
+func writeCollectionCache(path string, collection collectResult, files map[string]string) error {
+	cached := cachedCollection{IdiomaticPaths: collection.idiomaticPaths, ProjectToolsSkipped: collection.projectToolsSkipped, Files: files}
+	for _, tool := range collection.specs {
+		cached.Specs = append(cached.Specs, newCachedTool(tool))
+	}
+	for _, tool := range collection.candidates {
+		cached.Candidates = append(cached.Candidates, newCachedTool(tool))
+	}
+	for _, info := range collection.idiomaticInfos {
+		cached.IdiomaticInfos = append(cached.IdiomaticInfos, cachedInfo{Tool: info.tool, Version: info.version, Path: info.path, ConfigKey: info.configKey, Source: info.source})
+	}
+	for name, ok := range collection.userTools {
+		if ok {
+			cached.UserTools = append(cached.UserTools, name)
+		}
+	}
+	sort.Strings(cached.UserTools)
+
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".collection-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
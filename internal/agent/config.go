@@ -2,9 +2,16 @@ package agent
 
 import (
 	"fmt"
+	"maps"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -16,13 +23,119 @@ type ImageConfig struct {
 	Image               ImageSettings              `yaml:"image"`
 	Mise                MiseSettings               `yaml:"mise"`
 	ImageCustomizations ImageCustomizations        `yaml:"image_customizations"`
+	Detection           DetectionSettings          `yaml:"detection"`
+	Run                 RunSettings                `yaml:"run"`
+	Build               BuildSettings              `yaml:"build"`
+	DefaultAgent        string                     `yaml:"defaultAgent"` // agent to run when none is given on the command line
+	AgentAliases        map[string]string          `yaml:"agentAliases"` // invocation name to the configured agent it runs
+
+	// tools.specifiedOnly: install only env var and config tools, skipping
+	// file and idiomatic detection. It and Precedence share the tools mapping
+	// with the tool entries, so UnmarshalYAML reads them separately.
+	SpecifiedOnly *bool `yaml:"-"`
+	// tools.precedence orders the project tool sources; earlier sources win
+	// when the same tool is specified more than once
+	Precedence []string `yaml:"-"`
+
+	// Set by applyImageCustomizations: where each image package came from
+	// and the customization operations that were applied, for --show-packages
+	packageSources        map[string]string
+	appliedCustomizations []string
+	customizationErrors   []error // missing remove/replace targets when image_customizations.strict is set
+
+	// Dependency cycles already reported by walkToolDeps, so resolving tools
+	// and packages for the same agent warns once
+	warnedCycles map[string]bool
+}
+
+// UnmarshalYAML decodes the config, taking the specifiedOnly and precedence
+// settings out of the tools mapping before the rest of it is decoded as tool
+// entries
+func (c *ImageConfig) UnmarshalYAML(node *yaml.Node) error {
+	type plain ImageConfig
+	var specifiedOnly *bool
+	var precedence []string
+	settings := map[string]any{"specifiedOnly": &specifiedOnly, "precedence": &precedence}
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value != "tools" || node.Content[i+1].Kind != yaml.MappingNode {
+				continue
+			}
+			tools := node.Content[i+1]
+			for j := 0; j+1 < len(tools.Content); {
+				key := tools.Content[j].Value
+				setting, ok := settings[key]
+				if !ok {
+					j += 2
+					continue
+				}
+				if err := tools.Content[j+1].Decode(setting); err != nil {
+					return fmt.Errorf("tools.%s: %w", key, err)
+				}
+				tools.Content = slices.Delete(tools.Content, j, j+2)
+			}
+		}
+	}
+	if err := node.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	c.SpecifiedOnly = specifiedOnly
+	c.Precedence = precedence
+	return nil
+}
+
+// ToolsSpecifiedOnly reports whether tools.specifiedOnly is set
+func (c *ImageConfig) ToolsSpecifiedOnly() bool {
+	return c.SpecifiedOnly != nil && *c.SpecifiedOnly
 }
 
 // ToolConfigEntry defines a tool with version and dependencies
 type ToolConfigEntry struct {
-	Version            string   `yaml:"version"`
-	Depends            string   `yaml:"depends"`
-	AdditionalPackages []string `yaml:"additionalPackages"`
+	Version            string            `yaml:"version"`
+	Depends            string            `yaml:"depends"`
+	AdditionalPackages []string          `yaml:"additionalPackages"`
+	InstallArgs        []string          `yaml:"installArgs"`       // extra `mise install` flags; installs the tool in its own RUN step
+	When               []string          `yaml:"when"`              // file globs; the tool is only installed when one matches in the project
+	IncompatibleBases  []string          `yaml:"incompatibleBases"` // image.base globs the tool can't run on, e.g. "alpine*"
+	NpmRegistry        string            `yaml:"npmRegistry"`       // registry for the tool's npm scope, e.g. npm:@org/tool
+	LtsAliases         map[string]string `yaml:"ltsAliases"`        // node only: .nvmrc lts/<codename> to major version
+}
+
+// conditionMet reports whether the tool's `when` globs match a file in the
+// working directory. Tools without a condition are always installed, and
+// callers ignore the condition for tools the user specified.
+func (t ToolConfigEntry) conditionMet() bool {
+	if len(t.When) == 0 {
+		return true
+	}
+	for _, pattern := range t.When {
+		if matches, err := filepath.Glob(pattern); err == nil && len(matches) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// incompatibleWith returns the first incompatibleBases glob that matches base
+func (t ToolConfigEntry) incompatibleWith(base string) (string, bool) {
+	for _, pattern := range t.IncompatibleBases {
+		if matched, err := path.Match(pattern, base); err == nil && matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// CheckBaseCompatibility returns an error if any of the resolved tools declares
+// image.base incompatible, so the image isn't built only to fail at runtime
+func (c *ImageConfig) CheckBaseCompatibility(tools []string) error {
+	base := c.Image.ResolveBase()
+	for _, name := range tools {
+		if pattern, ok := c.Tools[name].incompatibleWith(base); ok {
+			return fmt.Errorf("tool %q is incompatible with base image %q (matches incompatibleBases %q)", name, base, pattern)
+		}
+	}
+	return nil
 }
 
 // AgentConfig defines an agent's configuration
@@ -33,29 +146,453 @@ type AgentConfig struct {
 	AdditionalMounts []string `yaml:"additionalMounts"`
 	EnvVars          []string `yaml:"envVars"`
 	Depends          []string `yaml:"depends"`
+	SeedFiles        []string `yaml:"seedFiles"`      // files in configDir copied into the image with --seed-config
+	LocalBinary      string   `yaml:"localBinary"`    // host binary to mount instead of installing packageName
+	NpmRegistry      string   `yaml:"npmRegistry"`    // registry for the scope of an npm:@scope/name packageName
+	NoColorEnv       []string `yaml:"noColorEnv"`     // agent-specific env vars added to run.noColorEnv with --no-color
+	NoConfigMount    bool     `yaml:"noConfigMount"`  // don't mount configDir from the host, for agents configured through env vars
+	PassEnv          []string `yaml:"passEnv"`        // host env var names, such as API keys, forwarded to the container when set
+	PackageVersion   string   `yaml:"packageVersion"` // version of packageName to install, defaulting to latest
 }
 
 // ImageSettings defines Docker image configuration
 type ImageSettings struct {
-	Base     string   `yaml:"base"`
-	Packages []string `yaml:"packages"`
+	Base           string   `yaml:"base"`
+	Packages       []string `yaml:"packages"`
+	PackageManager string   `yaml:"packageManager"` // "apt" or "apk", detected from base when empty
+	// ExcludeAgentFromTag leaves an unpinned agent tool out of the image tag
+	ExcludeAgentFromTag *bool `yaml:"excludeAgentFromTag"`
+	// TagArch builds for the host's platform and adds it to the image tag
+	TagArch *bool `yaml:"tagArch"`
+	// FilePerms maps file kinds (miseConfig, entrypoint, toolVersions) to octal modes
+	FilePerms map[string]string `yaml:"filePerms"`
+	// LoginShell runs the entrypoint from a login shell, with PATH set in /etc/profile.d
+	LoginShell *bool `yaml:"loginShell"`
+	// DefaultCommand is emitted as the image CMD, defaulting to the agent's command
+	DefaultCommand string `yaml:"defaultCommand"`
+	// BuildArgs are passed to the Docker build and declared as ARGs where the Dockerfile references them
+	BuildArgs map[string]string `yaml:"buildArgs"`
+	// InstallRecommends drops --no-install-recommends from the apt-get install
+	InstallRecommends *bool `yaml:"installRecommends"`
+	// AptClean removes /var/lib/apt/lists after installing, defaulting to true
+	AptClean *bool `yaml:"aptClean"`
+	// BashrcExtra lines are appended to the generated .bashrc after the PATH line
+	BashrcExtra []string `yaml:"bashrcExtra"`
+	// NpmRegistry is the default npm registry written to the agent user's .npmrc
+	NpmRegistry string `yaml:"npmRegistry"`
+	// AliasTag is a friendly tag, with {agent} and {project} placeholders,
+	// pointed at the image alongside its computed tag
+	AliasTag string `yaml:"aliasTag"`
+	// AgentUID is the agent user's uid, defaulting to 1000, e.g. to match
+	// the owner of the mounted project
+	AgentUID int `yaml:"agentUid"`
+	// AgentGID is the agent group's gid; 0 lets groupadd pick a system gid
+	AgentGID int `yaml:"agentGid"`
+}
+
+// defaultAgentUID is the agent user's uid when image.agentUid isn't set
+const defaultAgentUID = 1000
+
+// OmitAgentFromTag reports whether an unpinned agent tool is left out of the
+// image tag
+func (s ImageSettings) OmitAgentFromTag() bool {
+	return s.ExcludeAgentFromTag != nil && *s.ExcludeAgentFromTag
+}
+
+// UseLoginShell reports whether the entrypoint runs from a login shell
+func (s ImageSettings) UseLoginShell() bool {
+	return s.LoginShell != nil && *s.LoginShell
+}
+
+// TagHostArch reports whether images are built for the host's platform and
+// tagged with it
+func (s ImageSettings) TagHostArch() bool {
+	return s.TagArch != nil && *s.TagArch
+}
+
+// InstallRecommendedPackages reports whether apt installs recommended packages
+func (s ImageSettings) InstallRecommendedPackages() bool {
+	return s.InstallRecommends != nil && *s.InstallRecommends
+}
+
+// CleanAptLists reports whether apt package lists are removed after installing
+func (s ImageSettings) CleanAptLists() bool {
+	return s.AptClean == nil || *s.AptClean
+}
+
+// ResolveAgentUID returns the agent user's uid
+func (s ImageSettings) ResolveAgentUID() int {
+	if s.AgentUID > 0 {
+		return s.AgentUID
+	}
+	return defaultAgentUID
+}
+
+// npmScope returns the scope of an npm package such as npm:@org/agent
+func npmScope(pkg string) (string, bool) {
+	name := strings.TrimPrefix(pkg, "npm:")
+	scope, _, ok := strings.Cut(name, "/")
+	if !ok || !strings.HasPrefix(scope, "@") || len(scope) == 1 {
+		return "", false
+	}
+	return scope, true
+}
+
+// aliasTagPlaceholder matches a {name} placeholder in image.aliasTag
+var aliasTagPlaceholder = regexp.MustCompile(`\{[^}]*\}`)
+
+// validateAliasTag checks that image.aliasTag only uses known placeholders and
+// leaves a usable tag once sanitized
+func validateAliasTag(pattern string) error {
+	if pattern == "" {
+		return nil
+	}
+	for _, placeholder := range aliasTagPlaceholder.FindAllString(pattern, -1) {
+		if placeholder != "{agent}" && placeholder != "{project}" {
+			return fmt.Errorf("image.aliasTag: unknown placeholder %s (expected {agent} or {project})", placeholder)
+		}
+	}
+	if aliasTagName(pattern, "agent", "project") == "" {
+		return fmt.Errorf("image.aliasTag: %q is not a valid tag", pattern)
+	}
+	return nil
+}
+
+// hostnameLabel is one dot-separated label of an RFC 1123 hostname
+var hostnameLabel = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// validateHostname checks that a container hostname is a valid RFC 1123
+// hostname: dot-separated labels of letters, digits and hyphens that don't
+// start or end with a hyphen
+func validateHostname(field, hostname string) error {
+	if hostname == "" {
+		return nil
+	}
+	if len(hostname) > 253 {
+		return fmt.Errorf("%s must be at most 253 characters, got %d", field, len(hostname))
+	}
+	for _, label := range strings.Split(hostname, ".") {
+		if !hostnameLabel.MatchString(label) {
+			return fmt.Errorf("%s must be a valid hostname (letters, digits and hyphens, separated by dots), got %q", field, hostname)
+		}
+	}
+	return nil
+}
+
+// validateNpmRegistry checks that a registry is an http(s) URL that can be
+// written to .npmrc as-is
+func validateNpmRegistry(field, registry string) error {
+	u, err := url.Parse(registry)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s must be an http or https URL, got %q", field, registry)
+	}
+	if strings.ContainsAny(registry, "' \t\n") {
+		return fmt.Errorf("%s must not contain quotes or whitespace, got %q", field, registry)
+	}
+	return nil
+}
+
+// validateNpmRegistries checks the global registry and that agent and tool
+// registries belong to a scoped npm package, since .npmrc can only route
+// scopes to a registry
+func validateNpmRegistries(cfg *ImageConfig) error {
+	if cfg.Image.NpmRegistry != "" {
+		if err := validateNpmRegistry("image.npmRegistry", cfg.Image.NpmRegistry); err != nil {
+			return err
+		}
+	}
+	for name, agent := range cfg.Agents {
+		if agent.NpmRegistry == "" {
+			continue
+		}
+		field := fmt.Sprintf("agents.%s.npmRegistry", name)
+		if err := validateNpmRegistry(field, agent.NpmRegistry); err != nil {
+			return err
+		}
+		if _, ok := npmScope(agent.PackageName); !ok {
+			return fmt.Errorf("%s requires a scoped npm packageName such as npm:@org/agent, got %q", field, agent.PackageName)
+		}
+	}
+	for name, tool := range cfg.Tools {
+		if tool.NpmRegistry == "" {
+			continue
+		}
+		field := fmt.Sprintf("tools.%s.npmRegistry", name)
+		if err := validateNpmRegistry(field, tool.NpmRegistry); err != nil {
+			return err
+		}
+		if _, ok := npmScope(name); !ok {
+			return fmt.Errorf("%s requires a scoped npm tool such as npm:@org/tool, got %q", field, name)
+		}
+	}
+	return nil
+}
+
+// validateBashrcExtra rejects lines that would break out of the single-quoted
+// printf that writes them. A single quote has to be escaped the shell way, by
+// closing the quote, adding \' and reopening it.
+func validateBashrcExtra(lines []string) error {
+	for i, line := range lines {
+		if strings.ContainsAny(line, "\n\r") {
+			return fmt.Errorf("image.bashrcExtra line %d contains a newline; use one entry per line", i+1)
+		}
+		if strings.Contains(strings.ReplaceAll(line, `'\''`, ""), "'") {
+			return fmt.Errorf("image.bashrcExtra line %d contains an unescaped single quote (write ' as '\\'')", i+1)
+		}
+	}
+	return nil
+}
+
+// filePerms holds the modes used for files written into the build context
+type filePerms struct {
+	miseConfig   int64
+	entrypoint   int64
+	toolVersions int64 // 0 keeps the mode of the host file
+}
+
+// ResolveFilePerms parses image.filePerms, falling back to the default mode for any unset kind
+func (s ImageSettings) ResolveFilePerms() (filePerms, error) {
+	perms := filePerms{miseConfig: 0644, entrypoint: 0755}
+	for kind, value := range s.FilePerms {
+		mode, err := strconv.ParseInt(value, 8, 32)
+		if err != nil || mode < 0 || mode > 0777 {
+			return filePerms{}, fmt.Errorf("invalid image.filePerms.%s %q: must be an octal mode such as 0644", kind, value)
+		}
+		switch kind {
+		case "miseConfig":
+			perms.miseConfig = mode
+		case "entrypoint":
+			// The script is owned by root but run by the agent user
+			if mode&0005 != 0005 {
+				return filePerms{}, fmt.Errorf("invalid image.filePerms.entrypoint %q: the entrypoint is owned by root, so others need read and execute permission, e.g. 0755", value)
+			}
+			perms.entrypoint = mode
+		case "toolVersions":
+			perms.toolVersions = mode
+		default:
+			return filePerms{}, fmt.Errorf("unknown image.filePerms key %q (expected miseConfig, entrypoint or toolVersions)", kind)
+		}
+	}
+	return perms, nil
+}
+
+// ResolveBase returns the configured base image, defaulting to debian:12-slim
+func (s ImageSettings) ResolveBase() string {
+	if s.Base == "" {
+		return "debian:12-slim"
+	}
+	return s.Base
+}
+
+// Supported system package managers
+const (
+	packageManagerApt = "apt"
+	packageManagerApk = "apk"
+)
+
+// ResolvePackageManager returns the system package manager used to install packages.
+// When packageManager is not set it is detected from the base image name:
+// Alpine based images use apk, everything else uses apt.
+func (s ImageSettings) ResolvePackageManager() string {
+	if s.PackageManager != "" {
+		return s.PackageManager
+	}
+	if strings.Contains(strings.ToLower(s.Base), "alpine") {
+		return packageManagerApk
+	}
+	return packageManagerApt
+}
+
+// BuildSettings controls when an existing image is rebuilt
+type BuildSettings struct {
+	HashInputs []string `yaml:"hashInputs"` // project files whose content is hashed for rebuild detection, e.g. package.json
 }
 
 // MiseSettings defines mise installation commands and environment variables
 type MiseSettings struct {
-	Install []string       `yaml:"install"`
-	Env     map[string]any `yaml:"env"`
+	Install        []string       `yaml:"install"`
+	Env            map[string]any `yaml:"env"`
+	DataDir        string         `yaml:"dataDir"`        // absolute MISE_DATA_DIR, defaults to mise's own location
+	Jobs           int            `yaml:"jobs"`           // parallel `mise install` jobs (MISE_JOBS), 0 leaves mise's default
+	InheritUserEnv *bool          `yaml:"inheritUserEnv"` // copy the project mise.toml's [env] into mise.agent.toml
+	// PropagateSettings names mise.env and project mise.toml [settings] keys
+	// written to mise.agent.toml's [settings], so they apply when the agent runs
+	PropagateSettings []string `yaml:"propagateSettings"`
+
+	// jobsFromFlag is set when Jobs came from --mise-jobs, which takes
+	// priority over a host MISE_JOBS
+	jobsFromFlag bool
+}
+
+// InheritProjectEnv reports whether the project mise.toml's [env] is copied
+// into mise.agent.toml
+func (m MiseSettings) InheritProjectEnv() bool {
+	return m.InheritUserEnv != nil && *m.InheritUserEnv
+}
+
+// ResolveEnv returns mise.env with first-class settings such as jobs folded in
+func (m MiseSettings) ResolveEnv() map[string]any {
+	if m.Jobs <= 0 {
+		return m.Env
+	}
+	env := make(map[string]any, len(m.Env)+1)
+	for k, v := range m.Env {
+		env[k] = v
+	}
+	env["jobs"] = m.Jobs
+	return env
+}
+
+// defaultMiseDataDir is where mise keeps installs and shims for the agent user
+const defaultMiseDataDir = "/home/agent/.local/share/mise"
+
+// ResolveDataDir returns the mise data directory used in the image
+func (m MiseSettings) ResolveDataDir() string {
+	if m.DataDir == "" {
+		return defaultMiseDataDir
+	}
+	return path.Clean(m.DataDir)
+}
+
+// RunSettings defines options for the generated docker run command.
+// These don't affect the image.
+type RunSettings struct {
+	Hostname    string       `yaml:"hostname"`    // container hostname, defaults to the agent name
+	SecurityOpt []string     `yaml:"securityOpt"` // docker run --security-opt values, e.g. seccomp=./profile.json
+	Mode        string       `yaml:"mode"`        // print (default) the docker run command, or run the container directly
+	Tmpfs       []TmpfsMount `yaml:"tmpfs"`       // tmpfs mounts for scratch space, passed as --tmpfs
+	NoColorEnv  []string     `yaml:"noColorEnv"`  // env vars set with --no-color, defaulting to defaultNoColorEnv
+}
+
+// TmpfsMount is an in-memory filesystem mounted into the agent container
+type TmpfsMount struct {
+	Path string `yaml:"path"` // absolute path inside the container
+	Size string `yaml:"size"` // size limit, e.g. 512m or 2g; unlimited when empty
+	Mode string `yaml:"mode"` // octal permissions, e.g. 1777
+}
+
+var (
+	tmpfsSizePattern = regexp.MustCompile(`^[1-9][0-9]*[bkmgBKMG]?$`)
+	tmpfsModePattern = regexp.MustCompile(`^[0-7]{3,4}$`)
+)
+
+// validateTmpfs checks run.tmpfs entries so that a typo fails when the config
+// is loaded rather than when docker starts the container
+func validateTmpfs(mounts []TmpfsMount) error {
+	seen := make(map[string]bool)
+	for _, m := range mounts {
+		if !path.IsAbs(m.Path) {
+			return fmt.Errorf("run.tmpfs: path must be absolute, got %q", m.Path)
+		}
+		if strings.ContainsAny(m.Path, ":, ") {
+			return fmt.Errorf("run.tmpfs: path must not contain colons, commas or spaces, got %q", m.Path)
+		}
+		if seen[path.Clean(m.Path)] {
+			return fmt.Errorf("run.tmpfs: %s is mounted more than once", m.Path)
+		}
+		seen[path.Clean(m.Path)] = true
+		if m.Size != "" && !tmpfsSizePattern.MatchString(m.Size) {
+			return fmt.Errorf("run.tmpfs: invalid size %q for %s (expected a number with an optional k, m or g suffix, e.g. 512m)", m.Size, m.Path)
+		}
+		if m.Mode != "" && !tmpfsModePattern.MatchString(m.Mode) {
+			return fmt.Errorf("run.tmpfs: invalid mode %q for %s (expected octal, e.g. 1777)", m.Mode, m.Path)
+		}
+	}
+	return nil
+}
+
+// Run modes for run.mode, --print and --run
+const (
+	runModePrint = "print"
+	runModeRun   = "run"
+)
+
+// ResolveMode returns the run mode, defaulting to printing the command
+func (r RunSettings) ResolveMode() string {
+	if r.Mode == "" {
+		return runModePrint
+	}
+	return r.Mode
+}
+
+// defaultNoColorEnv are the env vars --no-color sets when run.noColorEnv is
+// empty. They turn off color and terminal escape codes in most CLIs.
+var defaultNoColorEnv = []string{"NO_COLOR=1", "TERM=dumb"}
+
+// ResolveNoColorEnv returns the env vars set with --no-color
+func (r RunSettings) ResolveNoColorEnv() []string {
+	if len(r.NoColorEnv) == 0 {
+		return defaultNoColorEnv
+	}
+	return r.NoColorEnv
+}
+
+// DetectionSettings controls how project tool versions are detected
+type DetectionSettings struct {
+	// Cache stores detected tools on disk and reuses them until the config
+	// or a file they were detected from changes
+	Cache *bool `yaml:"cache"`
+}
+
+// CacheEnabled reports whether detected tools are cached on disk
+func (s DetectionSettings) CacheEnabled() bool {
+	return s.Cache != nil && *s.Cache
+}
+
+// Project tool sources that can be ordered with tools.precedence
+const (
+	precedenceToolVersions = "tool-versions"
+	precedenceMiseToml     = "mise-toml"
+	precedenceIdiomatic    = "idiomatic"
+)
+
+// defaultPrecedence is the source order used when tools.precedence is not set
+var defaultPrecedence = []string{precedenceToolVersions, precedenceMiseToml, precedenceIdiomatic}
+
+// ResolvePrecedence returns the configured source order. Sources missing from
+// the configured list are appended in their default order.
+func (c *ImageConfig) ResolvePrecedence() ([]string, error) {
+	seen := make(map[string]bool)
+	var order []string
+	for _, source := range c.Precedence {
+		switch source {
+		case precedenceToolVersions, precedenceMiseToml, precedenceIdiomatic:
+		default:
+			return nil, fmt.Errorf("unknown tools.precedence source %q (expected %s)", source, strings.Join(defaultPrecedence, ", "))
+		}
+		if seen[source] {
+			continue
+		}
+		seen[source] = true
+		order = append(order, source)
+	}
+	for _, source := range defaultPrecedence {
+		if !seen[source] {
+			order = append(order, source)
+		}
+	}
+	return order, nil
 }
 
 // ImageCustomization represents a single customization operation (JSON patch style)
 type ImageCustomization struct {
-	Op    string `yaml:"op"`    // "add" or "remove"
-	Value string `yaml:"value"` // The value to add or remove
+	Op    string `yaml:"op"`    // "add", "remove", "replace" or "reset"
+	Value string `yaml:"value"` // The value to add or remove, or the replacement
+	From  string `yaml:"from"`  // The package a replace swaps for value
 }
 
 // ImageCustomizations defines customization operations for the image
 type ImageCustomizations struct {
-	Packages []ImageCustomization `yaml:"packages"`
+	Packages    []ImageCustomization `yaml:"packages"`
+	MiseInstall []ImageCustomization `yaml:"miseInstall"` // add/remove mise.install commands
+	MiseEnv     []ImageCustomization `yaml:"miseEnv"`     // add key=value to, or remove a key from, mise.env
+	Strict      *bool                `yaml:"strict"`      // fail, rather than warn, when a remove or replace target isn't in the list
+}
+
+// FailOnMissingTarget reports whether a missing remove or replace target is an
+// error rather than a warning
+func (c ImageCustomizations) FailOnMissingTarget() bool {
+	return c.Strict != nil && *c.Strict
 }
 
 // loadDefaultConfig parses the embedded default config
@@ -73,7 +610,9 @@ func loadDefaultConfig(data []byte) (*ImageConfig, error) {
 	return &cfg, nil
 }
 
-// loadConfigFile loads a config from a specific path
+// loadConfigFile loads a config from a specific path. ${VAR} references are
+// left in place; mergeConfigFiles expands them once every file's build args
+// are known.
 func loadConfigFile(path string) (*ImageConfig, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -90,6 +629,111 @@ func loadConfigFile(path string) (*ImageConfig, error) {
 	return &cfg, nil
 }
 
+// envRefPattern matches ${VAR} and ${VAR:-default} references in config values
+var envRefPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces ${VAR} references in the config values that commonly
+// differ between machines: image.base, image.npmRegistry, image.buildArgs,
+// the npmRegistry of tools and agents, and string mise.env values. Other
+// values, such as envVars and bashrcExtra, are shell snippets and are left
+// for the shell to expand. References to buildArgs are left for Docker to
+// substitute from the matching ARG.
+func (c *ImageConfig) expandEnv(buildArgs map[string]bool) error {
+	expand := func(key string, value *string) error {
+		expanded, err := expandEnvRefs(*value, buildArgs)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		*value = expanded
+		return nil
+	}
+
+	if err := expand("image.base", &c.Image.Base); err != nil {
+		return err
+	}
+	if err := expand("image.npmRegistry", &c.Image.NpmRegistry); err != nil {
+		return err
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Image.BuildArgs)) {
+		value := c.Image.BuildArgs[name]
+		if err := expand("image.buildArgs."+name, &value); err != nil {
+			return err
+		}
+		c.Image.BuildArgs[name] = value
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Tools)) {
+		tool := c.Tools[name]
+		if err := expand("tools."+name+".npmRegistry", &tool.NpmRegistry); err != nil {
+			return err
+		}
+		c.Tools[name] = tool
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Agents)) {
+		agent := c.Agents[name]
+		if err := expand("agents."+name+".npmRegistry", &agent.NpmRegistry); err != nil {
+			return err
+		}
+		c.Agents[name] = agent
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Mise.Env)) {
+		value, ok := c.Mise.Env[name].(string)
+		if !ok {
+			continue
+		}
+		if err := expand("mise.env."+name, &value); err != nil {
+			return err
+		}
+		c.Mise.Env[name] = value
+	}
+	return nil
+}
+
+// expandEnvRefs replaces ${VAR} with the variable's value and ${VAR:-default}
+// with the value, or default when VAR is unset or empty, like the shell. A
+// ${VAR} reference to an unset variable is an error. References to names in
+// keep are left as they are.
+func expandEnvRefs(value string, keep map[string]bool) (string, error) {
+	var missing string
+	expanded := envRefPattern.ReplaceAllStringFunc(value, func(ref string) string {
+		match := envRefPattern.FindStringSubmatch(ref)
+		name, hasDefault, fallback := match[1], match[2] != "", match[3]
+		if keep[name] {
+			return ref
+		}
+		env, ok := os.LookupEnv(name)
+		switch {
+		case hasDefault && env == "":
+			return fallback
+		case !ok && missing == "":
+			missing = name
+		}
+		return env
+	})
+	if missing != "" {
+		return "", fmt.Errorf("environment variable %s is not set (use ${%s:-default} to fall back to a default)", missing, missing)
+	}
+	return expanded, nil
+}
+
+// resolveSecurityOptPaths makes relative seccomp profile paths in
+// run.securityOpt absolute against dir, the directory of the config file
+// that set them, so a profile next to the user config is found from any
+// project
+func (c *ImageConfig) resolveSecurityOptPaths(dir string) error {
+	for i, opt := range c.Run.SecurityOpt {
+		profile, ok := strings.CutPrefix(opt, "seccomp=")
+		if !ok || profile == "unconfined" || profile == "builtin" || filepath.IsAbs(profile) {
+			continue
+		}
+		abs, err := filepath.Abs(filepath.Join(dir, profile))
+		if err != nil {
+			return fmt.Errorf("failed to resolve seccomp profile %s: %w", profile, err)
+		}
+		c.Run.SecurityOpt[i] = "seccomp=" + abs
+	}
+	return nil
+}
+
 // getXDGConfigPath returns the path to the XDG config file
 // Uses $XDG_CONFIG_HOME if set, otherwise ~/.config
 func getXDGConfigPath() string {
@@ -104,41 +748,70 @@ func getXDGConfigPath() string {
 	return filepath.Join(configHome, "agent-en-place.yaml")
 }
 
+// LoadOptions controls which config layers LoadMergedConfig reads
+type LoadOptions struct {
+	ConfigPath   string   // explicit config file (--config flag)
+	NoUserConfig bool     // skip the XDG and project-local configs
+	BuildArgs    []string // names of build args set outside the config files (--build-arg)
+}
+
 // LoadMergedConfig loads the default config and merges with user configs
 // Config precedence (later configs override earlier):
 // 1. Embedded default config
 // 2. XDG config ($XDG_CONFIG_HOME/agent-en-place.yaml or ~/.config/agent-en-place.yaml)
 // 3. Project-local config (./.agent-en-place.yaml)
 // 4. Explicit config path (--config flag)
-// After merging, image_customizations are applied to modify packages
-func LoadMergedConfig(defaultConfigData []byte, configPath string) (*ImageConfig, error) {
+// Layers 2 and 3 are skipped when opts.NoUserConfig is set.
+// After merging, image_customizations are applied to modify packages and mise
+// settings, and the settings are checked
+func LoadMergedConfig(defaultConfigData []byte, opts LoadOptions) (*ImageConfig, error) {
+	base, err := mergeConfigFiles(defaultConfigData, opts)
+	if err != nil {
+		return nil, err
+	}
+	if errs := base.settingsErrors(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return base, nil
+}
+
+// mergeConfigFiles is LoadMergedConfig without checking the merged settings
+func mergeConfigFiles(defaultConfigData []byte, opts LoadOptions) (*ImageConfig, error) {
 	base, err := loadDefaultConfig(defaultConfigData)
 	if err != nil {
 		return nil, err
 	}
 
-	// Load XDG config
-	xdgPath := getXDGConfigPath()
-	if xdgPath != "" {
-		xdgConfig, err := loadConfigFile(xdgPath)
+	type layer struct {
+		path string
+		cfg  *ImageConfig
+	}
+	var layers []layer
+	if !opts.NoUserConfig {
+		// Load XDG config
+		xdgPath := getXDGConfigPath()
+		if xdgPath != "" {
+			xdgConfig, err := loadConfigFile(xdgPath)
+			if err != nil {
+				return nil, err
+			}
+			if xdgConfig != nil {
+				layers = append(layers, layer{xdgPath, xdgConfig})
+			}
+		}
+
+		// Load project-local config
+		localConfig, err := loadConfigFile(".agent-en-place.yaml")
 		if err != nil {
 			return nil, err
 		}
-		if xdgConfig != nil {
-			base = mergeConfigs(base, xdgConfig)
+		if localConfig != nil {
+			layers = append(layers, layer{".agent-en-place.yaml", localConfig})
 		}
 	}
 
-	// Load project-local config
-	localConfig, err := loadConfigFile(".agent-en-place.yaml")
-	if err != nil {
-		return nil, err
-	}
-	if localConfig != nil {
-		base = mergeConfigs(base, localConfig)
-	}
-
 	// Load explicit config path if provided
+	configPath := opts.ConfigPath
 	if configPath != "" {
 		explicitConfig, err := loadConfigFile(configPath)
 		if err != nil {
@@ -147,21 +820,112 @@ func LoadMergedConfig(defaultConfigData []byte, configPath string) (*ImageConfig
 		if explicitConfig == nil {
 			return nil, fmt.Errorf("config file not found: %s", configPath)
 		}
-		base = mergeConfigs(base, explicitConfig)
+		layers = append(layers, layer{configPath, explicitConfig})
+	}
+
+	// A build arg set in any file, or with --build-arg, can be referenced from
+	// any other, so expansion waits until every file is read
+	buildArgs := make(map[string]bool)
+	for name := range base.Image.BuildArgs {
+		buildArgs[name] = true
+	}
+	for _, l := range layers {
+		for name := range l.cfg.Image.BuildArgs {
+			buildArgs[name] = true
+		}
+	}
+	for _, name := range opts.BuildArgs {
+		buildArgs[name] = true
+	}
+	for _, l := range layers {
+		if err := l.cfg.expandEnv(buildArgs); err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", l.path, err)
+		}
+		if err := l.cfg.resolveSecurityOptPaths(filepath.Dir(l.path)); err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", l.path, err)
+		}
+		base = mergeConfigs(base, l.cfg)
 	}
 
 	// Apply image customizations after all configs are merged
-	base = applyImageCustomizations(base)
+	return applyImageCustomizations(base), nil
+}
 
-	return base, nil
+// settingsErrors checks the merged config's settings, returning every problem
+// found. LoadMergedConfig fails on the first one; Validate reports them all.
+func (c *ImageConfig) settingsErrors() []error {
+	errs := append([]error{}, c.customizationErrors...)
+	if _, err := c.ResolvePrecedence(); err != nil {
+		errs = append(errs, err)
+	}
+
+	switch c.Image.PackageManager {
+	case "", packageManagerApt, packageManagerApk:
+	default:
+		errs = append(errs, fmt.Errorf("unknown image.packageManager %q (expected %s or %s)", c.Image.PackageManager, packageManagerApt, packageManagerApk))
+	}
+
+	switch c.Run.Mode {
+	case "", runModePrint, runModeRun:
+	default:
+		errs = append(errs, fmt.Errorf("unknown run.mode %q (expected %s or %s)", c.Run.Mode, runModePrint, runModeRun))
+	}
+
+	if c.Mise.DataDir != "" && !path.IsAbs(c.Mise.DataDir) {
+		errs = append(errs, fmt.Errorf("mise.dataDir must be an absolute path, got %q", c.Mise.DataDir))
+	}
+	if err := validateBashrcExtra(c.Image.BashrcExtra); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := c.Image.ResolveFilePerms(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Image.AgentUID < 0 {
+		errs = append(errs, fmt.Errorf("image.agentUid must be a positive integer, got %d", c.Image.AgentUID))
+	}
+	if c.Image.AgentGID < 0 {
+		errs = append(errs, fmt.Errorf("image.agentGid must be a positive integer, got %d", c.Image.AgentGID))
+	}
+	if c.Mise.Jobs < 0 {
+		errs = append(errs, fmt.Errorf("mise.jobs must be a positive integer, got %d", c.Mise.Jobs))
+	}
+	if err := validateTmpfs(c.Run.Tmpfs); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateNpmRegistries(c); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateAliasTag(c.Image.AliasTag); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateHostname("run.hostname", c.Run.Hostname); err != nil {
+		errs = append(errs, err)
+	}
+	for _, alias := range slices.Sorted(maps.Keys(c.AgentAliases)) {
+		if _, ok := c.Agents[c.AgentAliases[alias]]; !ok {
+			errs = append(errs, fmt.Errorf("agentAliases.%s: unknown agent %q", alias, c.AgentAliases[alias]))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Tools)) {
+		for _, pattern := range c.Tools[name].IncompatibleBases {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("tools.%s.incompatibleBases: invalid pattern %q", name, pattern))
+			}
+		}
+	}
+	return errs
 }
 
 // mergeConfigs deep merges user config into base config
 // - Tools: user adds/overrides individual tools
 // - Agents: user adds/overrides individual agents
 // - Image.Base: user replaces if set
+// - Image.PackageManager: user replaces if set
 // - Image.Packages: user replaces entirely if set
 // - Mise.Install: user replaces entirely if set
+// - Precedence: user replaces entirely if set
+// - Build.HashInputs: user replaces entirely if set
+// - AgentAliases: user adds/overrides individual aliases
 // - ImageCustomizations: user customizations are accumulated
 func mergeConfigs(base, user *ImageConfig) *ImageConfig {
 	result := &ImageConfig{
@@ -170,6 +934,12 @@ func mergeConfigs(base, user *ImageConfig) *ImageConfig {
 		Image:               base.Image,
 		Mise:                base.Mise,
 		ImageCustomizations: base.ImageCustomizations,
+		Detection:           base.Detection,
+		Run:                 base.Run,
+		Build:               base.Build,
+		DefaultAgent:        base.DefaultAgent,
+		SpecifiedOnly:       base.SpecifiedOnly,
+		Precedence:          base.Precedence,
 	}
 
 	// Copy base tools
@@ -195,6 +965,84 @@ func mergeConfigs(base, user *ImageConfig) *ImageConfig {
 		result.Image.Base = user.Image.Base
 	}
 
+	// Replace default command if user specified
+	if user.Image.DefaultCommand != "" {
+		result.Image.DefaultCommand = user.Image.DefaultCommand
+	}
+
+	// Replace package manager if user specified
+	if user.Image.PackageManager != "" {
+		result.Image.PackageManager = user.Image.PackageManager
+	}
+
+	// Merge file permissions (user adds/overrides individual kinds)
+	if len(user.Image.FilePerms) > 0 {
+		perms := make(map[string]string)
+		for k, v := range result.Image.FilePerms {
+			perms[k] = v
+		}
+		for k, v := range user.Image.FilePerms {
+			perms[k] = v
+		}
+		result.Image.FilePerms = perms
+	}
+
+	// Merge build args (user adds/overrides individual keys)
+	if len(user.Image.BuildArgs) > 0 {
+		args := make(map[string]string)
+		for k, v := range result.Image.BuildArgs {
+			args[k] = v
+		}
+		for k, v := range user.Image.BuildArgs {
+			args[k] = v
+		}
+		result.Image.BuildArgs = args
+	}
+
+	// Replace agent tag exclusion if user specified
+	if user.Image.ExcludeAgentFromTag != nil {
+		result.Image.ExcludeAgentFromTag = user.Image.ExcludeAgentFromTag
+	}
+
+	// Replace platform tagging if user specified
+	if user.Image.TagArch != nil {
+		result.Image.TagArch = user.Image.TagArch
+	}
+
+	// Replace login shell if user specified
+	if user.Image.LoginShell != nil {
+		result.Image.LoginShell = user.Image.LoginShell
+	}
+
+	// Replace recommended packages if user specified
+	if user.Image.InstallRecommends != nil {
+		result.Image.InstallRecommends = user.Image.InstallRecommends
+	}
+
+	// Replace extra bashrc lines if user specified
+	if len(user.Image.BashrcExtra) > 0 {
+		result.Image.BashrcExtra = user.Image.BashrcExtra
+	}
+
+	// Replace npm registry if user specified
+	if user.Image.NpmRegistry != "" {
+		result.Image.NpmRegistry = user.Image.NpmRegistry
+	}
+	if user.Image.AliasTag != "" {
+		result.Image.AliasTag = user.Image.AliasTag
+	}
+	if user.Image.AgentUID != 0 {
+		result.Image.AgentUID = user.Image.AgentUID
+	}
+	if user.Image.AgentGID != 0 {
+		result.Image.AgentGID = user.Image.AgentGID
+	}
+
+	// Replace apt cleanup if user specified
+	if user.Image.AptClean != nil {
+		result.Image.AptClean = user.Image.AptClean
+	}
+
 	// Replace packages entirely if user specified
 	if len(user.Image.Packages) > 0 {
 		result.Image.Packages = user.Image.Packages
@@ -205,6 +1053,26 @@ func mergeConfigs(base, user *ImageConfig) *ImageConfig {
 		result.Mise.Install = user.Mise.Install
 	}
 
+	// Replace mise data dir if user specified
+	if user.Mise.DataDir != "" {
+		result.Mise.DataDir = user.Mise.DataDir
+	}
+
+	// Replace mise jobs if user specified
+	if user.Mise.Jobs != 0 {
+		result.Mise.Jobs = user.Mise.Jobs
+	}
+
+	// Replace mise env inheritance if user specified
+	if user.Mise.InheritUserEnv != nil {
+		result.Mise.InheritUserEnv = user.Mise.InheritUserEnv
+	}
+
+	// Replace the propagated settings list if user specified
+	if len(user.Mise.PropagateSettings) > 0 {
+		result.Mise.PropagateSettings = user.Mise.PropagateSettings
+	}
+
 	// Merge mise env vars (user adds/overrides individual keys)
 	if len(user.Mise.Env) > 0 {
 		if result.Mise.Env == nil {
@@ -215,6 +1083,46 @@ func mergeConfigs(base, user *ImageConfig) *ImageConfig {
 		}
 	}
 
+	// Replace detection caching if user specified
+	if user.Detection.Cache != nil {
+		result.Detection.Cache = user.Detection.Cache
+	}
+
+	// Replace run hostname if user specified
+	if user.Run.Hostname != "" {
+		result.Run.Hostname = user.Run.Hostname
+	}
+
+	// Replace run security options if user specified
+	if len(user.Run.SecurityOpt) > 0 {
+		result.Run.SecurityOpt = user.Run.SecurityOpt
+	}
+	if user.Run.Mode != "" {
+		result.Run.Mode = user.Run.Mode
+	}
+	if len(user.Run.Tmpfs) > 0 {
+		result.Run.Tmpfs = user.Run.Tmpfs
+	}
+	if len(user.Run.NoColorEnv) > 0 {
+		result.Run.NoColorEnv = user.Run.NoColorEnv
+	}
+
+	if len(user.Build.HashInputs) > 0 {
+		result.Build.HashInputs = user.Build.HashInputs
+	}
+
+	// Replace default agent if user specified
+	if user.DefaultAgent != "" {
+		result.DefaultAgent = user.DefaultAgent
+	}
+
+	// Merge agent aliases (user adds/overrides individual names)
+	if len(base.AgentAliases) > 0 || len(user.AgentAliases) > 0 {
+		result.AgentAliases = make(map[string]string, len(base.AgentAliases)+len(user.AgentAliases))
+		maps.Copy(result.AgentAliases, base.AgentAliases)
+		maps.Copy(result.AgentAliases, user.AgentAliases)
+	}
+
 	// Accumulate image customizations from user config
 	if len(user.ImageCustomizations.Packages) > 0 {
 		result.ImageCustomizations.Packages = append(
@@ -222,16 +1130,51 @@ func mergeConfigs(base, user *ImageConfig) *ImageConfig {
 			user.ImageCustomizations.Packages...,
 		)
 	}
+	if len(user.ImageCustomizations.MiseInstall) > 0 {
+		result.ImageCustomizations.MiseInstall = append(
+			result.ImageCustomizations.MiseInstall,
+			user.ImageCustomizations.MiseInstall...,
+		)
+	}
+	if len(user.ImageCustomizations.MiseEnv) > 0 {
+		result.ImageCustomizations.MiseEnv = append(
+			result.ImageCustomizations.MiseEnv,
+			user.ImageCustomizations.MiseEnv...,
+		)
+	}
+	// Replace strict customizations and specified-only mode if user specified
+	if user.ImageCustomizations.Strict != nil {
+		result.ImageCustomizations.Strict = user.ImageCustomizations.Strict
+	}
+	if user.SpecifiedOnly != nil {
+		result.SpecifiedOnly = user.SpecifiedOnly
+	}
+
+	// Replace tool source precedence if user specified
+	if len(user.Precedence) > 0 {
+		result.Precedence = user.Precedence
+	}
 
 	return result
 }
 
-// GetAgent returns the agent config by name
+// GetAgent returns the agent config by name, following agentAliases
 func (c *ImageConfig) GetAgent(name string) (AgentConfig, bool) {
-	agent, ok := c.Agents[name]
+	agent, ok := c.Agents[c.ResolveAgentName(name)]
 	return agent, ok
 }
 
+// ResolveAgentName returns the agent an invocation name runs. An entry in
+// agentAliases takes precedence over an agent with the same name, so a team
+// config's agent can be run under the name you're used to. Aliases aren't
+// followed further, so they can't form a loop.
+func (c *ImageConfig) ResolveAgentName(name string) string {
+	if canonical, ok := c.AgentAliases[name]; ok {
+		return canonical
+	}
+	return name
+}
+
 // AgentNames returns a sorted list of available agent names
 func (c *ImageConfig) AgentNames() []string {
 	names := make([]string, 0, len(c.Agents))
@@ -253,40 +1196,99 @@ func (c *ImageConfig) ResolveToolDeps(agentName string, userTools map[string]boo
 	}
 
 	var result []toolDescriptor
+	c.walkToolDeps(agent, func(toolName string, tool ToolConfigEntry) bool {
+		// when only decides whether the agent needs a tool, so it doesn't
+		// apply to tools the project asks for
+		if !userTools[toolName] && !tool.conditionMet() {
+			if debug {
+				logDebug(fmt.Sprintf("skipping tool %q: no files match %v", toolName, tool.When), "tool", toolName)
+			}
+			return false
+		}
+		version := tool.Version
+		if version == "" {
+			version = "latest"
+		}
+
+		result = append(result, toolDescriptor{name: toolName, version: version, source: sourceConfig})
+
+		// Only resolve transitive dependencies if this tool was user-specified
+		if tool.Depends != "" && !userTools[toolName] && debug {
+			logDebug(fmt.Sprintf("skipping transitive dependency %q of %q (not user-specified)", tool.Depends, toolName), "dependency", tool.Depends, "tool", toolName)
+		}
+		return userTools[toolName]
+	})
+
+	return result
+}
+
+// toolDep is a queued tool dependency and the tool whose depends named it,
+// empty for the agent's own depends
+type toolDep struct {
+	name string
+	from string
+}
+
+// walkToolDeps visits an agent's tool dependencies breadth first, each tool
+// once. visit returns whether to follow the tool's depends. A depends chain
+// that leads back to a tool on its own path is a config mistake rather than a
+// shared dependency, so it is reported with a warning, once per config.
+func (c *ImageConfig) walkToolDeps(agent AgentConfig, visit func(name string, tool ToolConfigEntry) bool) {
 	seen := make(map[string]bool)
+	parents := make(map[string]string)
 
 	// Process dependencies using a queue for breadth-first resolution
-	queue := make([]string, len(agent.Depends))
-	copy(queue, agent.Depends)
+	var queue []toolDep
+	for _, name := range agent.Depends {
+		queue = append(queue, toolDep{name: name})
+	}
 
 	for len(queue) > 0 {
-		toolName := queue[0]
+		dep := queue[0]
 		queue = queue[1:]
 
-		if seen[toolName] {
+		if seen[dep.name] {
+			if cycle := dependencyCycle(parents, dep.from, dep.name); cycle != nil {
+				c.warnDependencyCycle(cycle)
+			}
 			continue
 		}
-		seen[toolName] = true
+		seen[dep.name] = true
+		parents[dep.name] = dep.from
 
-		tool := c.Tools[toolName]
-		version := tool.Version
-		if version == "" {
-			version = "latest"
+		tool := c.Tools[dep.name]
+		if visit(dep.name, tool) && tool.Depends != "" {
+			queue = append(queue, toolDep{name: tool.Depends, from: dep.name})
 		}
+	}
+}
 
-		result = append(result, toolDescriptor{name: toolName, version: version, source: sourceConfig})
-
-		// Only resolve transitive dependencies if this tool was user-specified
-		if tool.Depends != "" {
-			if userTools[toolName] {
-				queue = append(queue, tool.Depends)
-			} else if debug {
-				fmt.Fprintf(os.Stderr, "debug: skipping transitive dependency %q of %q (not user-specified)\n", tool.Depends, toolName)
-			}
+// dependencyCycle returns the cycle closed when from depends on name, e.g.
+// [a b a], or nil when name isn't from or one of the tools that led to it
+func dependencyCycle(parents map[string]string, from, name string) []string {
+	chain := []string{name}
+	for tool := from; tool != ""; tool = parents[tool] {
+		chain = append(chain, tool)
+		if tool == name {
+			slices.Reverse(chain)
+			return chain
 		}
 	}
+	return nil
+}
 
-	return result
+// warnDependencyCycle reports a tools depends cycle the first time it is found
+func (c *ImageConfig) warnDependencyCycle(cycle []string) {
+	key := strings.Join(slices.Sorted(slices.Values(cycle[1:])), ",")
+	if c.warnedCycles[key] {
+		return
+	}
+	if c.warnedCycles == nil {
+		c.warnedCycles = make(map[string]bool)
+	}
+	c.warnedCycles[key] = true
+	path := strings.Join(cycle, " -> ")
+	logWarn(fmt.Sprintf("tools have a dependency cycle %s; remove one of these depends", path), "cycle", path)
 }
 
 // ToToolSpec converts an AgentConfig to a ToolSpec for backwards compatibility
@@ -298,6 +1300,12 @@ func (a AgentConfig) ToToolSpec() ToolSpec {
 		ConfigDir:        a.ConfigDir,
 		AdditionalMounts: a.AdditionalMounts,
 		EnvVars:          a.EnvVars,
+		SeedFiles:        a.SeedFiles,
+		LocalBinary:      a.LocalBinary,
+		NoColorEnv:       a.NoColorEnv,
+		NoConfigMount:    a.NoConfigMount,
+		PassEnv:          a.PassEnv,
+		PackageVersion:   a.PackageVersion,
 	}
 }
 
@@ -305,63 +1313,201 @@ func (a AgentConfig) ToToolSpec() ToolSpec {
 // by traversing the agent's tool dependencies and collecting their additionalPackages.
 // userTools contains tools explicitly specified by the user - only these get transitive deps resolved.
 func (c *ImageConfig) ResolveAdditionalPackages(agentName string, userTools map[string]bool) []string {
+	var packages []string
+	for _, pkg := range c.resolveAdditionalPackageSources(agentName, userTools) {
+		packages = append(packages, pkg.name)
+	}
+	return packages
+}
+
+// packageSource is an additional package and the tool that requires it
+type packageSource struct {
+	name string
+	tool string
+}
+
+// resolveAdditionalPackageSources is ResolveAdditionalPackages with the
+// requiring tool recorded for each package
+func (c *ImageConfig) resolveAdditionalPackageSources(agentName string, userTools map[string]bool) []packageSource {
 	agent, ok := c.Agents[agentName]
 	if !ok {
 		return nil
 	}
 
-	var packages []string
-	seen := make(map[string]bool)
-
-	// Process dependencies using a queue for breadth-first resolution
-	queue := make([]string, len(agent.Depends))
-	copy(queue, agent.Depends)
-
-	for len(queue) > 0 {
-		toolName := queue[0]
-		queue = queue[1:]
-
-		if seen[toolName] {
-			continue
+	var packages []packageSource
+	c.walkToolDeps(agent, func(toolName string, tool ToolConfigEntry) bool {
+		if !userTools[toolName] && !tool.conditionMet() {
+			return false
+		}
+		for _, pkg := range tool.AdditionalPackages {
+			packages = append(packages, packageSource{name: pkg, tool: toolName})
 		}
-		seen[toolName] = true
-
-		tool := c.Tools[toolName]
-		packages = append(packages, tool.AdditionalPackages...)
 
 		// Only resolve transitive dependencies if this tool was user-specified
-		if tool.Depends != "" && userTools[toolName] {
-			queue = append(queue, tool.Depends)
-		}
-	}
+		return userTools[toolName]
+	})
 
 	return packages
 }
 
-// applyImageCustomizations applies add/remove operations to image packages
+// Where an image.packages entry came from, as reported by --show-packages
+const (
+	packageSourceImage         = "image.packages"
+	packageSourceCustomization = "image_customizations"
+)
+
+// packageSource returns where an image package came from. Packages of a
+// config that wasn't loaded through LoadMergedConfig are attributed to
+// image.packages.
+func (c *ImageConfig) packageSource(pkg string) string {
+	if source, ok := c.packageSources[pkg]; ok {
+		return source
+	}
+	return packageSourceImage
+}
+
+// applyImageCustomizations applies add/remove/replace operations to image
+// packages, then the mise install and env customizations
 // This is called after all config files have been merged
 func applyImageCustomizations(cfg *ImageConfig) *ImageConfig {
-	for _, customization := range cfg.ImageCustomizations.Packages {
+	original := append([]string{}, cfg.Image.Packages...)
+	originalSources := func() map[string]string {
+		sources := make(map[string]string, len(original))
+		for _, pkg := range original {
+			sources[pkg] = packageSourceImage
+		}
+		return sources
+	}
+	sources := originalSources()
+	var applied []string
+	var errs []error
+	// notFound reports a remove or replace target missing from the list
+	notFound := func(i int, msg, pkg string) {
+		if cfg.ImageCustomizations.FailOnMissingTarget() {
+			errs = append(errs, fmt.Errorf("image_customizations.packages[%d]: %s", i, msg))
+		} else {
+			logWarn(msg, "package", pkg)
+		}
+	}
+	for i, customization := range cfg.ImageCustomizations.Packages {
 		switch customization.Op {
+		case "reset":
+			// Discard the customizations applied so far, e.g. ones inherited
+			// from a lower-precedence config
+			cfg.Image.Packages = append([]string{}, original...)
+			sources = originalSources()
+			applied = append(applied, "reset")
 		case "add":
+			if slices.Contains(cfg.Image.Packages, customization.Value) {
+				applied = append(applied, "add "+customization.Value+" (already present)")
+				continue
+			}
 			cfg.Image.Packages = append(cfg.Image.Packages, customization.Value)
+			sources[customization.Value] = packageSourceCustomization
+			applied = append(applied, "add "+customization.Value)
 		case "remove":
-			found := false
-			newPackages := make([]string, 0, len(cfg.Image.Packages))
+			before := len(cfg.Image.Packages)
+			cfg.Image.Packages = slices.DeleteFunc(cfg.Image.Packages, func(pkg string) bool {
+				return pkg == customization.Value
+			})
+			delete(sources, customization.Value)
+			if len(cfg.Image.Packages) == before {
+				notFound(i, fmt.Sprintf("package %q not found for removal", customization.Value), customization.Value)
+				applied = append(applied, "remove "+customization.Value+" (not found)")
+			} else {
+				applied = append(applied, "remove "+customization.Value)
+			}
+		case "replace":
+			if !slices.Contains(cfg.Image.Packages, customization.From) {
+				notFound(i, fmt.Sprintf("package %q not found for replacement", customization.From), customization.From)
+				applied = append(applied, fmt.Sprintf("replace %s with %s (not found)", customization.From, customization.Value))
+				continue
+			}
+			// Swap in place, dropping the replacement's own entry if it was
+			// already in the list so it isn't installed twice
+			replaced := make([]string, 0, len(cfg.Image.Packages))
 			for _, pkg := range cfg.Image.Packages {
-				if pkg == customization.Value {
-					found = true
-				} else {
-					newPackages = append(newPackages, pkg)
+				if pkg == customization.From {
+					pkg = customization.Value
+				}
+				if !slices.Contains(replaced, pkg) {
+					replaced = append(replaced, pkg)
 				}
 			}
-			cfg.Image.Packages = newPackages
-			if !found {
-				fmt.Fprintf(os.Stderr, "Warning: package %q not found for removal\n", customization.Value)
-			}
+			cfg.Image.Packages = replaced
+			delete(sources, customization.From)
+			sources[customization.Value] = packageSourceCustomization
+			applied = append(applied, fmt.Sprintf("replace %s with %s", customization.From, customization.Value))
 		default:
-			fmt.Fprintf(os.Stderr, "Warning: unknown image customization operation %q\n", customization.Op)
+			logWarn(fmt.Sprintf("unknown image customization operation %q", customization.Op), "op", customization.Op)
+			applied = append(applied, fmt.Sprintf("%s %s (unknown operation, ignored)", customization.Op, customization.Value))
 		}
 	}
+	cfg.packageSources = sources
+	cfg.appliedCustomizations = applied
+	cfg.customizationErrors = append(errs, applyMiseCustomizations(cfg)...)
 	return cfg
 }
+
+// applyMiseCustomizations applies the miseInstall and miseEnv customizations:
+// add appends a mise.install command or sets a mise.env key from key=value,
+// and remove drops every matching command or the key. A missing remove target
+// is returned as an error when image_customizations.strict is set, and
+// otherwise warned about.
+func applyMiseCustomizations(cfg *ImageConfig) []error {
+	var errs []error
+	notFound := func(field string, i int, msg, key, value string) {
+		if cfg.ImageCustomizations.FailOnMissingTarget() {
+			errs = append(errs, fmt.Errorf("image_customizations.%s[%d]: %s", field, i, msg))
+		} else {
+			logWarn(msg, key, value)
+		}
+	}
+
+	if len(cfg.ImageCustomizations.MiseInstall) > 0 {
+		// Copy so the merged base config's list isn't modified
+		cfg.Mise.Install = append([]string{}, cfg.Mise.Install...)
+	}
+	for i, customization := range cfg.ImageCustomizations.MiseInstall {
+		switch customization.Op {
+		case "add":
+			cfg.Mise.Install = append(cfg.Mise.Install, customization.Value)
+		case "remove":
+			before := len(cfg.Mise.Install)
+			cfg.Mise.Install = slices.DeleteFunc(cfg.Mise.Install, func(command string) bool {
+				return command == customization.Value
+			})
+			if len(cfg.Mise.Install) == before {
+				notFound("miseInstall", i, fmt.Sprintf("mise install command %q not found for removal", customization.Value), "command", customization.Value)
+			}
+		default:
+			logWarn(fmt.Sprintf("unknown miseInstall customization operation %q", customization.Op), "op", customization.Op)
+		}
+	}
+
+	if len(cfg.ImageCustomizations.MiseEnv) > 0 {
+		env := make(map[string]any, len(cfg.Mise.Env))
+		maps.Copy(env, cfg.Mise.Env)
+		cfg.Mise.Env = env
+	}
+	for i, customization := range cfg.ImageCustomizations.MiseEnv {
+		switch customization.Op {
+		case "add":
+			key, value, ok := strings.Cut(customization.Value, "=")
+			if !ok || key == "" {
+				logWarn(fmt.Sprintf("miseEnv customization %q must be key=value, ignoring", customization.Value), "value", customization.Value)
+				continue
+			}
+			cfg.Mise.Env[key] = value
+		case "remove":
+			if _, ok := cfg.Mise.Env[customization.Value]; !ok {
+				notFound("miseEnv", i, fmt.Sprintf("mise env %q not found for removal", customization.Value), "key", customization.Value)
+				continue
+			}
+			delete(cfg.Mise.Env, customization.Value)
+		default:
+			logWarn(fmt.Sprintf("unknown miseEnv customization operation %q", customization.Op), "op", customization.Op)
+		}
+	}
+	return errs
+}
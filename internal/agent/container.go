@@ -0,0 +1,328 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+	"github.com/moby/term"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ExitError carries the exit code of an agent container started with --run so
+// the caller can exit with the same code
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("agent exited with code %d", e.Code)
+}
+
+// resolveRunMode picks between printing the docker run command and running
+// the container: the --print/--run flag first, then run.mode from config
+func resolveRunMode(flag string, run RunSettings) (string, error) {
+	switch flag {
+	case "":
+		return run.ResolveMode(), nil
+	case runModePrint, runModeRun:
+		return flag, nil
+	}
+	return "", fmt.Errorf("unknown run mode %q (expected %s or %s)", flag, runModePrint, runModeRun)
+}
+
+// runSpec describes the agent container. Run fills it in once, then prints it
+// as a docker run command or turns it into create options, so both modes
+// start the agent with the same mounts, env vars and identity.
+type runSpec struct {
+	image        string
+	command      string
+	platform     string
+	hostname     string
+	name         string
+	user         string
+	securityOpts []string
+	tmpfs        []TmpfsMount
+	memory       string
+	cpus         string
+	env          []string // NAME=value as written in config, or a bare NAME taken from the host
+	binds        []string // host:container[:mode]
+}
+
+// printArgs returns the docker run arguments for the container, between
+// docker run --rm -it and the image
+func (s runSpec) printArgs() []string {
+	var args []string
+	if s.platform != "" {
+		args = append(args, "--platform "+s.platform)
+	}
+	args = append(args, "--hostname "+shellQuote(s.hostname))
+	if s.name != "" {
+		args = append(args, "--name "+s.name)
+	}
+	args = append(args, buildSecurityArgs(s.securityOpts)...)
+	args = append(args, buildTmpfsArgs(s.tmpfs)...)
+	if s.memory != "" {
+		args = append(args, "--memory "+s.memory)
+	}
+	if s.cpus != "" {
+		args = append(args, "--cpus "+s.cpus)
+	}
+	if s.user != "" {
+		args = append(args, "--user "+s.user)
+	}
+	for _, env := range s.env {
+		args = append(args, "-e "+env)
+	}
+	for _, bind := range s.binds {
+		args = append(args, "-v "+bind)
+	}
+	return args
+}
+
+// printCommand returns the docker run command printed in print mode
+func (s runSpec) printCommand() string {
+	return fmt.Sprintf("docker run --rm -it %s %s %s", strings.Join(s.printArgs(), " "), s.image, s.command)
+}
+
+// shellSafe matches values that need no quoting in a shell command
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9._/:@%+=,-]+$`)
+
+// shellQuote single-quotes value for the printed command unless it's safe as is
+func shellQuote(value string) string {
+	if shellSafe.MatchString(value) {
+		return value
+	}
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// createOptions returns the create options for the container in run mode
+func (s runSpec) createOptions() (client.ContainerCreateOptions, error) {
+	cfg := &container.Config{
+		Image:        s.image,
+		Hostname:     s.hostname,
+		User:         s.user,
+		Tty:          true,
+		OpenStdin:    true,
+		StdinOnce:    true,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+	if s.command != "" {
+		// The entrypoint runs its arguments with bash -c, which parses
+		// quoting in the command the same way the shell does for --print
+		cfg.Cmd = []string{s.command}
+	}
+	securityOpts, err := apiSecurityOpts(s.securityOpts)
+	if err != nil {
+		return client.ContainerCreateOptions{}, err
+	}
+	host := &container.HostConfig{
+		Binds:       s.binds,
+		SecurityOpt: securityOpts,
+	}
+	options := client.ContainerCreateOptions{Config: cfg, HostConfig: host, Name: s.name}
+
+	for _, entry := range s.env {
+		if env, ok := resolveRunEnv(entry); ok {
+			cfg.Env = append(cfg.Env, env)
+		}
+	}
+	for _, m := range s.tmpfs {
+		if host.Tmpfs == nil {
+			host.Tmpfs = make(map[string]string)
+		}
+		host.Tmpfs[m.Path] = tmpfsOptions(m)
+	}
+	if s.memory != "" {
+		memory, err := parseMemoryLimit(s.memory)
+		if err != nil {
+			return client.ContainerCreateOptions{}, err
+		}
+		host.Memory = memory
+	}
+	if s.cpus != "" {
+		cpus, err := parseCPULimit(s.cpus)
+		if err != nil {
+			return client.ContainerCreateOptions{}, err
+		}
+		host.NanoCPUs = cpus
+	}
+	if s.platform != "" {
+		parts := strings.Split(s.platform, "/")
+		platform := &ocispec.Platform{OS: parts[0]}
+		if len(parts) > 1 {
+			platform.Architecture = parts[1]
+		}
+		if len(parts) > 2 {
+			platform.Variant = parts[2]
+		}
+		options.Platform = platform
+	}
+	return options, nil
+}
+
+// apiSecurityOpts replaces seccomp profile paths with the profile itself, as
+// the Engine API expects the JSON rather than a file to read. docker run does
+// the same before creating the container.
+func apiSecurityOpts(opts []string) ([]string, error) {
+	result := make([]string, 0, len(opts))
+	for _, opt := range opts {
+		profile, ok := strings.CutPrefix(opt, "seccomp=")
+		if !ok || profile == "unconfined" || profile == "builtin" {
+			result = append(result, opt)
+			continue
+		}
+		data, err := os.ReadFile(profile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read seccomp profile %s: %w", profile, err)
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, data); err != nil {
+			return nil, fmt.Errorf("failed to parse seccomp profile %s: %w", profile, err)
+		}
+		result = append(result, "seccomp="+compact.String())
+	}
+	return result, nil
+}
+
+// resolveRunEnv resolves an envVars entry the way the shell would when the
+// printed command is run, without starting one. A bare NAME is taken from the
+// environment and skipped when unset, like docker run -e NAME. Quotes around
+// the value are removed, and $NAME and ${NAME} are expanded unless it is
+// single quoted. Command substitution such as GH_TOKEN="$(gh auth token)"
+// isn't run, as the entry may come from a project's config: NAME is taken
+// from the environment instead, or skipped with a warning when unset.
+func resolveRunEnv(entry string) (string, bool) {
+	name, value, ok := strings.Cut(entry, "=")
+	if !ok {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", false
+		}
+		return name + "=" + value, true
+	}
+	if strings.Contains(value, "$(") || strings.Contains(value, "`") {
+		if hostValue, ok := os.LookupEnv(name); ok {
+			return name + "=" + hostValue, true
+		}
+		logWarn(fmt.Sprintf("%s isn't passed to the agent: its value runs a command, which only the shell does with --print; export %s to pass it with --run", name, name), "env", name)
+		return "", false
+	}
+	if len(value) >= 2 && value[0] == value[len(value)-1] && (value[0] == '"' || value[0] == '\'') {
+		quote := value[0]
+		value = value[1 : len(value)-1]
+		if quote == '\'' {
+			return name + "=" + value, true
+		}
+	}
+	return name + "=" + os.Expand(value, os.Getenv), true
+}
+
+// runContainer creates and starts the agent container attached to stdin and
+// stdout through a TTY, like docker run --rm -it. SIGINT and SIGTERM are
+// forwarded to the container and the container is removed once it exits.
+// It returns the container's exit code.
+func runContainer(ctx context.Context, cli dockerClient, options client.ContainerCreateOptions, stdin io.Reader, stdout io.Writer) (int, error) {
+	fd, isTerminal := term.GetFdInfo(stdin)
+	if isTerminal {
+		if size, err := term.GetWinsize(fd); err == nil {
+			options.HostConfig.ConsoleSize = [2]uint{uint(size.Height), uint(size.Width)}
+		}
+	}
+
+	created, err := cli.ContainerCreate(ctx, options)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create agent container: %w", err)
+	}
+	defer cli.ContainerRemove(context.Background(), created.ID, client.ContainerRemoveOptions{Force: true})
+
+	attached, err := cli.ContainerAttach(ctx, created.ID, client.ContainerAttachOptions{Stream: true, Stdin: true, Stdout: true, Stderr: true})
+	if err != nil {
+		return 0, fmt.Errorf("failed to attach to agent container: %w", err)
+	}
+	defer attached.Close()
+
+	wait := cli.ContainerWait(ctx, created.ID, client.ContainerWaitOptions{Condition: container.WaitConditionNextExit})
+
+	if isTerminal {
+		state, err := term.SetRawTerminal(fd)
+		if err != nil {
+			return 0, fmt.Errorf("failed to set terminal to raw mode: %w", err)
+		}
+		defer term.RestoreTerminal(fd, state)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM}, resizeSignals...)...)
+	defer signal.Stop(signals)
+
+	if _, err := cli.ContainerStart(ctx, created.ID, client.ContainerStartOptions{}); err != nil {
+		return 0, fmt.Errorf("failed to start agent container: %w", err)
+	}
+
+	// The TTY merges stdout and stderr into a single raw stream
+	output := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(stdout, attached.Reader)
+		output <- err
+	}()
+	go func() {
+		io.Copy(attached.Conn, stdin)
+		if conn, ok := attached.Conn.(interface{ CloseWrite() error }); ok {
+			conn.CloseWrite()
+		}
+	}()
+
+	for {
+		select {
+		case sig := <-signals:
+			if isResizeSignal(sig) {
+				if isTerminal {
+					resizeContainer(ctx, cli, created.ID, fd)
+				}
+				continue
+			}
+			cli.ContainerKill(ctx, created.ID, client.ContainerKillOptions{Signal: signalName(sig)})
+		case result := <-wait.Result:
+			if err := <-output; err != nil {
+				return 0, fmt.Errorf("failed to read agent output: %w", err)
+			}
+			if result.Error != nil && result.Error.Message != "" {
+				return 0, fmt.Errorf("agent container failed: %s", result.Error.Message)
+			}
+			return int(result.StatusCode), nil
+		case err := <-wait.Error:
+			return 0, fmt.Errorf("failed waiting for agent container: %w", err)
+		}
+	}
+}
+
+// resizeContainer matches the container's TTY to the host terminal size
+func resizeContainer(ctx context.Context, cli dockerClient, id string, fd uintptr) {
+	size, err := term.GetWinsize(fd)
+	if err != nil {
+		return
+	}
+	cli.ContainerResize(ctx, id, client.ContainerResizeOptions{Height: uint(size.Height), Width: uint(size.Width)})
+}
+
+func signalName(sig os.Signal) string {
+	switch sig {
+	case syscall.SIGINT:
+		return "SIGINT"
+	case syscall.SIGTERM:
+		return "SIGTERM"
+	}
+	return sig.String()
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package agent
+
+import (
+	"os"
+	"syscall"
+)
+
+// resizeSignals are the signals sent when the host terminal is resized
+var resizeSignals = []os.Signal{syscall.SIGWINCH}
+
+func isResizeSignal(sig os.Signal) bool {
+	return sig == syscall.SIGWINCH
+}
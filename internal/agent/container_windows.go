@@ -0,0 +1,12 @@
+//go:build windows
+
+package agent
+
+import "os"
+
+// Windows has no resize signal, so the TTY keeps the size it was created with
+var resizeSignals []os.Signal
+
+func isResizeSignal(sig os.Signal) bool {
+	return false
+}
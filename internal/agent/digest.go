@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configDigest returns a sha256 over everything that determines the agent
+// image: the merged config, the resolved tools, the build context sent to
+// Docker and the build.hashInputs files. CI can use it as a cache key
+// without a Docker connection. Each input is written under its own header so
+// that moving content between inputs changes the digest.
+func configDigest(toolFile, miseFile *fileSpec, collection collectResult, spec ToolSpec, imgCfg *ImageConfig, agentName string, env []string) (string, error) {
+	h := sha256.New()
+	section := func(name string, data []byte) {
+		fmt.Fprintf(h, "%s %d\n", name, len(data))
+		h.Write(data)
+	}
+
+	configData, err := yaml.Marshal(imgCfg)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode config: %w", err)
+	}
+	section("config", configData)
+
+	tools := append([]toolDescriptor{}, collection.specs...)
+	sort.Slice(tools, func(i, j int) bool { return tools[i].name < tools[j].name })
+	var resolved strings.Builder
+	for _, tool := range tools {
+		versions := append([]string{tool.version}, tool.fallbacks...)
+		fmt.Fprintf(&resolved, "%s %s %s\n", tool.name, strings.Join(versions, ","), tool.source)
+	}
+	section("tools", []byte(resolved.String()))
+	section("image", []byte(buildImageName(imageTagSpecs(collection.specs, spec, imgCfg))))
+
+	if err := writeBuildInputs(section, toolFile, miseFile, collection, spec, imgCfg, agentName, env); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// inputsTagLength is how much of the build inputs hash goes into the image tag
+const inputsTagLength = 8
+
+// agentImageName returns the image tag for the resolved tools, suffixed with
+// the first inputsTagLength characters of buildInputsHash, and the full hash.
+// Projects that need the same tool versions but copy different files into
+// the image get different tags, so they don't rebuild over each other's
+// image on alternate runs.
+func agentImageName(toolFile, miseFile *fileSpec, collection collectResult, spec ToolSpec, imgCfg *ImageConfig, agentName string, env []string) (string, string, error) {
+	inputsHash, err := buildInputsHash(toolFile, miseFile, collection, spec, imgCfg, agentName, env)
+	if err != nil {
+		return "", "", err
+	}
+	return buildImageName(imageTagSpecs(collection.specs, spec, imgCfg)) + "-" + inputsHash[:inputsTagLength], inputsHash, nil
+}
+
+// buildInputsHash returns a sha256 over the image's build context, exactly as
+// it is sent to Docker, plus the build.hashInputs files. Its short form is
+// part of the tag, and the full hash is stored as an image label so that an
+// existing image whose inputs changed is rebuilt even when the short form
+// collides. Unlike configDigest it leaves out settings such as run that don't
+// affect the image.
+func buildInputsHash(toolFile, miseFile *fileSpec, collection collectResult, spec ToolSpec, imgCfg *ImageConfig, agentName string, env []string) (string, error) {
+	h := sha256.New()
+	section := func(name string, data []byte) {
+		fmt.Fprintf(h, "%s %d\n", name, len(data))
+		h.Write(data)
+	}
+	if err := writeBuildInputs(section, toolFile, miseFile, collection, spec, imgCfg, agentName, env); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeBuildInputs passes each build input to section: the build context tar,
+// which holds the Dockerfile, the project's tool and version files, the
+// generated mise.agent.toml, seed files and the entrypoint, then the
+// build.hashInputs files in order. A missing hash input is recorded as such so
+// that creating it changes the result.
+func writeBuildInputs(section func(name string, data []byte), toolFile, miseFile *fileSpec, collection collectResult, spec ToolSpec, imgCfg *ImageConfig, agentName string, env []string) error {
+	buildContext, err := buildContextTar(toolFile, miseFile, collection, spec, imgCfg, agentName, env)
+	if err != nil {
+		return err
+	}
+	section("context", buildContext)
+
+	for _, path := range imgCfg.Build.HashInputs {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			section("missing "+path, nil)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read build.hashInputs file: %w", err)
+		}
+		section("input "+path, data)
+	}
+	return nil
+}
@@ -0,0 +1,554 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+	"github.com/moby/moby/client/pkg/versions"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// dockerClient is the subset of the Docker API used by agent-en-place.
+// It is satisfied by *client.Client and lets tests substitute a fake daemon.
+type dockerClient interface {
+	ImageBuild(ctx context.Context, buildContext io.Reader, options client.ImageBuildOptions) (client.ImageBuildResult, error)
+	ImageInspect(ctx context.Context, imageID string, inspectOpts ...client.ImageInspectOption) (client.ImageInspectResult, error)
+	ImageList(ctx context.Context, options client.ImageListOptions) (client.ImageListResult, error)
+	ImageRemove(ctx context.Context, imageID string, options client.ImageRemoveOptions) (client.ImageRemoveResult, error)
+	ImageTag(ctx context.Context, options client.ImageTagOptions) (client.ImageTagResult, error)
+	ImagePull(ctx context.Context, refStr string, options client.ImagePullOptions) (client.ImagePullResponse, error)
+	ContainerCreate(ctx context.Context, options client.ContainerCreateOptions) (client.ContainerCreateResult, error)
+	ContainerStart(ctx context.Context, containerID string, options client.ContainerStartOptions) (client.ContainerStartResult, error)
+	ContainerWait(ctx context.Context, containerID string, options client.ContainerWaitOptions) client.ContainerWaitResult
+	ContainerLogs(ctx context.Context, containerID string, options client.ContainerLogsOptions) (client.ContainerLogsResult, error)
+	ContainerRemove(ctx context.Context, containerID string, options client.ContainerRemoveOptions) (client.ContainerRemoveResult, error)
+	ContainerAttach(ctx context.Context, containerID string, options client.ContainerAttachOptions) (client.ContainerAttachResult, error)
+	ContainerKill(ctx context.Context, containerID string, options client.ContainerKillOptions) (client.ContainerKillResult, error)
+	ContainerResize(ctx context.Context, containerID string, options client.ContainerResizeOptions) (client.ContainerResizeResult, error)
+	ServerVersion(ctx context.Context, options client.ServerVersionOptions) (client.ServerVersionResult, error)
+}
+
+// apiVersionPattern matches a Docker API version such as "1.47"
+var apiVersionPattern = regexp.MustCompile(`^[0-9]+\.[0-9]+$`)
+
+// validateAPIVersion checks a --docker-api-version value
+func validateAPIVersion(version string) error {
+	if !apiVersionPattern.MatchString(version) {
+		return fmt.Errorf("invalid Docker API version %q: expected <major>.<minor>, e.g. 1.47", version)
+	}
+	if versions.GreaterThan(version, client.MaxAPIVersion) {
+		return fmt.Errorf("docker API version %s is newer than this client supports (up to %s)", version, client.MaxAPIVersion)
+	}
+	return nil
+}
+
+// dockerClientOptions returns the options used to connect to the daemon. By
+// default the API version is negotiated, or taken from DOCKER_API_VERSION. A
+// pinned version skips negotiation and takes precedence over
+// DOCKER_API_VERSION.
+func dockerClientOptions(apiVersion string) []client.Opt {
+	if apiVersion == "" {
+		return []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	}
+	return []client.Opt{client.WithTLSClientConfigFromEnv(), client.WithHostFromEnv(), client.WithAPIVersion(apiVersion)}
+}
+
+// checkAPIVersion makes sure the daemon accepts a pinned API version so that an
+// unsupported version fails up front with a clear message, rather than on
+// whichever request happens to come first
+func checkAPIVersion(ctx context.Context, cli dockerClient, apiVersion string) error {
+	server, err := cli.ServerVersion(ctx, client.ServerVersionOptions{})
+	if err != nil {
+		return fmt.Errorf("docker daemon rejected API version %s: %w", apiVersion, err)
+	}
+	if server.MinAPIVersion != "" && versions.LessThan(apiVersion, server.MinAPIVersion) ||
+		server.APIVersion != "" && versions.GreaterThan(apiVersion, server.APIVersion) {
+		return fmt.Errorf("docker daemon %s does not support API version %s (supported: %s to %s)", server.Version, apiVersion, server.MinAPIVersion, server.APIVersion)
+	}
+	return nil
+}
+
+// connectDocker creates a Docker client, negotiating the API version with the
+// daemon unless one is pinned, in which case the daemon must support it
+func connectDocker(ctx context.Context, apiVersion string) (*client.Client, error) {
+	cli, err := client.NewClientWithOpts(dockerClientOptions(apiVersion)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to docker daemon: %w", err)
+	}
+	if apiVersion != "" {
+		if err := checkAPIVersion(ctx, cli, apiVersion); err != nil {
+			return nil, err
+		}
+	}
+	return cli, nil
+}
+
+// localImage describes a locally available agent-en-place image
+type localImage struct {
+	tag     string
+	created time.Time
+	tools   []string // tool=version pairs from the image labels
+}
+
+// findAgentImages returns all local images under imageRepository that were built
+// for the given agent, newest first. Images are matched on the agent's tool label
+// so images whose tag excludes the agent are still found.
+func findAgentImages(ctx context.Context, cli dockerClient, spec ToolSpec) ([]localImage, error) {
+	result, err := cli.ImageList(ctx, client.ImageListOptions{
+		Filters: make(client.Filters).Add("reference", imageRepository),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	agentLabel := labelPrefix + getLabelName(spec.MiseToolName)
+	var images []localImage
+	for _, summary := range result.Items {
+		if _, ok := summary.Labels[agentLabel]; !ok {
+			continue
+		}
+		var tools []string
+		for key, value := range summary.Labels {
+			if name, ok := strings.CutPrefix(key, labelPrefix); ok && !slices.Contains(metadataLabels, name) {
+				tools = append(tools, fmt.Sprintf("%s=%s", name, value))
+			}
+		}
+		sort.Strings(tools)
+		for _, tag := range summary.RepoTags {
+			if !strings.HasPrefix(tag, imageRepository+":") {
+				continue
+			}
+			images = append(images, localImage{
+				tag:     tag,
+				created: time.Unix(summary.Created, 0),
+				tools:   tools,
+			})
+		}
+	}
+
+	sort.SliceStable(images, func(i, j int) bool {
+		if images[i].created.Equal(images[j].created) {
+			return images[i].tag < images[j].tag
+		}
+		return images[i].created.After(images[j].created)
+	})
+	return images, nil
+}
+
+// printAgentImages writes a table of the local images built for an agent
+func printAgentImages(w io.Writer, agentName string, images []localImage) {
+	if len(images) == 0 {
+		fmt.Fprintf(w, "No local images found for %s\n", agentName)
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TAG\tCREATED\tTOOLS")
+	for _, img := range images {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", img.tag, img.created.Local().Format("2006-01-02 15:04:05"), strings.Join(img.tools, ", "))
+	}
+	tw.Flush()
+}
+
+// buildTarget is a single image to build. platform is empty when building
+// for the daemon's native platform.
+// alias is a friendly tag also pointed at the image, empty when
+// image.aliasTag isn't set.
+type buildTarget struct {
+	tag      string
+	platform string
+	alias    string
+}
+
+// parsePlatforms parses a comma-separated --platform value such as
+// "linux/amd64,linux/arm64" into a deduplicated list of os/arch[/variant] strings
+func parsePlatforms(value string) ([]string, error) {
+	var platforms []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, "/")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid platform %q: expected os/arch[/variant], e.g. linux/arm64", entry)
+		}
+		if !slices.Contains(platforms, entry) {
+			platforms = append(platforms, entry)
+		}
+	}
+	return platforms, nil
+}
+
+// hostPlatform is the platform matching the machine agent-en-place runs on
+func hostPlatform() string {
+	return "linux/" + runtime.GOARCH
+}
+
+// buildPlatforms returns the platforms to build. With image.tagArch and no
+// --platform the host's platform is built explicitly, so its tag gets the
+// platform suffix and images built on amd64 and arm64 hosts don't collide.
+func buildPlatforms(platforms []string, tagArch bool) []string {
+	if len(platforms) == 0 && tagArch {
+		return []string{hostPlatform()}
+	}
+	return platforms
+}
+
+// platformTargets returns the images to build. Without platforms this is the
+// image itself; otherwise each platform gets its own tag suffix
+// (e.g. "-linux-arm64") so the images can coexist locally.
+func platformTargets(imageName string, platforms []string) []buildTarget {
+	if len(platforms) == 0 {
+		platforms = []string{""}
+	}
+	targets := make([]buildTarget, 0, len(platforms))
+	for _, platform := range platforms {
+		tag := imageName
+		if platform != "" {
+			tag += "-" + sanitizeTagComponent(platform)
+		}
+		targets = append(targets, buildTarget{tag: tag, platform: platform})
+	}
+	return targets
+}
+
+// withAliasTag sets each target's alias to aliasName under imageRepository,
+// with the same platform suffix as its computed tag so the aliases
+// of different platforms don't collide
+func withAliasTag(targets []buildTarget, imageName, aliasName string) []buildTarget {
+	if aliasName == "" {
+		return targets
+	}
+	for i, target := range targets {
+		targets[i].alias = imageRepository + ":" + aliasName + strings.TrimPrefix(target.tag, imageName)
+	}
+	return targets
+}
+
+// buildNetworkModes are the docker build network modes besides named networks
+var buildNetworkModes = []string{"default", "bridge", "host", "none"}
+
+// networkNamePattern matches a user-defined Docker network name
+var networkNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// validateBuildNetwork checks a --build-network value: one of
+// buildNetworkModes or the name of a user-defined network
+func validateBuildNetwork(mode string) error {
+	if slices.Contains(buildNetworkModes, mode) {
+		return nil
+	}
+	if strings.HasPrefix(mode, "container:") {
+		return fmt.Errorf("invalid --build-network %q: builds can't share a container's network", mode)
+	}
+	if !networkNamePattern.MatchString(mode) {
+		return fmt.Errorf("invalid --build-network %q: expected %s or a network name", mode, strings.Join(buildNetworkModes, ", "))
+	}
+	return nil
+}
+
+// runTarget picks the image to print a run command for, preferring the
+// host's architecture when several platforms were built
+func runTarget(targets []buildTarget) buildTarget {
+	native := hostPlatform()
+	for _, target := range targets {
+		if target.platform == native {
+			return target
+		}
+	}
+	return targets[0]
+}
+
+// metadataLabels are image labels under labelPrefix that describe the build
+// rather than an installed tool
+var metadataLabels = []string{"platform", "git.sha", "git.dirty", "inputs"}
+
+// inputsLabel records the buildInputsHash an image was built from
+const inputsLabel = labelPrefix + "inputs"
+
+// gitLabels returns labels recording the HEAD commit of the git repository in
+// dir and whether its working tree has uncommitted changes. It returns nil when
+// dir isn't a git repository or git isn't installed. The labels are applied at
+// build time rather than in the Dockerfile so new commits don't change the tag
+// or invalidate the build cache.
+func gitLabels(dir string) map[string]string {
+	sha, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return nil
+	}
+	status, err := exec.Command("git", "-C", dir, "status", "--porcelain").Output()
+	if err != nil {
+		return nil
+	}
+	return map[string]string{
+		labelPrefix + "git.sha":   strings.TrimSpace(string(sha)),
+		labelPrefix + "git.dirty": strconv.FormatBool(len(bytes.TrimSpace(status)) > 0),
+	}
+}
+
+// buildOptions controls how buildImages builds its targets
+type buildOptions struct {
+	rebuild    bool              // build even when the tag already exists
+	noCache    bool              // don't reuse cached layers; implies rebuild
+	inputsHash string            // rebuild an existing image whose inputs label doesn't match; empty skips the check
+	debug      bool              // stream the build output
+	buildArgs  map[string]string // passed to the daemon as build-time ARG values
+	network    string            // build network mode, e.g. host; empty uses the daemon default
+	labels     map[string]string // extra image labels that don't affect the tag, e.g. git metadata
+	log        io.Writer         // receives the raw build output when set, for --bundle
+}
+
+// imageBuildOptions returns the options used to build a target
+func imageBuildOptions(target buildTarget, build buildOptions) client.ImageBuildOptions {
+	tags := []string{target.tag}
+	if target.alias != "" {
+		tags = append(tags, target.alias)
+	}
+	opts := client.ImageBuildOptions{
+		Tags:        tags,
+		Remove:      true,
+		PullParent:  true,
+		Dockerfile:  "Dockerfile",
+		ForceRemove: true,
+		NetworkMode: build.network,
+		NoCache:     build.noCache,
+	}
+	if len(build.buildArgs) > 0 {
+		opts.BuildArgs = make(map[string]*string, len(build.buildArgs))
+		for key, value := range build.buildArgs {
+			opts.BuildArgs[key] = &value
+		}
+	}
+	if target.platform != "" {
+		parts := strings.Split(target.platform, "/")
+		platform := ocispec.Platform{OS: parts[0], Architecture: parts[1]}
+		if len(parts) == 3 {
+			platform.Variant = parts[2]
+		}
+		opts.Platforms = []ocispec.Platform{platform}
+		opts.Labels = map[string]string{labelPrefix + "platform": target.platform}
+	}
+	for key, value := range build.labels {
+		if opts.Labels == nil {
+			opts.Labels = make(map[string]string, len(build.labels))
+		}
+		opts.Labels[key] = value
+	}
+	return opts
+}
+
+// buildImages builds each target that is missing or stale (or all of them when
+// rebuild is set) one after another, tagging each with its alias as well.
+// Targets that are already current just have their alias re-pointed.
+// newContext is called once per build because the build context reader is
+// consumed by the daemon.
+func buildImages(ctx context.Context, cli dockerClient, targets []buildTarget, opts buildOptions, newContext func() (io.Reader, error)) error {
+	for _, target := range targets {
+		if !opts.rebuild && !opts.noCache && imageCurrent(ctx, cli, target.tag, opts.inputsHash) {
+			// The alias may still point at an image built for other tools, e.g.
+			// from another project
+			if target.alias != "" {
+				if _, err := cli.ImageTag(ctx, client.ImageTagOptions{Source: target.tag, Target: target.alias}); err != nil {
+					return fmt.Errorf("failed to tag %s as %s: %w", target.tag, target.alias, err)
+				}
+			}
+			continue
+		}
+
+		buildCtx, err := newContext()
+		if err != nil {
+			return fmt.Errorf("failed to prepare build context: %w", err)
+		}
+
+		buildResp, err := cli.ImageBuild(ctx, buildCtx, imageBuildOptions(target, opts))
+		if err != nil {
+			if target.platform != "" {
+				return fmt.Errorf("failed to build image for %s (the daemon must support --platform builds and emulate non-native architectures): %w", target.platform, err)
+			}
+			return fmt.Errorf("failed to build image: %w", err)
+		}
+		var body io.Reader = buildResp.Body
+		if opts.log != nil {
+			body = io.TeeReader(body, opts.log)
+		}
+		err = handleBuildOutput(body, opts.debug, target.tag)
+		buildResp.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// imageCurrent reports whether tag exists locally and, when inputsHash is set,
+// was built from the same inputs. Images built before the inputs label existed
+// count as stale and are rebuilt once.
+func imageCurrent(ctx context.Context, cli dockerClient, tag, inputsHash string) bool {
+	result, err := cli.ImageInspect(ctx, tag)
+	if err != nil {
+		return false
+	}
+	if inputsHash == "" {
+		return true
+	}
+	var built string
+	if result.Config != nil {
+		built = result.Config.Labels[inputsLabel]
+	}
+	if built != inputsHash {
+		logInfo(fmt.Sprintf("Build inputs changed since %s was built, rebuilding", tag), "image", tag)
+		return false
+	}
+	return true
+}
+
+// refreshBaseImages pulls the base image for every platform being built and
+// reports whether any pull produced a different image than was present locally
+func refreshBaseImages(ctx context.Context, cli dockerClient, base string, targets []buildTarget) (bool, error) {
+	changed := false
+	var pulled []string
+	for _, target := range targets {
+		if slices.Contains(pulled, target.platform) {
+			continue
+		}
+		pulled = append(pulled, target.platform)
+
+		before := imageDigest(ctx, cli, base)
+		opts := client.ImagePullOptions{}
+		if target.platform != "" {
+			opts.Platforms = imageBuildOptions(target, buildOptions{}).Platforms
+		}
+		resp, err := cli.ImagePull(ctx, base, opts)
+		if err != nil {
+			return false, fmt.Errorf("failed to pull base image %s: %w", base, err)
+		}
+		err = resp.Wait(ctx)
+		resp.Close()
+		if err != nil {
+			return false, fmt.Errorf("failed to pull base image %s: %w", base, err)
+		}
+
+		after := imageDigest(ctx, cli, base)
+		name := base
+		if target.platform != "" {
+			name = fmt.Sprintf("%s (%s)", base, target.platform)
+		}
+		if after != before {
+			changed = true
+			logInfo(fmt.Sprintf("Pulled new base image %s: %s", name, after), "image", base, "digest", after)
+		} else {
+			logInfo(fmt.Sprintf("Base image %s is up to date: %s", name, after), "image", base, "digest", after)
+		}
+	}
+	return changed, nil
+}
+
+// imageDigest returns the repo digest of a local image, falling back to its
+// ID for images that were never pulled from a registry
+func imageDigest(ctx context.Context, cli dockerClient, name string) string {
+	result, err := cli.ImageInspect(ctx, name)
+	if err != nil {
+		return ""
+	}
+	if len(result.RepoDigests) > 0 {
+		return result.RepoDigests[0]
+	}
+	return result.ID
+}
+
+// missingPackagePrefix marks a package the verification script couldn't find
+const missingPackagePrefix = "missing: "
+
+// packageCheckScript returns a shell script that refreshes the package index
+// and prints a missingPackagePrefix line for every package that isn't available
+func packageCheckScript(packageManager string, packages []string) string {
+	quoted := make([]string, len(packages))
+	for i, pkg := range packages {
+		quoted[i] = "'" + strings.ReplaceAll(pkg, "'", `'\''`) + "'"
+	}
+	list := strings.Join(quoted, " ")
+	if packageManager == packageManagerApk {
+		return fmt.Sprintf(`apk update -q >/dev/null && for p in %s; do [ -n "$(apk search -x -q "$p")" ] || echo "%s$p"; done`, list, missingPackagePrefix)
+	}
+	return fmt.Sprintf(`apt-get update -qq >/dev/null && for p in %s; do apt-cache show "$p" >/dev/null 2>&1 || echo "%s$p"; done`, list, missingPackagePrefix)
+}
+
+// verifyPackages runs a throwaway container from the base image that checks
+// every system package exists, so that all typos are reported at once before
+// the main build rather than one at a time as apt errors.
+func verifyPackages(ctx context.Context, cli dockerClient, base, packageManager string, packages []string) error {
+	if len(packages) == 0 {
+		return nil
+	}
+	if !imageExists(ctx, cli, base) {
+		resp, err := cli.ImagePull(ctx, base, client.ImagePullOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to pull base image %s: %w", base, err)
+		}
+		err = resp.Wait(ctx)
+		resp.Close()
+		if err != nil {
+			return fmt.Errorf("failed to pull base image %s: %w", base, err)
+		}
+	}
+
+	created, err := cli.ContainerCreate(ctx, client.ContainerCreateOptions{
+		Config: &container.Config{
+			Image: base,
+			Cmd:   []string{"/bin/sh", "-c", packageCheckScript(packageManager, packages)},
+			Tty:   true, // a single raw output stream, no multiplexing headers
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create package check container: %w", err)
+	}
+	defer cli.ContainerRemove(context.Background(), created.ID, client.ContainerRemoveOptions{Force: true})
+
+	wait := cli.ContainerWait(ctx, created.ID, client.ContainerWaitOptions{Condition: container.WaitConditionNextExit})
+	if _, err := cli.ContainerStart(ctx, created.ID, client.ContainerStartOptions{}); err != nil {
+		return fmt.Errorf("failed to start package check container: %w", err)
+	}
+	var exitCode int64
+	select {
+	case result := <-wait.Result:
+		exitCode = result.StatusCode
+	case err := <-wait.Error:
+		return fmt.Errorf("failed waiting for package check container: %w", err)
+	}
+
+	logs, err := cli.ContainerLogs(ctx, created.ID, client.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
+	if err != nil {
+		return fmt.Errorf("failed to read package check output: %w", err)
+	}
+	defer logs.Close()
+	output, err := io.ReadAll(logs)
+	if err != nil {
+		return fmt.Errorf("failed to read package check output: %w", err)
+	}
+
+	var missing []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if pkg, ok := strings.CutPrefix(strings.TrimSpace(line), missingPackagePrefix); ok {
+			missing = append(missing, pkg)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("packages not found in %s: %s", base, strings.Join(missing, ", "))
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("package check failed with exit code %d:\n%s", exitCode, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Log output settings. Warnings and errors are written as human readable text
+// by default, or as JSON lines for tooling that wraps agent-en-place.
+var (
+	logOutput io.Writer = os.Stderr
+	logJSON   bool
+)
+
+// SetLogFormat selects how warnings and errors are written to stderr.
+// Supported formats are "text" (the default) and "json".
+func SetLogFormat(format string) error {
+	switch format {
+	case "", "text":
+		logJSON = false
+	case "json":
+		logJSON = true
+	default:
+		return fmt.Errorf("unknown log format %q (expected text or json)", format)
+	}
+	return nil
+}
+
+// LogError reports a fatal error in the configured log format
+func LogError(err error) {
+	writeLog("error", "error: ", err.Error(), nil)
+}
+
+// logWarn reports a non-fatal problem. msg is the human readable message and
+// fields are key/value pairs that are only included in JSON output.
+func logWarn(msg string, fields ...string) {
+	writeLog("warn", "Warning: ", msg, fields)
+}
+
+// logInfo reports progress that isn't part of the command's stdout output
+func logInfo(msg string, fields ...string) {
+	writeLog("info", "", msg, fields)
+}
+
+// logDebug reports diagnostic output enabled by --debug
+func logDebug(msg string, fields ...string) {
+	writeLog("debug", "debug: ", msg, fields)
+}
+
+func writeLog(level, prefix, msg string, fields []string) {
+	if !logJSON {
+		fmt.Fprintf(logOutput, "%s%s\n", prefix, msg)
+		return
+	}
+	entry := map[string]string{"level": level, "msg": msg}
+	for i := 0; i+1 < len(fields); i += 2 {
+		entry[fields[i]] = fields[i+1]
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Fprintf(logOutput, "%s%s\n", prefix, msg)
+		return
+	}
+	fmt.Fprintf(logOutput, "%s\n", data)
+}
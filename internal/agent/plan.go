@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// buildPlan is the machine-readable description of an image written by
+// --plan-json. It's built from the same collection as --report json, but
+// describes what will be built rather than how each version was chosen.
+type buildPlan struct {
+	Agent          string       `json:"agent"`
+	Image          string       `json:"image"`
+	Tools          []planTool   `json:"tools"`
+	Packages       []string     `json:"packages"`       // system packages installed with the base image's package manager
+	MiseEnv        []planEnvVar `json:"miseEnv"`        // MISE_* variables baked into the image
+	IdiomaticFiles []string     `json:"idiomaticFiles"` // version files such as .nvmrc that were detected
+}
+
+// planTool is a tool installed in the image
+type planTool struct {
+	Name      string   `json:"name"`
+	Version   string   `json:"version"`
+	Fallbacks []string `json:"fallbacks,omitempty"` // further .tool-versions versions, which mise installs too
+	Source    string   `json:"source"`              // user, idiomatic, config or env
+	Origin    string   `json:"origin"`              // file or setting the version came from, as in --report json
+	LabelName string   `json:"labelName"`           // image label name, under com.mheap.agent-en-place.
+}
+
+type planEnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// buildBuildPlan describes the image for the tools collectToolSpecs resolved
+func buildBuildPlan(collection collectResult, spec ToolSpec, imgCfg *ImageConfig, agentName, imageName string, environ []string) buildPlan {
+	plan := buildPlan{
+		Agent:          agentName,
+		Image:          imageName,
+		Tools:          []planTool{},
+		Packages:       imagePackages(imgCfg, agentName, collection),
+		MiseEnv:        []planEnvVar{},
+		IdiomaticFiles: append([]string{}, collection.idiomaticPaths...),
+	}
+	for _, tool := range collection.specs {
+		plan.Tools = append(plan.Tools, planTool{
+			Name:      tool.name,
+			Version:   tool.version,
+			Fallbacks: tool.fallbacks,
+			Source:    string(tool.source),
+			Origin:    tool.origin,
+			LabelName: toolLabelName(tool),
+		})
+	}
+	for _, kv := range imageMiseEnvVars(imgCfg, environ) {
+		plan.MiseEnv = append(plan.MiseEnv, planEnvVar{Name: kv[0], Value: kv[1]})
+	}
+	if plan.Packages == nil {
+		plan.Packages = []string{}
+	}
+	return plan
+}
+
+// writeBuildPlan writes the plan as indented JSON
+func writeBuildPlan(w io.Writer, plan buildPlan) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(plan)
+}
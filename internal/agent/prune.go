@@ -0,0 +1,342 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/moby/moby/api/types/image"
+	"github.com/moby/moby/client"
+	"github.com/moby/moby/client/pkg/versions"
+	"github.com/moby/term"
+)
+
+// pruneOptions selects which images --prune removes
+type pruneOptions struct {
+	olderThan     time.Duration                            // remove images created longer ago than this; 0 removes superseded untagged images instead
+	outdated      bool                                     // remove images whose agent version is older than its latest release
+	latestVersion func(packageName string) (string, error) // looks up an agent's latest release for outdated, defaulting to mise latest
+	dryRun        bool                                     // list what would be removed without removing it
+	yes           bool                                     // remove without asking for confirmation
+	confirm       func(prompt string) bool                 // asks the user to confirm; nil outside an interactive terminal
+}
+
+// pruneImage is a local image that --prune removes
+type pruneImage struct {
+	id       string
+	agent    string   // configured agent the image was built for, empty when unknown
+	tags     []string // tags under imageRepository, or the short image ID for an untagged image
+	created  time.Time
+	size     int64
+	shared   bool // tagged outside imageRepository too, so removing our tags frees no space
+	untagged bool // superseded by a rebuild of its tag, so removed by ID
+	newest   bool // newest image for its agent and platform
+}
+
+// pruneCandidates returns the images under imageRepository, marking the newest
+// image for each agent and platform
+func pruneCandidates(items []image.Summary, agents map[string]AgentConfig) []pruneImage {
+	var images []pruneImage
+	newest := make(map[string]int)
+	for _, summary := range items {
+		img := pruneImage{id: summary.ID, agent: imageAgent(summary.Labels, agents), created: time.Unix(summary.Created, 0), size: summary.Size}
+		for _, tag := range summary.RepoTags {
+			if strings.HasPrefix(tag, imageRepository+":") {
+				img.tags = append(img.tags, tag)
+			} else {
+				img.shared = true
+			}
+		}
+		if len(img.tags) == 0 {
+			continue
+		}
+		group := img.agent + "/" + summary.Labels[labelPrefix+"platform"]
+		if i, ok := newest[group]; !ok || img.created.After(images[i].created) {
+			newest[group] = len(images)
+		}
+		images = append(images, img)
+	}
+	for _, i := range newest {
+		images[i].newest = true
+	}
+	return images
+}
+
+// selectPruneImages picks the images under imageRepository created before
+// now-olderThan. Images are returned oldest first.
+func selectPruneImages(items []image.Summary, agents map[string]AgentConfig, opts pruneOptions, now time.Time) []pruneImage {
+	var selected []pruneImage
+	cutoff := now.Add(-opts.olderThan)
+	for _, img := range pruneCandidates(items, agents) {
+		if img.created.Before(cutoff) {
+			selected = append(selected, img)
+		}
+	}
+	sortPruneImages(selected)
+	return selected
+}
+
+// selectSupersededImages picks the untagged images agent-en-place built. Each
+// tag names a tool set that any project with those tools may be using, so a
+// tagged image is never superseded; rebuilding a tag leaves the previous image
+// untagged, and those are the images that are safe to remove. items should be
+// the daemon's dangling images. Images are returned oldest first.
+func selectSupersededImages(items []image.Summary, agents map[string]AgentConfig) []pruneImage {
+	var selected []pruneImage
+	for _, summary := range items {
+		if !builtByAgentEnPlace(summary.Labels) || slices.ContainsFunc(summary.RepoTags, func(tag string) bool { return tag != "<none>:<none>" }) {
+			continue
+		}
+		selected = append(selected, pruneImage{
+			id:       summary.ID,
+			agent:    imageAgent(summary.Labels, agents),
+			tags:     []string{shortImageID(summary.ID)},
+			created:  time.Unix(summary.Created, 0),
+			size:     summary.Size,
+			untagged: true,
+		})
+	}
+	sortPruneImages(selected)
+	return selected
+}
+
+// builtByAgentEnPlace reports whether an image has any label under labelPrefix
+func builtByAgentEnPlace(labels map[string]string) bool {
+	for key := range labels {
+		if strings.HasPrefix(key, labelPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// shortImageID returns the 12 character form of an image ID, like docker images
+func shortImageID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// selectOutdatedImages picks the images whose agent version, read from the
+// image's labels, is older than the agent's latest release. The latest release
+// is looked up once per agent. The newest image for each agent and platform is
+// always kept, as are images built for an unknown agent or with a version that
+// can't be compared, such as "latest".
+func selectOutdatedImages(ctx context.Context, cli dockerClient, items []image.Summary, agents map[string]AgentConfig, latestVersion func(string) (string, error)) []pruneImage {
+	latest := make(map[string]string)
+	var selected []pruneImage
+	for _, img := range pruneCandidates(items, agents) {
+		if img.newest || img.agent == "" {
+			continue
+		}
+		packageName := agents[img.agent].PackageName
+		current, ok := latest[img.agent]
+		if !ok {
+			version, err := latestVersion(packageName)
+			if err != nil {
+				logWarn(fmt.Sprintf("keeping %s images: %v", img.agent, err), "agent", img.agent)
+			}
+			latest[img.agent] = version
+			current = version
+		}
+		if !isNumericVersion(current) {
+			continue
+		}
+
+		result, err := cli.ImageInspect(ctx, img.tags[0])
+		if err != nil || result.Config == nil {
+			continue
+		}
+		version := result.Config.Labels[labelPrefix+getLabelName(packageName)]
+		if isNumericVersion(version) && versions.LessThan(version, current) {
+			selected = append(selected, img)
+		}
+	}
+	sortPruneImages(selected)
+	return selected
+}
+
+// isNumericVersion reports whether a version can be compared with
+// versions.LessThan, which rules out aliases such as "latest" or "lts"
+func isNumericVersion(version string) bool {
+	return version != "" && version[0] >= '0' && version[0] <= '9'
+}
+
+// miseLatestVersion looks up a tool's latest release with mise on the host
+func miseLatestVersion(packageName string) (string, error) {
+	out, err := exec.Command("mise", "latest", packageName).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to look up the latest %s with mise: %w", packageName, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// sortPruneImages orders images oldest first
+func sortPruneImages(images []pruneImage) {
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].created.Equal(images[j].created) {
+			return images[i].tags[0] < images[j].tags[0]
+		}
+		return images[i].created.Before(images[j].created)
+	})
+}
+
+// imageAgent returns the configured agent an image was built for, found from
+// the agent's tool label, or "" when no configured agent matches
+func imageAgent(labels map[string]string, agents map[string]AgentConfig) string {
+	names := make([]string, 0, len(agents))
+	for name := range agents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		packageName := agents[name].PackageName
+		if packageName == "" {
+			continue
+		}
+		if _, ok := labels[labelPrefix+getLabelName(packageName)]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// pruneImages removes stale agent-en-place images and reports what was
+// removed and roughly how much space was reclaimed. Unless opts.yes is set,
+// the images are listed first and only removed once the user confirms; when
+// stdout isn't a terminal, as in scripts, nothing is removed without --yes. Outdated images
+// are only ever listed without --yes, as that policy relies on a version
+// lookup the user should check first. Images that can't
+// be removed, e.g. because a container still uses them, are reported and
+// skipped.
+func pruneImages(ctx context.Context, cli dockerClient, w io.Writer, agents map[string]AgentConfig, opts pruneOptions) error {
+	filters := make(client.Filters).Add("reference", imageRepository)
+	if !opts.outdated && opts.olderThan == 0 {
+		// Untagged images no longer match the repository reference
+		filters = make(client.Filters).Add("dangling", "true")
+	}
+	result, err := cli.ImageList(ctx, client.ImageListOptions{Filters: filters})
+	if err != nil {
+		return fmt.Errorf("failed to list images: %w", err)
+	}
+
+	var images []pruneImage
+	switch {
+	case opts.outdated:
+		latestVersion := opts.latestVersion
+		if latestVersion == nil {
+			latestVersion = miseLatestVersion
+		}
+		images = selectOutdatedImages(ctx, cli, result.Items, agents, latestVersion)
+	case opts.olderThan > 0:
+		images = selectPruneImages(result.Items, agents, opts, time.Now())
+	default:
+		images = selectSupersededImages(result.Items, agents)
+	}
+	if len(images) == 0 {
+		fmt.Fprintln(w, "No images to prune")
+		return nil
+	}
+
+	if opts.dryRun || !opts.yes {
+		var reclaimable int64
+		for _, img := range images {
+			for _, tag := range img.tags {
+				fmt.Fprintf(w, "Would delete %s\n", tag)
+			}
+			if !img.shared {
+				reclaimable += img.size
+			}
+		}
+		fmt.Fprintf(w, "Would reclaim up to %s\n", formatSize(reclaimable))
+		if opts.dryRun {
+			return nil
+		}
+		if opts.outdated {
+			fmt.Fprintln(w, "Pass --yes to delete these images")
+			return nil
+		}
+		if opts.confirm == nil {
+			return fmt.Errorf("refusing to delete %d images without confirmation as this isn't an interactive terminal; pass --yes to delete them", len(images))
+		}
+		if !opts.confirm(fmt.Sprintf("Delete %d images? [y/N] ", len(images))) {
+			fmt.Fprintln(w, "No images deleted")
+			return nil
+		}
+	}
+
+	var reclaimed int64
+	for _, img := range images {
+		removed := true
+		for _, tag := range img.tags {
+			ref := tag
+			if img.untagged {
+				ref = img.id
+			}
+			if _, err := cli.ImageRemove(ctx, ref, client.ImageRemoveOptions{PruneChildren: true}); err != nil {
+				logWarn(fmt.Sprintf("failed to remove %s: %v", tag, err), "image", tag)
+				removed = false
+				continue
+			}
+			fmt.Fprintf(w, "Deleted %s\n", tag)
+		}
+		if removed && !img.shared {
+			reclaimed += img.size
+		}
+	}
+	fmt.Fprintf(w, "Reclaimed up to %s\n", formatSize(reclaimed))
+	return nil
+}
+
+// terminalConfirm returns a confirm function that prompts on stderr, or nil
+// unless both stdout and stdin are terminals. Output that isn't a terminal
+// means a script is running, and the prompt couldn't be answered without
+// stdin.
+func terminalConfirm(stdin, stdout *os.File) func(string) bool {
+	if _, isTerminal := term.GetFdInfo(stdout); !isTerminal {
+		return nil
+	}
+	if _, isTerminal := term.GetFdInfo(stdin); !isTerminal {
+		return nil
+	}
+	return promptConfirm(stdin, os.Stderr)
+}
+
+// promptConfirm returns a confirm function for pruneOptions that writes the
+// prompt to w and accepts y or yes read from in
+func promptConfirm(in io.Reader, w io.Writer) func(string) bool {
+	reader := bufio.NewReader(in)
+	return func(prompt string) bool {
+		fmt.Fprint(w, prompt)
+		answer, _ := reader.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return true
+		}
+		return false
+	}
+}
+
+// formatSize formats a byte count with decimal units, like the docker CLI
+func formatSize(bytes int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	size := float64(bytes)
+	unit := 0
+	for size >= 1000 && unit < len(units)-1 {
+		size /= 1000
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", bytes, units[0])
+	}
+	return fmt.Sprintf("%.2f%s", size, units[unit])
+}
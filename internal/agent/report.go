@@ -0,0 +1,249 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// toolReport is the machine-readable diagnostic written by --report json.
+// It explains which sources were scanned, which version of each tool won and
+// why, and where every system package comes from.
+type toolReport struct {
+	Agent      string          `json:"agent"`
+	Image      string          `json:"image"`
+	Precedence []string        `json:"precedence"` // source kinds, highest priority first
+	Sources    []reportSource  `json:"sources"`
+	Tools      []reportTool    `json:"tools"`
+	ConfigDeps []reportDep     `json:"configDependencies"`
+	Packages   []reportPackage `json:"packages"`
+}
+
+// reportSource is a place tool versions are read from
+type reportSource struct {
+	Kind    string          `json:"kind"` // env, tool-versions, mise-toml, idiomatic
+	Name    string          `json:"name"` // file or variable name
+	Found   bool            `json:"found"`
+	Skipped bool            `json:"skipped,omitempty"` // ignored because of --agent-only or specified-only mode
+	Tools   []reportVersion `json:"tools,omitempty"`
+}
+
+type reportVersion struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// reportTool is a tool in the final image and the candidates it beat
+type reportTool struct {
+	Name       string            `json:"name"`
+	Version    string            `json:"version"`
+	Source     string            `json:"source"`
+	Overridden []reportCandidate `json:"overridden,omitempty"`
+}
+
+type reportCandidate struct {
+	Version string `json:"version"`
+	Source  string `json:"source"`
+}
+
+type reportDep struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	Transitive bool   `json:"transitive"` // pulled in by another tool rather than the agent
+}
+
+type reportPackage struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+}
+
+// buildToolReport assembles the diagnostic from what collectToolSpecs
+// recorded: the versions each source offered, in precedence order, and the
+// one that won for every tool. Sources are listed whether or not they exist.
+func buildToolReport(toolFile, miseFile *fileSpec, collection collectResult, spec ToolSpec, imgCfg *ImageConfig, agentName, imageName string, opts collectOptions) toolReport {
+	order, err := imgCfg.ResolvePrecedence()
+	if err != nil {
+		order = defaultPrecedence
+	}
+
+	r := toolReport{
+		Agent:      agentName,
+		Image:      imageName,
+		Precedence: append(append([]string{string(sourceEnvVar)}, order...), string(sourceConfig)),
+	}
+
+	offered := make(map[string][]reportVersion)
+	for _, c := range collection.candidates {
+		offered[c.origin] = append(offered[c.origin], reportVersion{Name: c.name, Version: c.version})
+	}
+	addSource := func(kind, name string, found, skipped bool) {
+		r.Sources = append(r.Sources, reportSource{Kind: kind, Name: name, Found: found, Skipped: skipped, Tools: offered[name]})
+	}
+
+	skipped := collection.projectToolsSkipped
+	addSource(string(sourceEnvVar), "AGENT_EN_PLACE_TOOLS", os.Getenv("AGENT_EN_PLACE_TOOLS") != "", opts.agentOnly)
+	for _, kind := range order {
+		switch kind {
+		case precedenceToolVersions:
+			addSource(kind, fileSpecLabel(toolFile, ".tool-versions"), toolFile != nil || fileExists(".tool-versions"), skipped)
+		case precedenceMiseToml:
+			found := miseFile != nil || slices.ContainsFunc(miseConfigFiles, fileExists)
+			addSource(kind, fileSpecLabel(miseFile, "mise.toml"), found, skipped)
+		case precedenceIdiomatic:
+			for _, path := range idiomaticReportPaths() {
+				addSource(kind, path, fileExists(path), skipped)
+			}
+		}
+	}
+	if opts.fromWorkflows {
+		addSource("workflows", workflowsDir, fileExists(workflowsDir), skipped)
+	}
+
+	agent := imgCfg.Agents[agentName]
+	for _, c := range collection.candidates {
+		if c.origin == string(sourceConfig) {
+			r.ConfigDeps = append(r.ConfigDeps, reportDep{
+				Name:       c.name,
+				Version:    c.version,
+				Transitive: !slices.Contains(agent.Depends, c.name),
+			})
+		}
+	}
+
+	for _, tool := range collection.specs {
+		entry := reportTool{Name: tool.name, Version: tool.version, Source: tool.origin}
+		won := false
+		for _, c := range collection.candidates {
+			if sanitizeTagComponent(c.name) != tool.name {
+				continue
+			}
+			// The first candidate for a tool is the one in specs
+			if !won {
+				won = true
+				continue
+			}
+			entry.Overridden = append(entry.Overridden, reportCandidate{Version: c.version, Source: c.origin})
+		}
+		r.Tools = append(r.Tools, entry)
+	}
+
+	r.Packages = packageSources(imgCfg, agentName, collection.userTools)
+
+	return r
+}
+
+// packageSources lists every system package installed in the image with the
+// setting that added it, in install order
+func packageSources(imgCfg *ImageConfig, agentName string, userTools map[string]bool) []reportPackage {
+	var packages []reportPackage
+	seen := make(map[string]bool)
+	for _, pkg := range imgCfg.Image.Packages {
+		if !seen[pkg] {
+			seen[pkg] = true
+			packages = append(packages, reportPackage{Name: pkg, Source: imgCfg.packageSource(pkg)})
+		}
+	}
+	for _, pkg := range imgCfg.resolveAdditionalPackageSources(agentName, userTools) {
+		if !seen[pkg.name] {
+			seen[pkg.name] = true
+			packages = append(packages, reportPackage{Name: pkg.name, Source: fmt.Sprintf("tools.%s.additionalPackages", pkg.tool)})
+		}
+	}
+	return packages
+}
+
+// writePackageList prints the packages for --show-packages followed by the
+// image_customizations operations that were applied
+func writePackageList(w io.Writer, packages []reportPackage, applied []string) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PACKAGE\tSOURCE")
+	for _, pkg := range packages {
+		fmt.Fprintf(tw, "%s\t%s\n", pkg.Name, pkg.Source)
+	}
+	tw.Flush()
+	if len(applied) > 0 {
+		fmt.Fprintln(w, "\nimage_customizations:")
+		for _, op := range applied {
+			fmt.Fprintf(w, "  %s\n", op)
+		}
+	}
+}
+
+// writeAgentList prints every configured agent, sorted by name, with what a
+// run installs for it: its package, command, config dir and the tools it
+// depends on, followed by any agentAliases
+func writeAgentList(w io.Writer, imgCfg *ImageConfig) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "AGENT\tPACKAGE\tCOMMAND\tCONFIG DIR\tDEPENDS")
+	for _, name := range imgCfg.AgentNames() {
+		agent := imgCfg.Agents[name]
+		pkg := agent.PackageName
+		if agent.PackageVersion != "" {
+			pkg += "@" + agent.PackageVersion
+		}
+		if agent.LocalBinary != "" {
+			pkg = "local:" + agent.LocalBinary
+		}
+		var deps []string
+		for _, dep := range imgCfg.ResolveToolDeps(name, map[string]bool{}, false) {
+			deps = append(deps, dep.name+"@"+dep.version)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", name, orDash(pkg), orDash(agent.Command), orDash(agent.ConfigDir), orDash(strings.Join(deps, ", ")))
+	}
+	tw.Flush()
+	if len(imgCfg.AgentAliases) > 0 {
+		fmt.Fprintln(w, "\naliases:")
+		for _, alias := range slices.Sorted(maps.Keys(imgCfg.AgentAliases)) {
+			fmt.Fprintf(w, "  %s -> %s\n", alias, imgCfg.AgentAliases[alias])
+		}
+	}
+}
+
+// orDash returns s, or "-" to keep an empty table cell visible
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// idiomaticReportPaths lists every idiomatic version file that is checked,
+// by tool and then in lookup order, followed by the files that can pin
+// several tools
+func idiomaticReportPaths() []string {
+	var paths []string
+	for _, tool := range slices.Sorted(maps.Keys(idiomaticToolFiles)) {
+		paths = append(paths, idiomaticToolFiles[tool]...)
+	}
+	for _, file := range multiToolFiles {
+		if !slices.Contains(paths, file.path) {
+			paths = append(paths, file.path)
+		}
+	}
+	return paths
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// validateReportFormat checks the --report value; json is the only format
+func validateReportFormat(format string) error {
+	if format != "" && format != "json" {
+		return fmt.Errorf("unknown report format %q (expected json)", format)
+	}
+	return nil
+}
+
+// writeToolReport writes the report as indented JSON
+func writeToolReport(w io.Writer, r toolReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
@@ -0,0 +1,248 @@
+package agent
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// miseBackends are the mise backends a packageName or tool name may use as a
+// "<backend>:<name>" prefix
+var miseBackends = []string{
+	"aqua", "asdf", "cargo", "conda", "core", "dotnet", "gem", "github",
+	"gitlab", "go", "http", "npm", "pipx", "spm", "ubi", "vfox",
+}
+
+// Validate loads the merged config and checks it as a whole, for use as a
+// pre-commit hook. Unlike loading the config for a run, it reports every
+// problem rather than stopping at the first.
+func Validate(cfg Config) error {
+	if cfg.Project != "" {
+		if cfg.ConfigPath != "" {
+			abs, err := filepath.Abs(cfg.ConfigPath)
+			if err != nil {
+				return fmt.Errorf("failed to resolve config path: %w", err)
+			}
+			cfg.ConfigPath = abs
+		}
+		restore, err := enterProjectDir(cfg.Project)
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+
+	imgCfg, err := mergeConfigFiles(defaultConfigYAML, LoadOptions{ConfigPath: cfg.ConfigPath, NoUserConfig: cfg.NoUserConfig})
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if err := imgCfg.Validate(); err != nil {
+		origins, originErr := configOrigins(LoadOptions{ConfigPath: cfg.ConfigPath, NoUserConfig: cfg.NoUserConfig})
+		if originErr != nil {
+			return originErr
+		}
+		problems := annotateOrigins(strings.Split(err.Error(), "\n"), origins)
+		return fmt.Errorf("config has %d problem(s):\n  %s", len(problems), strings.Join(problems, "\n  "))
+	}
+	fmt.Fprintln(os.Stdout, "config is valid")
+	return nil
+}
+
+// configOrigins maps each agents.<name> and tools.<name> key to the config
+// file that defines it last, and so wins the merge. Keys that only come from
+// the built-in defaults are left out.
+func configOrigins(opts LoadOptions) (map[string]string, error) {
+	var paths []string
+	if !opts.NoUserConfig {
+		if xdgPath := getXDGConfigPath(); xdgPath != "" {
+			paths = append(paths, xdgPath)
+		}
+		paths = append(paths, ".agent-en-place.yaml")
+	}
+	if opts.ConfigPath != "" {
+		paths = append(paths, opts.ConfigPath)
+	}
+
+	origins := make(map[string]string)
+	for _, path := range paths {
+		layer, err := loadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if layer == nil {
+			continue
+		}
+		for name := range layer.Agents {
+			origins["agents."+name] = path
+		}
+		for name := range layer.Tools {
+			origins["tools."+name] = path
+		}
+	}
+	return origins, nil
+}
+
+// annotateOrigins adds the defining config file to problems about a single
+// agent or tool. Longer keys are tried first so that a tool such as
+// "npm:@org/pkg" isn't attributed to a tool named "npm".
+func annotateOrigins(problems []string, origins map[string]string) []string {
+	keys := slices.SortedFunc(maps.Keys(origins), func(a, b string) int {
+		return cmp.Or(len(b)-len(a), strings.Compare(a, b))
+	})
+	annotated := make([]string, len(problems))
+	for i, problem := range problems {
+		annotated[i] = problem
+		for _, key := range keys {
+			if strings.HasPrefix(problem, key+".") || strings.HasPrefix(problem, key+":") {
+				annotated[i] = fmt.Sprintf("%s (in %s)", problem, origins[key])
+				break
+			}
+		}
+	}
+	return annotated
+}
+
+// Validate checks the settings of a merged config along with the references
+// between its sections: dependencies name configured tools, package names use
+// known mise backends, image customizations use known operations and tool
+// dependencies don't form cycles. All problems are returned together.
+func (c *ImageConfig) Validate() error {
+	problems := c.settingsErrors()
+
+	for _, name := range slices.Sorted(maps.Keys(c.Agents)) {
+		agent := c.Agents[name]
+		switch {
+		case agent.PackageName != "" && agent.LocalBinary != "":
+			problems = append(problems, fmt.Errorf("agents.%s: packageName and localBinary can't both be set", name))
+		case agent.PackageName == "" && agent.LocalBinary == "":
+			problems = append(problems, fmt.Errorf("agents.%s: one of packageName or localBinary is required", name))
+		case agent.PackageVersion != "" && agent.PackageName == "":
+			problems = append(problems, fmt.Errorf("agents.%s: packageVersion needs a packageName", name))
+		case agent.PackageName != "":
+			if err := validatePackageName(agent.PackageName); err != nil {
+				problems = append(problems, fmt.Errorf("agents.%s.packageName: %w", name, err))
+			}
+		}
+		for _, dep := range agent.Depends {
+			if _, ok := c.Tools[dep]; !ok {
+				problems = append(problems, fmt.Errorf("agents.%s.depends: unknown tool %q", name, dep))
+			}
+		}
+		for _, env := range agent.PassEnv {
+			if env == "" || strings.ContainsAny(env, "= \t") {
+				problems = append(problems, fmt.Errorf("agents.%s.passEnv: %q is not an env var name", name, env))
+			}
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(c.Tools)) {
+		if err := validatePackageName(name); err != nil {
+			problems = append(problems, fmt.Errorf("tools.%s: %w", name, err))
+		}
+		if dep := c.Tools[name].Depends; dep != "" {
+			if _, ok := c.Tools[dep]; !ok {
+				problems = append(problems, fmt.Errorf("tools.%s.depends: unknown tool %q", name, dep))
+			}
+		}
+	}
+	problems = append(problems, c.dependencyCycles()...)
+
+	for i, customization := range c.ImageCustomizations.Packages {
+		switch customization.Op {
+		case "reset":
+		case "add", "remove":
+			if customization.Value == "" {
+				problems = append(problems, fmt.Errorf("image_customizations.packages[%d]: %s requires a value", i, customization.Op))
+			}
+		case "replace":
+			if customization.From == "" || customization.Value == "" {
+				problems = append(problems, fmt.Errorf("image_customizations.packages[%d]: replace requires from and value", i))
+			}
+		default:
+			problems = append(problems, fmt.Errorf("image_customizations.packages[%d]: unknown operation %q (expected add, remove, replace or reset)", i, customization.Op))
+		}
+	}
+	for _, list := range []struct {
+		field          string
+		customizations []ImageCustomization
+	}{
+		{"miseInstall", c.ImageCustomizations.MiseInstall},
+		{"miseEnv", c.ImageCustomizations.MiseEnv},
+	} {
+		field := list.field
+		for i, customization := range list.customizations {
+			switch {
+			case customization.Op != "add" && customization.Op != "remove":
+				problems = append(problems, fmt.Errorf("image_customizations.%s[%d]: unknown operation %q (expected add or remove)", field, i, customization.Op))
+			case customization.Value == "":
+				problems = append(problems, fmt.Errorf("image_customizations.%s[%d]: %s requires a value", field, i, customization.Op))
+			case field == "miseEnv" && customization.Op == "add" && !strings.Contains(customization.Value, "="):
+				problems = append(problems, fmt.Errorf("image_customizations.miseEnv[%d]: add requires key=value", i))
+			}
+		}
+	}
+
+	if strings.TrimSpace(c.Image.Base) == "" {
+		problems = append(problems, errors.New("image.base: must not be empty"))
+	}
+
+	if c.DefaultAgent != "" {
+		if _, ok := c.GetAgent(c.DefaultAgent); !ok {
+			problems = append(problems, fmt.Errorf("defaultAgent: unknown agent %q", c.DefaultAgent))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.Join(problems...)
+}
+
+// validatePackageName checks a mise tool reference such as "node",
+// "npm:@openai/codex" or "ubi:BurntSushi/ripgrep"
+func validatePackageName(name string) error {
+	if strings.ContainsAny(name, " \t\n") {
+		return fmt.Errorf("%q contains whitespace", name)
+	}
+	backend, pkg, ok := strings.Cut(name, ":")
+	if !ok {
+		return nil
+	}
+	if !slices.Contains(miseBackends, backend) {
+		return fmt.Errorf("%q uses unknown mise backend %q", name, backend)
+	}
+	if pkg == "" {
+		return fmt.Errorf("%q is missing a package after the backend", name)
+	}
+	if backend == "npm" && strings.HasPrefix(pkg, "@") && !strings.Contains(pkg, "/") {
+		return fmt.Errorf("%q is a scoped npm package without a name", name)
+	}
+	return nil
+}
+
+// dependencyCycles returns an error for each cycle in the tools' depends
+func (c *ImageConfig) dependencyCycles() []error {
+	var errs []error
+	reported := make(map[string]bool)
+	for _, start := range slices.Sorted(maps.Keys(c.Tools)) {
+		var path []string
+		for name := start; name != ""; name = c.Tools[name].Depends {
+			if i := slices.Index(path, name); i >= 0 {
+				cycle := path[i:]
+				key := strings.Join(slices.Sorted(slices.Values(cycle)), ",")
+				if !reported[key] {
+					reported[key] = true
+					errs = append(errs, fmt.Errorf("tools: dependency cycle %s", strings.Join(append(cycle, name), " -> ")))
+				}
+				break
+			}
+			path = append(path, name)
+		}
+	}
+	return errs
+}
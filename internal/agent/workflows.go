@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// workflowsDir holds the GitHub Actions workflows read by --from-workflows
+const workflowsDir = ".github/workflows"
+
+// setupAction maps a GitHub setup action to the tool it installs and the
+// input holding its version. The version file input is the same name with a
+// "-file" suffix, e.g. node-version-file.
+type setupAction struct {
+	tool  string
+	input string
+}
+
+var workflowSetupActions = map[string]setupAction{
+	"actions/setup-node":   {tool: "node", input: "node-version"},
+	"actions/setup-python": {tool: "python", input: "python-version"},
+	"actions/setup-go":     {tool: "go", input: "go-version"},
+	"actions/setup-java":   {tool: "java", input: "java-version"},
+}
+
+type workflowFile struct {
+	Jobs map[string]struct {
+		Steps []struct {
+			Uses string               `yaml:"uses"`
+			With map[string]yaml.Node `yaml:"with"`
+		} `yaml:"steps"`
+	} `yaml:"jobs"`
+}
+
+// parseWorkflowTools reads tool versions from setup-* steps in the project's
+// GitHub Actions workflows. Files and jobs are visited in sorted order and the
+// first version found for a tool wins. Expressions such as matrix values
+// can't be resolved and are skipped. Node LTS aliases are resolved with
+// nodeLtsAliases (tools.node.ltsAliases) like they are in .nvmrc.
+func parseWorkflowTools(nodeLtsAliases map[string]string) []toolDescriptor {
+	seen := make(map[string]bool)
+	var specs []toolDescriptor
+	for _, path := range workflowPaths() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var workflow workflowFile
+		if err := yaml.Unmarshal(data, &workflow); err != nil {
+			logWarn(fmt.Sprintf("failed to parse %s, skipping", path), "path", path)
+			continue
+		}
+
+		jobs := make([]string, 0, len(workflow.Jobs))
+		for name := range workflow.Jobs {
+			jobs = append(jobs, name)
+		}
+		sort.Strings(jobs)
+
+		for _, job := range jobs {
+			for _, step := range workflow.Jobs[job].Steps {
+				action, _, _ := strings.Cut(step.Uses, "@")
+				setup, ok := workflowSetupActions[action]
+				if !ok || seen[setup.tool] {
+					continue
+				}
+				version, ok := workflowStepVersion(setup, step.With)
+				if !ok {
+					continue
+				}
+				if version, ok = normalizeWorkflowVersion(setup.tool, version, nodeLtsAliases); !ok {
+					logWarn(fmt.Sprintf("skipping %s %s from %s: it isn't a version mise can install", setup.input, version, path), "path", path, "tool", setup.tool)
+					continue
+				}
+				seen[setup.tool] = true
+				specs = append(specs, toolDescriptor{name: setup.tool, version: version, source: sourceUser})
+			}
+		}
+	}
+	return specs
+}
+
+// workflowVersionAliases are the moving versions setup actions accept that
+// don't pin a release. mise would resolve them differently, or not at all.
+var workflowVersionAliases = []string{"stable", "oldstable", "latest", "current", "node"}
+
+// normalizeWorkflowVersion turns a setup action version into one mise can
+// install: wildcards are trimmed ("20.x" -> "20"), a "v" prefix is dropped and
+// node's lts/* aliases are resolved. ok is false, and version returned as
+// given, for aliases such as stable or latest and unknown LTS codenames.
+func normalizeWorkflowVersion(tool, version string, nodeLtsAliases map[string]string) (string, bool) {
+	if slices.Contains(workflowVersionAliases, strings.ToLower(version)) {
+		return version, false
+	}
+	if tool == "node" && strings.HasPrefix(strings.ToLower(version), "lts/") {
+		resolved, ok := resolveNodeLts(version, nodeLtsAliases)
+		if !ok {
+			return version, false
+		}
+		return resolved, true
+	}
+	normalized := version
+	if len(normalized) > 1 && (normalized[0] == 'v' || normalized[0] == 'V') && normalized[1] >= '0' && normalized[1] <= '9' {
+		normalized = normalized[1:]
+	}
+	normalized, ok := trimVersionWildcard(normalized)
+	if !ok {
+		return version, false
+	}
+	return normalized, true
+}
+
+// workflowPaths returns the project's workflow files in sorted order
+func workflowPaths() []string {
+	var paths []string
+	for _, pattern := range []string{"*.yml", "*.yaml"} {
+		matches, _ := filepath.Glob(filepath.Join(workflowsDir, pattern))
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// workflowVersionFiles returns every file referenced by a setup step's version
+// file input, whether or not parseWorkflowTools ends up reading it
+func workflowVersionFiles() []string {
+	var files []string
+	for _, path := range workflowPaths() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var workflow workflowFile
+		if err := yaml.Unmarshal(data, &workflow); err != nil {
+			continue
+		}
+		for _, job := range workflow.Jobs {
+			for _, step := range job.Steps {
+				action, _, _ := strings.Cut(step.Uses, "@")
+				setup, ok := workflowSetupActions[action]
+				if !ok {
+					continue
+				}
+				if node, ok := step.With[setup.input+"-file"]; ok && node.Kind == yaml.ScalarNode && !strings.Contains(node.Value, "${{") {
+					files = append(files, filepath.Clean(node.Value))
+				}
+			}
+		}
+	}
+	sort.Strings(files)
+	return slices.Compact(files)
+}
+
+// workflowStepVersion returns the version a setup step pins, either inline or
+// through its version file input
+func workflowStepVersion(setup setupAction, with map[string]yaml.Node) (string, bool) {
+	if node, ok := with[setup.input]; ok {
+		// Lists of versions and ${{ }} expressions can't be pinned to one version
+		if node.Kind != yaml.ScalarNode || strings.Contains(node.Value, "${{") {
+			return "", false
+		}
+		version := strings.TrimSpace(node.Value)
+		return version, version != ""
+	}
+	if node, ok := with[setup.input+"-file"]; ok {
+		if node.Kind != yaml.ScalarNode || strings.Contains(node.Value, "${{") {
+			return "", false
+		}
+		return readWorkflowVersionFile(setup.tool, filepath.Clean(node.Value))
+	}
+	return "", false
+}
+
+// readWorkflowVersionFile reads the version from a file referenced by a
+// setup step's version file input
+func readWorkflowVersionFile(tool, path string) (string, bool) {
+	switch filepath.Base(path) {
+	case "go.mod":
+		return parseGoModVersion(path)
+	case ".tool-versions":
+		file, err := optionalFileSpec(path)
+		if err != nil {
+			return "", false
+		}
+		for _, spec := range parseToolVersions(file) {
+			if spec.name == tool {
+				return spec.version, true
+			}
+		}
+		return "", false
+	case "package.json":
+		if tool == "node" {
+			return parsePackageJsonNode(path)
+		}
+		return "", false
+	default:
+		return readFirstLine(path)
+	}
+}
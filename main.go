@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 
@@ -18,37 +20,225 @@ var (
 func main() {
 	debug := flag.Bool("debug", false, "show Docker build output instead of hiding it")
 	rebuild := flag.Bool("rebuild", false, "force rebuilding the Docker image")
+	noCache := flag.Bool("no-cache", false, "rebuild the Docker image without reusing cached layers (implies --rebuild)")
 	dockerfile := flag.Bool("dockerfile", false, "print the generated Dockerfile and exit")
 	miseFile := flag.Bool("mise-file", false, "print the generated mise.toml and exit")
+	dryRun := flag.Bool("dry-run", false, "generate the build context and list its files and size without connecting to Docker, then exit")
+	showContext := flag.Bool("show-context", false, "print every file in the build context (Dockerfile, mise.agent.toml, tool and version files) and exit")
+	listAgents := flag.Bool("list-agents", false, "list the configured agents with their package, command, config dir and tool dependencies and exit")
+	listImages := flag.Bool("list-images", false, "list local images built for the agent and exit")
+	prune := flag.Bool("prune", false, "remove local images left untagged when their tag was rebuilt and exit")
+	pruneOlderThan := flag.Int("prune-older-than", 0, "with --prune, remove images created more than this many days ago instead")
+	yes := flag.Bool("yes", false, "delete without asking for confirmation (required for --prune when stdout isn't a terminal)")
+	flag.BoolVar(yes, "y", false, "shorthand for --yes")
+	pruneOutdated := flag.Bool("prune-outdated", false, "list images whose agent version is older than its latest release, keeping the newest image per agent; add --yes to remove them (implies --prune)")
+	pruneDryRun := flag.Bool("prune-dry-run", false, "list the images --prune would remove without removing them (implies --prune)")
+	seedConfig := flag.Bool("seed-config", false, "copy the agent's allowlisted seedFiles from the host config dir into the image")
+	agentOnly := flag.Bool("agent-only", false, "install only the agent and its config dependencies, ignoring project tool files")
+	workdirName := flag.Bool("workdir-name", false, "name the container after the project directory and agent")
+	hostname := flag.String("hostname", "", "container hostname (overrides run.hostname, defaults to the agent name)")
+	platform := flag.String("platform", "", "comma-separated platforms to build for, e.g. linux/amd64,linux/arm64")
+	forcePlatformTag := flag.Bool("force-platform-tag", false, "build for the host platform and add it to the image tag so images from different architectures don't collide (like image.tagArch)")
+	agentUID := flag.Int("uid", 0, "uid of the agent user in the image, e.g. your own to match the mounted project's owner (overrides image.agentUid)")
+	agentGID := flag.Int("gid", 0, "gid of the agent group in the image (overrides image.agentGid)")
+	buildNetwork := flag.String("build-network", "", "network mode for the image build: default, bridge, host, none or a network name (default: the daemon's)")
+	refreshBase := flag.Bool("refresh-base", false, "pull the latest base image, then rebuild if it changed")
+	var buildArgs stringList
+	flag.Var(&buildArgs, "build-arg", "set a build-time variable as KEY=VALUE (repeatable, overrides image.buildArgs)")
+	var mounts stringList
+	flag.Var(&mounts, "mount", "bind mount a host path into the container as host:container[:ro] (repeatable, added to the agent's mounts)")
+	var envVars stringList
+	flag.Var(&envVars, "env", "set an env var in the container as KEY=VALUE, or KEY to pass it from the environment (repeatable)")
+	memory := flag.String("memory", "", "memory limit for the agent container, e.g. 2g (docker run --memory)")
+	cpus := flag.String("cpus", "", "number of CPUs the agent container may use, e.g. 1.5 (docker run --cpus)")
+	var securityOpts stringList
+	flag.Var(&securityOpts, "security-opt", "docker run --security-opt value, e.g. seccomp=./profile.json (repeatable, added to run.securityOpt)")
+	project := flag.String("project", "", "project directory to mount as /workdir and detect tools in (default: current directory)")
+	createConfigDir := flag.Bool("create-config-dir", true, "create the agent's config dir on the host if missing (false skips mounting it)")
+	report := flag.String("report", "", "print a tool version resolution report in the given format (json) and exit without building")
+	planJSON := flag.Bool("plan-json", false, "print the image name, tools with their sources, system packages, mise env vars and detected version files as JSON and exit without building")
+	mergeMiseConfigs := flag.Bool("merge-mise-configs", false, "merge mise.toml files from parent directories up to the repo root, nearest winning")
+	miseJobs := flag.Int("mise-jobs", 0, "number of parallel mise install jobs (overrides mise.jobs)")
+	verifyPackages := flag.Bool("verify-packages", false, "check that all system packages exist in the base image before building")
+	fromWorkflows := flag.Bool("from-workflows", false, "detect tool versions from actions/setup-* steps in .github/workflows")
+	strictIdiomatic := flag.Bool("strict-idiomatic", false, "fail when an idiomatic version file (e.g. .nvmrc) exists but has no valid version")
+	noFollowSymlinks := flag.Bool("no-follow-symlinks", false, "skip idiomatic version files (e.g. .nvmrc) that are symlinks, so they can't point outside the project")
+	fixWorkdirPerms := flag.Bool("fix-workdir-perms", false, "run the agent as the uid and gid that own the mounted project")
+	bundle := flag.String("bundle", "", "write a tar.gz with the Dockerfile, config, tool plan and build output to this path for bug reports")
+	dockerAPIVersion := flag.String("docker-api-version", "", "pin the Docker API version, e.g. 1.47, instead of negotiating it with the daemon (overrides DOCKER_API_VERSION)")
+	configDigest := flag.Bool("config-digest", false, "print a sha256 of the config, resolved tools and generated files for use as a CI cache key and exit")
+	noColor := flag.Bool("no-color", false, "set run.noColorEnv (default NO_COLOR=1 and TERM=dumb) and the agent's noColorEnv in the container, for scripted runs")
+	showPackages := flag.Bool("show-packages", false, "print the final system package list with where each package came from and exit")
+	runContainer := flag.Bool("run", false, "run the agent container directly instead of printing the docker run command")
+	printCommand := flag.Bool("print", false, "print the docker run command (overrides run.mode)")
+	validate := flag.Bool("validate", false, "check the merged config for errors and exit (same as the validate command)")
 	showVersion := flag.Bool("version", false, "show version information")
 	configPath := flag.String("config", "", "path to config file (overrides default config locations)")
+	noUserConfig := flag.Bool("no-user-config", false, "ignore ~/.config/agent-en-place.yaml and ./.agent-en-place.yaml, using only the defaults and --config")
+	logFormat := flag.String("log-format", "text", "format for warnings and errors on stderr: text or json")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "usage: %s [flags] [agent] [project-dir]\n\n", os.Args[0])
+		printAgents(out, agent.Config{Project: *project, ConfigPath: *configPath, NoUserConfig: *noUserConfig})
+		fmt.Fprintf(out, "\nflags:\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "prune-older-than" && *pruneOlderThan <= 0 {
+			fmt.Fprintf(os.Stderr, "error: --prune-older-than must be a positive number of days\n")
+			os.Exit(1)
+		}
+		if f.Name == "mise-jobs" && *miseJobs <= 0 {
+			fmt.Fprintf(os.Stderr, "error: --mise-jobs must be a positive integer\n")
+			os.Exit(1)
+		}
+	})
+
+	if *runContainer && *printCommand {
+		fmt.Fprintf(os.Stderr, "error: --run and --print can't be used together\n")
+		os.Exit(1)
+	}
+	var runMode string
+	switch {
+	case *runContainer:
+		runMode = "run"
+	case *printCommand:
+		runMode = "print"
+	}
+
+	if err := agent.SetLogFormat(*logFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
 	if *showVersion {
 		fmt.Printf("agent-en-place version %s (commit: %s, built: %s)\n", version, commit, date)
 		os.Exit(0)
 	}
 
 	args := flag.Args()
-	if len(args) != 1 {
-		fmt.Fprintf(os.Stderr, "usage: %s <agent>\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "run 'agent-en-place --help' for available agents\n")
+	if len(args) > 0 && args[0] == "validate" {
+		*validate = true
+		args = args[1:]
+	}
+	if *validate {
+		if len(args) > 1 {
+			fmt.Fprintf(os.Stderr, "usage: %s validate [project-dir]\n", os.Args[0])
+			os.Exit(1)
+		}
+		if len(args) == 1 && *project == "" {
+			*project = args[0]
+		}
+		err := agent.Validate(agent.Config{Project: *project, ConfigPath: *configPath, NoUserConfig: *noUserConfig})
+		if err != nil {
+			agent.LogError(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if len(args) == 2 && *project == "" {
+		*project = args[1]
+		args = args[:1]
+	}
+	if len(args) > 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s [agent] [project-dir]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "the agent defaults to AGENT_EN_PLACE_DEFAULT_AGENT or defaultAgent from config\n")
+		printAgents(os.Stderr, agent.Config{Project: *project, ConfigPath: *configPath, NoUserConfig: *noUserConfig})
 		os.Exit(1)
 	}
 
-	tool := strings.ToLower(args[0])
+	// An empty tool lets Run fall back to the configured default agent
+	var tool string
+	if len(args) == 1 {
+		tool = strings.ToLower(args[0])
+	}
 
 	cfg := agent.Config{
-		Debug:          *debug,
-		Rebuild:        *rebuild,
-		DockerfileOnly: *dockerfile,
-		MiseFileOnly:   *miseFile,
-		Tool:           tool,
-		ConfigPath:     *configPath,
+		Debug:            *debug,
+		Rebuild:          *rebuild,
+		NoCache:          *noCache,
+		DockerfileOnly:   *dockerfile,
+		ShowContext:      *showContext,
+		DryRun:           *dryRun,
+		ListAgents:       *listAgents,
+		MiseFileOnly:     *miseFile,
+		AgentOnly:        *agentOnly,
+		SeedConfig:       *seedConfig,
+		ListImages:       *listImages,
+		NoColor:          *noColor,
+		Prune:            *prune || *pruneDryRun || *pruneOutdated,
+		PruneOlderThan:   *pruneOlderThan,
+		PruneOutdated:    *pruneOutdated,
+		PruneDryRun:      *pruneDryRun,
+		Yes:              *yes,
+		WorkdirName:      *workdirName,
+		Hostname:         *hostname,
+		Platform:         *platform,
+		RefreshBase:      *refreshBase,
+		BuildArgs:        buildArgs,
+		Mounts:           mounts,
+		EnvVars:          envVars,
+		Memory:           *memory,
+		CPUs:             *cpus,
+		BuildNetwork:     *buildNetwork,
+		AgentUID:         *agentUID,
+		AgentGID:         *agentGID,
+		Project:          *project,
+		CreateConfigDir:  *createConfigDir,
+		Report:           *report,
+		PlanJSON:         *planJSON,
+		MiseJobs:         *miseJobs,
+		MergeMiseConfigs: *mergeMiseConfigs,
+		SecurityOpts:     securityOpts,
+		VerifyPackages:   *verifyPackages,
+		FromWorkflows:    *fromWorkflows,
+		StrictIdiomatic:  *strictIdiomatic,
+		NoFollowSymlinks: *noFollowSymlinks,
+		FixWorkdirPerms:  *fixWorkdirPerms,
+		RunMode:          runMode,
+		ShowPackages:     *showPackages,
+		Bundle:           *bundle,
+		ConfigDigest:     *configDigest,
+		DockerAPIVersion: *dockerAPIVersion,
+		ForcePlatformTag: *forcePlatformTag,
+		Tool:             tool,
+		ConfigPath:       *configPath,
+		NoUserConfig:     *noUserConfig,
 	}
 
 	if err := agent.Run(cfg); err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		// The agent's exit code is passed through as-is; it has already
+		// reported its own errors
+		var exitErr *agent.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
+		agent.LogError(err)
 		os.Exit(1)
 	}
 }
+
+// printAgents lists the agents from the merged config, so agents defined in
+// a user or project config show up alongside the built-in ones
+func printAgents(w io.Writer, cfg agent.Config) {
+	names, err := agent.AgentNames(cfg)
+	if err != nil {
+		fmt.Fprintf(w, "available agents: unknown (%v)\n", err)
+		return
+	}
+	fmt.Fprintf(w, "available agents: %s\n", strings.Join(names, ", "))
+}
+
+// stringList is a flag.Value that collects repeated flag values
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}